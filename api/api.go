@@ -35,6 +35,11 @@ func RouteAPI(w http.ResponseWriter, r *http.Request) {
 	/*
 		/api/link - GET, POST
 		/api/list - POST
+		/api/permissions/ - POST
+		/api/tokens - GET, POST, DELETE
+
+		Anyone may GET. Changes need a logged-in user or an API token, see authorize, and
+		changes to a list need its permissions to allow them, see core/permissions.go.
 
 		To differentiate between automated external users, who should get an API response from
 		this program using its own API, we will use a hidden form value to identify requests
@@ -47,8 +52,24 @@ func RouteAPI(w http.ResponseWriter, r *http.Request) {
 	if _, exists := w.Header()["Access-Control-Allow-Origin"]; !exists {
 		w.Header().Add("Access-Control-Allow-Origin", "*")
 	}
+	// GETs only read the database, everything else may change it.
+	if r.Method == http.MethodGet {
+		core.SYNC.RLock()
+		defer core.SYNC.RUnlock()
+	} else {
+		core.SYNC.Lock()
+		defer core.SYNC.Unlock()
+		if !core.TakingChanges(w) {
+			return
+		}
+		w = core.FailUnjournaled(w)
+	}
+	editor, ok := authorize(w, r)
+	if !ok {
+		return
+	}
+	user := editor.User
 	// Classification of API paths
-	<-core.SYNC
 	// link
 	if strings.HasPrefix(r.URL.RequestURI(), "/api/link") {
 		var internal bool // Is this going to get a page returned(internal == true) or a JSON response?
@@ -106,19 +127,37 @@ func RouteAPI(w http.ResponseWriter, r *http.Request) {
 				// Check to see if we even have a link at this ID.
 				if _, exists := core.LinkDataBase.Links[id]; !exists {
 					w.WriteHeader(http.StatusNotFound)
-					core.SYNC <- 1
 					return
 				}
 				inboundLink = core.LinkDataBase.Links[id]
-				inboundLink.Title = outboundLink.Title
-				inboundLink.URL = outboundLink.Url
 			}
 
 			// Check for keyword in db
 			ll, exists := core.LinkDataBase.Lists[outboundLink.Keyword]
+			if exists && !ll.CanEdit(editor) {
+				forbidden(w, ll, editor)
+				return
+			}
+			// Unlinking only changes this list. Anything else changes the link in all of its lists.
+			if id != 0 && r.PostFormValue("delete") != "true" {
+				if !core.LinkDataBase.CanEditLink(editor, inboundLink) {
+					http.Error(w, fmt.Sprintf("link ID %d is in a protected keyword you may not edit", id), http.StatusForbidden)
+					return
+				}
+				inboundLink.Title = outboundLink.Title
+				inboundLink.URL = outboundLink.Url
+			}
+			for _, kw := range strings.Fields(r.PostFormValue("otherlists")) {
+				kwd, _ := core.MakeNewKeyword(kw)
+				if other, exists := core.LinkDataBase.Lists[kwd]; exists && !other.CanEdit(editor) {
+					forbidden(w, other, editor)
+					return
+				}
+			}
 			if !exists {
-				// We need to create the keyword and link.
+				// We need to create the keyword and link. Whoever creates it owns it.
 				ll = core.MakeNewList(outboundLink.Keyword)
+				ll.Owners = []string{user}
 				core.LogInfo.Printf("New keyword created: '%s'\n", outboundLink.Keyword)
 			}
 
@@ -126,19 +165,17 @@ func RouteAPI(w http.ResponseWriter, r *http.Request) {
 			if r.PostFormValue("delete") == "true" {
 				core.LinkDataBase.Decouple(ll, inboundLink)
 				// link edit metadata
-				deleteEdit := core.EditRecord{EditDate: now, EditUser: core.ExtractUser(r), EditMsg: fmt.Sprintf("link decoupled: %s", inboundLink.URL)}
-				core.RedirectorMetadata.ListEdits[ll.Keyword] = core.PrependEdit(core.RedirectorMetadata.ListEdits[ll.Keyword], &deleteEdit)
+				deleteEdit := core.EditRecord{EditDate: now, EditUser: user, EditMsg: fmt.Sprintf("link decoupled: %s", inboundLink.URL)}
+				core.LinkDataBase.AddListEdit(ll.Keyword, &deleteEdit)
 
 				core.LogInfo.Printf("user %s deleted link ID %d\n", deleteEdit.EditUser, inboundLink.ID)
 				if internal {
 					// The template called this, so 302 to the dotpage for this keyword.
 					http.Redirect(w, r, fmt.Sprintf("/.%s", outboundLink.Keyword), http.StatusFound)
-					core.SYNC <- 1
 					return
 				}
 				// this isn't rendering a template, just an http response
 				w.WriteHeader(http.StatusGone)
-				core.SYNC <- 1
 				return
 			}
 
@@ -157,15 +194,15 @@ func RouteAPI(w http.ResponseWriter, r *http.Request) {
 				// inbound link has its new linkid now.
 				outboundLink.ID = lid
 				ll.TagBindings[lid] = allTags
-				newLinkEdit = core.EditRecord{EditDate: now, EditUser: core.ExtractUser(r), EditMsg: fmt.Sprintf("link created: %s", inboundLink.URL)}
+				newLinkEdit = core.EditRecord{EditDate: now, EditUser: user, EditMsg: fmt.Sprintf("link created: %s", inboundLink.URL)}
 				core.LogInfo.Printf("New link with ID %d was added to the DB by user %s.\n", lid, newLinkEdit.EditUser)
 			} else {
 				ll.TagBindings[id] = allTags
-				newLinkEdit = core.EditRecord{EditDate: now, EditUser: core.ExtractUser(r), EditMsg: fmt.Sprintf("link modified: %s", inboundLink.URL)}
+				newLinkEdit = core.EditRecord{EditDate: now, EditUser: user, EditMsg: fmt.Sprintf("link modified: %s", inboundLink.URL)}
 				core.LogInfo.Printf("Existing link with ID %d was modified by user %s.\n", id, newLinkEdit.EditUser)
 			}
 			// link edit metadata
-			core.RedirectorMetadata.LinkEdits[outboundLink.ID] = core.PrependEdit(core.RedirectorMetadata.LinkEdits[outboundLink.ID], &newLinkEdit)
+			core.LinkDataBase.AddLinkEdit(outboundLink.ID, &newLinkEdit)
 
 			// existing links will be coupled further down
 
@@ -179,15 +216,16 @@ func RouteAPI(w http.ResponseWriter, r *http.Request) {
 			for _, kw := range strings.Fields(r.PostFormValue("otherlists")) {
 				kwd, _ := core.MakeNewKeyword(kw)
 				// link edit metadata
-				otherListEdit := core.EditRecord{EditDate: now, EditUser: core.ExtractUser(r), EditMsg: fmt.Sprintf("link coupled: %s, tags: %s", inboundLink.URL, allTags)}
+				otherListEdit := core.EditRecord{EditDate: now, EditUser: user, EditMsg: fmt.Sprintf("link coupled: %s, tags: %s", inboundLink.URL, allTags)}
 				if ll, exists := core.LinkDataBase.Lists[kwd]; exists {
 					core.LinkDataBase.Couple(ll, inboundLink)
-					core.RedirectorMetadata.ListEdits[ll.Keyword] = core.PrependEdit(core.RedirectorMetadata.ListEdits[ll.Keyword], &otherListEdit)
+					core.LinkDataBase.AddListEdit(ll.Keyword, &otherListEdit)
 				} else {
 					// The other list they were trying to add to doesn't exist. No problem. Create it.
 					newList := core.MakeNewList(kwd)
+					newList.Owners = []string{user}
 					core.LinkDataBase.Couple(newList, inboundLink)
-					core.RedirectorMetadata.ListEdits[newList.Keyword] = core.PrependEdit(core.RedirectorMetadata.ListEdits[newList.Keyword], &otherListEdit)
+					core.LinkDataBase.AddListEdit(newList.Keyword, &otherListEdit)
 				}
 				allMemberships = append(allMemberships, kwd)
 				core.LogDebug.Printf("Coupling link to otherlist '%s'", kwd)
@@ -217,7 +255,6 @@ func RouteAPI(w http.ResponseWriter, r *http.Request) {
 				// give both debug log and user feedback on the failed input
 				core.LogError.Printf("regex compilation of '%s' failed! %s", inputRegex, err)
 				http.Error(w, err.Error(), http.StatusBadRequest)
-				core.SYNC <- 1
 				return
 			}
 			// only change these if validation passed
@@ -231,13 +268,12 @@ func RouteAPI(w http.ResponseWriter, r *http.Request) {
 			core.LinkDataBase.Couple(ll, inboundLink)
 
 			// link edit metadata
-			listEdit := core.EditRecord{EditDate: now, EditUser: core.ExtractUser(r), EditMsg: fmt.Sprintf("link coupled: %s, tags: %s", inboundLink.URL, allTags)}
-			core.RedirectorMetadata.ListEdits[ll.Keyword] = core.PrependEdit(core.RedirectorMetadata.ListEdits[kw], &listEdit)
+			listEdit := core.EditRecord{EditDate: now, EditUser: user, EditMsg: fmt.Sprintf("link coupled: %s, tags: %s", inboundLink.URL, allTags)}
+			core.LinkDataBase.AddListEdit(ll.Keyword, &listEdit)
 
 			if internal {
 				// The template called this, so 302 to the dotpage for this keyword.
 				http.Redirect(w, r, fmt.Sprintf("/.%s", outboundLink.Keyword), http.StatusFound)
-				core.SYNC <- 1
 				return
 			}
 			// this isn't rendering a template, just an http response
@@ -255,14 +291,16 @@ func RouteAPI(w http.ResponseWriter, r *http.Request) {
 			core.LogDebug.Printf("Incoming link id: %d\n", linkid)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
-				core.SYNC <- 1
 				return
 			}
 
-			data, err := json.Marshal(core.LinkDataBase.Links[linkid])
+			link, exists := core.LinkDataBase.Links[linkid]
+			if exists {
+				link = core.LinkDataBase.VisibleLink(editor, link)
+			}
+			data, err := json.Marshal(link)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
-				core.SYNC <- 1
 				return
 			}
 			w.Header().Set("Content-Type", "application/json")
@@ -289,24 +327,33 @@ func RouteAPI(w http.ResponseWriter, r *http.Request) {
 				msg := "Behavior entered was malformed"
 				core.LogError.Print(msg)
 				http.Error(w, msg, http.StatusBadRequest)
-				core.SYNC <- 1
+				return
+			}
+
+			ll, exists := core.LinkDataBase.Lists[kw]
+			if !exists || !ll.CanSee(editor) {
+				http.Error(w, fmt.Sprintf("there's no keyword '%s'", kw), http.StatusNotFound)
+				return
+			}
+			if !ll.CanEdit(editor) {
+				forbidden(w, ll, editor)
 				return
 			}
 
 			previousBehavior := core.LinkDataBase.Lists[kw].Behavior
 			core.LinkDataBase.Lists[kw].Behavior = requestedBehavior
-			core.LogInfo.Printf("Behavior on keyword '%s' changed to %d by user %s\n", kw, requestedBehavior, core.ExtractUser(r))
+			core.LinkDataBase.RecordList(core.LinkDataBase.Lists[kw])
+			core.LogInfo.Printf("Behavior on keyword '%s' changed to %d by user %s\n", kw, requestedBehavior, user)
 
 			if previousBehavior != requestedBehavior { // handle the case where they just clicked the button with no changes
 				// edit metadata on the list
 				editmsg := fmt.Sprintf("behavior changed from '%s' to '%s'", core.GetPrettyBehaviorString(previousBehavior), core.GetPrettyBehaviorString(requestedBehavior))
-				core.RedirectorMetadata.ListEdits[kw] = core.PrependEdit(core.RedirectorMetadata.ListEdits[kw], &core.EditRecord{EditDate: time.Now(), EditUser: core.ExtractUser(r), EditMsg: editmsg})
+				core.LinkDataBase.AddListEdit(kw, &core.EditRecord{EditDate: time.Now(), EditUser: user, EditMsg: editmsg})
 			}
 
 			if internal {
 				// The template called this, so 302 to the dotpage for this keyword.
 				http.Redirect(w, r, fmt.Sprintf("/.%s", kw), http.StatusFound)
-				core.SYNC <- 1
 				return
 			}
 			w.Header().Set("Content-Type", "application/json")
@@ -315,6 +362,52 @@ func RouteAPI(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusNotImplemented)
 		}
+	} else if r.URL.RequestURI() == "/api/permissions/" {
+		/*
+			A list's owners, protection and visibility, see core/permissions.go
+			POST: keyword, protection (open, owners or locked), visibility (public, team or
+			private), and space-separated owners and groups. They replace all of the list's
+			permissions, so to keep an owner, send them again.
+		*/
+		if r.Method != "POST" {
+			http.Error(w, "not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		kw, _ := core.MakeNewKeyword(r.FormValue("keyword"))
+		ll, exists := core.LinkDataBase.Lists[kw]
+		if !exists || !ll.CanSee(editor) {
+			http.Error(w, fmt.Sprintf("there's no keyword '%s'", kw), http.StatusNotFound)
+			return
+		}
+		if !ll.CanManage(editor) {
+			http.Error(w, fmt.Sprintf("only the owners of '%s' can change who may edit it", kw), http.StatusForbidden)
+			return
+		}
+		previous := ll.DescribePermissions()
+		err = ll.SetPermissions(r.FormValue("protection"), r.FormValue("visibility"), strings.Fields(r.FormValue("owners")), strings.Fields(r.FormValue("groups")))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		core.LinkDataBase.RecordList(ll)
+		if current := ll.DescribePermissions(); current != previous {
+			editmsg := fmt.Sprintf("permissions changed from '%s' to '%s'", previous, current)
+			core.LinkDataBase.AddListEdit(kw, &core.EditRecord{EditDate: time.Now(), EditUser: user, EditMsg: editmsg})
+			core.LogInfo.Printf("Permissions on keyword '%s' changed to '%s' by user %s\n", kw, current, user)
+		}
+
+		if r.FormValue("internal") != "" {
+			http.Redirect(w, r, fmt.Sprintf("/.%s", kw), http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keyword":    kw,
+			"protection": ll.GetProtection(),
+			"visibility": ll.GetVisibility(),
+			"owners":     ll.Owners,
+			"groups":     ll.OwnerGroups,
+		})
 	} else if r.URL.RequestURI() == "/api/keywords" {
 		// Keywords API, used initially just to get the data for the search box. proof-of-concept
 		switch r.Method {
@@ -325,14 +418,35 @@ func RouteAPI(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Cache-Control", "max-age=60") // cache locally to speed things up
 			w.WriteHeader(http.StatusFound)
 
-			data, err := json.Marshal(core.LinkDataBase.Lists)
+			// Only what the user may see, see core/permissions.go.
+			lists := core.LinkDataBase.Lists
+			if core.LinkDataBase.Hides(editor) {
+				db := core.LinkDataBase.Clone()
+				db.Redact(editor)
+				lists = db.Lists
+			}
+			data, err := json.Marshal(lists)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
-				core.SYNC <- 1
 				return
 			}
 			w.Write(data)
 		}
+	} else if strings.HasPrefix(r.URL.Path, "/api/tokens") {
+		/*
+			API tokens, for admins
+			"/api/tokens"
+			GET: list the tokens, without their secrets
+			POST: create a token. Its secret is in the reply, and never shown again.
+			{
+				name: "deploy-bot",
+				scopes: ["links:write", "variables:write"]
+			}
+
+			"/api/tokens/{name}"
+			DELETE: revoke a token
+		*/
+		routeTokens(w, r, user)
 	} else if strings.HasPrefix(r.URL.RequestURI(), "/api/variables/strings") {
 		/*
 			strings api
@@ -355,7 +469,6 @@ func RouteAPI(w http.ResponseWriter, r *http.Request) {
 		split := strings.Split(r.RequestURI, "/")
 		if len(split) < 5 {
 			http.Error(w, "ERROR: string name required in URL", http.StatusBadRequest)
-			core.SYNC <- 1
 			return
 		}
 		strName = strings.Trim(split[4], "\r\n")
@@ -364,14 +477,13 @@ func RouteAPI(w http.ResponseWriter, r *http.Request) {
 		case "DELETE":
 			// The delete operation is on the entire string/value variable.
 			if len(split) == 5 {
-				core.LogInfo.Printf("String %s is being deleted by user %s\n", strName, core.ExtractUser(r))
-				delete(core.LinkDataBase.Variables.Strings, strName)
+				core.LogInfo.Printf("String %s is being deleted by user %s\n", strName, user)
+				core.DeleteStringVar(strName)
 			}
 
 			data, err := json.Marshal("deleted")
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
-				core.SYNC <- 1
 				return
 			}
 			w.Header().Set("Content-Type", "application/json")
@@ -383,26 +495,23 @@ func RouteAPI(w http.ResponseWriter, r *http.Request) {
 			defer r.Body.Close()
 			if err != nil { // problem reading request body
 				http.Error(w, err.Error(), http.StatusBadRequest)
-				core.SYNC <- 1
 				return
 			}
 			err = json.Unmarshal(body, &pl)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
-				core.SYNC <- 1
 				return
 			}
 			// input sanitization
 			pl.Name = strings.Trim(pl.Name, "\r\n")
 			pl.Value = strings.Trim(pl.Value, "\r\n")
 			core.CreateStringVar(pl.Name, pl.Value)
-			core.LogInfo.Printf("String %s is being created by user %s\n", pl.Name, core.ExtractUser(r))
+			core.LogInfo.Printf("String %s is being created by user %s\n", pl.Name, user)
 
 			// bullshit reply for testing, TODO change this to something sensible
 			data, err := json.Marshal(core.LinkDataBase.Variables.Maps[strName])
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
-				core.SYNC <- 1
 				return
 			}
 			w.Header().Set("Content-Type", "application/json")
@@ -448,7 +557,6 @@ func RouteAPI(w http.ResponseWriter, r *http.Request) {
 		split := strings.Split(r.RequestURI, "/")
 		if len(split) < 5 {
 			http.Error(w, "ERROR: map name required in URL", http.StatusBadRequest)
-			core.SYNC <- 1
 			return
 		}
 		mapName := split[4]
@@ -456,20 +564,19 @@ func RouteAPI(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case "DELETE":
 			if len(split) == 5 {
-				core.LogInfo.Printf("Map %s is being deleted by user %s\n", mapName, core.ExtractUser(r))
+				core.LogInfo.Printf("Map %s is being deleted by user %s\n", mapName, user)
 				// The first case is they are deleting an entire map by name.
-				delete(core.LinkDataBase.Variables.Maps, mapName)
+				core.DeleteMapVar(mapName)
 			} else if len(split) == 6 {
 				// The second case is they are deleting a specific key:value pair from a map.
 				// These delete requests will have a request body indicating what is being removed.
 				core.LogInfo.Println("key is being deleted from map")
 				keyName := split[len(split)-1]
-				delete(core.LinkDataBase.Variables.Maps[mapName], keyName)
+				core.DeleteMapKey(mapName, keyName)
 			}
 			data, err := json.Marshal("deleted")
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
-				core.SYNC <- 1
 				return
 			}
 			w.Header().Set("Content-Type", "application/json")
@@ -481,13 +588,11 @@ func RouteAPI(w http.ResponseWriter, r *http.Request) {
 			defer r.Body.Close()
 			if err != nil { // problem reading request body
 				http.Error(w, err.Error(), http.StatusBadRequest)
-				core.SYNC <- 1
 				return
 			}
 			err = json.Unmarshal(body, &pl)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
-				core.SYNC <- 1
 				return
 			}
 
@@ -500,7 +605,6 @@ func RouteAPI(w http.ResponseWriter, r *http.Request) {
 				// key is the first element, value is the second
 				if len(pair) <= 1 { // they didn't provide a separator
 					http.Error(w, "no separator was specified", http.StatusBadRequest)
-					core.SYNC <- 1
 					return
 				}
 				// fmt.Printf("map  - %s\n", pair) // TODO: space crashes this
@@ -508,19 +612,122 @@ func RouteAPI(w http.ResponseWriter, r *http.Request) {
 			}
 
 			// This destroys the entire map and creates it new with incoming values.
-			core.LogInfo.Printf("Map %s is being created/modified by user %s\n", mapName, core.ExtractUser(r))
-			core.LinkDataBase.Variables.Maps[mapName] = tempInput
+			core.LogInfo.Printf("Map %s is being created/modified by user %s\n", mapName, user)
+			core.SetMapVar(mapName, tempInput)
 
 			// bullshit reply for testing
 			data, err := json.Marshal(core.LinkDataBase.Variables.Maps[mapName])
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
-				core.SYNC <- 1
 				return
 			}
 			w.Header().Set("Content-Type", "application/json")
 			w.Write(data)
 		}
 	}
-	core.SYNC <- 1
+}
+
+/*
+authorize works out who is making an API request, and refuses it if they may not make it.
+A request with a bearer token is the token's, as its User, and needs the scope
+the request calls for (see requiredScope). Without a token, anyone may read, and logged-in
+users may change things. Managing tokens takes an admin.
+*/
+func authorize(w http.ResponseWriter, r *http.Request) (core.Editor, bool) {
+	scope := requiredScope(r)
+	if secret := core.BearerToken(r); secret != "" {
+		token := core.LinkDataBase.LookupToken(secret)
+		if token == nil {
+			core.LogInfo.Printf("Unknown API token from %s\n", r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, "unknown API token", http.StatusUnauthorized)
+			return core.Editor{}, false
+		}
+		if !token.Allows(scope) {
+			http.Error(w, fmt.Sprintf("API token '%s' doesn't have the '%s' scope", token.Name, scope), http.StatusForbidden)
+			return core.Editor{}, false
+		}
+		return core.Editor{User: token.User(), Admin: token.Allows(core.ScopeAdmin)}, true
+	}
+	editor := core.EditorOf(r)
+	switch {
+	case scope == core.ScopeRead:
+	case editor.User == "":
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "log in or use an API token to make changes", http.StatusUnauthorized)
+		return core.Editor{}, false
+	case scope == core.ScopeAdmin && !editor.Admin:
+		http.Error(w, "only admins can manage API tokens", http.StatusForbidden)
+		return core.Editor{}, false
+	}
+	return editor, true
+}
+
+// forbidden refuses a change to a list the editor may not edit.
+func forbidden(w http.ResponseWriter, ll *core.ListOfLinks, editor core.Editor) {
+	if !ll.CanSee(editor) {
+		http.Error(w, fmt.Sprintf("the keyword '%s' is taken", ll.Keyword), http.StatusForbidden)
+		return
+	}
+	http.Error(w, fmt.Sprintf("the keyword '%s' is protected (%s) and you may not edit it", ll.Keyword, ll.GetProtection()), http.StatusForbidden)
+}
+
+// requiredScope is the token scope an API request needs.
+func requiredScope(r *http.Request) string {
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/api/tokens"):
+		return core.ScopeAdmin
+	case r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions:
+		return core.ScopeRead
+	case strings.HasPrefix(r.URL.Path, "/api/variables/"):
+		return core.ScopeVariablesWrite
+	}
+	return core.ScopeLinksWrite
+}
+
+// tokenInfo is what the API shows of a token.
+type tokenInfo struct {
+	Name      string    `json:"name"`
+	Scopes    []string  `json:"scopes"`
+	Created   time.Time `json:"created"`
+	CreatedBy string    `json:"created_by"`
+	Token     string    `json:"token,omitempty"` // the secret, only when it's created
+}
+
+// routeTokens lists, creates and revokes API tokens for an admin.
+func routeTokens(w http.ResponseWriter, r *http.Request, user string) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/tokens"), "/")
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case r.Method == "GET" && name == "":
+		tokens := []tokenInfo{}
+		for _, t := range core.LinkDataBase.Tokens() {
+			tokens = append(tokens, tokenInfo{Name: t.Name, Scopes: t.Scopes, Created: t.Created, CreatedBy: t.CreatedBy})
+		}
+		json.NewEncoder(w).Encode(tokens)
+	case r.Method == "POST" && name == "":
+		var request tokenInfo
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		secret, err := core.LinkDataBase.CreateToken(request.Name, request.Scopes, user)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		t := core.LinkDataBase.APITokens[request.Name]
+		core.LogInfo.Printf("API token '%s' with scopes %v was created by user %s\n", t.Name, t.Scopes, user)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(tokenInfo{Name: t.Name, Scopes: t.Scopes, Created: t.Created, CreatedBy: t.CreatedBy, Token: secret})
+	case r.Method == "DELETE" && name != "":
+		if err := core.LinkDataBase.RevokeToken(name); err != nil {
+			http.Error(w, fmt.Sprintf("no API token named '%s'", name), http.StatusNotFound)
+			return
+		}
+		core.LogInfo.Printf("API token '%s' was revoked by user %s\n", name, user)
+		json.NewEncoder(w).Encode(map[string]string{"result": "revoked"})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
 }
@@ -1,7 +1,9 @@
 package api
 
 import (
+	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -65,6 +67,7 @@ func TestRouteAPILink(t *testing.T) {
 	core.LogDebug.Println(encoded)
 	r3, _ := http.NewRequest("POST", "/api/link/", encoded)
 	r3.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r3.AddCookie(&http.Cookie{Name: "redirectorlogin", Value: "tester"}) // only logged-in users can edit
 
 	w3 := httptest.NewRecorder()
 	helpHandle.ServeHTTP(w3, r3)
@@ -77,6 +80,51 @@ func TestRouteAPILink(t *testing.T) {
 	}
 }
 
+// An edit that was waiting for SYNC while the redirector handed off is turned away.
+func TestRouteAPIHandedOff(t *testing.T) {
+	core.LinkDataBase = core.MakeNewLinkDatabase()
+	core.SetActive(false)
+	defer core.SetActive(true)
+	r := httptest.NewRequest("POST", "/api/variables/strings/planet", strings.NewReader(`{"name": "planet", "value": "mars"}`))
+	r.AddCookie(&http.Cookie{Name: "redirectorlogin", Value: "tester"})
+	w := httptest.NewRecorder()
+	RouteAPI(w, r)
+	if w.Code != http.StatusServiceUnavailable || core.LinkDataBase.Variables.Strings["planet"] != "" {
+		t.Errorf("a standby shouldn't take the change, got %d", w.Code)
+	}
+}
+
+// An edit that couldn't be journaled isn't reported as saved.
+func TestRouteAPIJournalFailure(t *testing.T) {
+	core.LinkDataBase = core.MakeNewLinkDatabase()
+	j, err := core.OpenJournal(t.TempDir() + "/godb.json.journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.Close() // every write to it fails from here on
+	core.LinkDataBase.AttachJournal(j)
+	post := func(internal string) *httptest.ResponseRecorder {
+		form := url.Values{"internal": {internal}, "returnto": {"wiki"}, "linkid": {"0"}, "url": {"wiki.example.com"}, "expiretime": {"1h"}}
+		r := httptest.NewRequest("POST", "/api/link/", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.AddCookie(&http.Cookie{Name: "redirectorlogin", Value: "tester"})
+		w := httptest.NewRecorder()
+		RouteAPI(w, r)
+		return w
+	}
+
+	for _, internal := range []string{"", "true"} {
+		w := post(internal)
+		if w.Code != http.StatusInternalServerError || w.Header().Get("Location") != "" {
+			t.Errorf("an edit that wasn't journaled should be a 500, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+	core.LinkDataBase.AttachJournal(nil)
+	if w := post(""); w.Code != http.StatusAccepted {
+		t.Errorf("a journal failure shouldn't fail later edits, got %d", w.Code)
+	}
+}
+
 // This tests for a nasty bug if a bad link ID is provided in the form.
 func TestRouteAPIBadLinkID(t *testing.T) {
 	// api/link
@@ -98,6 +146,7 @@ func TestRouteAPIBadLinkID(t *testing.T) {
 	core.LogDebug.Println(encoded)
 	r3, _ := http.NewRequest("POST", "/api/link/", encoded)
 	r3.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r3.AddCookie(&http.Cookie{Name: "redirectorlogin", Value: "tester"}) // only logged-in users can edit
 
 	w3 := httptest.NewRecorder()
 	apiHandle.ServeHTTP(w3, r3)
@@ -110,6 +159,229 @@ func TestRouteAPIBadLinkID(t *testing.T) {
 	}
 }
 
+// Changes need a login or a token with the right scope, and only admins manage tokens.
+func TestRouteAPITokens(t *testing.T) {
+	core.LinkDataBase = core.MakeNewLinkDatabase()
+	defer func(users []string, a core.Authenticator) { core.AdminUsers, core.Auth = users, a }(core.AdminUsers, core.Auth)
+	core.AdminUsers = []string{"root"}
+	proxy, _ := core.ParseProxy("192.0.2.1") // httptest's, admins need more than a login cookie
+	core.Auth = &core.TrustedHeaderAuth{UserHeader: core.DefaultAuthUserHeader, Proxies: []*net.IPNet{proxy}}
+	call := func(method, path, body, user, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if user != "" {
+			r.Header.Set(core.DefaultAuthUserHeader, user)
+		}
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		RouteAPI(w, r)
+		return w
+	}
+	newToken := func(name, scopes string) string {
+		w := call("POST", "/api/tokens", fmt.Sprintf(`{"name": "%s", "scopes": [%s]}`, name, scopes), "root", "")
+		var created struct{ Token string }
+		json.NewDecoder(w.Body).Decode(&created)
+		if w.Code != http.StatusCreated || created.Token == "" {
+			t.Fatalf("an admin should be able to create a token, got %d", w.Code)
+		}
+		return created.Token
+	}
+	setString := `{"name": "planet", "value": "mars"}`
+
+	if w := call("POST", "/api/tokens", `{"name": "mine", "scopes": ["admin"]}`, "someone", ""); w.Code != http.StatusForbidden {
+		t.Errorf("only admins should create tokens, got %d", w.Code)
+	}
+	if w := call("GET", "/api/tokens", "", "", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("listing tokens should need a login, got %d", w.Code)
+	}
+	if w := call("POST", "/api/variables/strings/planet", setString, "", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("changes without a login or token should be refused, got %d", w.Code)
+	}
+	if w := call("POST", "/api/variables/strings/planet", setString, "", "go2_bogus"); w.Code != http.StatusUnauthorized {
+		t.Errorf("an unknown token should be refused, got %d", w.Code)
+	}
+
+	reader := newToken("reader", `"read"`)
+	writer := newToken("deploy-bot", `"links:write", "variables:write"`)
+	if w := call("GET", "/api/keywords", "", "", reader); w.Code != http.StatusFound {
+		t.Errorf("a read token should read, got %d", w.Code)
+	}
+	if w := call("POST", "/api/variables/strings/planet", setString, "", reader); w.Code != http.StatusForbidden {
+		t.Errorf("a read token shouldn't change variables, got %d", w.Code)
+	}
+	if w := call("POST", "/api/variables/strings/planet", setString, "", writer); w.Code != http.StatusOK || core.LinkDataBase.Variables.Strings["planet"] != "mars" {
+		t.Errorf("a variables:write token should change variables, got %d", w.Code)
+	}
+	form := url.Values{"returnto": {"tokened"}, "linkid": {"0"}, "url": {"www.example.com"}, "expiretime": {"1h"}}
+	r := httptest.NewRequest("POST", "/api/link/", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Authorization", "Bearer "+writer)
+	w := httptest.NewRecorder()
+	RouteAPI(w, r)
+	if edits := core.LinkDataBase.Metadata.ListEdits["tokened"]; w.Code != http.StatusAccepted || len(edits) == 0 || edits[0].EditUser != "token:deploy-bot" {
+		t.Errorf("edits with a token should be the token's, got %d", w.Code)
+	}
+
+	// a token named after someone can't act as them, and nobody logs in as a token
+	core.LinkDataBase.Lists["tokened"].SetPermissions(core.ProtectionOwners, "", []string{"alice"}, nil)
+	alice := newToken("alice", `"links:write"`)
+	r = httptest.NewRequest("POST", "/api/link/", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Authorization", "Bearer "+alice)
+	w = httptest.NewRecorder()
+	RouteAPI(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("a token named alice shouldn't edit alice's keyword, got %d", w.Code)
+	}
+	if w := call("POST", "/api/variables/strings/planet", setString, "token:deploy-bot", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("logging in as a token should be refused, got %d", w.Code)
+	}
+
+	w = call("GET", "/api/tokens", "", "root", "")
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), reader) || !strings.Contains(w.Body.String(), `"deploy-bot"`) {
+		t.Errorf("tokens should be listed without their secrets, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := call("DELETE", "/api/tokens/reader", "", "", writer); w.Code != http.StatusForbidden {
+		t.Errorf("only admin tokens should revoke tokens, got %d", w.Code)
+	}
+	if w := call("DELETE", "/api/tokens/reader", "", "root", ""); w.Code != http.StatusOK {
+		t.Errorf("an admin should revoke tokens, got %d", w.Code)
+	}
+	if w := call("GET", "/api/keywords", "", "", reader); w.Code != http.StatusUnauthorized {
+		t.Errorf("a revoked token should be refused, got %d", w.Code)
+	}
+}
+
+// Lists belong to whoever makes them, and their owners decide who else may change them.
+func TestRouteAPIPermissions(t *testing.T) {
+	core.LinkDataBase = core.MakeNewLinkDatabase()
+	post := func(path string, form url.Values, user string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if user != "" {
+			r.AddCookie(&http.Cookie{Name: "redirectorlogin", Value: user})
+		}
+		w := httptest.NewRecorder()
+		RouteAPI(w, r)
+		return w
+	}
+	link := func(id, target string) url.Values {
+		return url.Values{"returnto": {"wiki"}, "linkid": {id}, "url": {target}, "title": {"wiki"}, "expiretime": {"1h"}}
+	}
+	behavior := url.Values{"keyword": {"wiki"}, "behavior": {"-1"}}
+	locked := url.Values{"keyword": {"wiki"}, "protection": {"owners"}, "owners": {"alice"}}
+
+	if w := post("/api/link/", link("0", "wiki.example.com"), "alice"); w.Code != http.StatusAccepted {
+		t.Fatalf("adding a link should work, got %d", w.Code)
+	}
+	if owners := core.LinkDataBase.Lists["wiki"].Owners; len(owners) != 1 || owners[0] != "alice" {
+		t.Errorf("the user creating a keyword should own it, got %v", owners)
+	}
+	if w := post("/api/behavior/", behavior, "bob"); w.Code != http.StatusNotImplemented {
+		t.Errorf("anyone should change an open keyword, got %d", w.Code)
+	}
+	if w := post("/api/behavior/", url.Values{"keyword": {"nothere"}, "behavior": {"-1"}}, "bob"); w.Code != http.StatusNotFound {
+		t.Errorf("changing a missing keyword should be a 404, got %d", w.Code)
+	}
+	if w := post("/api/permissions/", locked, "bob"); w.Code != http.StatusForbidden {
+		t.Errorf("only owners should change permissions, got %d", w.Code)
+	}
+	if w := post("/api/permissions/", locked, "alice"); w.Code != http.StatusOK || core.LinkDataBase.Lists["wiki"].GetProtection() != core.ProtectionOwners {
+		t.Fatalf("an owner should change permissions, got %d", w.Code)
+	}
+
+	for _, l := range core.LinkDataBase.Lists["wiki"].Links {
+		id := fmt.Sprint(l.ID)
+		if w := post("/api/link/", link(id, "evil.example.com"), "bob"); w.Code != http.StatusForbidden {
+			t.Errorf("non-owners shouldn't edit an owners-only keyword's links, got %d", w.Code)
+		}
+		unlink := link(id, "wiki.example.com")
+		unlink.Set("delete", "true")
+		if w := post("/api/link/", unlink, "bob"); w.Code != http.StatusForbidden {
+			t.Errorf("non-owners shouldn't unlink an owners-only keyword's links, got %d", w.Code)
+		}
+		// nor change it through another keyword
+		elsewhere := link(id, "evil.example.com")
+		elsewhere.Set("returnto", "elsewhere")
+		if w := post("/api/link/", elsewhere, "bob"); w.Code != http.StatusForbidden {
+			t.Errorf("non-owners shouldn't edit a protected link from another keyword, got %d", w.Code)
+		}
+		if w := post("/api/link/", link(id, "wiki2.example.com"), "alice"); w.Code != http.StatusAccepted {
+			t.Errorf("owners should edit their keyword's links, got %d", w.Code)
+		}
+	}
+	behavior.Set("behavior", "-3")
+	if w := post("/api/behavior/", behavior, "bob"); w.Code != http.StatusForbidden || core.LinkDataBase.Lists["wiki"].Behavior != -1 {
+		t.Errorf("non-owners shouldn't change an owners-only keyword's behavior, got %d", w.Code)
+	}
+	another := link("0", "other.example.com")
+	another.Set("returnto", "other")
+	another.Set("otherlists", "wiki")
+	if w := post("/api/link/", another, "bob"); w.Code != http.StatusForbidden || core.LinkDataBase.Lists["other"] != nil {
+		t.Errorf("non-owners shouldn't add links to an owners-only keyword through another, got %d", w.Code)
+	}
+
+	if w := post("/api/permissions/", url.Values{"keyword": {"wiki"}, "protection": {"locked"}, "owners": {"alice"}}, "alice"); w.Code != http.StatusOK {
+		t.Fatalf("an owner should lock their keyword, got %d", w.Code)
+	}
+	if w := post("/api/behavior/", behavior, "alice"); w.Code != http.StatusForbidden {
+		t.Errorf("a locked keyword shouldn't change, got %d", w.Code)
+	}
+	if w := post("/api/permissions/", url.Values{"keyword": {"wiki"}, "protection": {"owners"}}, "alice"); w.Code != http.StatusBadRequest {
+		t.Errorf("an owners-only keyword without owners should be refused, got %d", w.Code)
+	}
+	if edits := core.LinkDataBase.Metadata.ListEdits["wiki"]; len(edits) == 0 || !strings.Contains(edits[0].EditMsg, "permissions changed") {
+		t.Error("permission changes should be in the keyword's edit history")
+	}
+}
+
+// Keywords hidden from a user are left out of what the API tells them.
+func TestRouteAPIVisibility(t *testing.T) {
+	core.LinkDataBase = core.MakeNewLinkDatabase()
+	l, _ := core.MakeNewlink("wiki.example.com/private", "private wiki")
+	core.LinkDataBase.CommitNewLink(l)
+	ll := core.MakeNewList("secret")
+	core.LinkDataBase.Couple(ll, l)
+	ll.SetPermissions("", core.VisibilityPrivate, []string{"alice"}, nil)
+	call := func(method, path string, form url.Values, user string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if user != "" {
+			r.AddCookie(&http.Cookie{Name: "redirectorlogin", Value: user})
+		}
+		w := httptest.NewRecorder()
+		RouteAPI(w, r)
+		return w
+	}
+
+	for user, want := range map[string]bool{"": false, "bob": false, "alice": true} {
+		w := call("GET", "/api/keywords", nil, user)
+		if got := strings.Contains(w.Body.String(), "secret"); got != want {
+			t.Errorf("'%s' seeing the private keyword: got %t, want %t", user, got, want)
+		}
+		w = call("GET", fmt.Sprintf("/api/link/?linkid=%d", l.ID), nil, user)
+		if got := strings.Contains(w.Body.String(), "wiki.example.com"); got != want {
+			t.Errorf("'%s' seeing the private keyword's link: got %t, want %t", user, got, want)
+		}
+	}
+
+	if w := call("POST", "/api/behavior/", url.Values{"keyword": {"secret"}, "behavior": {"-1"}}, "bob"); w.Code != http.StatusNotFound {
+		t.Errorf("a hidden keyword shouldn't be found, got %d", w.Code)
+	}
+	adding := url.Values{"returnto": {"secret"}, "linkid": {"0"}, "url": {"evil.example.com"}, "expiretime": {"1h"}}
+	if w := call("POST", "/api/link/", adding, "bob"); w.Code != http.StatusForbidden || len(ll.Links) != 1 {
+		t.Errorf("nobody should add links to a keyword hidden from them, got %d", w.Code)
+	}
+	hide := url.Values{"keyword": {"secret"}, "visibility": {"team"}, "owners": {"alice"}, "groups": {"docs"}}
+	if w := call("POST", "/api/permissions/", hide, "bob"); w.Code != http.StatusNotFound {
+		t.Errorf("a hidden keyword's permissions shouldn't be found, got %d", w.Code)
+	}
+	if w := call("POST", "/api/permissions/", hide, "alice"); w.Code != http.StatusOK || ll.GetVisibility() != core.VisibilityTeam {
+		t.Errorf("an owner should change who sees their keyword, got %d", w.Code)
+	}
+}
+
 func FuzzTestRouteAPI(f *testing.F) {
 	srv := httptest.NewServer(http.HandlerFunc(RouteAPI))
 	defer srv.Close()
@@ -130,7 +402,10 @@ func FuzzTestRouteAPI(f *testing.F) {
 		linkPost.Set("otherlists", o)
 		encoded := strings.NewReader(linkPost.Encode())
 
-		_, err := http.DefaultClient.Post(fmt.Sprintf("%s/api/link/", srv.URL), "application/x-www-form-urlencoded", encoded)
+		r, _ := http.NewRequest("POST", fmt.Sprintf("%s/api/link/", srv.URL), encoded)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.AddCookie(&http.Cookie{Name: "redirectorlogin", Value: "fuzzer"})
+		_, err := http.DefaultClient.Do(r)
 
 		if err != nil {
 			t.Errorf("Error: %v", err)
@@ -187,5 +462,4 @@ func FuzzTestRouteAPI(f *testing.F) {
 // If this isn't here, logging calls during functions we are testing cause a SEGV
 func init() {
 	core.ConfigureLogging(true, os.Stdout)
-	core.SYNC <- 1
 }
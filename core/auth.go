@@ -0,0 +1,222 @@
+package core
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+/*
+Authentication
+
+An Authenticator works out who made a request. ExtractUser asks the configured one, Auth,
+so the edit records and log lines name whoever it finds.
+
+The config file picks one with "auth_mode":
+
+  - "cookie", the default, trusts the name a user typed in at /_login_, which is kept in
+    the redirectorlogin cookie. Anyone can claim to be anyone.
+  - "header" trusts the identity a single sign-on reverse proxy puts in the request's
+    headers, X-Forwarded-User or else X-Forwarded-Email unless configured otherwise. Only
+    requests from the addresses in "auth_trusted_proxies" are believed, so nobody can set
+    the headers themselves by going around the proxy. Users' groups are read from
+    "auth_groups_header" too, if it's set. There are no logins at /_login_.
+  - "oidc" has /_login_ send users to log in with an OpenID Connect issuer, see oidc.go.
+*/
+
+// Authentication modes.
+const (
+	AuthCookie = "cookie"
+	AuthHeader = "header"
+)
+
+// Identity headers trusted by default in header mode.
+const (
+	DefaultAuthUserHeader  = "X-Forwarded-User"
+	DefaultAuthEmailHeader = "X-Forwarded-Email"
+)
+
+// Authenticator works out who made a request.
+type Authenticator interface {
+	// User returns who made r, or "" if nobody is logged in.
+	User(r *http.Request) string
+	// Groups returns the groups the user who made r is in, if the Authenticator knows.
+	Groups(r *http.Request) []string
+	// LoginForm reports whether users log in and out with the form at /_login_.
+	LoginForm() bool
+}
+
+// Auth is the Authenticator ExtractUser asks, see ConfigureAuth.
+var Auth Authenticator = CookieAuth{}
+
+// CookieAuth takes the user's word for who they are, from the redirectorlogin cookie.
+type CookieAuth struct{}
+
+func (CookieAuth) User(r *http.Request) string {
+	if c, err := r.Cookie("redirectorlogin"); err == nil {
+		return c.Value
+	}
+	return ""
+}
+
+func (CookieAuth) Groups(r *http.Request) []string {
+	return nil
+}
+
+func (CookieAuth) LoginForm() bool {
+	return true
+}
+
+// TrustedHeaderAuth takes the identity a reverse proxy sets in the headers, on requests
+// from the proxy.
+type TrustedHeaderAuth struct {
+	UserHeader   string
+	EmailHeader  string       // used when there's no UserHeader
+	GroupsHeader string       // a comma-separated list of the user's groups, if set
+	Proxies      []*net.IPNet // where requests from the proxy come from
+}
+
+func (a *TrustedHeaderAuth) User(r *http.Request) string {
+	user := r.Header.Get(a.UserHeader)
+	if user == "" {
+		user = r.Header.Get(a.EmailHeader)
+	}
+	if user == "" {
+		return ""
+	}
+	if !a.fromProxy(r.RemoteAddr) {
+		LogDebug.Printf("ignoring identity '%s' from %s, which isn't a trusted proxy\n", user, r.RemoteAddr)
+		return ""
+	}
+	return user
+}
+
+func (a *TrustedHeaderAuth) Groups(r *http.Request) []string {
+	if a.GroupsHeader == "" || a.User(r) == "" {
+		return nil
+	}
+	var groups []string
+	for _, group := range strings.Split(r.Header.Get(a.GroupsHeader), ",") {
+		if group = strings.TrimSpace(group); group != "" {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+func (a *TrustedHeaderAuth) LoginForm() bool {
+	return false
+}
+
+// fromProxy reports whether a request from addr came through a trusted proxy.
+func (a *TrustedHeaderAuth) fromProxy(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, proxy := range a.Proxies {
+		if proxy.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseProxy reads a trusted proxy's address, or a CIDR block of them.
+func ParseProxy(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, block, err := net.ParseCIDR(s)
+		return block, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("'%s' isn't an IP address or CIDR block", s)
+	}
+	bits := 8 * net.IPv4len
+	if ip.To4() == nil {
+		bits = 8 * net.IPv6len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// ConfigureAuth makes Auth the Authenticator the config file asks for.
+func ConfigureAuth() error {
+	switch AuthMode {
+	case "", AuthCookie:
+		Auth = CookieAuth{}
+	case AuthHeader:
+		a := &TrustedHeaderAuth{UserHeader: AuthUserHeader, EmailHeader: AuthEmailHeader, GroupsHeader: AuthGroupsHeader}
+		if a.UserHeader == "" {
+			a.UserHeader = DefaultAuthUserHeader
+		}
+		if a.EmailHeader == "" {
+			a.EmailHeader = DefaultAuthEmailHeader
+		}
+		for _, s := range AuthTrustedProxies {
+			proxy, err := ParseProxy(s)
+			if err != nil {
+				return err
+			}
+			a.Proxies = append(a.Proxies, proxy)
+		}
+		if len(a.Proxies) == 0 {
+			return fmt.Errorf("auth_mode '%s' needs auth_trusted_proxies", AuthHeader)
+		}
+		Auth = a
+		LogInfo.Printf("Taking identities from the %s and %s headers set by %v\n", a.UserHeader, a.EmailHeader, AuthTrustedProxies)
+		if a.GroupsHeader != "" {
+			LogInfo.Printf("Taking groups from the %s header\n", a.GroupsHeader)
+		}
+	case AuthOIDC:
+		a, err := configureOIDC()
+		if err != nil {
+			return err
+		}
+		Auth = a
+		LogInfo.Printf("Logging users in with OpenID Connect issuer %s\n", a.Issuer)
+	default:
+		return fmt.Errorf("unknown auth_mode '%s'", AuthMode)
+	}
+	return nil
+}
+
+// configureOIDC sets up logins with the OpenID Connect issuer in the config file.
+func configureOIDC() (*OIDCAuth, error) {
+	if OIDCIssuer == "" || OIDCClientID == "" {
+		return nil, fmt.Errorf("auth_mode '%s' needs oidc_issuer and oidc_client_id", AuthOIDC)
+	}
+	key := []byte(AuthSessionKey)
+	if len(key) == 0 {
+		LogInfo.Println("No auth_session_key is set, so logins won't outlast this process")
+		key = []byte(randomToken())
+	} else if len(key) < 32 {
+		return nil, fmt.Errorf("auth_session_key should be at least 32 characters")
+	}
+	redirect := OIDCRedirectURL
+	if redirect == "" {
+		redirect = fmt.Sprintf("%s://%s/_login_", ExternalProto, ExternalAddress)
+		if ExternalPort != 0 {
+			redirect = fmt.Sprintf("%s://%s:%d/_login_", ExternalProto, ExternalAddress, ExternalPort)
+		}
+	}
+	a := NewOIDCAuth(OIDCIssuer, OIDCClientID, redirect, key)
+	a.ClientSecret = OIDCClientSecret
+	if len(OIDCScopes) > 0 {
+		a.Scopes = OIDCScopes
+	}
+	if !strings.Contains(" "+strings.Join(a.Scopes, " ")+" ", " openid ") {
+		return nil, fmt.Errorf("oidc_scopes must include 'openid'")
+	}
+	if OIDCUserClaim != "" {
+		a.UserClaim = OIDCUserClaim
+	}
+	if OIDCGroupsClaim != "" {
+		a.GroupsClaim = OIDCGroupsClaim
+	}
+	return a, nil
+}
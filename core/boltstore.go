@@ -0,0 +1,529 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+/*
+BoltStore keeps the link database in a single bbolt file. Every list, link, variable,
+and edit history is its own key, so a checkpoint only writes what changed since the
+last one (see changes.go) instead of the whole database.
+
+Records are the same JSON the JSON file backend writes for each entity. Lists are
+stored without copies of their links, only the IDs, since the links have their own keys.
+Usage logs are small and capped, so they're rewritten on every save.
+
+Only one process can have the file open at a time.
+*/
+type BoltStore struct {
+	Path string
+
+	mu    sync.Mutex
+	db    *bolt.DB
+	saved *LinkDatabase // the database the last save or load was for
+}
+
+var (
+	boltLists     = []byte("lists")
+	boltLinks     = []byte("links")
+	boltStrings   = []byte("strings")
+	boltMaps      = []byte("maps")
+	boltListEdits = []byte("listedits")
+	boltLinkEdits = []byte("linkedits")
+	boltLinkLog   = []byte("linklog")
+	boltTokens    = []byte("tokens")
+	boltInfo      = []byte("info") // NextLinkID, Generation, and SchemaVersion
+
+	boltBuckets = [][]byte{boltLists, boltLinks, boltStrings, boltMaps, boltListEdits, boltLinkEdits, boltLinkLog, boltTokens, boltInfo}
+)
+
+func init() {
+	RegisterStore("bolt", OpenBoltStore)
+}
+
+// OpenBoltStore opens (or creates) the bolt database file at path.
+func OpenBoltStore(path string) (Store, error) {
+	if path == "" {
+		return nil, errors.New("the bolt storage backend needs a file name")
+	}
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("could not open bolt database %s: %s", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range boltBuckets {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{Path: path, db: db}, nil
+}
+
+/*
+Load reads every record and puts the database back together. The records are assembled
+into the same document godb.json holds and go through the schema migrations on the way,
+so this backend doesn't need migrations of its own. A database that had to be migrated
+is written out in full on the next save.
+*/
+func (b *BoltStore) Load() (*LinkDatabase, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	lists := make(map[string]json.RawMessage)
+	links := make(map[string]json.RawMessage)
+	strs := make(map[string]string)
+	maps := make(map[string]json.RawMessage)
+	listEdits := make(map[string]json.RawMessage)
+	linkEdits := make(map[string]json.RawMessage)
+	linkLog := make(map[string]json.RawMessage)
+	tokens := make(map[string]json.RawMessage)
+	doc := map[string]interface{}{
+		"Lists":     lists,
+		"Links":     links,
+		"Variables": map[string]interface{}{"strings": strs, "maps": maps, "uses": map[string]interface{}{}},
+		"Metadata":  map[string]interface{}{"ListEdits": listEdits, "LinkEdits": linkEdits},
+		"LinkLog":   linkLog,
+	}
+	// the raw records are only valid during the transaction, so they're copied
+	collect := func(tx *bolt.Tx, bucket []byte, into map[string]json.RawMessage) error {
+		return tx.Bucket(bucket).ForEach(func(k, v []byte) error {
+			into[string(k)] = append(json.RawMessage(nil), v...)
+			return nil
+		})
+	}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		for bucket, into := range map[string]map[string]json.RawMessage{
+			string(boltLists): lists, string(boltLinks): links, string(boltMaps): maps,
+			string(boltListEdits): listEdits, string(boltLinkEdits): linkEdits, string(boltLinkLog): linkLog,
+			string(boltTokens): tokens,
+		} {
+			if err := collect(tx, []byte(bucket), into); err != nil {
+				return err
+			}
+		}
+		tx.Bucket(boltStrings).ForEach(func(k, v []byte) error {
+			strs[string(k)] = string(v)
+			return nil
+		})
+		info := tx.Bucket(boltInfo)
+		for _, key := range []string{"NextLinkID", "Generation", "SchemaVersion"} {
+			if v := info.Get([]byte(key)); v != nil {
+				doc[key] = json.Number(v)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) > 0 {
+		doc["APITokens"] = tokens
+	}
+	if _, exists := doc["NextLinkID"]; !exists {
+		// a new, empty bolt file
+		b.saved = nil
+		return MakeNewLinkDatabase(), nil
+	}
+
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	data, err = migrateOnLoad(data)
+	if err != nil {
+		return nil, err
+	}
+	var d LinkDatabase
+	if err = json.Unmarshal(data, &d); err != nil {
+		LogError.Printf("json parsing error: %s", err)
+		return nil, err
+	}
+	d.relink()
+	b.saved = nil
+	if doc["SchemaVersion"] == json.Number(strconv.Itoa(CurrentSchemaVersion())) {
+		b.saved = &d // nothing was migrated, the file matches d
+	}
+	return &d, err
+}
+
+/*
+Save writes the database. For the database this store last loaded or saved, only the
+entities in its change set are written, in one transaction. Any other database (the first
+save, a restored snapshot, a conversion) replaces everything in the file. If the
+transaction fails, the changes are kept for the next save.
+*/
+func (b *BoltStore) Save(d *LinkDatabase) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if d.saveAs() != b.saved {
+		err := b.db.Update(func(tx *bolt.Tx) error {
+			return writeAll(tx, d)
+		})
+		if err != nil {
+			return err
+		}
+		d.changes.take()
+		b.saved = d.saveAs()
+		return err
+	}
+
+	pending := d.changes.take()
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		for ch := range pending {
+			if err := writeChange(tx, d, ch); err != nil {
+				return err
+			}
+		}
+		return writeSmall(tx, d)
+	})
+	if err != nil {
+		d.changes.giveBack(pending)
+	}
+	return err
+}
+
+// writeAll replaces every bucket's contents with the database.
+func writeAll(tx *bolt.Tx, d *LinkDatabase) error {
+	for _, name := range boltBuckets {
+		if err := tx.DeleteBucket(name); err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+			return err
+		}
+		if _, err := tx.CreateBucket(name); err != nil {
+			return err
+		}
+	}
+	var err error
+	for _, ll := range d.Lists {
+		if err = putBoltList(tx, ll); err != nil {
+			return err
+		}
+	}
+	for id, l := range d.Links {
+		if err = putBoltJSON(tx, boltLinks, strconv.Itoa(id), l); err != nil {
+			return err
+		}
+	}
+	if d.Variables != nil {
+		for name, v := range d.Variables.Strings {
+			if err = tx.Bucket(boltStrings).Put([]byte(name), []byte(v)); err != nil {
+				return err
+			}
+		}
+		for name, m := range d.Variables.Maps {
+			if err = putBoltJSON(tx, boltMaps, name, m); err != nil {
+				return err
+			}
+		}
+	}
+	if d.Metadata != nil {
+		for k, e := range d.Metadata.ListEdits {
+			if err = putBoltJSON(tx, boltListEdits, string(k), e); err != nil {
+				return err
+			}
+		}
+		for id, e := range d.Metadata.LinkEdits {
+			if err = putBoltJSON(tx, boltLinkEdits, strconv.Itoa(id), e); err != nil {
+				return err
+			}
+		}
+	}
+	for name, t := range d.APITokens {
+		if err = putBoltJSON(tx, boltTokens, name, t); err != nil {
+			return err
+		}
+	}
+	return writeSmall(tx, d)
+}
+
+// writeSmall writes the usage logs, the next link ID, the generation, and the schema version.
+func writeSmall(tx *bolt.Tx, d *LinkDatabase) error {
+	if err := tx.DeleteBucket(boltLinkLog); err != nil {
+		return err
+	}
+	if _, err := tx.CreateBucket(boltLinkLog); err != nil {
+		return err
+	}
+	var err error
+	for k, usages := range d.LinkLog {
+		if err = putBoltJSON(tx, boltLinkLog, string(k), usages); err != nil {
+			return err
+		}
+	}
+	info := tx.Bucket(boltInfo)
+	if err = info.Put([]byte("NextLinkID"), []byte(strconv.Itoa(d.NextLinkID))); err != nil {
+		return err
+	}
+	if err = info.Put([]byte("Generation"), []byte(strconv.FormatUint(d.Generation, 10))); err != nil {
+		return err
+	}
+	return info.Put([]byte("SchemaVersion"), []byte(strconv.Itoa(CurrentSchemaVersion())))
+}
+
+// writeChange writes the current state of one changed entity, or deletes it if it's gone.
+func writeChange(tx *bolt.Tx, d *LinkDatabase, ch change) error {
+	switch ch.Kind {
+	case changeList:
+		if ll, exists := d.Lists[Keyword(ch.Key)]; exists {
+			return putBoltList(tx, ll)
+		}
+		return tx.Bucket(boltLists).Delete([]byte(ch.Key))
+	case changeLink:
+		id, _ := strconv.Atoi(ch.Key)
+		if l, exists := d.Links[id]; exists {
+			return putBoltJSON(tx, boltLinks, ch.Key, l)
+		}
+		return tx.Bucket(boltLinks).Delete([]byte(ch.Key))
+	case changeString:
+		if v, exists := d.Variables.Strings[ch.Key]; exists {
+			return tx.Bucket(boltStrings).Put([]byte(ch.Key), []byte(v))
+		}
+		return tx.Bucket(boltStrings).Delete([]byte(ch.Key))
+	case changeMap:
+		if m, exists := d.Variables.Maps[ch.Key]; exists {
+			return putBoltJSON(tx, boltMaps, ch.Key, m)
+		}
+		return tx.Bucket(boltMaps).Delete([]byte(ch.Key))
+	case changeListEdits:
+		if e, exists := d.Metadata.ListEdits[Keyword(ch.Key)]; exists {
+			return putBoltJSON(tx, boltListEdits, ch.Key, e)
+		}
+		return tx.Bucket(boltListEdits).Delete([]byte(ch.Key))
+	case changeLinkEdits:
+		id, _ := strconv.Atoi(ch.Key)
+		if e, exists := d.Metadata.LinkEdits[id]; exists {
+			return putBoltJSON(tx, boltLinkEdits, ch.Key, e)
+		}
+		return tx.Bucket(boltLinkEdits).Delete([]byte(ch.Key))
+	case changeToken:
+		if t, exists := d.APITokens[ch.Key]; exists {
+			return putBoltJSON(tx, boltTokens, ch.Key, t)
+		}
+		return tx.Bucket(boltTokens).Delete([]byte(ch.Key))
+	case changeLinkLog:
+		return nil // see writeSmall
+	}
+	return fmt.Errorf("unknown change kind '%s'", ch.Kind)
+}
+
+func putBoltJSON(tx *bolt.Tx, bucket []byte, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(bucket).Put([]byte(key), data)
+}
+
+// putBoltList stores a list with only the IDs of its links. Load puts the links back.
+func putBoltList(tx *bolt.Tx, ll *ListOfLinks) error {
+	stored := *ll
+	stored.Links = make(map[int]*Link, len(ll.Links))
+	for id := range ll.Links {
+		stored.Links[id] = &Link{ID: id}
+	}
+	return putBoltJSON(tx, boltLists, string(ll.Keyword), &stored)
+}
+
+func (b *BoltStore) getJSON(bucket []byte, key string, v interface{}) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucket).Get([]byte(key))
+		if data == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(data, v)
+	})
+}
+
+func (b *BoltStore) putJSON(bucket []byte, key string, v interface{}) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return putBoltJSON(tx, bucket, key, v)
+	})
+}
+
+func (b *BoltStore) delete(bucket []byte, key string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Delete([]byte(key))
+	})
+}
+
+// GetList returns a stored list. Its links only have their IDs filled in.
+func (b *BoltStore) GetList(k Keyword) (*ListOfLinks, error) {
+	var ll ListOfLinks
+	if err := b.getJSON(boltLists, string(k), &ll); err != nil {
+		return nil, err
+	}
+	return &ll, nil
+}
+
+func (b *BoltStore) PutList(ll *ListOfLinks) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return putBoltList(tx, ll)
+	})
+}
+
+func (b *BoltStore) DeleteList(k Keyword) error {
+	return b.delete(boltLists, string(k))
+}
+
+func (b *BoltStore) GetLink(id int) (*Link, error) {
+	var l Link
+	if err := b.getJSON(boltLinks, strconv.Itoa(id), &l); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+func (b *BoltStore) PutLink(l *Link) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if err := putBoltJSON(tx, boltLinks, strconv.Itoa(l.ID), l); err != nil {
+			return err
+		}
+		info := tx.Bucket(boltInfo)
+		next, _ := strconv.Atoi(string(info.Get([]byte("NextLinkID"))))
+		if l.ID >= next {
+			return info.Put([]byte("NextLinkID"), []byte(strconv.Itoa(l.ID+1)))
+		}
+		return nil
+	})
+}
+
+func (b *BoltStore) DeleteLink(id int) error {
+	return b.delete(boltLinks, strconv.Itoa(id))
+}
+
+func (b *BoltStore) GetStringVar(name string) (string, error) {
+	var v string
+	err := b.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(boltStrings).Get([]byte(name))
+		if data == nil {
+			return ErrNotFound
+		}
+		v = string(data)
+		return nil
+	})
+	return v, err
+}
+
+func (b *BoltStore) PutStringVar(name, value string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltStrings).Put([]byte(name), []byte(value))
+	})
+}
+
+func (b *BoltStore) DeleteStringVar(name string) error {
+	return b.delete(boltStrings, name)
+}
+
+func (b *BoltStore) GetMapVar(name string) (map[string]string, error) {
+	var m map[string]string
+	if err := b.getJSON(boltMaps, name, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (b *BoltStore) PutMapVar(name string, m map[string]string) error {
+	return b.putJSON(boltMaps, name, m)
+}
+
+func (b *BoltStore) DeleteMapVar(name string) error {
+	return b.delete(boltMaps, name)
+}
+
+func (b *BoltStore) LoadMetadata() (*Metadata, error) {
+	m := MakeNewMetadata()
+	err := b.db.View(func(tx *bolt.Tx) error {
+		err := tx.Bucket(boltListEdits).ForEach(func(k, v []byte) error {
+			var e []*EditRecord
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			m.ListEdits[Keyword(k)] = e
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(boltLinkEdits).ForEach(func(k, v []byte) error {
+			var e []*EditRecord
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			id, _ := strconv.Atoi(string(k))
+			m.LinkEdits[id] = e
+			return nil
+		})
+	})
+	return m, err
+}
+
+func (b *BoltStore) SaveMetadata(m *Metadata) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltListEdits, boltLinkEdits} {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		for k, e := range m.ListEdits {
+			if err := putBoltJSON(tx, boltListEdits, string(k), e); err != nil {
+				return err
+			}
+		}
+		for id, e := range m.LinkEdits {
+			if err := putBoltJSON(tx, boltLinkEdits, strconv.Itoa(id), e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *BoltStore) GetListEdits(k Keyword) ([]*EditRecord, error) {
+	var e []*EditRecord
+	err := b.getJSON(boltListEdits, string(k), &e)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	return e, err
+}
+
+func (b *BoltStore) PutListEdits(k Keyword, e []*EditRecord) error {
+	return b.putJSON(boltListEdits, string(k), e)
+}
+
+func (b *BoltStore) GetLinkEdits(id int) ([]*EditRecord, error) {
+	var e []*EditRecord
+	err := b.getJSON(boltLinkEdits, strconv.Itoa(id), &e)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	return e, err
+}
+
+func (b *BoltStore) PutLinkEdits(id int, e []*EditRecord) error {
+	return b.putJSON(boltLinkEdits, strconv.Itoa(id), e)
+}
+
+// Close closes the bolt file, releasing its lock.
+func (b *BoltStore) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.saved = nil
+	return b.db.Close()
+}
@@ -0,0 +1,97 @@
+package core
+
+import (
+	"sync"
+)
+
+/*
+Change tracking
+
+Backends that can write a single record (bolt) don't need to rewrite the whole database
+on every checkpoint. Every mutation marks the entity it touched in the database's change
+set, the same places that write to the journal. Clicks mark the link or list they counted
+against too when they're applied, even though they aren't journaled (see clicks.go). A
+backend's Save takes the set and writes only those entities, then the set starts over.
+
+Marking a change other than a click also moves the database's Generation along.
+*/
+
+// The kinds of entity a change can be for.
+const (
+	changeList      = "list"
+	changeLink      = "link"
+	changeString    = "string"
+	changeMap       = "map"
+	changeListEdits = "listedits"
+	changeLinkEdits = "linkedits"
+	changeToken     = "token"
+	changeLinkLog   = "linklog" // usage logs are all written with every save anyway
+)
+
+// change names one entity: its kind and its keyword, ID, or variable name.
+type change struct {
+	Kind string
+	Key  string
+}
+
+// changeSet holds the entities changed since the last incremental save.
+type changeSet struct {
+	mu      sync.Mutex
+	pending map[change]bool
+}
+
+func (c *changeSet) mark(kind, key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pending == nil {
+		c.pending = make(map[change]bool)
+	}
+	c.pending[change{kind, key}] = true
+}
+
+// take empties the set and returns what was in it.
+func (c *changeSet) take() map[change]bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	taken := c.pending
+	c.pending = nil
+	return taken
+}
+
+// any reports whether anything has changed since the set was last taken.
+func (c *changeSet) any() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.pending) > 0
+}
+
+// giveBack returns changes to the set after a save of them failed, so the next save tries again.
+func (c *changeSet) giveBack(taken map[change]bool) {
+	for ch := range taken {
+		c.mark(ch.Kind, ch.Key)
+	}
+}
+
+// checkpointCopy clones d for a checkpoint to save without holding SYNC, taking d's change
+// set along with it. Callers hold SYNC.
+func (d *LinkDatabase) checkpointCopy() *LinkDatabase {
+	c := d.Clone()
+	c.copyOf = d
+	c.changes.giveBack(d.changes.take())
+	return c
+}
+
+// saveAs is the database a store's incremental saves follow: for a checkpoint's copy, the
+// live database it came from, so the next checkpoint only writes what changed after it.
+func (d *LinkDatabase) saveAs() *LinkDatabase {
+	if d.copyOf != nil {
+		return d.copyOf
+	}
+	return d
+}
+
+// changed marks an entity for the next incremental save and bumps the generation.
+func (d *LinkDatabase) changed(kind, key string) {
+	d.Generation++
+	d.changes.mark(kind, key)
+}
@@ -0,0 +1,143 @@
+package core
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+Redirect side effects
+
+Redirects only hold SYNC for reading, so any number of them run at once and none of them
+may change the database. What a redirect would have changed is queued on the database
+instead: clicks on links and lists, and burn-after-reading links that have been followed.
+The queue is applied with SYNC held for writing, by RunClickQueue every second and by
+checkpoints before they save. Applied clicks are sent to the standby, but not journaled.
+
+A burn is claimed when it's queued. Only the first redirect to claim a burner link gets to
+follow it, even if others find the link before it's removed.
+
+A standby serves redirects too, but its database is the active's. It doesn't count clicks,
+since the active's counts would replace them, and won't follow burner links, which only the
+active can remove.
+*/
+type clickQueue struct {
+	mu    sync.Mutex
+	links map[int]int
+	lists map[Keyword]int
+	burns map[int]bool
+}
+
+// Click counts a redirect through a link.
+func (d *LinkDatabase) Click(l *Link) {
+	if !IsActive() {
+		return
+	}
+	d.clicks.mu.Lock()
+	defer d.clicks.mu.Unlock()
+	if d.clicks.links == nil {
+		d.clicks.links = make(map[int]int)
+	}
+	d.clicks.links[l.ID]++
+}
+
+// ClickList counts a visit to a list of links.
+func (d *LinkDatabase) ClickList(ll *ListOfLinks) {
+	if !IsActive() {
+		return
+	}
+	d.clicks.mu.Lock()
+	defer d.clicks.mu.Unlock()
+	if d.clicks.lists == nil {
+		d.clicks.lists = make(map[Keyword]int)
+	}
+	d.clicks.lists[ll.Keyword]++
+}
+
+/*
+Burn claims a burn-after-reading link for the calling redirect and queues its removal.
+It returns false if another redirect claimed it first, or this redirector is a standby, in
+which case the link must not be followed. Links that aren't burners can always be followed.
+*/
+func (d *LinkDatabase) Burn(l *Link) bool {
+	if l.Dtime != BurnTime {
+		return true
+	}
+	if !IsActive() {
+		return false
+	}
+	d.clicks.mu.Lock()
+	defer d.clicks.mu.Unlock()
+	if d.clicks.burns[l.ID] {
+		return false
+	}
+	if d.clicks.burns == nil {
+		d.clicks.burns = make(map[int]bool)
+	}
+	d.clicks.burns[l.ID] = true
+	LogInfo.Printf("Link %d is being burned.\n", l.ID)
+	return true
+}
+
+// applyClicks empties the queue into the database. Callers hold SYNC for writing.
+func (d *LinkDatabase) applyClicks() {
+	d.clicks.mu.Lock()
+	links, lists, burns := d.clicks.links, d.clicks.lists, d.clicks.burns
+	d.clicks.links, d.clicks.lists, d.clicks.burns = nil, nil, nil
+	d.clicks.mu.Unlock()
+	if !IsActive() {
+		return // handed off since they were queued, the peer was told it had everything
+	}
+
+	for id, n := range links {
+		if l, exists := d.Links[id]; exists {
+			l.Clicks += n
+			d.changes.mark(changeLink, strconv.Itoa(id))
+			d.replication.Append(&Mutation{Op: OpPutLink, LinkID: id, Link: l}, d.Generation)
+		}
+	}
+	for k, n := range lists {
+		if ll, exists := d.Lists[k]; exists {
+			ll.Clicks += n
+			d.changes.mark(changeList, string(k))
+			d.replication.Append(&Mutation{Op: OpPutList, Keyword: k, List: ll}, d.Generation)
+		}
+	}
+	for id := range burns {
+		if l, exists := d.Links[id]; exists {
+			d.destroyLink(l)
+		}
+	}
+}
+
+// burnsQueued reports whether any burned links are waiting to be removed.
+func (d *LinkDatabase) burnsQueued() bool {
+	d.clicks.mu.Lock()
+	defer d.clicks.mu.Unlock()
+	return len(d.clicks.burns) > 0
+}
+
+// ApplyClicks applies the live database's queued clicks and burns.
+func ApplyClicks(s *sync.RWMutex) {
+	s.Lock()
+	LinkDataBase.applyClicks()
+	s.Unlock()
+}
+
+// ApplyBurns removes burned links right away, if a redirect queued any. Redirects call
+// this once they have let go of SYNC, so a burned link is gone when they return.
+func ApplyBurns(s *sync.RWMutex) {
+	if LinkDataBase.burnsQueued() {
+		ApplyClicks(s)
+	}
+}
+
+// RunClickQueue applies queued clicks at the provided interval (a time duration string).
+func RunClickQueue(interval string, s *sync.RWMutex) {
+	duration, _ := time.ParseDuration(interval)
+	for {
+		time.Sleep(duration)
+		ApplyClicks(s)
+	}
+}
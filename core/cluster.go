@@ -0,0 +1,626 @@
+package core
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+Clustering
+
+A cluster is any number of redirectors, each listing the others in cluster_peers. One of
+them is elected leader. It serves requests and streams its changes to all of the others,
+its followers, the same way an active streams them to its standby (see replication.go).
+When the followers stop hearing from the leader they elect another one.
+
+Elections work the way they do in Raft. Time is divided into numbered terms, and each term
+has at most one leader. A follower that hears nothing from a leader for an election
+timeout starts a new term and asks the other nodes for their votes. Each node votes for one
+candidate per term. It only votes for a candidate whose database is at least as current as
+its own, meaning the candidate follows a later leader's stream or is further along the same
+one. A candidate with votes from a majority of the cluster, itself included, becomes leader.
+Any node that sees a term later than its own becomes a follower in that term, unless it's
+still hearing from its leader (see below). Election timeouts are randomized so candidates
+don't keep splitting the vote.
+
+A new leader starts a new replication stream, so each follower gets the whole database
+from it once and its changes after that. A leader that hasn't heard back from a majority
+of the cluster for an election timeout steps down. A leader cut off from the rest of the
+cluster therefore stops taking changes the others would never see.
+
+As with a pair, the leader applies changes before they reach its followers. If a leader
+fails, the changes only it had are lost. Anything that reached a majority is kept by
+whichever node is elected next.
+
+A node saves its term and vote to StateFile before acting on them, so a restarted node
+can't vote twice in one term. Before standing, a node asks the others whether they would
+vote for it in the next term, without anyone changing term (a pre-vote), and only stands if
+a majority would. A node still hearing from a leader, or leading, says no to both kinds of
+request, doesn't take up the candidate's term, and names its leader, so the candidate
+follows it. A node that merely lost touch for a while therefore can't raise its term while
+it's away and depose the leader when it's back. Where a node is in the leader's stream isn't
+saved, though. If the whole cluster restarts at once, any node can win the first election,
+and the others take its database.
+*/
+
+// Cluster roles.
+const (
+	RoleFollower  = "follower"
+	RoleCandidate = "candidate"
+	RoleLeader    = "leader"
+)
+
+// clusterState is what a node keeps in its StateFile.
+type clusterState struct {
+	Term     uint64 `json:"term"`
+	VotedFor string `json:"voted_for"`
+}
+
+// ClusterNode is one redirector in a cluster.
+type ClusterNode struct {
+	ID        string     // the address the other nodes reach this one at, and listens on
+	Peers     []string   // the other nodes' addresses
+	StateFile string     // where the term and vote are saved, nowhere if empty
+	OnLeader  func(bool) // told when this node becomes leader and when it stops, must not call back into the node
+
+	ref      dbRef
+	replica  *replica
+	heard    chan uint64   // the leader's stream arriving
+	granted  chan struct{} // a vote being given
+	transfer chan struct{} // the leader handing off to this node
+
+	mu       sync.Mutex
+	role     string
+	term     uint64
+	votedFor string
+	leader   string               // the last leader heard from
+	heardAt  time.Time            // when the leader's stream last arrived
+	log      *ReplicationLog      // the stream sent while leading
+	leadTerm uint64               // the term of the last stream this node sent
+	contact  map[string]time.Time // when each follower last acknowledged the stream, while leading
+	acked    map[string]uint64    // and how far along it was
+	changed  time.Time            // when the role last changed
+	why      string               // and why
+	leading  chan struct{}        // closed when this node stops leading
+	stop     chan struct{}
+	running  sync.WaitGroup // the goroutines Stop waits for
+	listener net.Listener
+}
+
+// NewClusterNode makes a node that keeps the database held in db current, guarded by s.
+func NewClusterNode(id string, peers []string, s *sync.RWMutex, db **LinkDatabase) *ClusterNode {
+	n := &ClusterNode{
+		ID:       id,
+		Peers:    peers,
+		ref:      dbRef{lock: s, db: db},
+		heard:    make(chan uint64, 1),
+		granted:  make(chan struct{}, 1),
+		transfer: make(chan struct{}, 1),
+		role:     RoleFollower,
+		stop:     make(chan struct{}),
+	}
+	n.replica = &replica{ref: n.ref, stale: n.stale}
+	return n
+}
+
+// stale reports whether a leader's stream from term has been superseded, by a later term
+// or by this node standing for election.
+func (n *ClusterNode) stale(term uint64) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return term < n.term || n.role != RoleFollower
+}
+
+// Start loads the node's saved term and vote, and starts it listening and following.
+func (n *ClusterNode) Start() error {
+	if n.StateFile != "" {
+		data, err := os.ReadFile(n.StateFile)
+		if err == nil {
+			var state clusterState
+			if err := json.Unmarshal(data, &state); err != nil {
+				return fmt.Errorf("cluster state %s could not be read: %s", n.StateFile, err)
+			}
+			n.term, n.votedFor = state.Term, state.VotedFor
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	listener, err := listenPeer(n.ID)
+	if err != nil {
+		return err
+	}
+	n.listener = listener
+	LogInfo.Printf("cluster %s: started in term %d with peers %v\n", n.ID, n.term, n.Peers)
+	n.running.Add(2)
+	go n.serve()
+	go n.run()
+	return nil
+}
+
+// Stop takes the node out of the cluster: it stops leading or following, and listening.
+// It returns once the node has stopped running elections and streaming to followers.
+func (n *ClusterNode) Stop() {
+	n.mu.Lock()
+	close(n.stop)
+	n.demote(n.term, "", "stopped")
+	n.mu.Unlock()
+	n.listener.Close()
+	n.replica.takeOver(nil)
+	n.running.Wait()
+}
+
+// Role returns whether the node is a follower, candidate, or leader.
+func (n *ClusterNode) Role() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.role
+}
+
+// Term returns the node's current term.
+func (n *ClusterNode) Term() uint64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.term
+}
+
+// Leader returns the ID of the last leader this node heard from, or its own while it leads.
+func (n *ClusterNode) Leader() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.leader
+}
+
+// majority is how many nodes, this one included, it takes to elect a leader.
+func (n *ClusterNode) majority() int {
+	return (len(n.Peers)+1)/2 + 1
+}
+
+// leaderTimeout is how long a leader can go unheard from before it's given up on, the
+// same time it takes a standby to give up on its active (see heartbeat.go).
+func leaderTimeout() time.Duration {
+	interval, misses, holddown := HeartbeatSettings()
+	return interval*time.Duration(misses) + holddown
+}
+
+// electionTimeout is how long a follower waits to hear from a leader before standing for
+// election, between one and two leaderTimeouts, picked at random each time.
+func electionTimeout() time.Duration {
+	base := leaderTimeout()
+	return base + time.Duration(rand.Int63n(int64(base)))
+}
+
+// save writes the term and vote to StateFile. Callers hold n.mu.
+func (n *ClusterNode) save() error {
+	if n.StateFile == "" {
+		return nil
+	}
+	data, err := json.Marshal(clusterState{Term: n.term, VotedFor: n.votedFor})
+	if err == nil {
+		err = WriteFileAtomic(n.StateFile, data, 0)
+	}
+	if err != nil {
+		LogError.Printf("cluster state %s could not be saved: %s\n", n.StateFile, err)
+	}
+	return err
+}
+
+// transition changes the node's role and logs why. Callers hold n.mu.
+func (n *ClusterNode) transition(to, why string) {
+	LogInfo.Printf("cluster %s: %s -> %s in term %d: %s\n", n.ID, n.role, to, n.term, why)
+	n.role, n.changed, n.why = to, time.Now(), why
+}
+
+// position returns the term of the stream the node's database is from and how far along
+// it is. Candidates are compared on this. Callers hold n.mu.
+func (n *ClusterNode) position() (uint64, uint64) {
+	_, term, applied := n.replica.position()
+	if n.log != nil && (n.leadTerm > term || n.leadTerm == term && n.log.Latest() > applied) {
+		return n.leadTerm, n.log.Latest()
+	}
+	return term, applied
+}
+
+// demote makes the node a follower in term, which may be later than its own. Callers hold n.mu.
+func (n *ClusterNode) demote(term uint64, leader, why string) {
+	if term > n.term {
+		n.term, n.votedFor = term, ""
+		n.save()
+	}
+	if leader != "" {
+		n.leader = leader
+	}
+	if n.role == RoleFollower {
+		return
+	}
+	if n.role == RoleLeader {
+		close(n.leading)
+		n.leading = nil
+		if n.OnLeader != nil {
+			n.OnLeader(false)
+		}
+	}
+	n.transition(RoleFollower, why)
+}
+
+// run waits out election timeouts while following, and checks on the followers while leading.
+func (n *ClusterNode) run() {
+	defer n.running.Done()
+	interval, _, _ := HeartbeatSettings()
+	for {
+		wait := electionTimeout()
+		if n.Role() == RoleLeader {
+			wait = interval
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-n.stop:
+			timer.Stop()
+			return
+		case <-n.heard:
+			timer.Stop()
+			n.mu.Lock()
+			n.heardAt = time.Now()
+			n.mu.Unlock()
+		case <-n.granted:
+			timer.Stop()
+		case <-n.transfer:
+			timer.Stop()
+			n.campaign(true)
+		case <-timer.C:
+			if n.Role() == RoleLeader {
+				n.checkFollowers()
+			} else if InMaintenance() {
+				LogInfo.Printf("cluster %s: no leader heard from, but in maintenance mode, not standing for election\n", n.ID)
+			} else {
+				n.campaign(false)
+			}
+		}
+	}
+}
+
+// campaign stands for election in a new term. A transfer is one the leader asked for, see Handoff.
+func (n *ClusterNode) campaign(transfer bool) {
+	n.mu.Lock()
+	select {
+	case <-n.stop:
+		n.mu.Unlock()
+		return
+	default:
+	}
+	why := "no leader heard from, standing for election"
+	if transfer {
+		why = fmt.Sprintf("%s handed off, standing for election", n.leader)
+	} else {
+		// a pre-vote first, so a node nobody would vote for doesn't raise its term
+		term := n.term
+		lastTerm, lastSeq := n.position()
+		n.mu.Unlock()
+		request := Frame{Type: FrameVote, Term: term + 1, Node: n.ID, LastTerm: lastTerm, Seq: lastSeq, PreVote: true}
+		votes, ok := n.ballot(&request, term)
+		if !ok {
+			return
+		}
+		if votes < n.majority() {
+			LogInfo.Printf("cluster %s: %d of %d nodes would vote for us in term %d, not standing\n", n.ID, votes, len(n.Peers)+1, term+1)
+			return
+		}
+		n.mu.Lock()
+		if n.term != term || n.hasLeader() {
+			n.mu.Unlock()
+			return // a leader turned up while we were asking
+		}
+	}
+	n.term++
+	n.votedFor, n.leader = n.ID, ""
+	if err := n.save(); err != nil {
+		n.mu.Unlock()
+		return
+	}
+	n.transition(RoleCandidate, why)
+	term := n.term
+	lastTerm, lastSeq := n.position()
+	n.mu.Unlock()
+
+	request := Frame{Type: FrameVote, Term: term, Node: n.ID, LastTerm: lastTerm, Seq: lastSeq, Transfer: transfer}
+	votes, ok := n.ballot(&request, term)
+	if !ok {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.role != RoleCandidate || n.term != term {
+		return // someone else won while we were counting
+	}
+	if votes < n.majority() {
+		LogInfo.Printf("cluster %s: %d of %d votes in term %d, not enough to lead\n", n.ID, votes, len(n.Peers)+1, term)
+		return
+	}
+	n.lead(fmt.Sprintf("won %d of %d votes", votes, len(n.Peers)+1))
+}
+
+/*
+ballot asks every peer for its vote, or pre-vote, on request, and counts them along with this
+node's own. The node is in term while it asks. It stops once a majority has voted, and gives
+up, with ok false, if a peer is in a later term or names a leader that's still leading. The
+node follows either of those instead.
+*/
+func (n *ClusterNode) ballot(request *Frame, term uint64) (votes int, ok bool) {
+	replies := make(chan *Frame, len(n.Peers))
+	for _, peer := range n.Peers {
+		go func(peer string) {
+			reply, err := requestVote(peer, request)
+			if err != nil {
+				LogDebug.Printf("cluster %s: no vote from %s: %s\n", n.ID, peer, err)
+			}
+			replies <- reply
+		}(peer)
+	}
+	votes = 1
+	deadline := time.After(electionTimeout())
+	for waiting := len(n.Peers); waiting > 0 && votes < n.majority(); waiting-- {
+		select {
+		case reply := <-replies:
+			if reply == nil {
+				continue
+			}
+			if reply.Term > term {
+				n.mu.Lock()
+				n.demote(reply.Term, "", "a peer is in a later term")
+				n.mu.Unlock()
+				return votes, false
+			}
+			if !reply.Granted && reply.Node != "" {
+				// standing would only raise the term, give the leader a timeout to reach us
+				n.mu.Lock()
+				if n.term == term && n.role != RoleLeader {
+					n.demote(term, reply.Node, fmt.Sprintf("%s is still leading", reply.Node))
+					n.heardAt = time.Now()
+				}
+				n.mu.Unlock()
+				return votes, false
+			}
+			if reply.Granted {
+				votes++
+			}
+		case <-deadline:
+			waiting = 0
+		case <-n.stop:
+			return votes, false
+		}
+	}
+	return votes, true
+}
+
+// requestVote asks the peer at addr for its vote.
+func requestVote(addr string, request *Frame) (*Frame, error) {
+	conn, err := dialPeer(addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(replicationTimeout))
+	if _, err = io.WriteString(conn, replicationPreamble); err == nil {
+		err = WriteFrame(conn, request)
+	}
+	if err != nil {
+		return nil, err
+	}
+	reply, err := ReadFrame(conn)
+	if err == nil && reply.Type != FrameVote {
+		err = fmt.Errorf("peer %s answered a vote request with a %s frame", addr, reply.Type)
+	}
+	return reply, err
+}
+
+// lead makes this node the leader in its current term. Callers hold n.mu.
+func (n *ClusterNode) lead(why string) {
+	n.transition(RoleLeader, why)
+	n.leader = n.ID
+	n.ref.lock.Lock()
+	StartReplication(*n.ref.db)
+	n.log = (*n.ref.db).replication
+	n.ref.lock.Unlock()
+	n.leadTerm = n.term
+	n.leading = make(chan struct{})
+	n.contact = make(map[string]time.Time)
+	n.acked = make(map[string]uint64)
+	for _, peer := range n.Peers {
+		n.contact[peer] = time.Now() // everyone gets an election timeout to show up
+		n.running.Add(1)
+		go n.stream(peer, n.term, n.leading)
+	}
+	if n.OnLeader != nil {
+		n.OnLeader(true)
+	}
+}
+
+// stream keeps the leader's changes flowing to one follower until leading is closed.
+func (n *ClusterNode) stream(peer string, term uint64, leading chan struct{}) {
+	defer n.running.Done()
+	st := &sender{
+		addr:  peer,
+		ref:   n.ref,
+		hello: Frame{Type: FrameHello, Term: term, Node: n.ID},
+		resumed: func(f *Frame) error {
+			if f.Term > term {
+				n.mu.Lock()
+				n.demote(f.Term, "", fmt.Sprintf("%s is in a later term", peer))
+				n.mu.Unlock()
+				return fmt.Errorf("%s is in term %d", peer, f.Term)
+			}
+			return nil
+		},
+		acked: func(seq uint64) {
+			n.mu.Lock()
+			if n.leading == leading {
+				n.contact[peer], n.acked[peer] = time.Now(), seq
+			}
+			n.mu.Unlock()
+		},
+		stop: leading,
+	}
+	interval, _, _ := HeartbeatSettings()
+	for {
+		err := st.run()
+		select {
+		case <-leading:
+			return
+		default:
+		}
+		if err != nil {
+			LogDebug.Printf("cluster %s: stream to %s: %s\n", n.ID, peer, err)
+		}
+		select {
+		case <-leading:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// checkFollowers steps down if a majority of the cluster hasn't been heard from lately.
+func (n *ClusterNode) checkFollowers() {
+	window := leaderTimeout()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.role != RoleLeader {
+		return
+	}
+	reachable := 1
+	for _, at := range n.contact {
+		if time.Since(at) < window {
+			reachable++
+		}
+	}
+	if reachable < n.majority() {
+		n.demote(n.term, "", fmt.Sprintf("only %d of %d nodes heard from in %s", reachable, len(n.Peers)+1, window))
+	}
+}
+
+// serve accepts connections from the other nodes.
+func (n *ClusterNode) serve() {
+	defer n.running.Done()
+	for {
+		conn, err := n.listener.Accept()
+		if err != nil {
+			select {
+			case <-n.stop:
+				return
+			default:
+				continue
+			}
+		}
+		go n.handle(conn.(*tls.Conn))
+	}
+}
+
+// handle answers a vote request or follows a leader's stream.
+func (n *ClusterNode) handle(conn *tls.Conn) {
+	defer conn.Close()
+	if err := handshake(conn); err != nil {
+		LogError.Printf("cluster %s: rejected connection from %s: %s\n", n.ID, conn.RemoteAddr(), err)
+		return
+	}
+	conn.SetDeadline(time.Now().Add(replicationTimeout))
+	reader := bufio.NewReader(conn)
+	if start, _ := reader.Peek(len(replicationPreamble)); string(start) != replicationPreamble {
+		LogError.Printf("cluster %s: garbage input from %s\n", n.ID, conn.RemoteAddr())
+		return
+	}
+	reader.Discard(len(replicationPreamble))
+	f, err := ReadFrame(reader)
+	if err != nil {
+		return
+	}
+	switch f.Type {
+	case FrameVote:
+		WriteFrame(conn, n.vote(f))
+	case FrameHandoff:
+		WriteFrame(conn, n.takeHandoff(f))
+	case FrameControl:
+		answerControl(conn, f)
+	case FrameHello:
+		n.mu.Lock()
+		if f.Term < n.term {
+			// a deposed leader, let it know
+			term := n.term
+			n.mu.Unlock()
+			WriteFrame(conn, &Frame{Type: FrameResume, Term: term})
+			return
+		}
+		n.demote(f.Term, f.Node, fmt.Sprintf("%s is leading", f.Node))
+		n.heardAt = time.Now() // before its first frame arrives, so we don't stand against it meanwhile
+		term := n.term
+		n.mu.Unlock()
+		if err := n.replica.follow(conn, reader, f, term, n.heard); err != nil && !errors.Is(err, io.EOF) {
+			LogDebug.Printf("cluster %s: stream from %s stopped: %s\n", n.ID, f.Node, err)
+		}
+	default:
+		LogError.Printf("cluster %s: unexpected %s frame from %s\n", n.ID, f.Type, conn.RemoteAddr())
+	}
+}
+
+// hasLeader reports whether this node is leading, or has heard from its leader within an
+// election timeout. Callers hold n.mu.
+func (n *ClusterNode) hasLeader() bool {
+	return n.role == RoleLeader || n.role == RoleFollower && n.leader != "" && time.Since(n.heardAt) < leaderTimeout()
+}
+
+// ahead reports whether this node's database is more current than a candidate's. Callers hold n.mu.
+func (n *ClusterNode) ahead(request *Frame) bool {
+	lastTerm, lastSeq := n.position()
+	return request.LastTerm < lastTerm || request.LastTerm == lastTerm && request.Seq < lastSeq
+}
+
+// vote decides whether to vote for a candidate, and answers it.
+func (n *ClusterNode) vote(request *Frame) *Frame {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	reply := &Frame{Type: FrameVote, Term: n.term}
+	if n.hasLeader() && !request.Transfer {
+		// our leader is fine, and a node that just lost touch shouldn't be able to depose it,
+		// not even by raising our term
+		LogInfo.Printf("cluster %s: not voting for %s, %s is still leading\n", n.ID, request.Node, n.leader)
+		reply.Node = n.leader // so the candidate follows it instead of standing
+		return reply
+	}
+	if request.PreVote {
+		// nothing changes, the candidate only wants to know whether it could win
+		reply.Granted = request.Term > n.term && !n.ahead(request)
+		return reply
+	}
+	// as in Raft, a later term is taken up before anything else is decided
+	if request.Term > n.term {
+		n.demote(request.Term, "", fmt.Sprintf("%s is standing in a later term", request.Node))
+		reply.Term = n.term
+	}
+	if request.Term < n.term || n.role == RoleLeader || (n.votedFor != "" && n.votedFor != request.Node) {
+		return reply
+	}
+	if n.ahead(request) {
+		LogInfo.Printf("cluster %s: not voting for %s in term %d, it's behind us\n", n.ID, request.Node, n.term)
+		return reply
+	}
+	n.votedFor = request.Node
+	if n.save() != nil {
+		n.votedFor = ""
+		return reply
+	}
+	LogInfo.Printf("cluster %s: voted for %s in term %d\n", n.ID, request.Node, n.term)
+	reply.Granted = true
+	select {
+	case n.granted <- struct{}{}: // no need to stand ourselves while it's counting
+	default:
+	}
+	return reply
+}
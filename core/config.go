@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"time"
 )
 
 /*
@@ -11,6 +12,12 @@ import (
 */
 
 var GodbFileName string
+var MetadataFileName = "go2metadata.json"
+var StorageBackend string // name of a registered Store, defaults to 'json'
+var CheckpointBackups int // number of previous DB files kept as godb.json.1, .2, ...
+var SnapshotDir string    // where point-in-time snapshots go, see snapshot.go
+var SnapshotInterval string
+var SnapshotRetention []RetentionRule
 
 var ListenAddress string   // address redirector process should listen on
 var ListenPort int         // port redirector process should listen on
@@ -26,23 +33,72 @@ var LinkLogCapacity int
 var LogFile string
 var FailoverPeer string
 var FailoverLocal string
+var FailoverTLSCert string   // this redirector's certificate for the failover peer, see peerauth.go
+var FailoverTLSKey string    // and its key
+var FailoverTLSCA string     // the CA both peers' certificates are signed by
+var HeartbeatInterval string // how often the active sends the standby a heartbeat
+var HeartbeatMisses int      // heartbeats the standby misses before it suspects the active
+var PromotionHolddown string // how long a suspecting standby waits before it takes over
+var ClusterLocal string      // this redirector's address in a cluster, see cluster.go
+var ClusterPeers []string    // the other redirectors in the cluster
+var AuthMode string          // how users are identified, see auth.go
+var AuthTrustedProxies []string
+var AuthUserHeader string
+var AuthEmailHeader string
+var AuthGroupsHeader string
+var AuthSessionKey string // signs login sessions, see oidc.go
+var OIDCIssuer string
+var OIDCClientID string
+var OIDCClientSecret string
+var OIDCRedirectURL string
+var OIDCScopes []string
+var OIDCUserClaim string
+var OIDCGroupsClaim string
 
 type Config struct {
-	LocalListenAddress string  `json:"local_listen_address"`
-	LocalListenPort    int     `json:"local_listen_port"`
-	ExternalAddress    string  `json:"external_address"`
-	ExternalPort       int     `json:"external_port"`
-	ExternalProto      string  `json:"external_proto"`
-	GodbFilename       string  `json:"godb_filename"`
-	RedirectorName     string  `json:"redirector_name"`
-	PruneInterval      string  `json:"prune_interval"`
-	NewListBehavior    string  `json:"new_list_behavior"`
-	LinkLogNewKeywords bool    `json:"link_log_new_keywords"`
-	LinkLogCapacity    int     `json:"link_log_capacity"`
-	LevDistRatio       float64 `json:"levenshtein_distance_ratio"`
-	LogFile            string  `json:"log_file"`
-	FailoverPeer       string  `json:"failover_peer"`
-	FailoverLocal      string  `json:"failover_local"`
+	LocalListenAddress string          `json:"local_listen_address"`
+	LocalListenPort    int             `json:"local_listen_port"`
+	ExternalAddress    string          `json:"external_address"`
+	ExternalPort       int             `json:"external_port"`
+	ExternalProto      string          `json:"external_proto"`
+	GodbFilename       string          `json:"godb_filename"`
+	RedirectorName     string          `json:"redirector_name"`
+	PruneInterval      string          `json:"prune_interval"`
+	NewListBehavior    string          `json:"new_list_behavior"`
+	LinkLogNewKeywords bool            `json:"link_log_new_keywords"`
+	LinkLogCapacity    int             `json:"link_log_capacity"`
+	LevDistRatio       float64         `json:"levenshtein_distance_ratio"`
+	LogFile            string          `json:"log_file"`
+	FailoverPeer       string          `json:"failover_peer"`
+	FailoverLocal      string          `json:"failover_local"`
+	FailoverTLSCert    string          `json:"failover_tls_cert"`
+	FailoverTLSKey     string          `json:"failover_tls_key"`
+	FailoverTLSCA      string          `json:"failover_tls_ca"`
+	HeartbeatInterval  string          `json:"heartbeat_interval"`
+	HeartbeatMisses    int             `json:"heartbeat_misses"`
+	PromotionHolddown  string          `json:"promotion_holddown"`
+	ClusterLocal       string          `json:"cluster_local"`
+	ClusterPeers       []string        `json:"cluster_peers"`
+	AuthMode           string          `json:"auth_mode"`
+	AuthTrustedProxies []string        `json:"auth_trusted_proxies"`
+	AuthUserHeader     string          `json:"auth_user_header"`
+	AuthEmailHeader    string          `json:"auth_email_header"`
+	AuthGroupsHeader   string          `json:"auth_groups_header"`
+	AuthSessionKey     string          `json:"auth_session_key"`
+	OIDCIssuer         string          `json:"oidc_issuer"`
+	OIDCClientID       string          `json:"oidc_client_id"`
+	OIDCClientSecret   string          `json:"oidc_client_secret"`
+	OIDCRedirectURL    string          `json:"oidc_redirect_url"`
+	OIDCScopes         []string        `json:"oidc_scopes"`
+	OIDCUserClaim      string          `json:"oidc_user_claim"`
+	OIDCGroupsClaim    string          `json:"oidc_groups_claim"`
+	AdminUsers         []string        `json:"admin_users"`
+	AdminGroups        []string        `json:"admin_groups"`
+	StorageBackend     string          `json:"storage_backend"`
+	CheckpointBackups  int             `json:"checkpoint_backups"`
+	SnapshotDir        string          `json:"snapshot_dir"`
+	SnapshotInterval   string          `json:"snapshot_interval"`
+	SnapshotRetention  []RetentionRule `json:"snapshot_retention"`
 }
 
 // RenderConfig parses config.json off the disk and returns a Config struct with an err value.
@@ -63,6 +119,69 @@ func RenderConfig(file string) (Config, error) {
 	if parsed.ExternalProto == "" {
 		err = fmt.Errorf("external_proto must be 'http' or 'https' in config file")
 	}
+	if parsed.CheckpointBackups < 0 {
+		err = fmt.Errorf("checkpoint_backups can't be negative in config file")
+	}
+	if parsed.SnapshotInterval != "" {
+		if _, perr := time.ParseDuration(parsed.SnapshotInterval); perr != nil {
+			err = fmt.Errorf("snapshot_interval '%s' is not a valid duration in config file", parsed.SnapshotInterval)
+		}
+	}
+	if parsed.FailoverPeer != "" && (parsed.FailoverTLSCert == "" || parsed.FailoverTLSKey == "" || parsed.FailoverTLSCA == "") {
+		err = fmt.Errorf("failover_peer needs failover_tls_cert, failover_tls_key, and failover_tls_ca in config file")
+	}
+	if parsed.ClusterLocal != "" || len(parsed.ClusterPeers) > 0 {
+		if parsed.ClusterLocal == "" || len(parsed.ClusterPeers) == 0 {
+			err = fmt.Errorf("cluster_local and cluster_peers have to be set together in config file")
+		}
+		if parsed.FailoverPeer != "" {
+			err = fmt.Errorf("failover_peer and cluster_peers can't both be set in config file")
+		}
+		if parsed.FailoverTLSCert == "" || parsed.FailoverTLSKey == "" || parsed.FailoverTLSCA == "" {
+			err = fmt.Errorf("cluster_peers needs failover_tls_cert, failover_tls_key, and failover_tls_ca in config file")
+		}
+	}
+	if parsed.HeartbeatInterval != "" {
+		if d, perr := time.ParseDuration(parsed.HeartbeatInterval); perr != nil || d <= 0 {
+			err = fmt.Errorf("heartbeat_interval '%s' is not a valid duration in config file", parsed.HeartbeatInterval)
+		}
+	}
+	if parsed.HeartbeatMisses < 0 {
+		err = fmt.Errorf("heartbeat_misses can't be negative in config file")
+	}
+	if parsed.PromotionHolddown != "" {
+		if d, perr := time.ParseDuration(parsed.PromotionHolddown); perr != nil || d < 0 {
+			err = fmt.Errorf("promotion_holddown '%s' is not a valid duration in config file", parsed.PromotionHolddown)
+		}
+	}
+	switch parsed.AuthMode {
+	case "", AuthCookie:
+		if len(parsed.AdminUsers) > 0 || len(parsed.AdminGroups) > 0 {
+			err = fmt.Errorf("admin_users and admin_groups need auth_mode '%s' or '%s' in config file", AuthHeader, AuthOIDC)
+		}
+	case AuthHeader:
+		if len(parsed.AuthTrustedProxies) == 0 {
+			err = fmt.Errorf("auth_mode '%s' needs auth_trusted_proxies in config file", AuthHeader)
+		}
+		for _, proxy := range parsed.AuthTrustedProxies {
+			if _, perr := ParseProxy(proxy); perr != nil {
+				err = fmt.Errorf("auth_trusted_proxies: %s in config file", perr)
+			}
+		}
+	case AuthOIDC:
+		if parsed.OIDCIssuer == "" || parsed.OIDCClientID == "" {
+			err = fmt.Errorf("auth_mode '%s' needs oidc_issuer and oidc_client_id in config file", AuthOIDC)
+		}
+	default:
+		err = fmt.Errorf("auth_mode must be '%s', '%s' or '%s' in config file", AuthCookie, AuthHeader, AuthOIDC)
+	}
+	for _, rule := range parsed.SnapshotRetention {
+		every, perr1 := time.ParseDuration(rule.Every)
+		_, perr2 := time.ParseDuration(rule.KeepFor)
+		if perr1 != nil || perr2 != nil || every <= 0 {
+			err = fmt.Errorf("snapshot_retention rule %+v needs valid 'every' and 'keep_for' durations in config file", rule)
+		}
+	}
 
 	return parsed, err
 }
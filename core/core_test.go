@@ -1,13 +1,31 @@
 package core
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
 	"math"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestListenURL(t *testing.T) {
@@ -323,28 +341,48 @@ func TestSortingInterfaces(t *testing.T) {
 }
 
 func TestModifyLogging(t *testing.T) {
+	db := MakeNewLinkDatabase()
+	j, err := OpenJournal(filepath.Join(t.TempDir(), "godb.json.journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.AttachJournal(j)
 	k, _ := MakeNewKeyword("duh")
 	ll := MakeNewList(k)
+	l, _ := MakeNewlink("localhost/duh", "duh")
+	db.CommitNewLink(l)
+	db.Couple(ll, l)
 
 	if ll.Logging != LinkLogNewKeywords {
 		t.Fail()
 	}
 
-	// turn off logging
-	ll.ModifyLogging(false)
-	if ll.Logging == true {
+	// turn on logging
+	db.ModifyLogging(ll, true)
+	db.LinkLog[k] = RotateSlice(db.LinkLog[k], "someone used it")
+	if ll.Logging == false {
 		t.Fail()
 	}
-	if len(LinkLog[ll.Keyword]) != 0 {
-		t.Fail()
+	replayed := MakeNewLinkDatabase()
+	j.Replay(replayed)
+	if _, exists := replayed.LinkLog[k]; !exists || !replayed.Lists[k].Logging {
+		t.Error("turning logging on should be journaled")
 	}
 
-	ll.ModifyLogging(true)
-	if ll.Logging == false {
+	// turn off logging, which forgets the usages
+	generation := db.Generation
+	db.ModifyLogging(ll, false)
+	if ll.Logging == true {
 		t.Fail()
 	}
-	if len(LinkLog[ll.Keyword]) != 0 {
-		t.Fail()
+	if _, exists := db.LinkLog[k]; exists || db.Generation == generation {
+		t.Error("turning logging off should delete the log, as a change")
+	}
+	replayed = MakeNewLinkDatabase()
+	replayed.LinkLog[k] = []string{"someone used it"}
+	j.Replay(replayed)
+	if _, exists := replayed.LinkLog[k]; exists || replayed.Lists[k].Logging {
+		t.Error("turning logging off should be journaled")
 	}
 }
 
@@ -521,6 +559,290 @@ func TestExport(t *testing.T) {
 	}
 }
 
+func TestJSONFileStore(t *testing.T) {
+	dir := t.TempDir()
+	defer func(name string) { MetadataFileName = name }(MetadataFileName)
+	MetadataFileName = filepath.Join(dir, "go2metadata.json")
+	st, err := OpenStore("", filepath.Join(dir, "godb.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenStore("carrierpigeon", "whatever"); err == nil {
+		t.Error("an unknown storage backend should not open")
+	}
+
+	db := MakeNewLinkDatabase()
+	l, _ := MakeNewlink("localhost/stored", "a stored link")
+	db.CommitNewLink(l)
+	k, _ := MakeNewKeyword("stored")
+	db.Couple(MakeNewList(k), l)
+	if err := st.Save(db); err != nil {
+		t.Fatal(err)
+	}
+
+	// A second store on the same file sees what the first one saved.
+	st2, _ := OpenJSONFileStore(filepath.Join(dir, "godb.json"))
+	loaded, err := st2.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := loaded.Lists[k]; !exists {
+		t.Errorf("list '%s' did not survive a save and load", k)
+	}
+	if loaded.Links[l.ID].URL != "http://localhost/stored" {
+		t.Errorf("link %d did not survive a save and load", l.ID)
+	}
+
+	// per-entity operations
+	if err := st2.PutStringVar("planet", "mars"); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := st.(*JSONFileStore).load(); v.Variables.Strings["planet"] != "mars" {
+		t.Error("string variable put was not written to the file")
+	}
+	if err := st2.DeleteList(k); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st2.GetList(k); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound for a deleted list, got: %v", err)
+	}
+	// the databases handed to Save and out of Load aren't the store's to change
+	if err := st.DeleteLink(l.ID); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Lists[k] == nil || db.Links[l.ID] == nil {
+		t.Error("per-entity operations changed a database given to Save or returned by Load")
+	}
+	if err := st2.PutListEdits(k, []*EditRecord{{EditMsg: "stored"}}); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := st.(*JSONFileStore).load(); len(v.Metadata.ListEdits[k]) != 1 {
+		t.Error("list edits were not written to the database file")
+	}
+}
+
+func TestMetadataInDatabase(t *testing.T) {
+	dir := t.TempDir()
+	defer func(name string) { MetadataFileName = name }(MetadataFileName)
+	MetadataFileName = filepath.Join(dir, "go2metadata.json")
+	dbfile := filepath.Join(dir, "godb.json")
+
+	// An old database with its edits in go2metadata.json gets them moved inside.
+	legacy := MakeNewMetadata()
+	legacy.ListEdits["wiki"] = []*EditRecord{{EditMsg: "from the old file", EditUser: "someone"}}
+	data, _ := json.Marshal(legacy)
+	if err := os.WriteFile(MetadataFileName, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dbfile, []byte(`{"Lists":{},"Links":{},"NextLinkID":1}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	report, err := MigrateFile(dbfile, true)
+	if err != nil || !strings.Contains(strings.Join(report, "\n"), "edit history of 1 lists and 0 links moved in from") {
+		t.Errorf("a dry run should report moving the edit metadata in: %v %v", report, err)
+	}
+	st, _ := OpenJSONFileStore(dbfile)
+	db, err := st.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(db.Metadata.ListEdits["wiki"]) != 1 || db.LinkLog == nil {
+		t.Fatal("legacy edit metadata was not loaded into the database")
+	}
+
+	// Edits and usage logs are saved with the database and survive the trip through the journal.
+	db.LinkLog["wiki"] = []string{"wiki/en"}
+	if err := st.Save(db); err != nil {
+		t.Fatal(err)
+	}
+	j, err := OpenJournal(JournalFileName(dbfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	db.AttachJournal(j)
+	db.AddLinkEdit(7, &EditRecord{EditMsg: "after the checkpoint"})
+
+	st2, _ := OpenJSONFileStore(dbfile)
+	loaded, err := st2.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Metadata.ListEdits["wiki"][0].EditUser != "someone" || loaded.LinkLog["wiki"][0] != "wiki/en" {
+		t.Error("edit metadata or usage log did not survive a save and load")
+	}
+	if _, err := j.Replay(loaded); err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Metadata.LinkEdits[7]) != 1 {
+		t.Error("a journaled link edit was not replayed")
+	}
+
+	// They go along with an export and import too.
+	var buf bytes.Buffer
+	s := new(sync.RWMutex)
+	if err := loaded.Export(&buf, s); err != nil {
+		t.Fatal(err)
+	}
+	defer func(d *LinkDatabase) { LinkDataBase = d }(LinkDataBase)
+	if err := LinkDataBase.Import(&buf, s); err != nil {
+		t.Fatal(err)
+	}
+	if len(LinkDataBase.Metadata.LinkEdits[7]) != 1 || len(LinkDataBase.LinkLog["wiki"]) != 1 {
+		t.Error("edit metadata or usage log was lost in an export and import")
+	}
+}
+
+func TestMigrateDocument(t *testing.T) {
+	old := []byte(`{"Lists":{"wiki":{"Keyword":"wiki","Links":{"4":{"ID":4,"URL":"https://en.wikipedia.org","Lists":["wiki"],"LinkVariables":null,"Clicks":12}},"Behavior":-2,"TagBindings":{"4":"en"}}},"Links":{"0":{"ID":0,"URL":"http://127.0.0.1","LinkVariables":null},"4":{"ID":4,"URL":"https://en.wikipedia.org","Lists":["wiki"],"LinkVariables":null,"Clicks":12}},"NextLinkID":5}`)
+	migrated, report, err := MigrateDocument(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report) == 0 {
+		t.Error("migrating a version 0 document didn't report anything")
+	}
+
+	var db LinkDatabase
+	if err := json.Unmarshal(migrated, &db); err != nil {
+		t.Fatalf("migrated document doesn't unmarshal: %s", err)
+	}
+	if db.SchemaVersion != CurrentSchemaVersion() {
+		t.Errorf("schema version is %d after migration, expected %d", db.SchemaVersion, CurrentSchemaVersion())
+	}
+	if tags := db.Lists["wiki"].TagBindings[4]; len(tags) != 1 || tags[0] != "en" {
+		t.Errorf("tag binding was not converted to a list: %v", tags)
+	}
+	if db.Variables == nil || db.Variables.Uses == nil {
+		t.Error("variables were not initialized")
+	}
+	if db.Links[0].LinkVariables == nil {
+		t.Error("link zero's link variables were not initialized")
+	}
+	if db.Links[4].Clicks != 12 {
+		t.Errorf("click count changed during migration: %d", db.Links[4].Clicks)
+	}
+	if db.Metadata == nil || db.Metadata.ListEdits == nil || db.Metadata.LinkEdits == nil || db.LinkLog == nil {
+		t.Error("edit metadata or the usage log was not initialized")
+	}
+
+	// already current, nothing to do
+	again, report, err := MigrateDocument(migrated)
+	if err != nil || len(report) != 0 || !bytes.Equal(again, migrated) {
+		t.Errorf("a current document was changed by migration: %v %v", report, err)
+	}
+	// from the future
+	if _, _, err := MigrateDocument([]byte(`{"SchemaVersion":9999}`)); err == nil {
+		t.Error("a document newer than the current schema should not load")
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "godb.json")
+	for i := 1; i <= 4; i++ {
+		if err := WriteFileAtomic(path, []byte(fmt.Sprint(i)), 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := map[string]string{path: "4", path + ".1": "3", path + ".2": "2"}
+	for f, contents := range expected {
+		data, err := os.ReadFile(f)
+		if err != nil || string(data) != contents {
+			t.Errorf("%s: expected '%s', got '%s' (%v)", f, contents, data, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Error("more backups were kept than asked for")
+	}
+	if _, err := os.Stat(path + ".tmp"); err == nil {
+		t.Error("temp file was left behind")
+	}
+}
+
+func TestJournalReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "godb.json.journal")
+	j, err := OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := MakeNewLinkDatabase()
+	db.AttachJournal(j)
+
+	l1, _ := MakeNewlink("localhost/journaled", "journaled")
+	l2, _ := MakeNewlink("localhost/decoupled", "decoupled later")
+	db.CommitNewLink(l1)
+	db.CommitNewLink(l2)
+	k, _ := MakeNewKeyword("journaled")
+	ll := MakeNewList(k)
+	db.Couple(ll, l1)
+	db.Couple(ll, l2)
+	ll.Behavior = RedirectToTop
+	db.RecordList(ll)
+	db.Decouple(ll, l2)
+	db.Variables.Strings = map[string]string{"planet": "mars"}
+	db.RecordStringVar("planet")
+
+	// crash in the middle of writing an entry
+	j.fh.Write([]byte(`{"op":"putlink","link_id":`))
+
+	replayed := MakeNewLinkDatabase()
+	count, err := j.Replay(replayed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count == 0 {
+		t.Fatal("nothing was replayed from the journal")
+	}
+	rl, exists := replayed.Lists[k]
+	if !exists {
+		t.Fatalf("list '%s' was not replayed", k)
+	}
+	if rl.Behavior != RedirectToTop {
+		t.Errorf("behavior change was not replayed, got: %d", rl.Behavior)
+	}
+	if _, exists := rl.Links[l2.ID]; exists {
+		t.Error("decoupled link is still in the replayed list")
+	}
+	if _, exists := replayed.Links[l2.ID]; exists {
+		t.Error("link with no memberships was not removed on replay")
+	}
+	if rl.Links[l1.ID] != replayed.Links[l1.ID] {
+		t.Error("replayed list does not point at the replayed link")
+	}
+	if replayed.NextLinkID != db.NextLinkID {
+		t.Errorf("NextLinkID is %d after replay, expected %d", replayed.NextLinkID, db.NextLinkID)
+	}
+	if replayed.Variables.Strings["planet"] != "mars" {
+		t.Error("string variable was not replayed")
+	}
+
+	// the partial entry was cut off, so new entries start on a clean line
+	db.RecordLink(l1)
+	if count2, _ := j.Replay(MakeNewLinkDatabase()); count2 != count+1 {
+		t.Errorf("expected %d entries after the partial one was discarded, got: %d", count+1, count2)
+	}
+	j.Truncate()
+	if count3, _ := j.Replay(MakeNewLinkDatabase()); count3 != 0 {
+		t.Errorf("journal was not empty after truncation: %d entries", count3)
+	}
+
+	// a checkpoint only drops the entries from before it was taken
+	db.RecordLink(l1)
+	offset, err := j.Offset()
+	if err != nil || offset == 0 {
+		t.Fatalf("the journal should have an entry, offset %d: %v", offset, err)
+	}
+	db.RecordStringVar("planet")
+	if err := j.TruncateTo(offset); err != nil {
+		t.Fatal(err)
+	}
+	db.RecordList(ll)
+	kept := MakeNewLinkDatabase()
+	if count4, _ := j.Replay(kept); count4 != 2 || kept.Variables.Strings["planet"] != "mars" || kept.Lists[k] == nil {
+		t.Errorf("the entries after the checkpoint should be kept and appended to, got %d", count4)
+	}
+}
+
 func FuzzMakeNewKeyword(f *testing.F) {
 	f.Add("working")
 	f.Add("***")
@@ -608,6 +930,1613 @@ func FuzzGetLink(f *testing.F) {
 // If this isn't here, logging calls during functions we are testing cause a SEGV
 func init() {
 	ConfigureLogging(true, os.Stdout)
+}
+
+func TestSnapshots(t *testing.T) {
+	dir := t.TempDir()
+	defer func(d string, st Store, db *LinkDatabase) { SnapshotDir, DBStore, LinkDataBase = d, st, db }(SnapshotDir, DBStore, LinkDataBase)
+	SnapshotDir = filepath.Join(dir, "snapshots")
+	DBStore, _ = OpenJSONFileStore(filepath.Join(dir, "godb.json"))
+	s := new(sync.RWMutex)
+
+	// hourly for a day, daily for a month
+	rules := []RetentionRule{{Every: "1h", KeepFor: "24h"}, {Every: "24h", KeepFor: "720h"}}
+	now := time.Date(2026, 6, 30, 12, 0, 0, 0, time.UTC)
+	os.MkdirAll(SnapshotDir, 0755)
+	for _, age := range []time.Duration{0, 20 * time.Minute, 40 * time.Minute, 5 * time.Hour, 30 * time.Hour, 31 * time.Hour, 40 * 24 * time.Hour} {
+		os.WriteFile(filepath.Join(SnapshotDir, snapshotName(now.Add(-age))), []byte("{}"), 0644)
+	}
+	removed, err := PruneSnapshots(rules, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The oldest snapshot in each hour or day is kept. The 20 minute one shares an hour
+	// with the 40 minute one, the 30 hour one shares a day with the 31 hour one, and 40
+	// days is past every rule.
+	expected := []string{snapshotName(now.Add(-20 * time.Minute)), snapshotName(now.Add(-30 * time.Hour)), snapshotName(now.Add(-40 * 24 * time.Hour))}
+	if strings.Join(removed, " ") != strings.Join(expected, " ") {
+		t.Errorf("pruned %v, expected %v", removed, expected)
+	}
+
+	// snapshot, edit, diff, restore
+	LinkDataBase = MakeNewLinkDatabase()
+	l, _ := MakeNewlink("localhost/kept", "kept")
+	LinkDataBase.CommitNewLink(l)
+	k, _ := MakeNewKeyword("kept")
+	LinkDataBase.Couple(MakeNewList(k), l)
+	secret, _ := LinkDataBase.CreateToken("deploy-bot", []string{ScopeLinksWrite}, "alice")
+	snap, err := TakeSnapshot(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	LinkDataBase.RevokeToken("deploy-bot")
+	LinkDataBase.Decouple(LinkDataBase.Lists[k], l)
+	l2, _ := MakeNewlink("localhost/new", "new")
+	LinkDataBase.CommitNewLink(l2)
+	k2, _ := MakeNewKeyword("new")
+	LinkDataBase.Couple(MakeNewList(k2), l2)
+
+	old, err := LoadSnapshot(snap.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff := DiffSnapshot(snap.Name, LinkDataBase, old)
+	if len(diff.ListsAdded) != 1 || diff.ListsAdded[0] != k || len(diff.ListsRemoved) != 1 || diff.ListsRemoved[0] != k2 {
+		t.Errorf("unexpected diff: %+v", diff)
+	}
+	if _, err := LoadSnapshot("../godb.json"); err == nil {
+		t.Error("a snapshot name must not reach outside the snapshot directory")
+	}
+
+	before := LinkDataBase.Generation
+	if err := RestoreSnapshot(snap.Name, s); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := LinkDataBase.Lists[k]; !exists || LinkDataBase.Lists[k2] != nil {
+		t.Error("the restored database does not match the snapshot")
+	}
+	if LinkDataBase.NextLinkID <= l2.ID {
+		t.Error("link IDs handed out after the snapshot would be reused")
+	}
+	if LinkDataBase.LookupToken(secret) != nil {
+		t.Error("a token revoked after the snapshot was brought back by restoring it")
+	}
+	if LinkDataBase.Generation <= before {
+		t.Errorf("the restored database should be past generation %d, got %d", before, LinkDataBase.Generation)
+	}
+	if saved, _ := DBStore.(*JSONFileStore).load(); saved.Lists[k] == nil {
+		t.Error("the restored database was not saved to the storage backend")
+	}
+
+	// snapshots taken during a restore see the database before or after it, see go test -race
+	done := make(chan error)
+	go func() {
+		_, err := TakeSnapshot(s)
+		done <- err
+	}()
+	if err := RestoreSnapshot(snap.Name, s); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBoltStore(t *testing.T) {
+	dir := t.TempDir()
+	defer func(name string) { MetadataFileName = name }(MetadataFileName)
+	MetadataFileName = filepath.Join(dir, "go2metadata.json")
+
+	// convert a JSON database
+	db := MakeNewLinkDatabase()
+	l, _ := MakeNewlink("localhost/bolted", "a bolted link")
+	db.CommitNewLink(l)
+	k, _ := MakeNewKeyword("bolted")
+	db.Couple(MakeNewList(k), l)
+	db.AddListEdit(k, &EditRecord{EditMsg: "link coupled", EditUser: "someone"})
+	js, _ := OpenJSONFileStore(filepath.Join(dir, "godb.json"))
+	if err := js.Save(db); err != nil {
+		t.Fatal(err)
+	}
+	st, err := OpenStore("bolt", filepath.Join(dir, "godb.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CopyStore(js, st); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := st.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Lists[k] == nil || loaded.Lists[k].Links[l.ID] != loaded.Links[l.ID] {
+		t.Fatal("list did not survive the conversion, or its links aren't the database's links")
+	}
+	if loaded.Links[l.ID].URL != "http://localhost/bolted" || len(loaded.Metadata.ListEdits[k]) != 1 {
+		t.Error("link or edit history did not survive the conversion")
+	}
+
+	// incremental saves write only what changed, including clicks
+	l2, _ := MakeNewlink("localhost/second", "another one")
+	loaded.CommitNewLink(l2)
+	loaded.Couple(loaded.Lists[k], l2)
+	loaded.Click(loaded.Links[l.ID])
+	loaded.applyClicks()
+	if err := st.Save(loaded); err != nil {
+		t.Fatal(err)
+	}
+	link, err := st.GetLink(l2.ID)
+	if err != nil || link.URL != "http://localhost/second" {
+		t.Errorf("new link was not saved: %v", err)
+	}
+	link, _ = st.GetLink(l.ID)
+	if link.Clicks != 1 {
+		t.Errorf("a click was not saved, clicks: %d", link.Clicks)
+	}
+	ll, _ := st.GetList(k)
+	if len(ll.Links) != 2 {
+		t.Error("list membership change was not saved")
+	}
+	CreateStringVar("saved", "nope") // on the global database, so it's in no change set
+	if _, err := st.GetStringVar("saved"); err != ErrNotFound {
+		t.Error("an unmarked variable should not have been written")
+	}
+
+	// a checkpoint saves a copy, and edits after it's made wait for the next save
+	loaded.Links[l2.ID].Title = "copied"
+	loaded.RecordLink(loaded.Links[l2.ID])
+	checkpoint := loaded.checkpointCopy()
+	loaded.Links[l.ID].Title = "after the copy"
+	loaded.RecordLink(loaded.Links[l.ID])
+	if err := st.Save(checkpoint); err != nil {
+		t.Fatal(err)
+	}
+	if link, _ := st.GetLink(l2.ID); link.Title != "copied" {
+		t.Errorf("the checkpoint's edit was not saved, title '%s'", link.Title)
+	}
+	if link, _ := st.GetLink(l.ID); link.Title == "after the copy" || !loaded.changes.any() {
+		t.Error("an edit made after the copy should be left for the next save")
+	}
+	if st.(*BoltStore).saved != loaded {
+		t.Error("saving a checkpoint's copy should keep the next save incremental")
+	}
+
+	loaded.Decouple(loaded.Lists[k], l2)
+	loaded.Decouple(loaded.Lists[k], loaded.Links[l.ID])
+	if err := st.Save(loaded); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.GetList(k); err != ErrNotFound {
+		t.Errorf("an emptied list should be gone, got: %v", err)
+	}
+	loaded.CreateToken("bolted", []string{ScopeRead}, "someone")
+	if err := st.Save(loaded); err != nil {
+		t.Fatal(err)
+	}
+	st.Close()
+
+	reopened, err := OpenBoltStore(filepath.Join(dir, "godb.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	again, err := reopened.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(again.Lists) != 0 || again.NextLinkID != loaded.NextLinkID {
+		t.Errorf("reloaded database doesn't match what was saved: %d lists, next link ID %d", len(again.Lists), again.NextLinkID)
+	}
+	if token := again.APITokens["bolted"]; token == nil || token.Hash != loaded.APITokens["bolted"].Hash {
+		t.Error("an API token was not saved")
+	}
+}
+
+func TestSQLStore(t *testing.T) {
+	dir := t.TempDir()
+	db := MakeNewLinkDatabase()
+	l, _ := MakeNewlink("localhost/docs/{1}", "docs by topic")
+	db.CommitNewLink(l)
+	l.LinkVariables["team"] = "infra"
+	l2, _ := MakeNewlink("localhost/home", "home page")
+	db.CommitNewLink(l2)
+	k, _ := MakeNewKeyword("docs")
+	ll := MakeNewList(k)
+	db.Couple(ll, l)
+	db.Couple(ll, l2)
+	ll.TagBindings[l.ID] = []string{"topic", "t"}
+	ll.Extractions[l.ID] = ExtractionCapture{ExampleParam: "dns", Regex: "(?P<topic>[a-z]+)"}
+	ll.Behavior = l2.ID
+	db.Click(l2)
+	db.applyClicks()
+	db.Variables.Strings = map[string]string{"planet": "mars"}
+	db.Variables.Maps = map[string]map[string]string{"colors": {"red": "#f00"}, "empty": {}}
+	db.AddListEdit(k, &EditRecord{EditDate: time.Now(), EditUser: "someone", EditMsg: "second"})
+	db.AddLinkEdit(l.ID, &EditRecord{EditDate: time.Now(), EditUser: "someone", EditMsg: "created"})
+	db.LinkLog[k] = []string{"docs/dns", "docs/ntp"}
+	db.CreateToken("deploy", []string{ScopeRead, ScopeLinksWrite}, "someone")
+	ll.SetPermissions(ProtectionOwners, VisibilityTeam, []string{"someone", "another"}, []string{"infra"})
+
+	st, err := OpenStore("sqlite", filepath.Join(dir, "godb.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	if err := st.Save(db); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := st.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := json.Marshal(db)
+	got, _ := json.Marshal(loaded)
+	if !bytes.Equal(want, got) {
+		t.Errorf("database changed in a trip through sqlite\nwant: %s\n got: %s", want, got)
+	}
+	if loaded.Lists[k].Links[l.ID] != loaded.Links[l.ID] {
+		t.Error("list members should be the database's links")
+	}
+
+	// incremental saves
+	loaded.Decouple(loaded.Lists[k], loaded.Links[l2.ID])
+	loaded.Click(loaded.Links[l.ID])
+	loaded.applyClicks()
+	loaded.Variables.Maps["colors"]["blue"] = "#00f"
+	loaded.RecordMapVar("colors")
+	if err := st.Save(loaded); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.GetLink(l2.ID); err != ErrNotFound {
+		t.Errorf("a removed link should be gone, got: %v", err)
+	}
+	if link, _ := st.GetLink(l.ID); link.Clicks != 1 || link.LinkVariables["team"] != "infra" {
+		t.Error("a click on a link was not saved")
+	}
+	if m, _ := st.GetMapVar("colors"); m["blue"] != "#00f" {
+		t.Error("map variable change was not saved")
+	}
+	if list, _ := st.GetList(k); len(list.Links) != 1 || len(list.TagBindings[l.ID]) != 2 {
+		t.Error("list change was not saved")
+	}
+	if list, _ := st.GetList(k); list.Protection != ProtectionOwners || list.Visibility != VisibilityTeam || len(list.Owners) != 2 || list.OwnerGroups[0] != "infra" {
+		t.Errorf("list owners were not saved: %+v", list)
+	}
+
+	// a database from before lists had owners
+	old := filepath.Join(dir, "old.sqlite")
+	raw, err := sql.Open("sqlite", old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range []string{
+		`CREATE TABLE lists (keyword TEXT PRIMARY KEY, behavior INTEGER NOT NULL, clicks INTEGER NOT NULL, usage TEXT NOT NULL, logging INTEGER NOT NULL)`,
+		`INSERT INTO lists VALUES ('old', -2, 3, '', 0)`,
+		`PRAGMA user_version = 1`,
+	} {
+		if _, err := raw.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	raw.Close()
+	st2, err := OpenStore("sqlite", old)
+	if err != nil {
+		t.Fatalf("a version 1 database should be upgraded: %s", err)
+	}
+	defer st2.Close()
+	if list, err := st2.GetList("old"); err != nil || list.Clicks != 3 || list.GetProtection() != ProtectionOpen || list.GetVisibility() != VisibilityPublic {
+		t.Errorf("an upgraded list should be open and public: %+v %v", list, err)
+	}
+}
+
+func TestCloneAndNDJSON(t *testing.T) {
+	db := MakeNewLinkDatabase()
+	l, _ := MakeNewlink("localhost/docs/{1}", "docs by topic")
+	db.CommitNewLink(l)
+	l.LinkVariables["team"] = "infra"
+	l2, _ := MakeNewlink("localhost/home", "home page")
+	db.CommitNewLink(l2)
+	k, _ := MakeNewKeyword("docs")
+	ll := MakeNewList(k)
+	db.Couple(ll, l)
+	db.Couple(ll, l2)
+	ll.TagBindings[l.ID] = []string{"topic"}
+	db.Variables.Strings = map[string]string{"planet": "mars"}
+	db.Variables.Maps = map[string]map[string]string{"colors": {"red": "#f00"}}
+	db.AddListEdit(k, &EditRecord{EditDate: time.Now(), EditUser: "someone", EditMsg: "created"})
+	db.AddLinkEdit(l.ID, &EditRecord{EditDate: time.Now(), EditUser: "someone", EditMsg: "created"})
+	db.LinkLog[k] = []string{"docs/dns"}
+	db.CreateToken("deploy", []string{ScopeLinksWrite}, "someone")
+	want, _ := json.Marshal(db)
+
+	c := db.Clone()
+	if got, _ := json.Marshal(c); !bytes.Equal(want, got) {
+		t.Errorf("clone differs\nwant: %s\n got: %s", want, got)
+	}
+	if c.Lists[k].Links[l.ID] != c.Links[l.ID] {
+		t.Error("cloned lists should hold the clone's links")
+	}
+	c.Links[l.ID].Clicks = 10
+	c.Lists[k].TagBindings[l.ID][0] = "changed"
+	c.Variables.Maps["colors"]["red"] = "#e00"
+	if l.Clicks != 0 || ll.TagBindings[l.ID][0] != "topic" || db.Variables.Maps["colors"]["red"] != "#f00" {
+		t.Error("changing a clone changed the original")
+	}
+
+	var buf bytes.Buffer
+	if err := db.WriteNDJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 10 || !strings.Contains(lines[0], `"type":"header"`) {
+		t.Errorf("expected a header and 9 records, got:\n%s", buf.String())
+	}
+	loaded, err := ReadNDJSON(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := json.Marshal(loaded); !bytes.Equal(want, got) {
+		t.Errorf("database changed in a trip through NDJSON\nwant: %s\n got: %s", want, got)
+	}
+	if loaded.Lists[k].Links[l.ID] != loaded.Links[l.ID] {
+		t.Error("imported lists should hold the imported links")
+	}
+
+	for _, bad := range []string{
+		"",
+		lines[1] + "\n",
+		`{"type":"header","schema_version":1}` + "\n",
+		lines[0] + "\n" + `{"type":"bogus"}` + "\n",
+		lines[0] + "\nnot json\n",
+	} {
+		if _, err := ReadNDJSON(strings.NewReader(bad)); err == nil {
+			t.Errorf("expected an error reading %q", bad)
+		}
+	}
+}
+
+func TestGeneration(t *testing.T) {
+	defer func(d *LinkDatabase) { LinkDataBase = d }(LinkDataBase)
+	db := MakeNewLinkDatabase()
+	LinkDataBase = db
+	moved := func(what string, change func()) {
+		before := db.Generation
+		change()
+		if db.Generation <= before {
+			t.Errorf("%s should move the generation past %d", what, before)
+		}
+	}
+
+	l, _ := MakeNewlink("localhost/a", "a")
+	k, _ := MakeNewKeyword("a")
+	ll := MakeNewList(k)
+	moved("CommitNewLink", func() { db.CommitNewLink(l) })
+	moved("Couple", func() { db.Couple(ll, l) })
+	moved("CreateStringVar", func() { CreateStringVar("planet", "mars") })
+	moved("SetMapVar", func() { SetMapVar("colors", map[string]string{"red": "#f00"}) })
+	moved("Decouple", func() { db.Decouple(ll, l) })
+
+	l2, _ := MakeNewlink("localhost/b", "b")
+	db.CommitNewLink(l2)
+	db.Couple(ll, l2)
+	l2.Dtime = time.Now().Add(-time.Hour)
+	moved("Prune", func() { db.Prune() })
+
+	l3, _ := MakeNewlink("localhost/c", "c")
+	db.CommitNewLink(l3)
+	db.Couple(ll, l3)
+	before := db.Generation
+	db.changes.take()
+	db.Click(l3)
+	db.ClickList(ll)
+	db.applyClicks()
+	if db.Generation != before {
+		t.Error("clicks should not move the generation")
+	}
+	if !db.changes.any() || l3.Clicks != 1 || ll.Clicks != 1 {
+		t.Error("clicks should be counted and marked for saving")
+	}
+	if db.Clone().Generation != db.Generation {
+		t.Error("a clone should have the same generation")
+	}
+}
+
+func TestReplication(t *testing.T) {
+	defer func(d *LinkDatabase, n int) { LinkDataBase, ReplicationBacklog = d, n }(LinkDataBase, ReplicationBacklog)
+	s := new(sync.RWMutex)
+
+	var buf bytes.Buffer
+	WriteFrame(&buf, &Frame{Type: FrameAck, Seq: 42})
+	if f, err := ReadFrame(&buf); err != nil || f.Type != FrameAck || f.Seq != 42 {
+		t.Errorf("frame didn't survive the round trip: %+v, %v", f, err)
+	}
+	buf.Write([]byte{0xff, 0xff, 0xff, 0xff})
+	if _, err := ReadFrame(&buf); err == nil {
+		t.Error("an oversized frame should be refused")
+	}
+
+	// the active's side: some edits before the standby shows up, and some after
+	active := MakeNewLinkDatabase()
+	StartReplication(active)
+	log := active.replication
+	k, _ := MakeNewKeyword("replicated")
+	ll := MakeNewList(k)
+	l, _ := MakeNewlink("localhost/one", "one")
+	active.CommitNewLink(l)
+	active.Couple(ll, l)
+	LinkDataBase = active
+	snap, err := log.snapshot(active)
+	if err != nil || snap.Seq != log.Latest() {
+		t.Fatalf("snapshot should be tagged with sequence %d: %+v, %v", log.Latest(), snap, err)
+	}
+	l2, _ := MakeNewlink("localhost/two", "two")
+	active.CommitNewLink(l2)
+	active.Couple(ll, l2)
+	active.Click(l2)
+	active.applyClicks()
+	frames, ok := log.Since(snap.Seq)
+	if !ok || len(frames) != 4 {
+		t.Fatalf("expected 3 edits and a click after the snapshot, got %d", len(frames))
+	}
+
+	// the standby's side, over a pipe
+	LinkDataBase = MakeNewLinkDatabase()
+	r := &replica{ref: liveDB(s)}
+	standby, peer := net.Pipe()
+	updates := make(chan uint64, 1)
+	followed := make(chan error, 1)
+	go func() {
+		reader := bufio.NewReader(standby)
+		hello, err := ReadFrame(reader)
+		if err == nil {
+			err = r.follow(standby, reader, hello, 0, updates)
+		}
+		followed <- err
+	}()
+	WriteFrame(peer, &Frame{Type: FrameHello, Stream: log.Stream, Seq: log.Latest()})
+	if resume, err := ReadFrame(peer); err != nil || resume.Type != FrameResume || resume.Seq != 0 || resume.Stream != "" {
+		t.Fatalf("a new standby should resume from nothing: %+v, %v", resume, err)
+	}
+	for _, f := range append([]*Frame{snap}, frames...) {
+		WriteFrame(peer, f)
+		if ack, err := ReadFrame(peer); err != nil || ack.Type != FrameAck || ack.Seq != f.Seq {
+			t.Fatalf("frame %d wasn't acknowledged: %+v, %v", f.Seq, ack, err)
+		}
+	}
+	peer.Close()
+	<-followed
+
+	got := LinkDataBase
+	if got == active || got.Generation != active.Generation || len(got.Links) != 2 {
+		t.Fatalf("standby should have its own copy at generation %d, has %d links at %d", active.Generation, len(got.Links), got.Generation)
+	}
+	if got.Links[l2.ID].Clicks != 1 {
+		t.Error("clicks should be replicated")
+	}
+	for id, link := range got.Lists[k].Links {
+		if link != got.Links[id] {
+			t.Errorf("list should point at the standby's link %d", id)
+		}
+	}
+	if r.stream != log.Stream || r.applied != log.Latest() {
+		t.Errorf("standby should be at %d of %s, is at %d of %s", log.Latest(), log.Stream, r.applied, r.stream)
+	}
+
+	// mutations are applied in order, once
+	if err := r.apply(frames[0]); err != nil {
+		t.Errorf("a repeated mutation should be ignored: %v", err)
+	}
+	active.RecordLink(l)
+	active.RecordLink(l2)
+	frames, _ = log.Since(r.applied)
+	if err := r.apply(frames[1]); err == nil {
+		t.Error("a gap in the sequence should stop the stream")
+	}
+
+	// a mutation that doesn't apply stops the stream, and leaves the database as it was
+	applied := r.applied
+	for _, m := range []string{`{"op":"putlist","keyword":"broken"}`, `{"op":"putlink","link_id":99}`} {
+		if err := r.apply(&Frame{Type: FrameMutation, Seq: applied + 1, Mutation: json.RawMessage(m)}); err == nil {
+			t.Errorf("%s should be refused", m)
+		}
+		if !r.ref.lock.TryLock() {
+			t.Fatalf("%s left the database locked", m)
+		}
+		r.ref.lock.Unlock()
+	}
+	if _, exists := got.Lists["broken"]; exists || got.Links[99] != nil || r.applied != applied {
+		t.Error("a refused mutation shouldn't change anything")
+	}
+	for _, ll := range got.Lists {
+		for id, link := range ll.Links {
+			if link == nil {
+				t.Errorf("list '%s' has no link %d", ll.Keyword, id)
+			}
+		}
+	}
+
+	// falling too far behind, or a restore, means sending the whole database
+	ReplicationBacklog = 2
+	for i := 0; i < 3; i++ {
+		active.RecordLink(l)
+	}
+	if _, ok := log.Since(r.applied); ok {
+		t.Error("mutations past the backlog should be forgotten")
+	}
+	if frames, ok := log.Since(log.Latest() - 2); !ok || len(frames) != 2 {
+		t.Error("mutations within the backlog should be kept")
+	}
+	latest := log.Latest()
+	log.Reset()
+	if _, ok := log.Since(latest); ok {
+		t.Error("a reset should send a standby the whole database")
+	}
+	if frames, ok := log.Since(log.Latest()); !ok || len(frames) != 0 {
+		t.Error("a standby current with the reset should have nothing to catch up on")
+	}
+}
+
+func TestWaitForFailure(t *testing.T) {
+	defer func(i string, m int, h string) {
+		HeartbeatInterval, HeartbeatMisses, PromotionHolddown = i, m, h
+	}(HeartbeatInterval, HeartbeatMisses, PromotionHolddown)
+
+	HeartbeatInterval, HeartbeatMisses, PromotionHolddown = "", 0, "soon"
+	if i, m, h := HeartbeatSettings(); i != time.Second || m != 3 || h != 2*time.Second {
+		t.Errorf("unset heartbeat settings should get the defaults, got %s, %d, %s", i, m, h)
+	}
+
+	HeartbeatInterval, HeartbeatMisses, PromotionHolddown = "50ms", 2, "100ms"
+	beats := make(chan uint64, 1)
+	failed := make(chan time.Time, 1)
+	go func() {
+		WaitForFailure(beats)
+		failed <- time.Now()
+	}()
+	for i := 0; i < 10; i++ {
+		time.Sleep(20 * time.Millisecond)
+		beats <- uint64(i)
+	}
+	// long enough to be suspected, not long enough to be promoted
+	time.Sleep(150 * time.Millisecond)
+	beats <- 10
+	stopped := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	select {
+	case <-failed:
+		t.Fatal("a heartbeat during the hold-down should keep the standby following")
+	default:
+	}
+	select {
+	case at := <-failed:
+		if at.Sub(stopped) < 200*time.Millisecond {
+			t.Errorf("standby took over %s after the last heartbeat, before the misses and hold-down were up", at.Sub(stopped))
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("standby should take over once heartbeats stop")
+	}
+}
+
+// writeTestCert makes a key and a certificate for 127.0.0.1 in dir, signed by parent, or
+// self-signed as a CA when parent is nil.
+func writeTestCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	os.WriteFile(filepath.Join(dir, name+".pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key
+}
+
+func TestPeerTLS(t *testing.T) {
+	defer func(cert, key, ca, peer, local string, cfg *tls.Config) {
+		FailoverTLSCert, FailoverTLSKey, FailoverTLSCA, FailoverPeer, FailoverLocal, peerTLS = cert, key, ca, peer, local, cfg
+	}(FailoverTLSCert, FailoverTLSKey, FailoverTLSCA, FailoverPeer, FailoverLocal, peerTLS)
+
+	dir := t.TempDir()
+	ca, caKey := writeTestCert(t, dir, "ca", nil, nil)
+	writeTestCert(t, dir, "peer", ca, caKey)
+	rogueCA, rogueKey := writeTestCert(t, dir, "rogueca", nil, nil)
+	writeTestCert(t, dir, "rogue", rogueCA, rogueKey)
+	rogue, _ := tls.LoadX509KeyPair(filepath.Join(dir, "rogue.pem"), filepath.Join(dir, "rogue.key"))
+
+	FailoverTLSCert, FailoverTLSKey = filepath.Join(dir, "peer.pem"), filepath.Join(dir, "peer.key")
+	FailoverTLSCA = filepath.Join(dir, "missing.pem")
+	if err := LoadPeerTLS(); err == nil {
+		t.Error("a missing CA should stop failover TLS from loading")
+	}
+	FailoverTLSCA = filepath.Join(dir, "ca.pem")
+	if err := LoadPeerTLS(); err != nil {
+		t.Fatal(err)
+	}
+
+	FailoverLocal = "127.0.0.1:0"
+	listener, err := listenPeer(FailoverLocal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	FailoverPeer = listener.Addr().String()
+	accepted := make(chan error)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- handshake(conn.(*tls.Conn))
+			conn.Close()
+		}
+	}()
+
+	conn, err := dialPeer(FailoverPeer)
+	if err != nil {
+		t.Fatalf("peers with certificates from the same CA should connect: %s", err)
+	}
+	conn.Close()
+	if err := <-accepted; err != nil {
+		t.Errorf("the listener should accept a peer with a certificate from the CA: %s", err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	for name, cfg := range map[string]*tls.Config{
+		"no certificate":                {RootCAs: pool},
+		"a certificate from a rogue CA": {RootCAs: pool, Certificates: []tls.Certificate{rogue}},
+	} {
+		if c, err := tls.Dial("tcp4", FailoverPeer, cfg); err == nil {
+			c.Read(make([]byte, 1))
+			c.Close()
+		}
+		if err := <-accepted; !errors.Is(err, errPeerAuth) {
+			t.Errorf("the listener should reject a peer with %s, got %v", name, err)
+		}
+	}
+
+	// and we won't talk to an impostor either
+	impostor, err := tls.Listen("tcp4", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{rogue}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer impostor.Close()
+	go func() {
+		if c, err := impostor.Accept(); err == nil {
+			c.(*tls.Conn).Handshake()
+			c.Close()
+		}
+	}()
+	FailoverPeer = impostor.Addr().String()
+	if _, err := dialPeer(FailoverPeer); !errors.Is(err, errPeerAuth) {
+		t.Errorf("a peer with a certificate from a rogue CA shouldn't be trusted, got %v", err)
+	}
+}
+
+// eventually polls cond until it's true or the timeout is up.
+func eventually(timeout time.Duration, cond func() bool) bool {
+	for end := time.Now().Add(timeout); time.Now().Before(end); time.Sleep(10 * time.Millisecond) {
+		if cond() {
+			return true
+		}
+	}
+	return cond()
+}
+
+func TestCluster(t *testing.T) {
+	defer func(cert, key, ca string, cfg *tls.Config, i string, m int, h string) {
+		FailoverTLSCert, FailoverTLSKey, FailoverTLSCA, peerTLS = cert, key, ca, cfg
+		HeartbeatInterval, HeartbeatMisses, PromotionHolddown = i, m, h
+	}(FailoverTLSCert, FailoverTLSKey, FailoverTLSCA, peerTLS, HeartbeatInterval, HeartbeatMisses, PromotionHolddown)
+
+	dir := t.TempDir()
+	ca, caKey := writeTestCert(t, dir, "ca", nil, nil)
+	writeTestCert(t, dir, "node", ca, caKey)
+	FailoverTLSCert, FailoverTLSKey = filepath.Join(dir, "node.pem"), filepath.Join(dir, "node.key")
+	FailoverTLSCA = filepath.Join(dir, "ca.pem")
+	if err := LoadPeerTLS(); err != nil {
+		t.Fatal(err)
+	}
+	HeartbeatInterval, HeartbeatMisses, PromotionHolddown = "50ms", 2, "100ms"
+
+	// three nodes on loopback, each with its own database
+	const size = 3
+	addrs := make([]string, size)
+	for i := range addrs {
+		l, err := net.Listen("tcp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs[i] = l.Addr().String()
+		l.Close()
+	}
+	locks := make([]*sync.RWMutex, size)
+	dbs := make([]*LinkDatabase, size)
+	nodes := make([]*ClusterNode, size)
+	start := func(i int) {
+		var peers []string
+		for j, addr := range addrs {
+			if j != i {
+				peers = append(peers, addr)
+			}
+		}
+		nodes[i] = NewClusterNode(addrs[i], peers, locks[i], &dbs[i])
+		nodes[i].StateFile = filepath.Join(dir, fmt.Sprintf("node%d.cluster", i))
+		if err := nodes[i].Start(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range nodes {
+		locks[i], dbs[i] = new(sync.RWMutex), MakeNewLinkDatabase()
+		start(i)
+	}
+	stopped := -1
+	defer func() {
+		for i, n := range nodes {
+			if i != stopped {
+				n.Stop()
+			}
+		}
+	}()
+
+	// one leader, that everyone else follows
+	elected := func() int {
+		leader := -1
+		for i, n := range nodes {
+			if i == stopped {
+				continue
+			}
+			if n.Role() == RoleLeader {
+				if leader != -1 {
+					return -1
+				}
+				leader = i
+			}
+		}
+		if leader == -1 {
+			return -1
+		}
+		for i, n := range nodes {
+			if i != stopped && (n.Leader() != addrs[leader] || n.Term() != nodes[leader].Term()) {
+				return -1
+			}
+		}
+		return leader
+	}
+	var leader int
+	if !eventually(5*time.Second, func() bool { leader = elected(); return leader != -1 }) {
+		t.Fatal("the cluster should elect a leader that all nodes follow")
+	}
+
+	// the leader's changes reach every follower
+	k, _ := MakeNewKeyword("clustered")
+	add := func(i int, url string) int {
+		locks[i].Lock()
+		defer locks[i].Unlock()
+		ll, ok := dbs[i].Lists[k]
+		if !ok {
+			ll = MakeNewList(k)
+		}
+		l, _ := MakeNewlink(url, url)
+		dbs[i].CommitNewLink(l)
+		dbs[i].Couple(ll, l)
+		return l.ID
+	}
+	has := func(i int, ids ...int) bool {
+		locks[i].RLock()
+		defer locks[i].RUnlock()
+		for _, id := range ids {
+			if dbs[i].Links[id] == nil || dbs[i].Lists[k] == nil || dbs[i].Lists[k].Links[id] != dbs[i].Links[id] {
+				return false
+			}
+		}
+		return true
+	}
+	first := add(leader, "localhost/first")
+	for i := range nodes {
+		if !eventually(5*time.Second, func() bool { return has(i, first) }) {
+			t.Fatalf("node %d should have the leader's link", i)
+		}
+	}
+
+	// the leader reports its followers caught up, and the followers report the leader
+	if !eventually(5*time.Second, func() bool {
+		st := nodes[leader].Status()
+		for _, peer := range st.Peers {
+			if peer.Lag != 0 || peer.LastSync == nil {
+				return false
+			}
+		}
+		return st.Role == RoleLeader && len(st.Peers) == size-1
+	}) {
+		t.Errorf("the leader should report every follower caught up: %+v", nodes[leader].Status())
+	}
+	for i, n := range nodes {
+		if st := n.Status(); i != leader && (st.Role != RoleFollower || st.Leader != addrs[leader] || st.Sequence == 0) {
+			t.Errorf("node %d should report following %s: %+v", i, addrs[leader], st)
+		}
+	}
+
+	// the leader can hand off to a follower that has everything
+	old := leader
+	if _, err := nodes[old].Handoff(); err != nil {
+		t.Fatalf("the leader should hand off: %s", err)
+	}
+	if !eventually(5*time.Second, func() bool { leader = elected(); return leader != -1 && leader != old }) {
+		t.Fatal("a follower should be elected once the leader hands off")
+	}
+	if !has(leader, first) {
+		t.Error("the leader handed off to should have the link")
+	}
+
+	// the rest of the cluster elects a new leader when the leader goes
+	term := nodes[leader].Term()
+	stopped = leader
+	nodes[leader].Stop()
+	if !eventually(5*time.Second, func() bool { leader = elected(); return leader != -1 }) {
+		t.Fatal("the remaining nodes should elect a new leader")
+	}
+	if nodes[leader].Term() <= term {
+		t.Errorf("the new leader should be in a later term than %d, is in %d", term, nodes[leader].Term())
+	}
+	second := add(leader, "localhost/second")
+
+	// and the old leader catches up when it comes back, as a follower
+	old = stopped
+	start(old)
+	stopped = -1
+	if nodes[old].Term() < term {
+		t.Errorf("a restarted node should remember its term %d, has %d", term, nodes[old].Term())
+	}
+	if !eventually(5*time.Second, func() bool { return elected() == leader && has(old, first, second) }) {
+		t.Errorf("a restarted node should follow the leader and catch up, has role %s in term %d", nodes[old].Role(), nodes[old].Term())
+	}
+	for i := range nodes {
+		if !has(i, first, second) {
+			t.Errorf("node %d should have both links", i)
+		}
+	}
+
+	// a node that stood for election alone behind a partition rejoins in a much later term
+	rejoined := (leader + 1) % size
+	term = nodes[leader].Term() + 20
+	nodes[rejoined].Stop()
+	stopped = rejoined
+	os.WriteFile(nodes[rejoined].StateFile, []byte(fmt.Sprintf(`{"term":%d}`, term)), 0644)
+	start(rejoined)
+	stopped = -1
+	if !eventually(5*time.Second, func() bool { leader = elected(); return leader != -1 && has(rejoined, first, second) }) {
+		t.Fatalf("the cluster should settle on one leader after a partitioned node rejoins, node %d is %s in term %d", rejoined, nodes[rejoined].Role(), nodes[rejoined].Term())
+	}
+	if nodes[leader].Term() < term {
+		t.Errorf("the cluster should take up the rejoined node's term %d, is in %d", term, nodes[leader].Term())
+	}
+	// and it stays settled, rather than the rejoined node standing again and again
+	settled := nodes[leader].Term()
+	time.Sleep(4 * leaderTimeout())
+	if elected() != leader || nodes[rejoined].Term() != settled {
+		t.Errorf("the cluster should stay in term %d under node %d, node %d is %s in term %d", settled, leader, rejoined, nodes[rejoined].Role(), nodes[rejoined].Term())
+	}
+}
+
+// A node still hearing from its leader refuses a candidate's vote and pre-vote without
+// taking up its term, and says who's leading.
+func TestClusterVote(t *testing.T) {
+	db := MakeNewLinkDatabase()
+	n := NewClusterNode("127.0.0.1:1", []string{"127.0.0.1:2", "127.0.0.1:3"}, new(sync.RWMutex), &db)
+	n.term, n.leader, n.heardAt = 5, "127.0.0.1:2", time.Now()
+
+	// a node that lost touch can't depose the leader, or raise our term
+	for _, request := range []*Frame{
+		{Type: FrameVote, Term: 6, Node: "127.0.0.1:3", PreVote: true},
+		{Type: FrameVote, Term: 9, Node: "127.0.0.1:3"},
+	} {
+		reply := n.vote(request)
+		if reply.Granted || reply.Term != 5 || reply.Node != "127.0.0.1:2" {
+			t.Errorf("a follower with a leader should refuse and name its leader: %+v", reply)
+		}
+	}
+	if n.Term() != 5 || n.Role() != RoleFollower || n.votedFor != "" {
+		t.Errorf("the follower should stay in its term without voting, is %s in term %d", n.Role(), n.Term())
+	}
+
+	// once the leader goes quiet, a pre-vote changes nothing and a vote takes up the term
+	n.heardAt = time.Time{}
+	if reply := n.vote(&Frame{Type: FrameVote, Term: 6, Node: "127.0.0.1:3", PreVote: true}); !reply.Granted || n.Term() != 5 || n.votedFor != "" {
+		t.Errorf("a pre-vote should be granted without taking up the term or voting: %+v", reply)
+	}
+	if reply := n.vote(&Frame{Type: FrameVote, Term: 4, Node: "127.0.0.1:3"}); reply.Granted || reply.Term != 5 {
+		t.Errorf("a candidate in an earlier term should be refused and told the term: %+v", reply)
+	}
+	if reply := n.vote(&Frame{Type: FrameVote, Term: 6, Node: "127.0.0.1:3"}); !reply.Granted || reply.Term != 6 || n.votedFor != "127.0.0.1:3" {
+		t.Errorf("a candidate in a later term should get the vote: %+v", reply)
+	}
+
+	// nor can it depose a leader
+	n.role, n.leader = RoleLeader, n.ID
+	if reply := n.vote(&Frame{Type: FrameVote, Term: 9, Node: "127.0.0.1:3"}); reply.Granted || reply.Node != n.ID || n.Role() != RoleLeader || n.Term() != 6 {
+		t.Errorf("a leader should refuse and name itself: %+v", reply)
+	}
+}
+
+func TestFencing(t *testing.T) {
+	defer func(d *LinkDatabase, file string, term uint64, seed int, i string, m int, h string) {
+		LinkDataBase, GodbFileName, pairTerm.term, ActiveStandbySeed = d, file, term, seed
+		HeartbeatInterval, HeartbeatMisses, PromotionHolddown = i, m, h
+		SetActive(true)
+	}(LinkDataBase, GodbFileName, pairTerm.term, ActiveStandbySeed, HeartbeatInterval, HeartbeatMisses, PromotionHolddown)
+	s := new(sync.RWMutex)
+	GodbFileName = filepath.Join(t.TempDir(), "godb.json")
+
+	// terms survive restarts, and go up with each promotion
+	pairTerm.term = 0
+	if err := LoadTerm(); err != nil || CurrentTerm() != 0 {
+		t.Fatalf("with no term file the term should be 0, got %d, %v", CurrentTerm(), err)
+	}
+	LinkDataBase = MakeNewLinkDatabase()
+	Promote("starting up", s)
+	Promote("the peer went quiet", s)
+	pairTerm.term = 0
+	if err := LoadTerm(); err != nil || CurrentTerm() != 2 {
+		t.Fatalf("two promotions should be term 2 after a restart, got %d, %v", CurrentTerm(), err)
+	}
+	observeTerm(1)
+	observeTerm(5)
+	if CurrentTerm() != 5 {
+		t.Errorf("a later term from the peer should be taken up, got %d", CurrentTerm())
+	}
+
+	// the later term wins, then the higher diceroll
+	ActiveStandbySeed = 500
+	for _, c := range []struct {
+		term uint64
+		roll int
+		wins bool
+	}{{6, 0, true}, {4, 999, false}, {5, 501, true}, {5, 499, false}, {5, 0, false}} {
+		if peerWins(c.term, c.roll) != c.wins {
+			t.Errorf("a peer active in term %d with roll %d against us in term 5 with roll 500: wins should be %v", c.term, c.roll, c.wins)
+		}
+	}
+
+	// edits the standby never acknowledged are reported when we step down
+	log := LinkDataBase.replication
+	k, _ := MakeNewKeyword("diverged")
+	l, _ := MakeNewlink("localhost/diverged", "made on the wrong side")
+	LinkDataBase.CommitNewLink(l)
+	log.ack(log.Latest())
+	LinkDataBase.Couple(MakeNewList(k), l)
+	unacked, _ := log.Since(log.Acked())
+	HeartbeatInterval, HeartbeatMisses, PromotionHolddown = "20ms", 1, "20ms"
+	updates := make(chan uint64, 1)
+	stepDown("the peer is in a later term", updates, s)
+	if IsActive() {
+		t.Fatal("stepping down should make us standby")
+	}
+	data, err := os.ReadFile(DivergenceFileName(GodbFileName, 5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != len(unacked) || len(lines) == 0 {
+		t.Fatalf("the %d unacknowledged edits should be reported, got %d lines", len(unacked), len(lines))
+	}
+	var m Mutation
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &m); err != nil || m.Keyword != k {
+		t.Errorf("the report should hold the diverged edits as mutations: %+v, %v", m, err)
+	}
+
+	// and with no peer to follow, we take over again in a new term
+	if !eventually(2*time.Second, IsActive) {
+		t.Fatal("a stepped-down redirector should take over when the peer goes quiet")
+	}
+	if CurrentTerm() != 6 {
+		t.Errorf("taking over again should start term 6, got %d", CurrentTerm())
+	}
+
+	// a standby won't take frames from another term than the stream's, or from a stream
+	// that has been superseded
+	r := &replica{ref: liveDB(s), stale: func(term uint64) bool { return term < CurrentTerm() }}
+	follow := func(frames []*Frame, between func()) error {
+		standby, peer := net.Pipe()
+		defer peer.Close()
+		followed := make(chan error, 1)
+		go func() {
+			followed <- r.follow(standby, bufio.NewReader(standby), &Frame{Type: FrameHello, Term: 6}, CurrentTerm(), updates)
+		}()
+		if resume, err := ReadFrame(peer); err != nil || resume.Term != CurrentTerm() {
+			t.Fatalf("the resume frame should carry the standby's term: %+v, %v", resume, err)
+		}
+		WriteFrame(peer, frames[0])
+		if ack, err := ReadFrame(peer); err != nil || ack.Type != FrameAck {
+			t.Fatalf("the first frame should be acknowledged: %+v, %v", ack, err)
+		}
+		between()
+		go io.Copy(io.Discard, peer)
+		WriteFrame(peer, frames[1])
+		return <-followed
+	}
+	err = follow([]*Frame{{Type: FrameHeartbeat, Term: 6}, {Type: FrameHeartbeat, Term: 5}}, func() {})
+	if err == nil || !strings.Contains(err.Error(), "term 5") {
+		t.Errorf("a frame from another term should stop the stream, got %v", err)
+	}
+	err = follow([]*Frame{{Type: FrameHeartbeat, Term: 6}, {Type: FrameHeartbeat, Term: 6}}, func() { observeTerm(7) })
+	if err == nil || !strings.Contains(err.Error(), "superseded") {
+		t.Errorf("a stream from a stale term should be dropped, got %v", err)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	defer func(d *LinkDatabase, file, peer string, term uint64) {
+		LinkDataBase, GodbFileName, FailoverPeer, pairTerm.term = d, file, peer, term
+		SetActive(true)
+	}(LinkDataBase, GodbFileName, FailoverPeer, pairTerm.term)
+	s := new(sync.RWMutex)
+	GodbFileName = filepath.Join(t.TempDir(), "godb.json")
+	LinkDataBase = MakeNewLinkDatabase()
+
+	FailoverPeer = ""
+	if st := Status(s); st.Mode != ModeStandalone || st.Role != RoleActive || len(st.Peers) != 0 {
+		t.Errorf("without a peer we should be a standalone active: %+v", st)
+	}
+
+	// an active counts the edits its standby hasn't acknowledged
+	FailoverPeer = "127.0.0.1:1"
+	Promote("testing", s)
+	log := LinkDataBase.replication
+	l, _ := MakeNewlink("localhost/status", "status")
+	LinkDataBase.CommitNewLink(l)
+	log.ack(log.Latest())
+	LinkDataBase.Couple(MakeNewList("status"), l)
+	unacked, _ := log.Since(log.Acked())
+	st := Status(s)
+	if st.Mode != ModeFailover || st.Role != RoleActive || st.Term != CurrentTerm() || st.Reason != "testing" || st.LastChange == nil {
+		t.Errorf("an active should report its term and why it took over: %+v", st)
+	}
+	if len(st.Peers) != 1 || st.Peers[0].Lag != uint64(len(unacked)) || st.Peers[0].LastSync == nil {
+		t.Errorf("the standby should be %d edits behind: %+v", len(unacked), st.Peers)
+	}
+
+	SetActive(false)
+	if st := Status(s); st.Role != RoleStandby || !st.Peers[0].Leader {
+		t.Errorf("a standby should report following its peer: %+v", st)
+	}
+}
+
+func TestSwitchover(t *testing.T) {
+	defer func(i string, m int, h string, term uint64, peer string) {
+		HeartbeatInterval, HeartbeatMisses, PromotionHolddown = i, m, h
+		pairTerm.term, FailoverPeer = term, peer
+		SetActive(true)
+		SetMaintenance(false)
+		standbyReplica.stream, standbyReplica.applied = "", 0
+	}(HeartbeatInterval, HeartbeatMisses, PromotionHolddown, pairTerm.term, FailoverPeer)
+
+	// a standby in maintenance mode doesn't take over, however long the active is quiet
+	HeartbeatInterval, HeartbeatMisses, PromotionHolddown = "20ms", 1, "20ms"
+	beats := make(chan uint64, 1)
+	failed := make(chan string, 1)
+	SetMaintenance(true)
+	go func() { failed <- WaitForFailure(beats) }()
+	select {
+	case <-failed:
+		t.Fatal("a standby in maintenance mode shouldn't take over")
+	case <-time.After(300 * time.Millisecond):
+	}
+	SetMaintenance(false)
+	select {
+	case <-failed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the standby should take over once maintenance mode is off")
+	}
+
+	// the active hands off to a standby with everything, which takes over straight away
+	HeartbeatInterval, HeartbeatMisses, PromotionHolddown = "1s", 3, "2s"
+	SetActive(false)
+	pairTerm.term = 3
+	standbyReplica.stream, standbyReplica.applied = "stream", 5
+	go func() { failed <- WaitForFailure(beats) }()
+	for _, c := range []struct {
+		f           Frame
+		maintenance bool
+		why         string
+	}{
+		{Frame{Term: 2, Stream: "stream", Seq: 5}, false, "not 2"},
+		{Frame{Term: 3, Stream: "other", Seq: 5}, false, "up to sequence 5"},
+		{Frame{Term: 3, Stream: "stream", Seq: 6}, false, "up to sequence 5"},
+		{Frame{Term: 3, Stream: "stream", Seq: 5}, true, "maintenance"},
+	} {
+		SetMaintenance(c.maintenance)
+		if reply := takeHandoff(&c.f); reply.Granted || !strings.Contains(reply.Reason, c.why) {
+			t.Errorf("a handoff of %+v should be refused with '%s', got %+v", c.f, c.why, reply)
+		}
+	}
+	SetMaintenance(false)
+	if reply := takeHandoff(&Frame{Term: 3, Node: "the active", Stream: "stream", Seq: 5}); !reply.Granted {
+		t.Fatalf("a standby with everything should take a handoff: %s", reply.Reason)
+	}
+	select {
+	case why := <-failed:
+		if !strings.Contains(why, "the active handed off") {
+			t.Errorf("the standby should take over because of the handoff, not %s", why)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("a standby handed off to should take over at once")
+	}
+
+	// admin actions
+	if _, err := Control("reboot"); err != ErrNotFound {
+		t.Errorf("an unknown action should be ErrNotFound, got %v", err)
+	}
+	if _, err := Control(ControlMaintenanceOn); err != nil || !InMaintenance() {
+		t.Errorf("maintenance mode should be on: %v", err)
+	}
+	FailoverPeer = ""
+	if _, err := Control(ControlSwitchover); err == nil {
+		t.Error("a switchover without a peer should fail")
+	}
+}
+
+func TestSynchronize(t *testing.T) {
+	defer func(cert, key, ca string, cfg *tls.Config, peer string, d *LinkDatabase, file string, term uint64, seed int, i string, m int, h string) {
+		FailoverTLSCert, FailoverTLSKey, FailoverTLSCA, peerTLS, FailoverPeer = cert, key, ca, cfg, peer
+		LinkDataBase, GodbFileName, pairTerm.term, ActiveStandbySeed = d, file, term, seed
+		HeartbeatInterval, HeartbeatMisses, PromotionHolddown = i, m, h
+		SetActive(true)
+	}(FailoverTLSCert, FailoverTLSKey, FailoverTLSCA, peerTLS, FailoverPeer, LinkDataBase, GodbFileName, pairTerm.term, ActiveStandbySeed, HeartbeatInterval, HeartbeatMisses, PromotionHolddown)
+
+	dir := t.TempDir()
+	ca, caKey := writeTestCert(t, dir, "ca", nil, nil)
+	writeTestCert(t, dir, "node", ca, caKey)
+	FailoverTLSCert, FailoverTLSKey = filepath.Join(dir, "node.pem"), filepath.Join(dir, "node.key")
+	FailoverTLSCA = filepath.Join(dir, "ca.pem")
+	if err := LoadPeerTLS(); err != nil {
+		t.Fatal(err)
+	}
+	GodbFileName = filepath.Join(dir, "godb.json")
+
+	// a peer that answers each diceroll with the next of answers
+	listener, err := listenPeer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	FailoverPeer = listener.Addr().String()
+	answers, heard := make(chan string, 1), make(chan string, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			msg, _ := io.ReadAll(conn)
+			heard <- string(msg)
+			conn.Write([]byte(<-answers))
+			conn.Close()
+		}
+	}()
+
+	// the newer database is active, and the diceroll only breaks ties
+	ActiveStandbySeed, pairTerm.term = 500, 2
+	for _, c := range []struct {
+		answer     string
+		generation uint64
+		active     bool
+	}{
+		{diceroll(9999999, 10, 4), 10, false},
+		{diceroll(0, 10, 4), 10, true},
+		{diceroll(0, 11, 4), 10, false},
+		{diceroll(9999999, 9, 4), 10, true},
+	} {
+		SetActive(true)
+		answers <- c.answer
+		Synchronize(c.generation)
+		if roll, generation, _, err := parseDiceroll(<-heard); err != nil || roll != 500 || generation != c.generation {
+			t.Errorf("we should send our roll and generation %d: %d, %d, %v", c.generation, roll, generation, err)
+		}
+		if IsActive() != c.active {
+			t.Errorf("at generation %d against the peer's %s, active should be %v", c.generation, c.answer, c.active)
+		}
+	}
+	if CurrentTerm() != 4 {
+		t.Errorf("the peer's term should be taken up, got %d", CurrentTerm())
+	}
+
+	// a running redirector keeps its role unless the peer coming up has a newer database
+	s := new(sync.RWMutex)
+	LinkDataBase = MakeNewLinkDatabase()
+	LinkDataBase.Generation = 10
+	HeartbeatInterval, HeartbeatMisses, PromotionHolddown = "20ms", 1, "20ms"
+	updates := make(chan uint64, 1)
+	ask := func(msg string) int {
+		ours, theirs := net.Pipe()
+		go func() {
+			answerDiceroll(ours, msg, updates, s)
+			ours.Close()
+		}()
+		data, _ := io.ReadAll(theirs)
+		roll, generation, _, err := parseDiceroll(string(data))
+		if err != nil || generation != 10 {
+			t.Errorf("we should answer with our generation: %d, %v", generation, err)
+		}
+		return roll
+	}
+	SetActive(true)
+	if roll := ask(diceroll(1, 10, 4)); roll != 9999999 || !IsActive() {
+		t.Errorf("an active should stay active for a peer with the same database, answered %d", roll)
+	}
+	if roll := ask(diceroll(1, 11, 4)); roll != 0 || IsActive() {
+		t.Errorf("an active should step down for a peer with a newer database, answered %d", roll)
+	}
+	if !eventually(2*time.Second, IsActive) {
+		t.Fatal("with no stream from the peer, we should take over again")
+	}
+	SetActive(false)
+	if roll := ask(diceroll(1, 10, 4)); roll != 0 {
+		t.Errorf("a standby should let a peer with the same database be active, answered %d", roll)
+	}
+	if roll := ask(diceroll(1, 9, 4)); roll != 9999999 {
+		t.Errorf("a standby shouldn't let a peer with an older database be active, answered %d", roll)
+	}
+
+	// a restored database is newer than the one the peer last saw, however old the snapshot
+	defer func(st Store) { DBStore = st }(DBStore)
+	DBStore, _ = OpenJSONFileStore(GodbFileName)
+	live := MakeNewLinkDatabase()
+	live.Generation = 10
+	snap := MakeNewLinkDatabase()
+	snap.Generation = 7
+	revoked, _ := snap.CreateToken("revoked-bot", []string{ScopeAdmin}, "alice")
+	snapStore, _ := OpenJSONFileStore(filepath.Join(dir, "snapshot.json"))
+	if err := DBStore.Save(live); err != nil || snapStore.Save(snap) != nil {
+		t.Fatal(err)
+	}
+	if err := RestoreSnapshotFile(filepath.Join(dir, "snapshot.json")); err != nil {
+		t.Fatal(err)
+	}
+	if generation := StoredGeneration(DBStore); generation <= 10 {
+		t.Fatalf("the restored database should be past generation 10, got %d", generation)
+	}
+	if restored, _ := DBStore.Load(); restored.LookupToken(revoked) != nil {
+		t.Error("a token revoked since the snapshot was brought back by restoring it")
+	}
+	SetActive(true)
+	answers <- diceroll(9999999, 10, 4)
+	Synchronize(StoredGeneration(DBStore))
+	<-heard
+	if !IsActive() {
+		t.Error("a peer at the generation from before the restore shouldn't hand back the replaced data")
+	}
+}
+
+func TestAuth(t *testing.T) {
+	defer func(mode string, proxies []string, groups string) {
+		AuthMode, AuthTrustedProxies, AuthGroupsHeader = mode, proxies, groups
+		ConfigureAuth()
+	}(AuthMode, AuthTrustedProxies, AuthGroupsHeader)
+	request := func(from string, headers map[string]string) *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = from
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		r.AddCookie(&http.Cookie{Name: "redirectorlogin", Value: "anybody"})
+		return r
+	}
+
+	AuthMode = AuthCookie
+	if err := ConfigureAuth(); err != nil || !Auth.LoginForm() {
+		t.Fatalf("cookie mode should have a login form: %v", err)
+	}
+	if user := ExtractUser(request("192.0.2.1:5000", nil)); user != "anybody" {
+		t.Errorf("cookie mode should trust the cookie, got '%s'", user)
+	}
+
+	AuthMode, AuthTrustedProxies = AuthHeader, nil
+	if err := ConfigureAuth(); err == nil {
+		t.Error("header mode without trusted proxies should be refused")
+	}
+	AuthTrustedProxies = []string{"proxy.example.com"}
+	if err := ConfigureAuth(); err == nil {
+		t.Error("a trusted proxy should have to be an address")
+	}
+	AuthTrustedProxies = []string{"10.0.0.5", "192.168.10.0/24", "2001:db8::1"}
+	if err := ConfigureAuth(); err != nil || Auth.LoginForm() {
+		t.Fatalf("header mode shouldn't have a login form: %v", err)
+	}
+	user := map[string]string{"X-Forwarded-User": "alice", "X-Forwarded-Email": "bob@example.com"}
+	email := map[string]string{"X-Forwarded-Email": "bob@example.com"}
+	for _, c := range []struct {
+		from    string
+		headers map[string]string
+		want    string
+	}{
+		{"10.0.0.5:5000", user, "alice"},
+		{"192.168.10.77:5000", email, "bob@example.com"},
+		{"[2001:db8::1]:5000", user, "alice"},
+		{"10.0.0.6:5000", user, ""}, // not the proxy
+		{"10.0.0.5:5000", nil, ""},  // the cookie doesn't count
+	} {
+		if got := ExtractUser(request(c.from, c.headers)); got != c.want {
+			t.Errorf("from %s with %v: got '%s', want '%s'", c.from, c.headers, got, c.want)
+		}
+	}
+
+	// groups come from their own header, when there is one
+	grouped := map[string]string{"X-Forwarded-User": "alice", "X-Forwarded-Groups": " infra, ,sales "}
+	if groups := Auth.Groups(request("10.0.0.5:5000", grouped)); groups != nil {
+		t.Errorf("without auth_groups_header there should be no groups, got %v", groups)
+	}
+	AuthGroupsHeader = "X-Forwarded-Groups"
+	ConfigureAuth()
+	if groups := Auth.Groups(request("10.0.0.5:5000", grouped)); len(groups) != 2 || groups[0] != "infra" || groups[1] != "sales" {
+		t.Errorf("groups should be read from the header, got %v", groups)
+	}
+	if groups := Auth.Groups(request("10.0.0.6:5000", grouped)); groups != nil {
+		t.Errorf("groups from an address that isn't the proxy should be ignored, got %v", groups)
+	}
+
+	AuthMode = "ldap"
+	if err := ConfigureAuth(); err == nil {
+		t.Error("an unknown auth mode should be refused")
+	}
+}
+
+func TestTokens(t *testing.T) {
+	db := MakeNewLinkDatabase()
+	for _, bad := range []struct {
+		name   string
+		scopes []string
+	}{
+		{"", []string{ScopeRead}},
+		{"has spaces", []string{ScopeRead}},
+		{"deploy", nil},
+		{"deploy", []string{"links:delete"}},
+	} {
+		if _, err := db.CreateToken(bad.name, bad.scopes, "admin"); err == nil {
+			t.Errorf("token '%s' with scopes %v should have been refused", bad.name, bad.scopes)
+		}
+	}
+	secret, err := db.CreateToken("deploy", []string{ScopeLinksWrite}, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CreateToken("deploy", []string{ScopeRead}, "admin"); err == nil {
+		t.Error("token names should be unique")
+	}
+	data, _ := json.Marshal(db)
+	if strings.Contains(string(data), secret) {
+		t.Error("the token's secret should not be kept")
+	}
+	token := db.LookupToken(secret)
+	if token == nil || token.Name != "deploy" || token.CreatedBy != "admin" {
+		t.Fatalf("the secret should find its token, got %v", token)
+	}
+	if db.LookupToken(secret+"x") != nil || db.LookupToken("") != nil {
+		t.Error("only the secret should find the token")
+	}
+	if !token.Allows(ScopeRead) || !token.Allows(ScopeLinksWrite) || token.Allows(ScopeVariablesWrite) || token.Allows(ScopeAdmin) {
+		t.Errorf("a links:write token should read and write links, and nothing else")
+	}
+	if admin := (&APIToken{Scopes: []string{ScopeAdmin}}); !admin.Allows(ScopeVariablesWrite) {
+		t.Error("an admin token should be allowed everything")
+	}
+
+	// tokens are replicated like everything else
+	replica := MakeNewLinkDatabase()
+	db.replication = NewReplicationLog()
+	db.CreateToken("backup", []string{ScopeRead}, "admin")
+	db.RevokeToken("deploy")
+	frames, _ := db.replication.Since(0)
+	for _, f := range frames {
+		var m Mutation
+		json.Unmarshal(f.Mutation, &m)
+		if err := replica.Apply(&m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(replica.APITokens) != 1 || replica.APITokens["backup"] == nil || replica.LookupToken(secret) != nil {
+		t.Errorf("the replica should only have the backup token, got %v", replica.APITokens)
+	}
+	if err := db.RevokeToken("deploy"); err != ErrNotFound {
+		t.Errorf("revoking a revoked token should be ErrNotFound, got %v", err)
+	}
 
-	SYNC <- 1 // sync start point
+	r := httptest.NewRequest("GET", "/api/tokens", nil)
+	r.Header.Set("Authorization", "bearer "+secret)
+	if BearerToken(r) != secret {
+		t.Error("the bearer token should be read from the Authorization header")
+	}
+	defer func(users, groups []string, a Authenticator) { AdminUsers, AdminGroups, Auth = users, groups, a }(AdminUsers, AdminGroups, Auth)
+	AdminUsers = []string{"root"}
+	r.AddCookie(&http.Cookie{Name: "redirectorlogin", Value: "root"})
+	Auth = CookieAuth{}
+	if IsAdmin(r) {
+		t.Error("anyone can set the login cookie, so it shouldn't make them an admin")
+	}
+	proxy, _ := ParseProxy("192.0.2.1")
+	Auth = &TrustedHeaderAuth{UserHeader: DefaultAuthUserHeader, Proxies: []*net.IPNet{proxy}}
+	r.Header.Set(DefaultAuthUserHeader, "root")
+	if !IsAdmin(r) {
+		t.Error("users in admin_users should be admins")
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	k, _ := MakeNewKeyword("wiki")
+	ll := MakeNewList(k)
+	anonymous := Editor{}
+	alice := Editor{User: "alice"}
+	bob := Editor{User: "bob", Groups: []string{"infra"}}
+	carol := Editor{User: "carol", Groups: []string{"sales"}}
+	admin := Editor{User: "root", Admin: true}
+
+	// nobody owns an old list, and anyone logged in may edit or claim it
+	if ll.GetProtection() != ProtectionOpen || !ll.CanEdit(carol) || !ll.CanManage(carol) || ll.CanEdit(anonymous) || ll.CanManage(anonymous) {
+		t.Error("a list without owners should be open to anyone logged in")
+	}
+
+	if err := ll.SetPermissions("secret", "", nil, nil); err == nil {
+		t.Error("an unknown protection should be refused")
+	}
+	if err := ll.SetPermissions(ProtectionOwners, "", nil, nil); err == nil {
+		t.Error("an owners-only list without owners should be refused")
+	}
+	if err := ll.SetPermissions(ProtectionOwners, "", []string{"alice"}, []string{"infra"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		editor Editor
+		edit   bool
+		manage bool
+	}{
+		{alice, true, true},
+		{bob, true, true}, // by his group
+		{carol, false, false},
+		{admin, true, true},
+		{anonymous, false, false},
+	} {
+		if ll.CanEdit(c.editor) != c.edit || ll.CanManage(c.editor) != c.manage {
+			t.Errorf("owners-only, %+v: want edit %t manage %t", c.editor, c.edit, c.manage)
+		}
+	}
+
+	ll.SetPermissions(ProtectionLocked, "", []string{"alice"}, nil)
+	if ll.CanEdit(alice) || !ll.CanManage(alice) || !ll.CanEdit(admin) || ll.CanManage(bob) {
+		t.Error("only admins should edit a locked list, and its owners should be able to unlock it")
+	}
+	if got := ll.DescribePermissions(); got != "locked, public, owners alice" {
+		t.Errorf("description: got '%s'", got)
+	}
+
+	// a link is only as editable as the least editable of its lists
+	db := MakeNewLinkDatabase()
+	l, _ := MakeNewlink("localhost/wiki", "wiki")
+	db.CommitNewLink(l)
+	db.Couple(ll, l)
+	other, _ := MakeNewKeyword("docs")
+	db.Couple(MakeNewList(other), l)
+	if db.CanEditLink(carol, l) || !db.CanEditLink(admin, l) {
+		t.Error("a link in a locked list should only be editable by admins")
+	}
+	ll.SetPermissions(ProtectionOpen, "", nil, nil)
+	if !db.CanEditLink(carol, l) || ll.Protection != "" {
+		t.Error("a link in open lists should be editable")
+	}
+
+	// permissions survive a clone without being shared
+	ll.SetPermissions(ProtectionOwners, "", []string{"alice"}, nil)
+	c := db.Clone()
+	c.Lists[k].Owners[0] = "mallory"
+	if ll.Owners[0] != "alice" || c.Lists[k].Protection != ProtectionOwners {
+		t.Error("a clone should have its own copy of a list's owners")
+	}
+}
+
+func TestVisibility(t *testing.T) {
+	defer func(d *LinkDatabase) { LinkDataBase = d }(LinkDataBase)
+	db := MakeNewLinkDatabase()
+	LinkDataBase = db
+	anonymous := Editor{}
+	alice := Editor{User: "alice"}
+	bob := Editor{User: "bob", Groups: []string{"infra"}}
+	carol := Editor{User: "carol", Groups: []string{"sales"}}
+	admin := Editor{User: "root", Admin: true}
+
+	lists := make(map[string]*ListOfLinks)
+	for _, name := range []string{"handbook", "oncall", "salary"} {
+		k, _ := MakeNewKeyword(name)
+		lists[name] = MakeNewList(k)
+	}
+	if err := lists["oncall"].SetPermissions("", VisibilityTeam, []string{"alice"}, nil); err == nil {
+		t.Error("a team list without an owning group should be refused")
+	}
+	if err := lists["salary"].SetPermissions("", VisibilityPrivate, nil, []string{"infra"}); err == nil {
+		t.Error("a private list without an owning user should be refused")
+	}
+	lists["oncall"].SetPermissions("", VisibilityTeam, []string{"alice"}, []string{"infra"})
+	lists["salary"].SetPermissions("", VisibilityPrivate, []string{"alice"}, []string{"infra"})
+
+	for _, c := range []struct {
+		list string
+		who  Editor
+		see  bool
+	}{
+		{"handbook", anonymous, true},
+		{"oncall", alice, true},
+		{"oncall", bob, true}, // by his group
+		{"oncall", carol, false},
+		{"oncall", anonymous, false},
+		{"salary", alice, true},
+		{"salary", bob, false}, // the group doesn't count
+		{"salary", admin, true},
+	} {
+		if got := lists[c.list].CanSee(c.who); got != c.see {
+			t.Errorf("%s, %+v: want see %t", c.list, c.who, c.see)
+		}
+	}
+	if lists["oncall"].CanEdit(carol) || lists["oncall"].CanManage(carol) {
+		t.Error("nobody should change a list they can't see")
+	}
+
+	// links: one public and on call, one only on call, one private
+	shared, _ := MakeNewlink("localhost/pager", "pager schedule")
+	secret, _ := MakeNewlink("localhost/runbook", "incident runbook")
+	pay, _ := MakeNewlink("localhost/pay", "pay bands")
+	for _, l := range []*Link{shared, secret, pay} {
+		db.CommitNewLink(l)
+	}
+	db.Couple(lists["handbook"], shared)
+	db.Couple(lists["oncall"], shared)
+	db.Couple(lists["oncall"], secret)
+	db.Couple(lists["salary"], pay)
+	db.AddListEdit("oncall", &EditRecord{EditDate: time.Now(), EditUser: "alice", EditMsg: "created"})
+	db.AddLinkEdit(secret.ID, &EditRecord{EditDate: time.Now(), EditUser: "alice", EditMsg: "created"})
+
+	if v := db.VisibleLink(carol, shared); v == nil || len(v.Lists) != 1 || len(shared.Lists) != 2 {
+		t.Error("a shared link should be seen without its hidden lists, leaving the link alone")
+	}
+	if db.VisibleLink(carol, secret) != nil || db.LinkVisible(carol, secret) || db.VisibleLink(bob, secret) != secret {
+		t.Error("a link only in hidden lists should be hidden")
+	}
+	if db.Hides(admin) || !db.Hides(carol) {
+		t.Error("admins should see everything")
+	}
+
+	c := db.Clone()
+	c.Redact(carol)
+	if len(c.Lists) != 1 || len(c.Links) != 1 || len(c.Links[shared.ID].Lists) != 1 || c.Metadata.ListEdits["oncall"] != nil || c.Metadata.LinkEdits[secret.ID] != nil {
+		t.Errorf("redacting should leave only what carol sees: %d lists, %d links", len(c.Lists), len(c.Links))
+	}
+	if len(db.Lists) != 3 || len(db.Links[shared.ID].Lists) != 2 {
+		t.Error("redacting a clone shouldn't touch the database")
+	}
+
+	SearchKeywordsTrie, SearchKeywordsData = db.IndexKeywords()
+	for _, c := range []struct {
+		who  Editor
+		want int
+	}{{carol, 0}, {bob, 1}, {admin, 1}} {
+		if got := SearchDB("oncall", 5, c.who, SYNC); len(got) != c.want {
+			t.Errorf("searching as %+v: got %v", c.who, got)
+		}
+	}
 }
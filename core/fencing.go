@@ -0,0 +1,200 @@
+package core
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+Split-brain fencing
+
+If the failover peers lose touch with each other but both stay up, the standby promotes
+itself and there are two actives, each taking its own edits. Terms tell them apart. The
+pair's term goes up by one every time a redirector becomes active, and is saved next to
+the database (see TermFileName) so a restart can't reuse it. The active sends its term in
+every frame of its replication stream, and a standby answers with its own when it resumes.
+
+When the peers can reach each other again, the active in the later term stays active. On a
+tie, which only happens when both came up active at once, the higher diceroll stays active.
+The other one steps down, either when the winner's stream arrives or when the winner turns
+its own stream away. A standby also turns away a stream from a term earlier than its own.
+
+The edits the losing side made that its peer never acknowledged are its side of the split.
+Before the winner's database replaces its own, they are written to a divergence report
+(see DivergenceFileName), one mutation per line as in the journal, and each one is logged.
+Nothing is merged automatically: whoever looks at the report decides what to make again.
+*/
+
+var pairTerm struct {
+	mu   sync.Mutex
+	term uint64
+}
+
+// stepping is held while a redirector steps down, until its divergent edits are reported.
+var stepping sync.Mutex
+
+// TermFileName returns where the pair's term is kept for the database at dbfile.
+func TermFileName(dbfile string) string {
+	return fmt.Sprintf("%s.term", dbfile)
+}
+
+// DivergenceFileName returns where the edits made in a stale term are reported.
+func DivergenceFileName(dbfile string, term uint64) string {
+	return fmt.Sprintf("%s.diverged-%d", dbfile, term)
+}
+
+// LoadTerm reads the pair's term from disk. A missing file means no term has started yet.
+func LoadTerm() error {
+	data, err := os.ReadFile(TermFileName(GodbFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	term, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return fmt.Errorf("%s could not be read: %s", TermFileName(GodbFileName), err)
+	}
+	pairTerm.mu.Lock()
+	pairTerm.term = term
+	pairTerm.mu.Unlock()
+	return nil
+}
+
+// CurrentTerm returns the latest term this redirector has been active in or heard of.
+func CurrentTerm() uint64 {
+	pairTerm.mu.Lock()
+	defer pairTerm.mu.Unlock()
+	return pairTerm.term
+}
+
+// setTerm saves term and makes it current. Callers hold pairTerm.mu.
+func setTerm(term uint64) {
+	pairTerm.term = term
+	if err := WriteFileAtomic(TermFileName(GodbFileName), []byte(strconv.FormatUint(term, 10)), 0); err != nil {
+		LogError.Printf("term %d could not be saved: %s\n", term, err)
+	}
+}
+
+// observeTerm catches up with a later term heard from the peer.
+func observeTerm(term uint64) {
+	pairTerm.mu.Lock()
+	defer pairTerm.mu.Unlock()
+	if term > pairTerm.term {
+		LogInfo.Printf("The active peer is in term %d, ours was %d\n", term, pairTerm.term)
+		setTerm(term)
+	}
+}
+
+// Promote makes this redirector active in a new term, with a new replication stream for the
+// standby. The reason is kept for the status page.
+func Promote(reason string, s *sync.RWMutex) {
+	pairTerm.mu.Lock()
+	setTerm(pairTerm.term + 1)
+	term := pairTerm.term
+	pairTerm.mu.Unlock()
+	s.Lock()
+	StartReplication(LinkDataBase)
+	s.Unlock()
+	SetActive(true)
+	noteRoleChange(reason)
+	LogInfo.Printf("Active in term %d: %s\n", term, reason)
+}
+
+// peerWins reports whether a peer that's active in term, with the given diceroll, should
+// be active rather than us.
+func peerWins(term uint64, roll int) bool {
+	ours := CurrentTerm()
+	return term > ours || term == ours && roll > ActiveStandbySeed
+}
+
+/*
+stepDown makes an active redirector a standby, because the peer is active in a later term.
+It returns once the edits the peer never got are reported, so the peer's database can
+replace ours. We take over again if the peer stops sending heartbeats, as any standby does.
+It does nothing on a standby.
+*/
+func stepDown(why string, updates chan uint64, s *sync.RWMutex) {
+	stepping.Lock()
+	defer stepping.Unlock()
+	if !IsActive() {
+		return
+	}
+	SetActive(false)
+	noteRoleChange(why)
+	LogError.Printf("Stepping down to STANDBY from term %d: %s\n", CurrentTerm(), why)
+	reportDivergence(s)
+	go func() {
+		why := WaitForFailure(updates)
+		LogError.Println("Active peer is gone. Assuming ACTIVE role...")
+		Promote(why, s)
+	}()
+}
+
+// reportDivergence writes out the edits the standby never acknowledged. If some of them are
+// no longer kept, the whole database is written as NDJSON instead.
+func reportDivergence(s *sync.RWMutex) {
+	term := CurrentTerm()
+	path := DivergenceFileName(GodbFileName, term)
+	s.RLock()
+	log := LinkDataBase.replication
+	var frames []*Frame
+	var whole *LinkDatabase
+	ok := log != nil
+	if ok {
+		frames, ok = log.Since(log.Acked())
+	}
+	if !ok {
+		whole = LinkDataBase.Clone()
+	}
+	s.RUnlock()
+
+	fh, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		LogError.Printf("edits made in term %d could not be reported: %s\n", term, err)
+		return
+	}
+	defer fh.Close()
+	if whole != nil {
+		LogError.Printf("Some edits made in term %d may never have reached the peer and are no longer kept. The whole database is saved in %s\n", term, path)
+		if err := whole.WriteNDJSON(fh); err != nil {
+			LogError.Printf("%s could not be written: %s\n", path, err)
+		}
+		return
+	}
+	if len(frames) == 0 {
+		LogInfo.Printf("The peer had every edit made in term %d\n", term)
+		return
+	}
+	LogError.Printf("%d edits made in term %d never reached the peer and will be replaced. They are saved in %s\n", len(frames), term, path)
+	out := bufio.NewWriter(fh)
+	for _, f := range frames {
+		var m Mutation
+		if json.Unmarshal(f.Mutation, &m) == nil {
+			LogError.Printf("diverged edit %d: %s %s\n", f.Seq, m.Op, m.target())
+		}
+		out.Write(f.Mutation)
+		out.WriteByte('\n')
+	}
+	if err := out.Flush(); err != nil {
+		LogError.Printf("%s could not be written: %s\n", path, err)
+	}
+}
+
+// target names what a mutation changed, for the log.
+func (m *Mutation) target() string {
+	switch {
+	case m.Keyword != "":
+		return fmt.Sprintf("keyword '%s'", m.Keyword)
+	case m.Name != "":
+		return fmt.Sprintf("variable '%s'", m.Name)
+	default:
+		return fmt.Sprintf("link %d", m.LinkID)
+	}
+}
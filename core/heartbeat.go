@@ -0,0 +1,119 @@
+package core
+
+import (
+	"fmt"
+	"time"
+)
+
+/*
+Failure detection
+
+The active sends its standby a heartbeat every HeartbeatInterval, in the same stream as
+its changes (see replication.go). Anything the standby gets from the active shows the
+active is up, but the heartbeats make sure something arrives at least that often.
+
+The standby counts a heartbeat as missed for every interval that goes by without hearing
+from the active. After HeartbeatMisses in a row it suspects the active has failed. It
+waits PromotionHolddown more before taking over, and goes back to following if the active
+is heard from in the meantime. A single slow response from the active, like a long GC
+pause, shouldn't get past both.
+
+A standby in maintenance mode stays suspect however long the active is quiet. One the active
+hands off to takes over straight away (see switchover.go).
+
+Every change of state is logged, so each failover can be traced afterwards.
+*/
+
+// Standby states.
+const (
+	StandbyFollowing = "following"
+	StandbySuspect   = "suspect"
+	StandbyPromoting = "promoting"
+)
+
+// Heartbeat settings used when the config file doesn't give them.
+const (
+	DefaultHeartbeatInterval = "1s"
+	DefaultHeartbeatMisses   = 3
+	DefaultPromotionHolddown = "2s"
+)
+
+// HeartbeatSettings returns the configured heartbeat interval, missed heartbeat threshold,
+// and promotion hold-down, with defaults in place of anything unset or unusable.
+func HeartbeatSettings() (time.Duration, int, time.Duration) {
+	interval, err := time.ParseDuration(HeartbeatInterval)
+	if err != nil || interval <= 0 {
+		interval, _ = time.ParseDuration(DefaultHeartbeatInterval)
+	}
+	misses := HeartbeatMisses
+	if misses <= 0 {
+		misses = DefaultHeartbeatMisses
+	}
+	holddown, err := time.ParseDuration(PromotionHolddown)
+	if err != nil || holddown < 0 {
+		holddown, _ = time.ParseDuration(DefaultPromotionHolddown)
+	}
+	return interval, misses, holddown
+}
+
+/*
+WaitForFailure follows the active's heartbeats, which arrive on heartbeats as the sequence
+number the standby is current to. It returns once the active has missed enough of them
+and stayed silent through the hold-down, or handed off, when the standby should take over.
+It returns why.
+*/
+func WaitForFailure(heartbeats <-chan uint64) string {
+	interval, misses, holddown := HeartbeatSettings()
+	LogInfo.Printf("standby %s: heartbeat every %s, suspect the active after %d missed, promote %s after that\n", StandbyFollowing, interval, misses, holddown)
+
+	state := StandbyFollowing
+	transition := func(to, why string) {
+		LogInfo.Printf("standby %s -> %s: %s\n", state, to, why)
+		state = to
+	}
+	heard := time.Now()
+	var seq uint64
+	var missed int
+	var suspected time.Time
+	for {
+		var deadline time.Time
+		if state == StandbyFollowing {
+			deadline = heard.Add(interval * time.Duration(missed+1))
+		} else {
+			deadline = suspected.Add(holddown)
+		}
+		timer := time.NewTimer(time.Until(deadline))
+		select {
+		case seq = <-heartbeats:
+			timer.Stop()
+			heard = time.Now()
+			if state == StandbySuspect {
+				transition(StandbyFollowing, fmt.Sprintf("heard from the active again at sequence %d", seq))
+			} else if missed > 0 {
+				LogInfo.Printf("standby %s: heard from the active again after %d missed heartbeats\n", state, missed)
+			}
+			missed = 0
+		case why := <-handedOff:
+			timer.Stop()
+			transition(StandbyPromoting, why)
+			return why
+		case <-timer.C:
+			if state == StandbySuspect {
+				if InMaintenance() {
+					LogInfo.Printf("standby %s: nothing from the active for %s, but in maintenance mode, not taking over\n", state, time.Since(heard).Round(time.Millisecond))
+					suspected = time.Now()
+					continue
+				}
+				why := fmt.Sprintf("nothing from the active for %s, last at sequence %d", time.Since(heard).Round(time.Millisecond), seq)
+				transition(StandbyPromoting, why)
+				return why
+			}
+			missed++
+			LogInfo.Printf("standby %s: missed heartbeat %d of %d\n", state, missed, misses)
+			if missed >= misses {
+				suspected = time.Now()
+				transition(StandbySuspect, fmt.Sprintf("%d heartbeats missed since %s", missed, heard.Format(time.RFC3339Nano)))
+			}
+		}
+	}
+}
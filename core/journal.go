@@ -0,0 +1,530 @@
+package core
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+Mutation journal
+
+Edits to the link database only live in memory until the next checkpoint writes the
+whole thing out. The journal closes that gap. Every mutation is appended to the journal
+file as a line of JSON and synced to the disk before the edit is considered done.
+
+Journal entries record the state of an entity after the change, not the change itself.
+Replaying an entry twice has the same result as replaying it once, so it doesn't
+matter if a checkpoint already included some of them.
+
+On startup the journal is replayed over the last checkpoint. After each successful
+checkpoint it is truncated up to where it was when the checkpoint's copy was taken, since
+the checkpoint now holds everything before that.
+
+Link clicks and keyword usage logs are not journaled. They happen on every redirect and
+are only saved by checkpoints. Turning a keyword's usage log on or off is, since turning it
+off deletes the log, see ModifyLogging.
+*/
+
+// Journal operations, one for each kind of entity a mutation can touch.
+const (
+	OpPutList       = "putlist"
+	OpDeleteList    = "deletelist"
+	OpPutLink       = "putlink"
+	OpDeleteLink    = "deletelink"
+	OpPutString     = "putstring"
+	OpDeleteString  = "deletestring"
+	OpPutMap        = "putmap"
+	OpDeleteMap     = "deletemap"
+	OpListEdits     = "listedits"
+	OpLinkEdits     = "linkedits"
+	OpPutToken      = "puttoken"
+	OpDeleteToken   = "deletetoken"
+	OpPutLinkLog    = "putlinklog"
+	OpDeleteLinkLog = "deletelinklog"
+)
+
+// Mutation is a single journal entry.
+type Mutation struct {
+	Op      string            `json:"op"`
+	Time    time.Time         `json:"time"`
+	Keyword Keyword           `json:"keyword,omitempty"`
+	LinkID  int               `json:"link_id,omitempty"`
+	Name    string            `json:"name,omitempty"`
+	List    *ListOfLinks      `json:"list,omitempty"`
+	Link    *Link             `json:"link,omitempty"`
+	Value   string            `json:"value,omitempty"`
+	Map     map[string]string `json:"map,omitempty"`
+	Edits   []*EditRecord     `json:"edits,omitempty"`
+	Token   *APIToken         `json:"token,omitempty"`
+	Usages  []string          `json:"usages,omitempty"`
+}
+
+// Journal is an append-only file of mutations.
+type Journal struct {
+	Path string
+	mu   sync.Mutex
+	fh   *os.File
+}
+
+// JournalFileName returns the journal location used alongside a database file.
+func JournalFileName(dbfile string) string {
+	return fmt.Sprintf("%s.journal", dbfile)
+}
+
+// OpenJournal opens (or creates) the journal file at path for appending.
+func OpenJournal(path string) (*Journal, error) {
+	fh, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Journal{Path: path, fh: fh}, nil
+}
+
+// Append writes a mutation to the end of the journal and syncs it to the disk.
+// A nil journal discards everything, which is what databases without one get.
+func (j *Journal) Append(m *Mutation) error {
+	if j == nil {
+		return nil
+	}
+	if m.Time.IsZero() {
+		m.Time = time.Now().UTC()
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		LogError.Println("JSON marshal error:", err)
+		return err
+	}
+	data = append(data, '\n')
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err = j.fh.Write(data); err != nil {
+		LogError.Printf("journal write to %s failed: %s\n", j.Path, err)
+		return err
+	}
+	if err = j.fh.Sync(); err != nil {
+		LogError.Printf("journal sync of %s failed: %s\n", j.Path, err)
+	}
+	return err
+}
+
+/*
+Replay applies every mutation in the journal to the provided database, returning the
+number of entries applied.
+
+A crash can leave a partial line at the end of the file. Replay stops at the first line
+that won't parse and cuts the file off there, so new entries aren't appended after garbage.
+*/
+func (j *Journal) Replay(d *LinkDatabase) (int, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, err := j.fh.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	var count int
+	var good int64 // offset just past the last entry we could use
+	reader := bufio.NewReader(j.fh)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				LogError.Printf("journal %s ends with a partial entry, discarding it\n", j.Path)
+			}
+			break
+		} else if err != nil {
+			return count, err
+		}
+		var m Mutation
+		if err := json.Unmarshal(line, &m); err != nil {
+			LogError.Printf("journal %s has an unreadable entry after %d good ones, discarding the rest: %s\n", j.Path, count, err)
+			break
+		}
+		if err := d.Apply(&m); err != nil {
+			LogError.Printf("journal entry %d could not be applied: %s\n", count+1, err)
+		}
+		good += int64(len(line))
+		count++
+	}
+	d.relink()
+	return count, j.fh.Truncate(good)
+}
+
+// Truncate empties the journal. This is done after a checkpoint has saved everything
+// the journal was holding.
+func (j *Journal) Truncate() error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.truncate()
+}
+
+// truncate empties the journal. Callers hold j.mu.
+func (j *Journal) truncate() error {
+	err := j.fh.Truncate(0)
+	if err != nil {
+		LogError.Printf("journal %s could not be truncated: %s\n", j.Path, err)
+		return err
+	}
+	return j.fh.Sync()
+}
+
+// Offset is how far into the journal the entries appended so far go, for TruncateTo.
+func (j *Journal) Offset() (int64, error) {
+	if j == nil {
+		return 0, nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	fi, err := j.fh.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+/*
+TruncateTo drops the journal's entries up to offset, which a checkpoint has saved, and keeps
+the ones appended since. Those are written to a new journal that's renamed over the old one,
+so a crash leaves one or the other, and either replays to the same database.
+*/
+func (j *Journal) TruncateTo(offset int64) error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	fi, err := j.fh.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() <= offset {
+		return j.truncate() // nothing came in after the checkpoint
+	}
+	tail := make([]byte, fi.Size()-offset)
+	if _, err = j.fh.ReadAt(tail, offset); err != nil {
+		return err
+	}
+	if err = WriteFileAtomic(j.Path, tail, 0); err != nil {
+		LogError.Printf("journal %s could not be truncated: %s\n", j.Path, err)
+		return err
+	}
+	fh, err := os.OpenFile(j.Path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		LogError.Printf("journal %s could not be reopened: %s\n", j.Path, err)
+		return err
+	}
+	j.fh.Close()
+	j.fh = fh
+	return nil
+}
+
+func (j *Journal) Close() error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.fh.Close()
+}
+
+/*
+StartJournal opens the journal kept next to the configured database and attaches it to d.
+
+With replay set, entries left over from before a crash or kill are applied to d first and
+the number applied is returned. Without it, leftover entries are thrown away because d
+didn't come from the database they belong to.
+*/
+func StartJournal(d *LinkDatabase, replay bool) (int, error) {
+	var count int
+	j, err := OpenJournal(JournalFileName(GodbFileName))
+	if err != nil {
+		return count, err
+	}
+	if replay {
+		count, err = j.Replay(d)
+	} else {
+		err = j.Truncate()
+	}
+	if err != nil {
+		j.Close()
+		return count, err
+	}
+	d.AttachJournal(j)
+	return count, err
+}
+
+// AttachJournal makes this database record its mutations in j.
+func (d *LinkDatabase) AttachJournal(j *Journal) {
+	d.journal = j
+}
+
+// record journals a mutation and queues it for the standby, if there is one. A failed
+// journal write is kept for JournalErr, so the edit it was part of can be failed.
+func (d *LinkDatabase) record(m *Mutation) {
+	if err := d.journal.Append(m); err != nil && d.journalErr == nil {
+		d.journalErr = err
+	}
+	d.replication.Append(m, d.Generation)
+}
+
+// JournalErr returns the first journal write that failed since it was last called, and forgets it.
+func (d *LinkDatabase) JournalErr() error {
+	err := d.journalErr
+	d.journalErr = nil
+	return err
+}
+
+/*
+FailUnjournaled wraps w for a request that edits the live database, with SYNC held until
+the response is written. If one of its edits didn't reach the journal, a response saying
+it worked becomes a 500 instead: the edit is live, but it would be lost if the redirector
+stopped before its next checkpoint.
+*/
+func FailUnjournaled(w http.ResponseWriter) http.ResponseWriter {
+	LinkDataBase.JournalErr() // failures from before this request aren't its fault
+	return &unjournaledWriter{ResponseWriter: w, d: LinkDataBase}
+}
+
+type unjournaledWriter struct {
+	http.ResponseWriter
+	d       *LinkDatabase
+	checked bool
+	failed  bool
+}
+
+func (u *unjournaledWriter) WriteHeader(code int) {
+	if !u.checked {
+		u.checked = true
+		if err := u.d.JournalErr(); err != nil && code < http.StatusBadRequest {
+			u.failed = true
+			u.Header().Del("Location")
+			http.Error(u.ResponseWriter, fmt.Sprintf("the change was made but couldn't be journaled, it may be lost: %s", err), http.StatusInternalServerError)
+			return
+		}
+	}
+	if !u.failed {
+		u.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (u *unjournaledWriter) Write(data []byte) (int, error) {
+	if !u.checked {
+		u.WriteHeader(http.StatusOK)
+	}
+	if u.failed {
+		return len(data), nil
+	}
+	return u.ResponseWriter.Write(data)
+}
+
+// RecordList journals the current state of a list of links. If the list has been
+// removed from the database, its deletion is journaled instead.
+func (d *LinkDatabase) RecordList(ll *ListOfLinks) {
+	if ll == nil {
+		return
+	}
+	d.changed(changeList, string(ll.Keyword))
+	if _, exists := d.Lists[ll.Keyword]; !exists {
+		d.record(&Mutation{Op: OpDeleteList, Keyword: ll.Keyword})
+		return
+	}
+	d.record(&Mutation{Op: OpPutList, Keyword: ll.Keyword, List: ll})
+}
+
+// RecordLink journals the current state of a link, or its deletion if it is gone.
+func (d *LinkDatabase) RecordLink(l *Link) {
+	if l == nil {
+		return
+	}
+	d.changed(changeLink, strconv.Itoa(l.ID))
+	if _, exists := d.Links[l.ID]; !exists {
+		d.record(&Mutation{Op: OpDeleteLink, LinkID: l.ID})
+		return
+	}
+	d.record(&Mutation{Op: OpPutLink, LinkID: l.ID, Link: l})
+}
+
+// RecordLinkLog journals a keyword's usage log, or its deletion.
+func (d *LinkDatabase) RecordLinkLog(k Keyword) {
+	d.changed(changeLinkLog, string(k))
+	if usages, exists := d.LinkLog[k]; exists {
+		d.record(&Mutation{Op: OpPutLinkLog, Keyword: k, Usages: usages})
+		return
+	}
+	d.record(&Mutation{Op: OpDeleteLinkLog, Keyword: k})
+}
+
+// RecordStringVar journals the current value of a string variable, or its deletion.
+func (d *LinkDatabase) RecordStringVar(name string) {
+	d.changed(changeString, name)
+	if v, exists := d.Variables.Strings[name]; exists {
+		d.record(&Mutation{Op: OpPutString, Name: name, Value: v})
+		return
+	}
+	d.record(&Mutation{Op: OpDeleteString, Name: name})
+}
+
+// RecordMapVar journals the current contents of a map variable, or its deletion.
+func (d *LinkDatabase) RecordMapVar(name string) {
+	d.changed(changeMap, name)
+	if m, exists := d.Variables.Maps[name]; exists {
+		d.record(&Mutation{Op: OpPutMap, Name: name, Map: m})
+		return
+	}
+	d.record(&Mutation{Op: OpDeleteMap, Name: name})
+}
+
+// RecordListEdits journals the edit history of a list.
+func (d *LinkDatabase) RecordListEdits(k Keyword) {
+	d.changed(changeListEdits, string(k))
+	d.record(&Mutation{Op: OpListEdits, Keyword: k, Edits: d.Metadata.ListEdits[k]})
+}
+
+// RecordLinkEdits journals the edit history of a link.
+func (d *LinkDatabase) RecordLinkEdits(id int) {
+	d.changed(changeLinkEdits, strconv.Itoa(id))
+	d.record(&Mutation{Op: OpLinkEdits, LinkID: id, Edits: d.Metadata.LinkEdits[id]})
+}
+
+// RecordToken journals an API token, or its revocation.
+func (d *LinkDatabase) RecordToken(name string) {
+	d.changed(changeToken, name)
+	if t, exists := d.APITokens[name]; exists {
+		d.record(&Mutation{Op: OpPutToken, Name: name, Token: t})
+		return
+	}
+	d.record(&Mutation{Op: OpDeleteToken, Name: name})
+}
+
+// Apply makes the change described by a mutation to this database. The entity it
+// changed is marked for the next incremental save, and the generation goes up.
+func (d *LinkDatabase) Apply(m *Mutation) error {
+	if d.Variables == nil {
+		d.Variables = &UserVariables{}
+	}
+	d.initMetadata()
+	switch m.Op {
+	case OpPutList:
+		if m.List == nil {
+			return fmt.Errorf("%s for '%s' has no list", m.Op, m.Keyword)
+		}
+		if m.List.Links == nil {
+			m.List.Links = make(map[int]*Link)
+		}
+		if m.List.TagBindings == nil {
+			m.List.TagBindings = make(map[int][]string)
+		}
+		d.Lists[m.Keyword] = m.List
+		d.changed(changeList, string(m.Keyword))
+	case OpDeleteList:
+		delete(d.Lists, m.Keyword)
+		d.changed(changeList, string(m.Keyword))
+	case OpPutLink:
+		if m.Link == nil {
+			return fmt.Errorf("%s for link %d has no link", m.Op, m.LinkID)
+		}
+		d.Links[m.LinkID] = m.Link
+		if m.LinkID >= d.NextLinkID {
+			d.NextLinkID = m.LinkID + 1
+		}
+		d.changed(changeLink, strconv.Itoa(m.LinkID))
+	case OpDeleteLink:
+		delete(d.Links, m.LinkID)
+		d.changed(changeLink, strconv.Itoa(m.LinkID))
+	case OpPutString:
+		if d.Variables.Strings == nil {
+			d.Variables.Strings = make(map[string]string)
+		}
+		d.Variables.Strings[m.Name] = m.Value
+		d.changed(changeString, m.Name)
+	case OpDeleteString:
+		delete(d.Variables.Strings, m.Name)
+		d.changed(changeString, m.Name)
+	case OpPutMap:
+		if d.Variables.Maps == nil {
+			d.Variables.Maps = make(map[string]map[string]string)
+		}
+		if m.Map == nil {
+			m.Map = make(map[string]string)
+		}
+		d.Variables.Maps[m.Name] = m.Map
+		d.changed(changeMap, m.Name)
+	case OpDeleteMap:
+		delete(d.Variables.Maps, m.Name)
+		d.changed(changeMap, m.Name)
+	case OpListEdits:
+		d.Metadata.ListEdits[m.Keyword] = m.Edits
+		d.changed(changeListEdits, string(m.Keyword))
+	case OpLinkEdits:
+		d.Metadata.LinkEdits[m.LinkID] = m.Edits
+		d.changed(changeLinkEdits, strconv.Itoa(m.LinkID))
+	case OpPutToken:
+		if m.Token == nil {
+			return fmt.Errorf("%s for '%s' has no token", m.Op, m.Name)
+		}
+		if d.APITokens == nil {
+			d.APITokens = make(map[string]*APIToken)
+		}
+		d.APITokens[m.Name] = m.Token
+		d.changed(changeToken, m.Name)
+	case OpDeleteToken:
+		delete(d.APITokens, m.Name)
+		d.changed(changeToken, m.Name)
+	case OpPutLinkLog:
+		if d.LinkLog == nil {
+			d.LinkLog = make(map[Keyword][]string)
+		}
+		d.LinkLog[m.Keyword] = m.Usages
+		d.changed(changeLinkLog, string(m.Keyword))
+	case OpDeleteLinkLog:
+		delete(d.LinkLog, m.Keyword)
+		d.changed(changeLinkLog, string(m.Keyword))
+	default:
+		return fmt.Errorf("unknown journal operation '%s'", m.Op)
+	}
+	return nil
+}
+
+// relink points every list's links back at the link objects in d.Links. Lists decoded
+// from JSON carry their own copies of each link, which would otherwise go stale.
+func (d *LinkDatabase) relink() {
+	for _, ll := range d.Lists {
+		for id := range ll.Links {
+			if l, exists := d.Links[id]; exists {
+				ll.Links[id] = l
+			}
+		}
+	}
+}
+
+// relinkMutation does what relink does for just the entity a mutation put in place.
+// A list's links that aren't in the database are dropped rather than left as copies.
+func (d *LinkDatabase) relinkMutation(m *Mutation) {
+	switch {
+	case m.Op == OpPutList && m.List != nil:
+		for id := range m.List.Links {
+			if l, exists := d.Links[id]; exists {
+				m.List.Links[id] = l
+			} else if m.List.Links[id] == nil {
+				delete(m.List.Links, id)
+			}
+		}
+	case m.Op == OpPutLink && m.Link != nil:
+		for _, ll := range d.Lists {
+			if _, exists := ll.Links[m.LinkID]; exists {
+				ll.Links[m.LinkID] = m.Link
+			}
+		}
+	}
+}
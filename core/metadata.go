@@ -1,8 +1,6 @@
 package core
 
 import (
-	"encoding/json"
-	"os"
 	"time"
 )
 
@@ -12,7 +10,9 @@ List and link metadata
 We maintain a data structure with two halves, one for lists and the other for links.
 The more interesting edits are coupling/decoupling, tag modifications, and new/destroyed things.
 
-The data is nice to have if you want to persist it along with a corresponding link database.
+The metadata lives in the LinkDatabase, so it is checkpointed, journaled, replicated and
+exported along with the lists and links it describes. Older redirectors kept it in a
+separate go2metadata.json, which schema migration 4 moves into the database.
 For lists, the keyword is used to locate edit records.
 For links, the id is used to locate edit records.
 */
@@ -42,40 +42,30 @@ func MakeNewMetadata() *Metadata {
 	return m
 }
 
-/*
-Import reads the given file off the disk, then unmarshalls the JSON
-into a Metadata struct and returns it along with err.
-
-The copied mutex lock value here is not an issue because this is done
-once on startup.
-*/
-func (m *Metadata) Import(f string) (*Metadata, error) {
-	var tempdata *Metadata
-	var err error
-	data, err := os.ReadFile(f)
-	if err != nil {
-		LogError.Printf("No edit metadata file '%s' was found\n", f)
-		return tempdata, err
+// initMetadata fills in the metadata and usage log for databases saved without them.
+func (d *LinkDatabase) initMetadata() {
+	if d.Metadata == nil {
+		d.Metadata = MakeNewMetadata()
 	}
-
-	err = json.Unmarshal(data, &tempdata)
-	if err != nil {
-		LogError.Printf("json parsing error: %s", err)
-		return tempdata, err
+	if d.Metadata.ListEdits == nil {
+		d.Metadata.ListEdits = make(map[Keyword][]*EditRecord)
 	}
-	return tempdata, err
-}
-
-func (m *Metadata) Export(f string) error {
-	file, err := json.Marshal(m)
-	if err != nil {
-		LogError.Println("JSON marshal error:", err)
-		return err
+	if d.Metadata.LinkEdits == nil {
+		d.Metadata.LinkEdits = make(map[int][]*EditRecord)
 	}
-	err = os.WriteFile(f, file, 0644)
-	if err != nil {
-		LogError.Fatal(err)
+	if d.LinkLog == nil {
+		d.LinkLog = make(map[Keyword][]string)
 	}
-	LogInfo.Printf("Link metadata exported to %s.\n", f)
-	return err
+}
+
+// AddListEdit records an edit made to the list with keyword k.
+func (d *LinkDatabase) AddListEdit(k Keyword, e *EditRecord) {
+	d.Metadata.ListEdits[k] = PrependEdit(d.Metadata.ListEdits[k], e)
+	d.RecordListEdits(k)
+}
+
+// AddLinkEdit records an edit made to the link with the given ID.
+func (d *LinkDatabase) AddLinkEdit(id int, e *EditRecord) {
+	d.Metadata.LinkEdits[id] = PrependEdit(d.Metadata.LinkEdits[id], e)
+	d.RecordLinkEdits(id)
 }
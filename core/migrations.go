@@ -0,0 +1,246 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+)
+
+/*
+Schema migrations
+
+The serialized LinkDatabase carries a SchemaVersion. Whenever the layout of godb.json
+changes, a Migration is added to the end of Migrations with the next version number.
+Each one upgrades a document from the version before it. Documents written before
+versioning existed are version 0.
+
+Migrations work on the decoded JSON document and not on a LinkDatabase, because the
+reason for a migration is usually that the old data won't unmarshal into the new types.
+*/
+
+// Migration upgrades a database document to Version from the version before it.
+// Migrate returns a line for each change it made (or would make, in a dry run).
+type Migration struct {
+	Version     int
+	Description string
+	Migrate     func(doc map[string]interface{}) ([]string, error)
+}
+
+// Migrations must stay ordered by version. Never change one that has been released,
+// add a new one instead.
+var Migrations = []Migration{
+	{1, "tag bindings are lists of tags, not single strings", migrateTagBindingLists},
+	{2, "variables and their link uses are always initialized", migrateVariables},
+	{3, "link variables are always initialized", migrateLinkVariables},
+	{4, "edit metadata and usage logs are kept in the database", migrateMetadata},
+}
+
+// CurrentSchemaVersion is the version of the newest migration, the version every
+// database is written with.
+func CurrentSchemaVersion() int {
+	return Migrations[len(Migrations)-1].Version
+}
+
+/*
+MigrateDocument runs every migration newer than the document's SchemaVersion over a
+JSON database document. It returns the upgraded document and a report of what changed.
+If nothing needed to change, the original data is returned untouched.
+*/
+func MigrateDocument(data []byte) ([]byte, []string, error) {
+	var report []string
+	var doc map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber() // link IDs and click counts must come back out exactly as they went in
+	if err := dec.Decode(&doc); err != nil {
+		return data, report, err
+	}
+
+	version := 0
+	if v, ok := doc["SchemaVersion"].(json.Number); ok {
+		n, err := v.Int64()
+		if err != nil {
+			return data, report, fmt.Errorf("SchemaVersion is not an integer: %s", v)
+		}
+		version = int(n)
+	}
+	if version > CurrentSchemaVersion() {
+		return data, report, fmt.Errorf("database schema version %d is newer than this redirector supports (%d)", version, CurrentSchemaVersion())
+	}
+	if version == CurrentSchemaVersion() {
+		return data, report, nil
+	}
+
+	for _, m := range Migrations {
+		if m.Version <= version {
+			continue
+		}
+		changes, err := m.Migrate(doc)
+		if err != nil {
+			return data, report, fmt.Errorf("schema version %d: %s", m.Version, err)
+		}
+		report = append(report, fmt.Sprintf("schema version %d: %s (%d changes)", m.Version, m.Description, len(changes)))
+		for _, c := range changes {
+			report = append(report, fmt.Sprintf("  %s", c))
+		}
+		doc["SchemaVersion"] = m.Version
+	}
+
+	migrated, err := json.Marshal(doc)
+	if err != nil {
+		return data, report, err
+	}
+	return migrated, report, err
+}
+
+// migrateOnLoad runs MigrateDocument for anything loading a database, logging what changed.
+func migrateOnLoad(data []byte) ([]byte, error) {
+	migrated, report, err := MigrateDocument(data)
+	if err != nil {
+		LogError.Printf("database migration failed: %s\n", err)
+		return data, err
+	}
+	for _, line := range report {
+		LogInfo.Printf("migration: %s\n", line)
+	}
+	return migrated, err
+}
+
+// MigrateFile upgrades a JSON database file in place and returns the report of what
+// changed. The file is only rewritten if something changed and dryRun is false. The
+// version being replaced is kept as a numbered backup.
+func MigrateFile(path string, dryRun bool) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	migrated, report, err := MigrateDocument(data)
+	if err != nil || len(report) == 0 || dryRun {
+		return report, err
+	}
+	backups := CheckpointBackups
+	if backups < 1 {
+		backups = 1
+	}
+	return report, WriteFileAtomic(path, migrated, backups)
+}
+
+/*
+	The migrations themselves. These take whatever shape the document had at the
+	previous version, so they can't assume anything the earlier migrations didn't.
+*/
+
+// sortedKeys gives a stable order to map iteration so reports are repeatable.
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Version 1: TagBindings used to map a link ID to a single tag string.
+// This is what tools/convert.py used to do by hand.
+func migrateTagBindingLists(doc map[string]interface{}) ([]string, error) {
+	var changes []string
+	lists, _ := doc["Lists"].(map[string]interface{})
+	for _, kwd := range sortedKeys(lists) {
+		ll, _ := lists[kwd].(map[string]interface{})
+		bindings, _ := ll["TagBindings"].(map[string]interface{})
+		for _, id := range sortedKeys(bindings) {
+			if tag, isString := bindings[id].(string); isString {
+				bindings[id] = []interface{}{tag}
+				changes = append(changes, fmt.Sprintf("list '%s' link %s: tag '%s' converted to a list", kwd, id, tag))
+			}
+		}
+	}
+	return changes, nil
+}
+
+// Version 2: databases from before variables existed have none, and databases from
+// before variable uses were tracked have a null Uses.
+func migrateVariables(doc map[string]interface{}) ([]string, error) {
+	var changes []string
+	vars, ok := doc["Variables"].(map[string]interface{})
+	if !ok {
+		vars = make(map[string]interface{})
+		doc["Variables"] = vars
+		changes = append(changes, "variables initialized")
+	}
+	if vars["uses"] == nil {
+		vars["uses"] = make(map[string]interface{})
+		changes = append(changes, "variable uses initialized")
+	}
+	return changes, nil
+}
+
+// Version 3: older links, link zero included, were saved with null LinkVariables.
+func migrateLinkVariables(doc map[string]interface{}) ([]string, error) {
+	var changes []string
+	links, _ := doc["Links"].(map[string]interface{})
+	for _, id := range sortedKeys(links) {
+		l, _ := links[id].(map[string]interface{})
+		if l != nil && l["LinkVariables"] == nil {
+			l["LinkVariables"] = make(map[string]interface{})
+			changes = append(changes, fmt.Sprintf("link %s: link variables initialized", id))
+		}
+	}
+	lists, _ := doc["Lists"].(map[string]interface{})
+	for _, kwd := range sortedKeys(lists) {
+		ll, _ := lists[kwd].(map[string]interface{})
+		members, _ := ll["Links"].(map[string]interface{})
+		for _, id := range sortedKeys(members) {
+			l, _ := members[id].(map[string]interface{})
+			if l != nil && l["LinkVariables"] == nil {
+				l["LinkVariables"] = make(map[string]interface{})
+			}
+		}
+	}
+	return changes, nil
+}
+
+/*
+Version 4: edit metadata used to be kept in a separate file, go2metadata.json (see
+MetadataFileName). It's moved into the document, or started empty if there's no such file.
+Databases saved without a usage log get an empty one.
+*/
+func migrateMetadata(doc map[string]interface{}) ([]string, error) {
+	var changes []string
+	if doc["Metadata"] == nil {
+		data, err := os.ReadFile(MetadataFileName)
+		switch {
+		case errors.Is(err, os.ErrNotExist) || (err == nil && len(data) == 0):
+			doc["Metadata"] = map[string]interface{}{}
+			changes = append(changes, "edit metadata initialized")
+		case err != nil:
+			return changes, err
+		default:
+			var metadata map[string]interface{}
+			dec := json.NewDecoder(bytes.NewReader(data))
+			dec.UseNumber()
+			if err := dec.Decode(&metadata); err != nil {
+				return changes, fmt.Errorf("%s: %s", MetadataFileName, err)
+			}
+			doc["Metadata"] = metadata
+			lists, _ := metadata["ListEdits"].(map[string]interface{})
+			links, _ := metadata["LinkEdits"].(map[string]interface{})
+			changes = append(changes, fmt.Sprintf("edit history of %d lists and %d links moved in from %s", len(lists), len(links), MetadataFileName))
+		}
+	}
+	// a bolt database's document is built with typed maps, so only missing ones are replaced
+	if metadata, ok := doc["Metadata"].(map[string]interface{}); ok {
+		for _, key := range []string{"ListEdits", "LinkEdits"} {
+			if metadata[key] == nil {
+				metadata[key] = map[string]interface{}{}
+			}
+		}
+	}
+	if doc["LinkLog"] == nil {
+		doc["LinkLog"] = map[string]interface{}{}
+		changes = append(changes, "usage log initialized")
+	}
+	return changes, nil
+}
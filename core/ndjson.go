@@ -0,0 +1,280 @@
+package core
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+/*
+NDJSON export and import
+
+This is the link database as newline-delimited JSON, one record per line: a header,
+then every link, list, variable, edit history, usage log, and API token. Unlike godb.json it can be
+written and read a record at a time, so nothing ever holds the whole encoded database.
+
+Exporting the live database only holds SYNC long enough to Clone it. The records are
+written from the copy with SYNC released, so edits carry on during a large export.
+Importing parses everything before SYNC is taken, and only holds it to swap databases.
+
+Lists are written with only the IDs of their links, since each link has its own record.
+*/
+
+// Record types, in the order they're written.
+const (
+	RecordHeader    = "header"
+	RecordLink      = "link"
+	RecordList      = "list"
+	RecordString    = "string"
+	RecordMap       = "map"
+	RecordListEdits = "listedits"
+	RecordLinkEdits = "linkedits"
+	RecordLinkLog   = "linklog"
+	RecordToken     = "token"
+)
+
+// oldestNDJSONSchemaVersion is the oldest schema version with the records written now.
+// Migrations since then haven't changed them, so exports from any of those versions import.
+const oldestNDJSONSchemaVersion = 3
+
+// ExportRecord is one line of an NDJSON export.
+type ExportRecord struct {
+	Type          string            `json:"type"`
+	SchemaVersion int               `json:"schema_version,omitempty"`
+	NextLinkID    int               `json:"next_link_id,omitempty"`
+	Generation    uint64            `json:"generation,omitempty"`
+	Keyword       Keyword           `json:"keyword,omitempty"`
+	LinkID        int               `json:"link_id,omitempty"`
+	Name          string            `json:"name,omitempty"`
+	Link          *Link             `json:"link,omitempty"`
+	List          *ListOfLinks      `json:"list,omitempty"`
+	Value         string            `json:"value,omitempty"`
+	Map           map[string]string `json:"map,omitempty"`
+	Edits         []*EditRecord     `json:"edits,omitempty"`
+	Usages        []string          `json:"usages,omitempty"`
+	Token         *APIToken         `json:"token,omitempty"`
+}
+
+// ExportNDJSON streams the database to w as NDJSON. The database is cloned while SYNC is
+// held and written out after it has been released.
+func (d *LinkDatabase) ExportNDJSON(w io.Writer, s *sync.RWMutex) error {
+	s.RLock()
+	c := d.Clone()
+	s.RUnlock()
+	return c.WriteNDJSON(w)
+}
+
+// WriteNDJSON writes the database to w as NDJSON, in a stable order. Nothing else may be
+// changing d while it runs, so this is for databases no one else has, like a Clone.
+func (d *LinkDatabase) WriteNDJSON(w io.Writer) error {
+	buf := bufio.NewWriter(w)
+	enc := json.NewEncoder(buf) // Encode ends every record with a newline
+	emit := func(r *ExportRecord) error {
+		return enc.Encode(r)
+	}
+
+	err := emit(&ExportRecord{Type: RecordHeader, SchemaVersion: CurrentSchemaVersion(), NextLinkID: d.NextLinkID, Generation: d.Generation})
+	ids := make([]int, 0, len(d.Links))
+	for id := range d.Links {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		if err == nil {
+			err = emit(&ExportRecord{Type: RecordLink, LinkID: id, Link: d.Links[id]})
+		}
+	}
+	keys := make([]Keyword, 0, len(d.Lists))
+	for k := range d.Lists {
+		keys = append(keys, k)
+	}
+	for _, k := range sortKeywords(keys) {
+		if err == nil {
+			ll := *d.Lists[k]
+			ll.Links = make(map[int]*Link, len(d.Lists[k].Links))
+			for id := range d.Lists[k].Links {
+				ll.Links[id] = &Link{ID: id}
+			}
+			err = emit(&ExportRecord{Type: RecordList, Keyword: k, List: &ll})
+		}
+	}
+	if d.Variables != nil {
+		for _, name := range sortedNames(d.Variables.Strings) {
+			if err == nil {
+				err = emit(&ExportRecord{Type: RecordString, Name: name, Value: d.Variables.Strings[name]})
+			}
+		}
+		names := make([]string, 0, len(d.Variables.Maps))
+		for name := range d.Variables.Maps {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if err == nil {
+				err = emit(&ExportRecord{Type: RecordMap, Name: name, Map: d.Variables.Maps[name]})
+			}
+		}
+	}
+	if d.Metadata != nil {
+		keys = keys[:0]
+		for k := range d.Metadata.ListEdits {
+			keys = append(keys, k)
+		}
+		for _, k := range sortKeywords(keys) {
+			if err == nil {
+				err = emit(&ExportRecord{Type: RecordListEdits, Keyword: k, Edits: d.Metadata.ListEdits[k]})
+			}
+		}
+		ids = ids[:0]
+		for id := range d.Metadata.LinkEdits {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+		for _, id := range ids {
+			if err == nil {
+				err = emit(&ExportRecord{Type: RecordLinkEdits, LinkID: id, Edits: d.Metadata.LinkEdits[id]})
+			}
+		}
+	}
+	keys = keys[:0]
+	for k := range d.LinkLog {
+		keys = append(keys, k)
+	}
+	for _, k := range sortKeywords(keys) {
+		if err == nil {
+			err = emit(&ExportRecord{Type: RecordLinkLog, Keyword: k, Usages: d.LinkLog[k]})
+		}
+	}
+	for _, t := range d.Tokens() {
+		if err == nil {
+			err = emit(&ExportRecord{Type: RecordToken, Name: t.Name, Token: t})
+		}
+	}
+	if err != nil {
+		LogError.Printf("NDJSON export failed: %s\n", err)
+		return err
+	}
+	return buf.Flush()
+}
+
+// sortKeywords puts keywords in a stable order.
+func sortKeywords(keys []Keyword) []Keyword {
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+func sortedNames(m map[string]string) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/*
+ReadNDJSON builds a database out of an NDJSON export, one record at a time. The header
+must come first. Exports written at an older schema version are refused rather than
+guessed at, since the schema migrations work on whole godb.json documents.
+*/
+func ReadNDJSON(r io.Reader) (*LinkDatabase, error) {
+	d := MakeNewLinkDatabase()
+	reader := bufio.NewReader(r)
+	var line int
+	for {
+		data, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) && len(data) == 0 {
+			break
+		} else if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		line++
+		var rec ExportRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return nil, fmt.Errorf("NDJSON line %d: %s", line, err)
+		}
+		if line == 1 {
+			if rec.Type != RecordHeader {
+				return nil, errors.New("NDJSON export doesn't start with a header record")
+			}
+			if rec.SchemaVersion < oldestNDJSONSchemaVersion || rec.SchemaVersion > CurrentSchemaVersion() {
+				return nil, fmt.Errorf("NDJSON export has schema version %d and this redirector reads %d to %d, export it again as JSON", rec.SchemaVersion, oldestNDJSONSchemaVersion, CurrentSchemaVersion())
+			}
+			d.NextLinkID = rec.NextLinkID
+			d.Generation = rec.Generation
+			continue
+		}
+		if err := d.applyRecord(&rec); err != nil {
+			return nil, fmt.Errorf("NDJSON line %d: %s", line, err)
+		}
+	}
+	if line == 0 {
+		return nil, errors.New("NDJSON export is empty")
+	}
+	d.relink()
+	return d, nil
+}
+
+func (d *LinkDatabase) applyRecord(rec *ExportRecord) error {
+	switch rec.Type {
+	case RecordLink:
+		if rec.Link == nil {
+			return errors.New("link record has no link")
+		}
+		d.Links[rec.LinkID] = rec.Link
+	case RecordList:
+		if rec.List == nil {
+			return errors.New("list record has no list")
+		}
+		d.Lists[rec.Keyword] = rec.List
+	case RecordString:
+		if d.Variables.Strings == nil {
+			d.Variables.Strings = make(map[string]string)
+		}
+		d.Variables.Strings[rec.Name] = rec.Value
+	case RecordMap:
+		if rec.Map == nil {
+			rec.Map = make(map[string]string)
+		}
+		if d.Variables.Maps == nil {
+			d.Variables.Maps = make(map[string]map[string]string)
+		}
+		d.Variables.Maps[rec.Name] = rec.Map
+	case RecordListEdits:
+		d.Metadata.ListEdits[rec.Keyword] = rec.Edits
+	case RecordLinkEdits:
+		d.Metadata.LinkEdits[rec.LinkID] = rec.Edits
+	case RecordLinkLog:
+		d.LinkLog[rec.Keyword] = rec.Usages
+	case RecordToken:
+		if rec.Token == nil {
+			return errors.New("token record has no token")
+		}
+		if d.APITokens == nil {
+			d.APITokens = make(map[string]*APIToken)
+		}
+		d.APITokens[rec.Name] = rec.Token
+	default:
+		return fmt.Errorf("unknown record type '%s'", rec.Type)
+	}
+	return nil
+}
+
+// ImportNDJSON reads an NDJSON export and makes it the live LinkDataBase. SYNC is only
+// taken once the whole export has been read.
+func (d *LinkDatabase) ImportNDJSON(r io.Reader, s *sync.RWMutex) error {
+	imported, err := ReadNDJSON(r)
+	if err != nil {
+		LogError.Printf("NDJSON import failed: %s\n", err)
+		return err
+	}
+	s.Lock()
+	imported.supersede(LinkDataBase)
+	LinkDataBase = imported
+	s.Unlock()
+	return err
+}
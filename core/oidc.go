@@ -0,0 +1,623 @@
+package core
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	_ "crypto/sha512" // SHA-384 and SHA-512, for RS384, ES512 and the like
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+OpenID Connect
+
+With "auth_mode": "oidc", users log in with the organization's identity provider instead
+of typing in a name. /_login_ sends them to the issuer's authorization endpoint for the
+authorization code flow with PKCE, and the issuer sends them back to /_login_ with a code.
+The redirector trades the code for an ID token at the issuer's token endpoint, checks the
+token's signature against the keys the issuer publishes (its JWKS), and checks it was
+issued by the issuer, to us, for this login, and hasn't expired. The user's name and
+groups come from the claims named by oidc_user_claim and oidc_groups_claim.
+
+The endpoints are discovered from the issuer's /.well-known/openid-configuration the first
+time someone logs in, so the redirector starts even when the issuer is down.
+
+Who a user is lives in a cookie signed with auth_session_key, good for sessionLifetime.
+Redirectors sharing a key accept each other's sessions, so the members of a failover pair
+or cluster should share one. Without one, a key is made up at startup and everyone has to
+log in again after a restart. A login under way keeps its state, verifier and nonce in a
+signed cookie of its own, so it can finish on whichever redirector the issuer sends it to.
+*/
+
+// AuthOIDC is the authentication mode that logs users in with an OpenID Connect issuer.
+const AuthOIDC = "oidc"
+
+// Claims read from ID tokens by default.
+const (
+	DefaultOIDCUserClaim   = "email"
+	DefaultOIDCGroupsClaim = "groups"
+)
+
+// DefaultOIDCScopes are asked for when oidc_scopes isn't set.
+var DefaultOIDCScopes = []string{"openid", "profile", "email"}
+
+const (
+	sessionCookie = "redirectorsession"
+	loginCookie   = "redirectoroidc"
+)
+
+var sessionLifetime = 24 * time.Hour
+var loginTimeout = 10 * time.Minute // to come back from the issuer
+var clockSkew = time.Minute         // allowed between us and the issuer
+var jwksRefresh = time.Minute       // the least time between fetches of the issuer's keys
+
+// Identity is who a session belongs to.
+type Identity struct {
+	User   string   `json:"user"`
+	Groups []string `json:"groups,omitempty"`
+}
+
+// OIDCAuth logs users in with an OpenID Connect issuer, and knows them by a signed session cookie.
+type OIDCAuth struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string // if the issuer wants one as well as PKCE
+	RedirectURL  string // our /_login_, as the issuer is told to send users back to it
+	Scopes       []string
+	UserClaim    string
+	GroupsClaim  string
+	Client       *http.Client
+
+	key []byte // signs cookies
+
+	mu        sync.Mutex
+	endpoints *oidcEndpoints
+	keys      map[string]crypto.PublicKey // by key ID
+	fetched   time.Time                   // when keys was
+}
+
+// oidcEndpoints is the part of the issuer's discovery document we use.
+type oidcEndpoints struct {
+	Issuer        string `json:"issuer"`
+	Authorization string `json:"authorization_endpoint"`
+	Token         string `json:"token_endpoint"`
+	JWKS          string `json:"jwks_uri"`
+}
+
+// oidcLogin is what a login under way needs to finish, kept in loginCookie.
+type oidcLogin struct {
+	State    string `json:"state"`
+	Verifier string `json:"verifier"`
+	Nonce    string `json:"nonce"`
+	Next     string `json:"next"`
+}
+
+// sealed is a signed cookie's value, before it's signed.
+type sealed struct {
+	Data    json.RawMessage `json:"d"`
+	Expires int64           `json:"exp"`
+}
+
+func (a *OIDCAuth) User(r *http.Request) string {
+	if id := a.session(r); id != nil {
+		return id.User
+	}
+	return ""
+}
+
+// Groups returns the groups the issuer says the user making r is in.
+func (a *OIDCAuth) Groups(r *http.Request) []string {
+	if id := a.session(r); id != nil {
+		return id.Groups
+	}
+	return nil
+}
+
+func (a *OIDCAuth) LoginForm() bool {
+	return true
+}
+
+// session returns who r's session cookie says they are, or nil.
+func (a *OIDCAuth) session(r *http.Request) *Identity {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil
+	}
+	var id Identity
+	if err := a.open(sessionCookie, c.Value, &id); err != nil {
+		LogDebug.Printf("ignoring session cookie from %s: %s\n", r.RemoteAddr, err)
+		return nil
+	}
+	return &id
+}
+
+/*
+StartLogin sets up a login that comes back to next, a URL on this redirector, and returns
+the URL of the issuer's authorization endpoint to send the user to.
+*/
+func (a *OIDCAuth) StartLogin(w http.ResponseWriter, next string) (string, error) {
+	endpoints, err := a.discover()
+	if err != nil {
+		return "", err
+	}
+	login := oidcLogin{State: randomToken(), Verifier: randomToken(), Nonce: randomToken(), Next: localPath(next)}
+	if err = a.setCookie(w, loginCookie, login, loginTimeout); err != nil {
+		return "", err
+	}
+	challenge := sha256.Sum256([]byte(login.Verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {a.ClientID},
+		"redirect_uri":          {a.RedirectURL},
+		"scope":                 {strings.Join(a.Scopes, " ")},
+		"state":                 {login.State},
+		"nonce":                 {login.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	u, err := url.Parse(endpoints.Authorization)
+	if err != nil {
+		return "", fmt.Errorf("bad authorization endpoint: %s", err)
+	}
+	if u.RawQuery != "" {
+		u.RawQuery += "&"
+	}
+	u.RawQuery += query.Encode()
+	return u.String(), nil
+}
+
+/*
+FinishLogin takes the issuer's answer to a login, r, and starts a session for the user
+it names. It returns who they are and where on this redirector to send them.
+*/
+func (a *OIDCAuth) FinishLogin(w http.ResponseWriter, r *http.Request) (*Identity, string, error) {
+	var login oidcLogin
+	c, err := r.Cookie(loginCookie)
+	if err != nil {
+		return nil, "", errors.New("no login was under way, or it took too long")
+	}
+	http.SetCookie(w, a.cookie(loginCookie, "", time.Unix(0, 0)))
+	if err = a.open(loginCookie, c.Value, &login); err != nil {
+		return nil, "", err
+	}
+	query := r.URL.Query()
+	if !hmac.Equal([]byte(query.Get("state")), []byte(login.State)) {
+		return nil, "", errors.New("the login's state doesn't match")
+	}
+	if e := query.Get("error"); e != "" {
+		return nil, "", fmt.Errorf("the issuer refused: %s %s", e, query.Get("error_description"))
+	}
+	raw, err := a.exchange(query.Get("code"), login.Verifier)
+	if err != nil {
+		return nil, "", err
+	}
+	claims, err := a.verify(raw, login.Nonce)
+	if err != nil {
+		return nil, "", err
+	}
+	id, err := a.identity(claims)
+	if err != nil {
+		return nil, "", err
+	}
+	if err = a.setCookie(w, sessionCookie, id, sessionLifetime); err != nil {
+		return nil, "", err
+	}
+	return id, login.Next, nil
+}
+
+// Logout ends the user's session.
+func (a *OIDCAuth) Logout(w http.ResponseWriter) {
+	http.SetCookie(w, a.cookie(sessionCookie, "", time.Unix(0, 0)))
+}
+
+// discover fetches the issuer's endpoints, once it manages to.
+func (a *OIDCAuth) discover() (*oidcEndpoints, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.endpoints != nil {
+		return a.endpoints, nil
+	}
+	var endpoints oidcEndpoints
+	if err := a.getJSON(strings.TrimSuffix(a.Issuer, "/")+"/.well-known/openid-configuration", &endpoints); err != nil {
+		return nil, fmt.Errorf("could not discover the issuer: %s", err)
+	}
+	if endpoints.Issuer != a.Issuer {
+		return nil, fmt.Errorf("the issuer calls itself '%s', not '%s'", endpoints.Issuer, a.Issuer)
+	}
+	if endpoints.Authorization == "" || endpoints.Token == "" || endpoints.JWKS == "" {
+		return nil, errors.New("the issuer's discovery document is missing endpoints")
+	}
+	a.endpoints = &endpoints
+	LogInfo.Printf("Discovered OpenID Connect issuer %s\n", a.Issuer)
+	return a.endpoints, nil
+}
+
+// getJSON decodes the JSON at u into v.
+func (a *OIDCAuth) getJSON(u string, v interface{}) error {
+	resp, err := a.Client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s", u, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// exchange trades an authorization code for an ID token at the token endpoint.
+func (a *OIDCAuth) exchange(code, verifier string) (string, error) {
+	endpoints, err := a.discover()
+	if err != nil {
+		return "", err
+	}
+	if code == "" {
+		return "", errors.New("the issuer sent no code")
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {a.RedirectURL},
+		"client_id":     {a.ClientID},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequest("POST", endpoints.Token, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if a.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(a.ClientID), url.QueryEscape(a.ClientSecret))
+	}
+	resp, err := a.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var answer struct {
+		IDToken     string `json:"id_token"`
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+	if err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&answer); err != nil {
+		return "", fmt.Errorf("the token endpoint answered %s", resp.Status)
+	}
+	if answer.Error != "" {
+		return "", fmt.Errorf("the token endpoint refused: %s %s", answer.Error, answer.Description)
+	}
+	if answer.IDToken == "" {
+		return "", errors.New("the token endpoint sent no ID token")
+	}
+	return answer.IDToken, nil
+}
+
+// verify checks an ID token came from the issuer for this login, and returns its claims.
+func (a *OIDCAuth) verify(raw, nonce string) (map[string]interface{}, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("the ID token isn't a JWT")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("bad ID token header: %s", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("bad ID token signature: %s", err)
+	}
+	key, err := a.publicKey(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err = verifySignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err = decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("bad ID token claims: %s", err)
+	}
+	now := time.Now()
+	if iss, _ := claims["iss"].(string); iss != a.Issuer {
+		return nil, fmt.Errorf("the ID token was issued by '%s'", iss)
+	}
+	if !hasAudience(claims["aud"], a.ClientID) {
+		return nil, fmt.Errorf("the ID token isn't for client '%s'", a.ClientID)
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(clockSkew)) {
+		return nil, errors.New("the ID token has expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(clockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("the ID token isn't valid yet")
+	}
+	if n, _ := claims["nonce"].(string); !hmac.Equal([]byte(n), []byte(nonce)) {
+		return nil, errors.New("the ID token is for another login")
+	}
+	return claims, nil
+}
+
+// identity reads who the user is from an ID token's claims.
+func (a *OIDCAuth) identity(claims map[string]interface{}) (*Identity, error) {
+	user, _ := claims[a.UserClaim].(string)
+	if user == "" {
+		return nil, fmt.Errorf("the ID token has no '%s' claim", a.UserClaim)
+	}
+	id := &Identity{User: user}
+	switch groups := claims[a.GroupsClaim].(type) {
+	case string:
+		id.Groups = []string{groups}
+	case []interface{}:
+		for _, g := range groups {
+			if s, ok := g.(string); ok {
+				id.Groups = append(id.Groups, s)
+			}
+		}
+	}
+	return id, nil
+}
+
+// hasAudience reports whether the aud claim, a string or a list of them, includes client.
+func hasAudience(aud interface{}, client string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == client
+	case []interface{}:
+		for _, a := range aud {
+			if a == client {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// publicKey returns the issuer's key with the given ID, fetching its keys again if it's new.
+func (a *OIDCAuth) publicKey(kid string) (crypto.PublicKey, error) {
+	endpoints, err := a.discover()
+	if err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	find := func() crypto.PublicKey {
+		if kid == "" && len(a.keys) == 1 {
+			for _, key := range a.keys {
+				return key
+			}
+		}
+		return a.keys[kid]
+	}
+	if key := find(); key != nil {
+		return key, nil
+	}
+	if time.Since(a.fetched) < jwksRefresh {
+		return nil, fmt.Errorf("the issuer has no key '%s'", kid)
+	}
+	var set struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err = a.getJSON(endpoints.JWKS, &set); err != nil {
+		return nil, fmt.Errorf("could not fetch the issuer's keys: %s", err)
+	}
+	a.keys, a.fetched = make(map[string]crypto.PublicKey), time.Now()
+	for _, raw := range set.Keys {
+		id, key, err := parseJWK(raw)
+		if err != nil {
+			LogDebug.Printf("skipping one of the issuer's keys: %s\n", err)
+			continue
+		}
+		a.keys[id] = key
+	}
+	if key := find(); key != nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("the issuer has no key '%s'", kid)
+}
+
+// parseJWK reads a signing key from a JSON Web Key.
+func parseJWK(raw []byte) (string, crypto.PublicKey, error) {
+	var jwk struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Use string `json:"use"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+		Crv string `json:"crv"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	}
+	if err := json.Unmarshal(raw, &jwk); err != nil {
+		return "", nil, err
+	}
+	if jwk.Use != "" && jwk.Use != "sig" {
+		return "", nil, fmt.Errorf("key '%s' isn't for signing", jwk.Kid)
+	}
+	number := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil, fmt.Errorf("key '%s' is malformed", jwk.Kid)
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+	switch jwk.Kty {
+	case "RSA":
+		n, err := number(jwk.N)
+		if err != nil {
+			return "", nil, err
+		}
+		e, err := number(jwk.E)
+		if err != nil || !e.IsInt64() {
+			return "", nil, fmt.Errorf("key '%s' is malformed", jwk.Kid)
+		}
+		return jwk.Kid, &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[jwk.Crv]
+		if !ok {
+			return "", nil, fmt.Errorf("key '%s' is on unknown curve '%s'", jwk.Kid, jwk.Crv)
+		}
+		x, err := number(jwk.X)
+		if err != nil {
+			return "", nil, err
+		}
+		y, err := number(jwk.Y)
+		if err != nil {
+			return "", nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return "", nil, fmt.Errorf("key '%s' isn't on its curve", jwk.Kid)
+		}
+		return jwk.Kid, &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return "", nil, fmt.Errorf("key '%s' is of unknown type '%s'", jwk.Kid, jwk.Kty)
+}
+
+// verifySignature checks a JWT's signature, made with alg, over signed.
+func verifySignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	hashes := map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}
+	unsupported := fmt.Errorf("the ID token is signed with unsupported algorithm '%s'", alg)
+	if len(alg) != 5 {
+		return unsupported
+	}
+	hash, ok := hashes[alg[2:]]
+	if !ok {
+		return unsupported
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+	bad := errors.New("the ID token's signature doesn't match the issuer's key")
+	switch alg[:2] {
+	case "RS":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok || rsa.VerifyPKCS1v15(pub, hash, digest, signature) != nil {
+			return bad
+		}
+	case "ES":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return bad
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return bad
+		}
+		r, s := new(big.Int).SetBytes(signature[:size]), new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return bad
+		}
+	default:
+		return unsupported
+	}
+	return nil
+}
+
+// decodeSegment decodes one base64url part of a JWT into v.
+func decodeSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// randomToken makes a random string for states, nonces and PKCE verifiers.
+func randomToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// localPath keeps only the path and query of a URL, so a login can't be sent somewhere else.
+func localPath(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || !strings.HasPrefix(u.Path, "/") || strings.HasPrefix(u.Path, "//") {
+		return "/"
+	}
+	next := &url.URL{Path: u.Path, RawQuery: u.RawQuery}
+	return next.String()
+}
+
+// setCookie signs v into the cookie called name, good for ttl.
+func (a *OIDCAuth) setCookie(w http.ResponseWriter, name string, v interface{}, ttl time.Duration) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	expires := time.Now().Add(ttl)
+	payload, _ := json.Marshal(sealed{Data: data, Expires: expires.Unix()})
+	value := base64.RawURLEncoding.EncodeToString(payload)
+	http.SetCookie(w, a.cookie(name, value+"."+a.sign(name, value), expires))
+	return nil
+}
+
+// open checks the signature on the value of the cookie called name, and decodes it into v.
+func (a *OIDCAuth) open(name, value string, v interface{}) error {
+	payload, signature, ok := strings.Cut(value, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(a.sign(name, payload))) {
+		return errors.New("the cookie's signature doesn't match")
+	}
+	var s sealed
+	if err := decodeSegment(payload, &s); err != nil {
+		return err
+	}
+	if time.Now().After(time.Unix(s.Expires, 0)) {
+		return errors.New("the cookie has expired")
+	}
+	return json.Unmarshal(s.Data, v)
+}
+
+// sign signs the value of the cookie called name, so it can't pass for another one.
+func (a *OIDCAuth) sign(name, value string) string {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(name + "=" + value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// cookie makes one of our cookies, which scripts can't read.
+func (a *OIDCAuth) cookie(name, value string, expires time.Time) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(a.RedirectURL, "https:"),
+		SameSite: http.SameSiteLaxMode, // sent when the issuer sends users back
+	}
+}
+
+// NewOIDCAuth sets up logins with the OpenID Connect issuer, signing cookies with key.
+func NewOIDCAuth(issuer, clientID, redirectURL string, key []byte) *OIDCAuth {
+	return &OIDCAuth{
+		Issuer:      issuer,
+		ClientID:    clientID,
+		RedirectURL: redirectURL,
+		Scopes:      DefaultOIDCScopes,
+		UserClaim:   DefaultOIDCUserClaim,
+		GroupsClaim: DefaultOIDCGroupsClaim,
+		Client:      &http.Client{Timeout: 10 * time.Second},
+		key:         key,
+	}
+}
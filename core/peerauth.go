@@ -0,0 +1,98 @@
+package core
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+/*
+Failover peer authentication
+
+Everything between failover peers goes over mutual TLS: the diceroll and the replication
+stream. Each redirector has a certificate and key, and both peers' certificates are
+signed by the CA in failover_tls_ca. A peer that can't present a certificate from that CA
+is turned away before anything it sends is read, so nothing else on the network can
+replace the links or rig the diceroll.
+
+Peers are dialed by the address in failover_peer, so each certificate needs that address
+(an IP or a DNS name) among its subject alternative names.
+*/
+
+var peerTLS *tls.Config
+
+// errPeerAuth is returned when a TLS connection to the peer couldn't be set up.
+var errPeerAuth = errors.New("failover peer could not be authenticated")
+
+// LoadPeerTLS reads the failover certificate, key, and CA. It has to be called before
+// any connection to the failover peer is made.
+func LoadPeerTLS() error {
+	cert, err := tls.LoadX509KeyPair(FailoverTLSCert, FailoverTLSKey)
+	if err != nil {
+		return fmt.Errorf("failover certificate could not be loaded: %s", err)
+	}
+	pem, err := os.ReadFile(FailoverTLSCA)
+	if err != nil {
+		return fmt.Errorf("failover CA could not be loaded: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("failover CA %s has no PEM certificates in it", FailoverTLSCA)
+	}
+	peerTLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}
+	return nil
+}
+
+// dialPeer connects to the peer at addr and completes the TLS handshake. If the peer is
+// up but the handshake fails, the error wraps errPeerAuth.
+func dialPeer(addr string) (*tls.Conn, error) {
+	if peerTLS == nil {
+		return nil, errors.New("failover TLS hasn't been loaded")
+	}
+	raw, err := net.DialTimeout("tcp4", addr, replicationTimeout)
+	if err != nil {
+		return nil, err
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	cfg := peerTLS.Clone()
+	cfg.ServerName = host
+	conn := tls.Client(raw, cfg)
+	if err := handshake(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// listenPeer opens a listener for peers at addr. Connections it accepts still have to
+// finish their handshake, see handshake.
+func listenPeer(addr string) (net.Listener, error) {
+	if peerTLS == nil {
+		return nil, errors.New("failover TLS hasn't been loaded")
+	}
+	l, err := net.Listen("tcp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(l, peerTLS), nil
+}
+
+// handshake finishes a TLS handshake within replicationTimeout.
+func handshake(conn *tls.Conn) error {
+	conn.SetDeadline(time.Now().Add(replicationTimeout))
+	defer conn.SetDeadline(time.Time{})
+	if err := conn.Handshake(); err != nil {
+		return fmt.Errorf("%w: %s", errPeerAuth, err)
+	}
+	return nil
+}
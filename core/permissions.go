@@ -0,0 +1,303 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+/*
+List permissions
+
+Every list has owners, users and groups, and a protection level saying who may change it:
+
+	open    anyone logged in may add, edit and unlink links and change its behavior
+	owners  only its owners may
+	locked  nobody may, until an owner unlocks it
+
+Owners, and anyone when a list has no owners yet, may change who owns a list and its
+protection. Admins (see tokens.go) may do anything. Whoever creates a list owns it, and
+lists from before owners existed have none and are open, so nothing changes for them
+until somebody claims them.
+
+A link can be in several lists, and changing it changes all of them, so changing a link
+takes being allowed to edit every list it's in. Unlinking it from a list only takes that list.
+
+A list's visibility says who may see it at all:
+
+	public   everyone, the default
+	team     its owners and the members of its owning groups
+	private  only the users who own it
+
+To anyone else a hidden list doesn't exist. It redirects nowhere, has no list page, and is
+left out of search, suggestions, /api/keywords and /_db_, along with its edit history and
+any links that are only in hidden lists. Admins see everything. Nobody may change a list
+they can't see.
+*/
+
+// Protection levels.
+const (
+	ProtectionOpen   = "open"
+	ProtectionOwners = "owners"
+	ProtectionLocked = "locked"
+)
+
+// Protections are the protection levels a list can have.
+var Protections = []string{ProtectionOpen, ProtectionOwners, ProtectionLocked}
+
+// Visibility levels.
+const (
+	VisibilityPublic  = "public"
+	VisibilityTeam    = "team"
+	VisibilityPrivate = "private"
+)
+
+// Visibilities are the visibility levels a list can have.
+var Visibilities = []string{VisibilityPublic, VisibilityTeam, VisibilityPrivate}
+
+// Editor is someone changing the database: a user, or the name of an API token.
+type Editor struct {
+	User   string
+	Groups []string
+	Admin  bool
+}
+
+// EditorOf returns who made r, as the Authenticator tells it.
+func EditorOf(r *http.Request) Editor {
+	return Editor{User: ExtractUser(r), Groups: Auth.Groups(r), Admin: IsAdmin(r)}
+}
+
+// GetProtection returns the list's protection level. Lists without one are open.
+func (ll *ListOfLinks) GetProtection() string {
+	if ll.Protection == "" {
+		return ProtectionOpen
+	}
+	return ll.Protection
+}
+
+// GetVisibility returns who may see the list. Lists without a visibility are public.
+func (ll *ListOfLinks) GetVisibility() string {
+	if ll.Visibility == "" {
+		return VisibilityPublic
+	}
+	return ll.Visibility
+}
+
+// IsOwner reports whether e is one of the list's owners, or in one of its owning groups.
+func (ll *ListOfLinks) IsOwner(e Editor) bool {
+	if e.User == "" {
+		return false
+	}
+	if contains(ll.Owners, e.User) {
+		return true
+	}
+	for _, group := range e.Groups {
+		if contains(ll.OwnerGroups, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// CanSee reports whether e may see the list.
+func (ll *ListOfLinks) CanSee(e Editor) bool {
+	switch ll.GetVisibility() {
+	case VisibilityPublic:
+		return true
+	case VisibilityTeam:
+		return e.Admin || ll.IsOwner(e)
+	}
+	return e.Admin || (e.User != "" && contains(ll.Owners, e.User))
+}
+
+// CanEdit reports whether e may change the list's links and behavior.
+func (ll *ListOfLinks) CanEdit(e Editor) bool {
+	switch {
+	case e.User == "" || !ll.CanSee(e):
+		return false
+	case e.Admin:
+		return true
+	}
+	switch ll.GetProtection() {
+	case ProtectionOpen:
+		return true
+	case ProtectionOwners:
+		return ll.IsOwner(e)
+	}
+	return false
+}
+
+// CanManage reports whether e may change the list's owners, protection and visibility.
+func (ll *ListOfLinks) CanManage(e Editor) bool {
+	switch {
+	case e.User == "" || !ll.CanSee(e):
+		return false
+	case e.Admin:
+		return true
+	case len(ll.Owners) == 0 && len(ll.OwnerGroups) == 0:
+		return true
+	}
+	return ll.IsOwner(e)
+}
+
+// CanEditLink reports whether e may change l, which takes being allowed to edit every list it's in.
+func (d *LinkDatabase) CanEditLink(e Editor, l *Link) bool {
+	if e.User == "" {
+		return false
+	}
+	for _, kw := range l.Lists {
+		if ll, exists := d.Lists[kw]; exists && !ll.CanEdit(e) {
+			return false
+		}
+	}
+	return true
+}
+
+// VisibleLists returns the lists l is in that e may see.
+func (d *LinkDatabase) VisibleLists(e Editor, l *Link) []Keyword {
+	visible := make([]Keyword, 0, len(l.Lists))
+	for _, kw := range l.Lists {
+		if ll, exists := d.Lists[kw]; !exists || ll.CanSee(e) {
+			visible = append(visible, kw)
+		}
+	}
+	return visible
+}
+
+// LinkVisible reports whether e may see l, which they may unless all of its lists are hidden from them.
+func (d *LinkDatabase) LinkVisible(e Editor, l *Link) bool {
+	return len(l.Lists) == 0 || len(d.VisibleLists(e, l)) > 0
+}
+
+/*
+VisibleLink returns l as e may see it: l itself, a copy of it without the lists hidden from
+e, or nil if it's only in hidden lists.
+*/
+func (d *LinkDatabase) VisibleLink(e Editor, l *Link) *Link {
+	visible := d.VisibleLists(e, l)
+	switch {
+	case len(visible) == len(l.Lists):
+		return l
+	case len(visible) == 0:
+		return nil
+	}
+	c := *l
+	c.Lists = visible
+	return &c
+}
+
+// Hides reports whether any list is hidden from e.
+func (d *LinkDatabase) Hides(e Editor) bool {
+	for _, ll := range d.Lists {
+		if !ll.CanSee(e) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Redact removes everything e may not see from the database: hidden lists with their edit
+history and usage logs, links only in hidden lists, and hidden lists from the memberships
+of the other links. It's for copies of the database being sent to e, see Clone.
+*/
+func (d *LinkDatabase) Redact(e Editor) {
+	hidden := make(map[Keyword]bool)
+	for k, ll := range d.Lists {
+		if !ll.CanSee(e) {
+			hidden[k] = true
+		}
+	}
+	for id, l := range d.Links {
+		if len(l.Lists) == 0 {
+			continue
+		}
+		visible := make([]Keyword, 0, len(l.Lists))
+		for _, kw := range l.Lists {
+			if !hidden[kw] {
+				visible = append(visible, kw)
+			}
+		}
+		l.Lists = visible
+		if len(visible) == 0 {
+			delete(d.Links, id)
+			if d.Metadata != nil {
+				delete(d.Metadata.LinkEdits, id)
+			}
+		}
+	}
+	for k := range hidden {
+		delete(d.Lists, k)
+		delete(d.LinkLog, k)
+		if d.Metadata != nil {
+			delete(d.Metadata.ListEdits, k)
+		}
+	}
+	if d.Variables != nil {
+		for name, links := range d.Variables.Uses {
+			var kept []*Link
+			for _, l := range links {
+				if _, exists := d.Links[l.ID]; exists {
+					kept = append(kept, l)
+				}
+			}
+			d.Variables.Uses[name] = kept
+		}
+	}
+}
+
+/*
+SetPermissions changes the list's owners, protection and visibility. An owners-only list
+needs at least one owner, or nobody but admins could edit it. Likewise a team list needs an
+owning group, and a private list an owning user.
+*/
+func (ll *ListOfLinks) SetPermissions(protection, visibility string, owners, groups []string) error {
+	if protection == "" {
+		protection = ProtectionOpen
+	}
+	if visibility == "" {
+		visibility = VisibilityPublic
+	}
+	switch {
+	case !contains(Protections, protection):
+		return fmt.Errorf("unknown protection '%s', protections are %s", protection, strings.Join(Protections, ", "))
+	case !contains(Visibilities, visibility):
+		return fmt.Errorf("unknown visibility '%s', visibilities are %s", visibility, strings.Join(Visibilities, ", "))
+	case protection == ProtectionOwners && len(owners) == 0 && len(groups) == 0:
+		return errors.New("an owners-only list needs at least one owner")
+	case visibility == VisibilityTeam && len(groups) == 0:
+		return errors.New("a team list needs an owning group")
+	case visibility == VisibilityPrivate && len(owners) == 0:
+		return errors.New("a private list needs an owning user")
+	}
+	// the defaults are left empty, so lists that never had permissions look the same as before
+	if protection == ProtectionOpen {
+		protection = ""
+	}
+	if visibility == VisibilityPublic {
+		visibility = ""
+	}
+	ll.Protection = protection
+	ll.Visibility = visibility
+	ll.Owners = copyStrings(owners)
+	ll.OwnerGroups = copyStrings(groups)
+	return nil
+}
+
+// DescribePermissions describes the list's owners, protection and visibility for its edit history.
+func (ll *ListOfLinks) DescribePermissions() string {
+	owners := append(copyStrings(ll.Owners), prefixed("group:", ll.OwnerGroups)...)
+	if len(owners) == 0 {
+		return fmt.Sprintf("%s, %s, no owners", ll.GetProtection(), ll.GetVisibility())
+	}
+	return fmt.Sprintf("%s, %s, owners %s", ll.GetProtection(), ll.GetVisibility(), strings.Join(owners, " "))
+}
+
+func prefixed(prefix string, list []string) []string {
+	p := make([]string, len(list))
+	for i, s := range list {
+		p[i] = prefix + s
+	}
+	return p
+}
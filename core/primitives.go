@@ -9,6 +9,7 @@ import (
 	"net/url"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 	"unicode"
 )
@@ -17,8 +18,14 @@ import (
 	Primitives
 */
 
-// goroutine sync mechanism for linkdatabase interactions
-var SYNC = make(chan int, 1)
+/*
+goroutine sync mechanism for linkdatabase interactions
+
+Anything that only reads the database (redirects, pages, exports, checkpoints) holds
+SYNC.RLock, so they all run at once. Anything that changes it holds SYNC.Lock. Redirects
+queue their clicks instead of counting them in place, see clicks.go.
+*/
+var SYNC = new(sync.RWMutex)
 
 // used for Mtime, date set ridiculously far in the future
 var Never = time.Date(2081, 7, 17, 7, 12, 0, 0, time.UTC)
@@ -26,16 +33,6 @@ var Never = time.Date(2081, 7, 17, 7, 12, 0, 0, time.UTC)
 // used to indicate links to be 'burned after reading', date set well in the past
 var BurnTime = time.Date(1, 1, 1, 1, 1, 1, 1, time.UTC)
 
-/*
-LinkLog structure for special link usages on all special keywords
-This grows to the size of len(keywords) in the link database.
-Each array of strings is a list of most recent to oldest usages of that keyword.
-This is thrown away when the redirector shuts down.
-*/
-var LinkLog = make(map[Keyword][]string)
-
-var RedirectorMetadata = MakeNewMetadata()
-
 var LinkZero = newEmptyLink(LinkDataBase, "127.0.0.1", "This is link zero.", "link zero!")
 
 var SearchKeywordsTrie = MakeNewTrie()
@@ -95,13 +92,45 @@ type ListOfLinks struct {
 	Logging     bool
 	TagBindings map[int][]string
 	Extractions map[int]ExtractionCapture // int == link ID, ExtractionCapture == param example and regex
+	Owners      []string                  `json:",omitempty"` // users who own the list, see permissions.go
+	OwnerGroups []string                  `json:",omitempty"` // groups whose members own it
+	Protection  string                    `json:",omitempty"` // who may edit it, "" is open
+	Visibility  string                    `json:",omitempty"` // who may see it, "" is public
 }
 
 type LinkDatabase struct {
-	Lists      map[Keyword]*ListOfLinks
-	Links      map[int]*Link
-	Variables  *UserVariables
-	NextLinkID int
+	Lists         map[Keyword]*ListOfLinks
+	Links         map[int]*Link
+	Variables     *UserVariables
+	NextLinkID    int
+	SchemaVersion int // see migrations.go
+
+	/*
+		Generation goes up by one with every change to a list, link, variable, or edit
+		history. It is saved with the database and sent to the failover peer, so the higher
+		of two generations is the newer database. Clicks and usage logs don't move it.
+	*/
+	Generation uint64
+
+	// Edit history for lists and links, see metadata.go.
+	Metadata *Metadata
+
+	/*
+		LinkLog holds usages of special keywords, one entry per keyword with logging on.
+		Each array of strings is a list of most recent to oldest usages of that keyword.
+		It is saved, replicated and exported along with the rest of the database.
+	*/
+	LinkLog map[Keyword][]string
+
+	// API tokens by name, see tokens.go.
+	APITokens map[string]*APIToken `json:",omitempty"`
+
+	journal     *Journal        // mutations are recorded here when set, see journal.go
+	journalErr  error           // the first journal write that failed, see JournalErr
+	replication *ReplicationLog // and numbered for the standby here, see replication.go
+	changes     changeSet       // entities changed since the last incremental save, see changes.go
+	clicks      clickQueue      // redirect side effects waiting for the write lock, see clicks.go
+	copyOf      *LinkDatabase   // the live database a checkpoint's copy was cloned from, see saveAs
 }
 
 // Gpath holds a Keyword, a Tag, and an array of any Params supplied by the user.
@@ -283,15 +312,20 @@ func (ll *ListOfLinks) GetRedirectURL() string {
 // false == linklog entry for the keyword is deleted, can be used to clear out history
 // The reason this exists is the user has the right to be forgotten. They should be able to
 // both record and delete recordings of usages of keywords.
-func (ll *ListOfLinks) ModifyLogging(setting bool) {
+// Both the list's setting and its linklog are journaled.
+func (d *LinkDatabase) ModifyLogging(ll *ListOfLinks, setting bool) {
 	ll.Logging = setting
 	if setting {
 		var a []string
-		LinkLog[ll.Keyword] = a // empty slice initially
+		d.LinkLog[ll.Keyword] = a // empty slice initially
 	} else {
-		delete(LinkLog, ll.Keyword)
+		delete(d.LinkLog, ll.Keyword)
 		LogDebug.Printf("Linklog for '%s' destroyed due to user request to disable logging\n", ll.Keyword)
 	}
+	if d.Lists[ll.Keyword] == ll {
+		d.RecordList(ll) // a list that isn't in the database yet is recorded when it is
+	}
+	d.RecordLinkLog(ll.Keyword)
 }
 
 // Return a tag []string for a given link ID in this list of links.
@@ -398,37 +432,43 @@ var LinkDataBase = MakeNewLinkDatabase()
 // NewLinkDatabase is an exported constructor for making that first links db
 func MakeNewLinkDatabase() *LinkDatabase {
 	return &LinkDatabase{
-		Lists:      make(map[Keyword]*ListOfLinks),
-		Links:      make(map[int]*Link),
-		Variables:  &UserVariables{},
-		NextLinkID: 1,
+		Lists:         make(map[Keyword]*ListOfLinks),
+		Links:         make(map[int]*Link),
+		Variables:     &UserVariables{Uses: make(map[string][]*Link)},
+		NextLinkID:    1,
+		SchemaVersion: CurrentSchemaVersion(),
+		Metadata:      MakeNewMetadata(),
+		LinkLog:       make(map[Keyword][]string),
 	}
 }
 
 // Import will read data from the provided io.Reader into memory at the global
-// LinkDataBase variable.
-func (d *LinkDatabase) Import(fh io.Reader, s chan int) error {
+// LinkDataBase variable. Older schema versions are migrated on the way in.
+func (d *LinkDatabase) Import(fh io.Reader, s *sync.RWMutex) error {
 	var tempdb LinkDatabase
 	var err error
-	<-s
+	s.Lock()
+	defer s.Unlock()
 	data, _ := io.ReadAll(fh)
-	err = json.Unmarshal(data, &tempdb)
+	data, err = migrateOnLoad(data)
+	if err == nil {
+		err = json.Unmarshal(data, &tempdb)
+	}
 	if err != nil {
 		LogError.Printf("json parsing error: %s", err)
-		s <- 1
 		return err
 	}
 
 	LinkDataBase = &tempdb
-	s <- 1
 	return err
 }
 
 // Export will marshal the current LinkDataBase into JSON and write it to the provided
 // io.Writer.
-func (d *LinkDatabase) Export(fh io.Writer, s chan int) error {
-	<-s
+func (d *LinkDatabase) Export(fh io.Writer, s *sync.RWMutex) error {
+	s.RLock()
 	file, err := json.Marshal(d)
+	s.RUnlock()
 	if err != nil {
 		LogError.Println("JSON marshal error:", err)
 		return err
@@ -437,10 +477,130 @@ func (d *LinkDatabase) Export(fh io.Writer, s chan int) error {
 	if err != nil {
 		LogError.Fatal(err)
 	}
-	s <- 1
 	return err
 }
 
+/*
+Clone returns a deep copy of the database, sharing nothing with the original. The copy's
+lists point at the copy's links. Callers hold SYNC while cloning the live database, then
+can release it and take as long as they like with the copy.
+
+The copy has no journal and no pending changes.
+*/
+func (d *LinkDatabase) Clone() *LinkDatabase {
+	c := &LinkDatabase{
+		Lists:         make(map[Keyword]*ListOfLinks, len(d.Lists)),
+		Links:         make(map[int]*Link, len(d.Links)),
+		Variables:     &UserVariables{Uses: make(map[string][]*Link)},
+		NextLinkID:    d.NextLinkID,
+		SchemaVersion: d.SchemaVersion,
+		Generation:    d.Generation,
+		Metadata:      MakeNewMetadata(),
+		LinkLog:       make(map[Keyword][]string, len(d.LinkLog)),
+	}
+	for id, l := range d.Links {
+		c.Links[id] = l.clone()
+	}
+	for k, ll := range d.Lists {
+		cl := *ll
+		cl.Owners = copyStrings(ll.Owners)
+		cl.OwnerGroups = copyStrings(ll.OwnerGroups)
+		cl.Links = make(map[int]*Link, len(ll.Links))
+		for id, l := range ll.Links {
+			if shared, exists := c.Links[id]; exists {
+				cl.Links[id] = shared
+			} else {
+				cl.Links[id] = l.clone()
+			}
+		}
+		if ll.TagBindings != nil {
+			cl.TagBindings = make(map[int][]string, len(ll.TagBindings))
+			for id, tags := range ll.TagBindings {
+				cl.TagBindings[id] = copyStrings(tags)
+			}
+		}
+		if ll.Extractions != nil {
+			cl.Extractions = make(map[int]ExtractionCapture, len(ll.Extractions))
+			for id, x := range ll.Extractions {
+				cl.Extractions[id] = x
+			}
+		}
+		c.Lists[k] = &cl
+	}
+	if d.Variables != nil {
+		if d.Variables.Strings != nil {
+			c.Variables.Strings = make(map[string]string, len(d.Variables.Strings))
+			for name, v := range d.Variables.Strings {
+				c.Variables.Strings[name] = v
+			}
+		}
+		if d.Variables.Maps != nil {
+			c.Variables.Maps = make(map[string]map[string]string, len(d.Variables.Maps))
+			for name, m := range d.Variables.Maps {
+				cm := make(map[string]string, len(m))
+				for key, v := range m {
+					cm[key] = v
+				}
+				c.Variables.Maps[name] = cm
+			}
+		}
+	}
+	if d.Metadata != nil {
+		for k, e := range d.Metadata.ListEdits {
+			c.Metadata.ListEdits[k] = cloneEdits(e)
+		}
+		for id, e := range d.Metadata.LinkEdits {
+			c.Metadata.LinkEdits[id] = cloneEdits(e)
+		}
+	}
+	for k, usages := range d.LinkLog {
+		c.LinkLog[k] = copyStrings(usages)
+	}
+	if d.APITokens != nil {
+		c.APITokens = make(map[string]*APIToken, len(d.APITokens))
+		for name, t := range d.APITokens {
+			ct := *t
+			ct.Scopes = copyStrings(t.Scopes)
+			c.APITokens[name] = &ct
+		}
+	}
+	return c
+}
+
+func (l *Link) clone() *Link {
+	c := *l
+	if l.Lists != nil {
+		c.Lists = append(make([]Keyword, 0, len(l.Lists)), l.Lists...)
+	}
+	if l.LinkVariables != nil {
+		c.LinkVariables = make(map[string]string, len(l.LinkVariables))
+		for name, v := range l.LinkVariables {
+			c.LinkVariables[name] = v
+		}
+	}
+	return &c
+}
+
+// copyStrings copies a slice, keeping the difference between nil and empty.
+func copyStrings(s []string) []string {
+	if s == nil {
+		return nil
+	}
+	return append(make([]string, 0, len(s)), s...)
+}
+
+func cloneEdits(edits []*EditRecord) []*EditRecord {
+	if edits == nil {
+		return nil
+	}
+	c := make([]*EditRecord, len(edits))
+	for i, e := range edits {
+		copied := *e
+		c[i] = &copied
+	}
+	return c
+}
+
 // convenience function used to create an empty link for the DB at ID == 0.
 func newEmptyLink(d *LinkDatabase, incomingURL string, title string, keyword Keyword) *Link {
 	createTime := time.Now().UTC()
@@ -478,7 +638,7 @@ func (d *LinkDatabase) Decouple(ll *ListOfLinks, linkObj *Link) {
 	if len(ll.Links) == 0 {
 		delete(d.Lists, ll.Keyword)
 		// remove the usage log for this keyword
-		//delete(LinkLog, ll.Keyword)  TODO, turn this back on
+		//delete(d.LinkLog, ll.Keyword)  TODO, turn this back on
 	}
 
 	// Fix effects of a previous bug: decouple wasn't removing tagbindings
@@ -506,6 +666,8 @@ func (d *LinkDatabase) Decouple(ll *ListOfLinks, linkObj *Link) {
 		LogInfo.Printf("Link %d has been removed (no remaining list memberships)", linkObj.ID)
 		delete(d.Links, linkObj.ID)
 	}
+	d.RecordList(ll)
+	d.RecordLink(linkObj)
 }
 
 // Couple a an existing link's pointer to a list of links. The list can be existing or will be committed here if new.
@@ -535,6 +697,8 @@ func (d *LinkDatabase) Couple(ll *ListOfLinks, linkObj *Link) {
 	}
 	ll.Links[linkObj.ID] = linkObj
 	LogInfo.Printf("Link ID %d has been coupled with keyword '%s'\n", linkObj.ID, ll.Keyword)
+	d.RecordLink(linkObj)
+	d.RecordList(ll)
 }
 
 // CommitNewLink adds a Link object to the database.
@@ -548,6 +712,7 @@ func (d *LinkDatabase) CommitNewLink(l *Link) (int, error) {
 		l.ID = id
 		d.Links[id] = l
 		d.NextLinkID++
+		d.RecordLink(l)
 	} else {
 		msg := "the link being added was not ID=0/new"
 		LogError.Println(msg)
@@ -631,21 +796,26 @@ func (d *LinkDatabase) TopLists(count int) []*ListOfLinks {
 }
 
 /*
-IndexKeywords is meant to be run at a regular interval. It maintains a
+IndexKeywords is meant to be run at a regular interval. It builds a
 data structure full of keywords and interesting strings associated with
 these keywords. This is useful for search functions, so they don't have
 to iterate through the entire linkDB themselves.
+
+The index is built from scratch and returned, for the caller to swap in
+as SearchKeywordsTrie and SearchKeywordsData.
 */
-func (d *LinkDatabase) IndexKeywords() {
+func (d *LinkDatabase) IndexKeywords() (*Trie, map[string]string) {
+	trie := MakeNewTrie()
+	data := make(map[string]string)
 	for kwd, ll := range d.Lists {
-		SearchKeywordsTrie.Insert(strings.ToLower(kwd.ToString()))
+		trie.Insert(strings.ToLower(kwd.ToString()))
 		// need to get the link tags used on the list
 		var alltags string
 		for _, bindings := range ll.TagBindings {
 			b := strings.Join(bindings, " ")
 			alltags = alltags + fmt.Sprintf(" %s", b)
 		}
-		SearchKeywordsData[kwd.ToString()] = alltags
+		data[kwd.ToString()] = alltags
 	}
 	for _, lnk := range d.Links {
 		// join with spaces: title, linkvariables(keys)
@@ -655,11 +825,12 @@ func (d *LinkDatabase) IndexKeywords() {
 		}
 		// all list names this link is a member of
 		for _, list := range lnk.Lists {
-			searchStr := strings.TrimSpace(SearchKeywordsData[list.ToString()] + fmt.Sprintf(" %s", t))
+			searchStr := strings.TrimSpace(data[list.ToString()] + fmt.Sprintf(" %s", t))
 			searchStr = strings.ToLower(searchStr)
-			SearchKeywordsData[list.ToString()] = searchStr
+			data[list.ToString()] = searchStr
 		}
 	}
+	return trie, data
 }
 
 /*
@@ -674,12 +845,23 @@ func (d *LinkDatabase) Prune() {
 			if lnk.Dtime.Equal(BurnTime) {
 				continue // special case: If it's a burner, leave it where it is.
 			}
-			DestroyLink(lnk)
+			d.destroyLink(lnk)
 			LogInfo.Printf("Pruning link from database: %d", id)
 		}
 	}
 }
 
+// expiring reports whether Prune has anything to remove.
+func (d *LinkDatabase) expiring() bool {
+	now := time.Now()
+	for _, lnk := range d.Links {
+		if lnk.Dtime.Before(now) && !lnk.Dtime.Equal(BurnTime) {
+			return true
+		}
+	}
+	return false
+}
+
 /*
 Search-related structures and functions
 */
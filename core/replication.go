@@ -0,0 +1,549 @@
+package core
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+Replication
+
+The active keeps its standby current by streaming mutations to it. These are the same
+entries the journal holds (see journal.go), each the state of an entity after a change.
+As a mutation is recorded it is also given the next number in the replication log's
+sequence. The standby applies mutations in order and acknowledges the last sequence number
+it has. When it reconnects, it asks to resume from there.
+
+The active only keeps the last ReplicationBacklog mutations. A standby that is further
+behind than that is sent the whole database instead, tagged with the sequence number it
+is current to, and mutations carry on from there. So is a standby following a different
+stream: one that has just started, or one whose active restarted or restored a snapshot.
+
+Clicks go across as the links and lists they were counted against, each time the click
+queue is applied. Keyword usage logs only go across with the whole database.
+
+On the wire, a stream starts with replicationPreamble. Everything after that is frames:
+a four byte big-endian length, then that many bytes of JSON.
+
+	active                            standby
+	hello {stream, seq}          ->
+	                             <-   resume {stream, seq}
+	snapshot {stream, seq, db}   ->   (only when the standby can't resume)
+	mutation {seq, mutation}     ->
+	heartbeat {seq}              ->   (every heartbeat_interval, see heartbeat.go)
+	                             <-   ack {seq}
+*/
+
+// ReplicationBacklog is how many recent mutations the active keeps for a standby to
+// catch up from. A standby further behind than this is sent the whole database.
+var ReplicationBacklog = 10000
+
+// replicationPreamble starts a replication stream, which tells it apart from a diceroll.
+const replicationPreamble = "go2replicate\n"
+
+// replicationTimeout bounds how long either side waits on the other.
+const replicationTimeout = 10 * time.Second
+
+// maxFrameSize bounds the length of a frame, so a garbled length can't exhaust memory.
+const maxFrameSize = 1 << 30
+
+// Frame types.
+const (
+	FrameHello     = "hello"
+	FrameResume    = "resume"
+	FrameSnapshot  = "snapshot"
+	FrameMutation  = "mutation"
+	FrameHeartbeat = "heartbeat"
+	FrameAck       = "ack"
+	FrameVote      = "vote"
+	FrameHandoff   = "handoff" // see switchover.go
+	FrameControl   = "control"
+)
+
+// Frame is one message in a replication stream.
+type Frame struct {
+	Type       string          `json:"type"`
+	Stream     string          `json:"stream,omitempty"`
+	Seq        uint64          `json:"seq"`
+	Generation uint64          `json:"generation,omitempty"`
+	Term       uint64          `json:"term,omitempty"`      // the sender's term, see fencing.go and cluster.go
+	Roll       int             `json:"roll,omitempty"`      // an active's diceroll, breaking ties between terms
+	Node       string          `json:"node,omitempty"`      // the leader sending a stream, a candidate, or a voter's leader
+	LastTerm   uint64          `json:"last_term,omitempty"` // the term of a candidate's stream
+	Granted    bool            `json:"granted,omitempty"`   // whether a vote, handoff or admin action was granted
+	Transfer   bool            `json:"transfer,omitempty"`  // a vote asked for because the leader handed off
+	PreVote    bool            `json:"pre_vote,omitempty"`  // whether a vote would be given, see cluster.go
+	Action     string          `json:"action,omitempty"`    // an admin action being asked for
+	Reason     string          `json:"reason,omitempty"`    // what came of a handoff or admin action
+	Mutation   json.RawMessage `json:"mutation,omitempty"`
+	Database   json.RawMessage `json:"database,omitempty"`
+}
+
+// WriteFrame writes one length-prefixed frame to w.
+func WriteFrame(w io.Writer, f *Frame) error {
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	copy(buf[4:], data)
+	_, err = w.Write(buf)
+	return err
+}
+
+// ReadFrame reads one length-prefixed frame from r.
+func ReadFrame(r io.Reader) (*Frame, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size > maxFrameSize {
+		return nil, fmt.Errorf("replication frame of %d bytes is too large", size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	var f Frame
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// ReplicationLog numbers the mutations made to a database and keeps the recent ones.
+type ReplicationLog struct {
+	Stream  string // names this sequence, which starts over when the active does
+	mu      sync.Mutex
+	base    uint64   // the sequence number just before frames[0]
+	frames  []*Frame // the kept mutations, oldest first
+	acked   uint64
+	ackedAt time.Time
+	notify  chan struct{}
+}
+
+// NewReplicationLog starts a sequence with a new stream name.
+func NewReplicationLog() *ReplicationLog {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return &ReplicationLog{Stream: hex.EncodeToString(id), notify: make(chan struct{}, 1)}
+}
+
+// StartReplication gives d a new replication log, so its mutations can be sent to a standby.
+func StartReplication(d *LinkDatabase) {
+	d.replication = NewReplicationLog()
+}
+
+// Append gives a mutation the next sequence number. The mutation is encoded right away,
+// since the entity it points at will keep changing. A nil log discards everything.
+func (l *ReplicationLog) Append(m *Mutation, generation uint64) {
+	if l == nil {
+		return
+	}
+	if m.Time.IsZero() {
+		m.Time = time.Now().UTC()
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		LogError.Println("JSON marshal error:", err)
+		return
+	}
+	l.mu.Lock()
+	l.frames = append(l.frames, &Frame{Type: FrameMutation, Seq: l.latest() + 1, Generation: generation, Mutation: data})
+	if over := len(l.frames) - ReplicationBacklog; over > 0 {
+		l.base += uint64(over)
+		l.frames = l.frames[over:]
+	}
+	l.mu.Unlock()
+	l.wake()
+}
+
+// Reset drops the kept mutations and skips a sequence number, after the database has been
+// replaced wholesale. Any standby resuming from before the reset is sent the whole database.
+func (l *ReplicationLog) Reset() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	l.base = l.latest() + 1
+	l.frames = nil
+	l.mu.Unlock()
+	l.wake()
+}
+
+func (l *ReplicationLog) wake() {
+	select {
+	case l.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (l *ReplicationLog) latest() uint64 {
+	return l.base + uint64(len(l.frames))
+}
+
+// Latest returns the sequence number of the newest mutation.
+func (l *ReplicationLog) Latest() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.latest()
+}
+
+// Since returns the mutations after seq, oldest first. It returns false if some of them
+// are no longer kept, or seq is from somewhere else.
+func (l *ReplicationLog) Since(seq uint64) ([]*Frame, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if seq < l.base || seq > l.latest() {
+		return nil, false
+	}
+	return append([]*Frame(nil), l.frames[seq-l.base:]...), true
+}
+
+// Acked returns the last sequence number the standby acknowledged.
+func (l *ReplicationLog) Acked() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.acked
+}
+
+func (l *ReplicationLog) ack(seq uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.acked, l.ackedAt = seq, time.Now()
+}
+
+// AckedAt returns when the standby last acknowledged anything.
+func (l *ReplicationLog) AckedAt() time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.ackedAt
+}
+
+// snapshot frames the whole of d. Callers hold SYNC, so the sequence number matches it.
+func (l *ReplicationLog) snapshot(d *LinkDatabase) (*Frame, error) {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+	return &Frame{Type: FrameSnapshot, Stream: l.Stream, Seq: l.Latest(), Generation: d.Generation, Database: data}, nil
+}
+
+// dbRef is a database kept current by replication: the variable that holds it and the
+// lock guarding it. That's LinkDataBase and SYNC, except for in-process cluster nodes.
+type dbRef struct {
+	lock *sync.RWMutex
+	db   **LinkDatabase
+}
+
+// liveDB refers to the live LinkDataBase, guarded by s.
+func liveDB(s *sync.RWMutex) dbRef {
+	return dbRef{lock: s, db: &LinkDataBase}
+}
+
+// sender streams one database's mutations to one peer.
+type sender struct {
+	addr    string
+	ref     dbRef
+	hello   Frame              // sent first, with the stream and sequence number filled in
+	resumed func(*Frame) error // looks over the peer's resume frame, and can refuse to go on
+	acked   func(uint64)       // called with each acknowledgement, the log's ack by default
+	stop    <-chan struct{}    // closing this ends the stream
+}
+
+// replicate streams the live database's mutations to the standby peer until the connection
+// fails. If the peer turns out to be active in a later term, we step down.
+func replicate(updates chan uint64, s *sync.RWMutex) error {
+	st := &sender{addr: FailoverPeer, ref: liveDB(s), hello: Frame{Type: FrameHello, Term: CurrentTerm(), Roll: ActiveStandbySeed}}
+	st.resumed = func(f *Frame) error {
+		if peerWins(f.Term, f.Roll) {
+			stepDown(fmt.Sprintf("the peer turned our stream away, it's in term %d", f.Term), updates, s)
+			return fmt.Errorf("peer is in term %d, we were in %d", f.Term, st.hello.Term)
+		}
+		return nil
+	}
+	return st.run()
+}
+
+/*
+run streams mutations to the peer until the connection fails or the stream is stopped.
+Frames are taken from the log with the database's lock held for reading, so a whole
+database sent in their place is current to the sequence number it's tagged with. Every
+frame carries the hello's term.
+*/
+func (st *sender) run() error {
+	st.ref.lock.RLock()
+	log := (*st.ref.db).replication
+	st.ref.lock.RUnlock()
+	if log == nil {
+		return errors.New("the link database has no replication log")
+	}
+	acked := st.acked
+	if acked == nil {
+		acked = log.ack
+	}
+
+	conn, err := dialPeer(st.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(replicationTimeout))
+	hello := st.hello
+	hello.Stream, hello.Seq = log.Stream, log.Latest()
+	if _, err = io.WriteString(conn, replicationPreamble); err == nil {
+		err = WriteFrame(conn, &hello)
+	}
+	if err != nil {
+		return err
+	}
+	resume, err := ReadFrame(conn)
+	if err != nil {
+		return err
+	}
+	if resume.Type != FrameResume {
+		return fmt.Errorf("peer %s sent a %s frame instead of resuming", st.addr, resume.Type)
+	}
+	if st.resumed != nil {
+		if err := st.resumed(resume); err != nil {
+			return err
+		}
+	}
+	conn.SetDeadline(time.Time{})
+	LogInfo.Printf("Peer %s is up, resuming from sequence %d\n", st.addr, resume.Seq)
+
+	// acknowledgements are read on their own, until the connection goes
+	done := make(chan error, 1)
+	go func() {
+		for {
+			f, err := ReadFrame(conn)
+			if err != nil {
+				done <- err
+				return
+			}
+			if f.Type == FrameAck {
+				acked(f.Seq)
+			}
+		}
+	}()
+
+	interval, _, _ := HeartbeatSettings()
+	heartbeat := time.NewTicker(interval)
+	defer heartbeat.Stop()
+	out := bufio.NewWriter(conn)
+	sent := resume.Seq
+	current := resume.Stream == log.Stream
+	for {
+		select {
+		case <-st.stop:
+			return nil
+		default:
+		}
+		var frames []*Frame
+		st.ref.lock.RLock()
+		if current {
+			frames, current = log.Since(sent)
+		}
+		if !current {
+			var f *Frame
+			if f, err = log.snapshot(*st.ref.db); err == nil {
+				LogInfo.Printf("Peer %s can't resume from sequence %d, sending the whole database\n", st.addr, sent)
+				frames, current = []*Frame{f}, true
+			}
+		}
+		st.ref.lock.RUnlock()
+		if err != nil {
+			return err
+		}
+
+		// heartbeats go out on time whether or not there are changes to send
+		select {
+		case <-heartbeat.C:
+			frames = append(frames, &Frame{Type: FrameHeartbeat})
+		default:
+			if len(frames) == 0 {
+				select {
+				case <-log.notify:
+					continue
+				case err := <-done:
+					return err
+				case <-st.stop:
+					return nil
+				case <-heartbeat.C:
+					frames = []*Frame{{Type: FrameHeartbeat}}
+				}
+			}
+		}
+		conn.SetWriteDeadline(time.Now().Add(replicationTimeout))
+		for _, f := range frames {
+			if f.Type == FrameHeartbeat {
+				f.Seq = sent
+			} else {
+				sent = f.Seq
+			}
+			framed := *f // the log's frames are shared, and the term is ours
+			framed.Term = hello.Term
+			if err := WriteFrame(out, &framed); err != nil {
+				return err
+			}
+		}
+		if err := out.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
+// replica is a standby's or follower's place in a replication stream.
+type replica struct {
+	ref   dbRef
+	stale func(term uint64) bool // reports whether a stream from term has been superseded, if set
+	mu    sync.Mutex             // held while following a stream
+
+	posMu    sync.Mutex
+	stream   string
+	term     uint64 // the term of the cluster leader the stream is from
+	applied  uint64
+	syncedAt time.Time // when the last frame was handled
+
+	connMu sync.Mutex
+	conn   net.Conn // the stream being followed
+}
+
+// position returns the stream being followed, its term, and the last sequence number applied.
+func (r *replica) position() (string, uint64, uint64) {
+	r.posMu.Lock()
+	defer r.posMu.Unlock()
+	return r.stream, r.term, r.applied
+}
+
+// takeOver closes the connection being followed, if any, in favor of a new one. The active
+// may reconnect before this side has noticed the old connection is gone.
+func (r *replica) takeOver(conn net.Conn) {
+	r.connMu.Lock()
+	defer r.connMu.Unlock()
+	if r.conn != nil {
+		r.conn.Close()
+	}
+	r.conn = conn
+}
+
+/*
+follow applies a replication stream to the database, once its hello frame has been read.
+What has been applied is acknowledged whenever it catches up with what has arrived. Each
+time a frame is handled, the sequence number it's current to is offered on updates. The
+term goes back to the sender with the resume frame, and every frame after the hello has to
+be from the hello's term. Once the stream is stale, say because we took over, the rest of it
+is dropped.
+*/
+func (r *replica) follow(conn net.Conn, reader *bufio.Reader, hello *Frame, term uint64, updates chan uint64) error {
+	r.takeOver(conn)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stream, _, applied := r.position()
+	if err := WriteFrame(conn, &Frame{Type: FrameResume, Stream: stream, Seq: applied, Term: term}); err != nil {
+		return err
+	}
+	interval, _, _ := HeartbeatSettings()
+	for {
+		conn.SetDeadline(time.Now().Add(interval + replicationTimeout))
+		f, err := ReadFrame(reader)
+		if err != nil {
+			return err
+		}
+		if f.Term != hello.Term {
+			return fmt.Errorf("peer sent a frame from term %d in a stream from term %d", f.Term, hello.Term)
+		}
+		if r.stale != nil && r.stale(hello.Term) {
+			return fmt.Errorf("the stream from term %d has been superseded", hello.Term)
+		}
+		if stream, _, _ := r.position(); f.Type == FrameMutation && stream != hello.Stream {
+			return fmt.Errorf("peer sent mutation %d before the database it applies to", f.Seq)
+		}
+		if err := r.apply(f); err != nil {
+			return err
+		}
+		r.posMu.Lock()
+		r.syncedAt = time.Now()
+		applied := r.applied
+		r.posMu.Unlock()
+		if reader.Buffered() == 0 {
+			if err := WriteFrame(conn, &Frame{Type: FrameAck, Seq: applied}); err != nil {
+				return err
+			}
+		}
+		select {
+		case updates <- applied:
+		default:
+		}
+	}
+}
+
+// apply makes one frame's change to the database.
+func (r *replica) apply(f *Frame) error {
+	switch f.Type {
+	case FrameHeartbeat:
+	case FrameSnapshot:
+		var d LinkDatabase
+		if err := json.Unmarshal(f.Database, &d); err != nil {
+			return err
+		}
+		d.initMetadata()
+		d.relink()
+		r.ref.lock.Lock()
+		// anything journaled here is older than what we were just sent
+		d.AttachJournal((*r.ref.db).journal)
+		d.journal.Truncate()
+		*r.ref.db = &d
+		r.ref.lock.Unlock()
+		r.posMu.Lock()
+		r.stream, r.term, r.applied = f.Stream, f.Term, f.Seq
+		r.posMu.Unlock()
+		LogInfo.Printf("Loaded the whole database from the active peer at sequence %d\n", f.Seq)
+	case FrameMutation:
+		_, _, applied := r.position()
+		if f.Seq <= applied {
+			return nil // we already have it
+		}
+		if f.Seq != applied+1 {
+			return fmt.Errorf("peer sent mutation %d, expected %d", f.Seq, applied+1)
+		}
+		var m Mutation
+		if err := json.Unmarshal(f.Mutation, &m); err != nil {
+			return err
+		}
+		if err := r.applyMutation(&m, f.Generation); err != nil {
+			return err
+		}
+		r.posMu.Lock()
+		r.applied = f.Seq
+		r.posMu.Unlock()
+	default:
+		return fmt.Errorf("peer sent an unexpected %s frame", f.Type)
+	}
+	return nil
+}
+
+// applyMutation applies one of the peer's mutations to the database, which is at generation once it has.
+func (r *replica) applyMutation(m *Mutation, generation uint64) error {
+	r.ref.lock.Lock()
+	defer r.ref.lock.Unlock()
+	d := *r.ref.db
+	if err := d.Apply(m); err != nil {
+		return err
+	}
+	d.relinkMutation(m)
+	d.Generation = generation
+	return nil
+}
@@ -0,0 +1,405 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Point-in-time snapshots
+
+While the redirector is active it writes a timestamped copy of the link database into
+SnapshotDir every SnapshotInterval. Snapshots are the same JSON as godb.json, so any of
+them can be loaded with -i as well as restored.
+
+Old snapshots are pruned by the retention rules. Each rule keeps one snapshot per
+Every-sized slice of time, for snapshots younger than KeepFor. "hourly for a day, daily
+for a month" is two rules: {1h, 24h} and {24h, 720h}. A snapshot is kept if any rule
+wants it, and the newest snapshot is always kept.
+*/
+
+// RetentionRule keeps one snapshot per Every for the snapshots younger than KeepFor.
+// Both are time duration strings.
+type RetentionRule struct {
+	Every   string `json:"every"`
+	KeepFor string `json:"keep_for"`
+}
+
+// Snapshot describes one snapshot file in SnapshotDir.
+type Snapshot struct {
+	Name string    `json:"name"`
+	Time time.Time `json:"time"`
+	Size int64     `json:"size"`
+}
+
+const snapshotPrefix = "godb-"
+const snapshotSuffix = ".json"
+const snapshotTimeFormat = "20060102T150405Z"
+
+// snapshotName gives the file name of the snapshot taken at t.
+func snapshotName(t time.Time) string {
+	return fmt.Sprintf("%s%s%s", snapshotPrefix, t.UTC().Format(snapshotTimeFormat), snapshotSuffix)
+}
+
+// parseSnapshotName returns the time a snapshot was taken, from its file name.
+func parseSnapshotName(name string) (time.Time, error) {
+	if !strings.HasPrefix(name, snapshotPrefix) || !strings.HasSuffix(name, snapshotSuffix) {
+		return time.Time{}, fmt.Errorf("'%s' is not a snapshot name", name)
+	}
+	stamp := strings.TrimSuffix(strings.TrimPrefix(name, snapshotPrefix), snapshotSuffix)
+	return time.Parse(snapshotTimeFormat, stamp)
+}
+
+// TakeSnapshot writes a copy of the live link database into SnapshotDir.
+func TakeSnapshot(s *sync.RWMutex) (Snapshot, error) {
+	// LinkDataBase is read under the lock too, a restore can replace it
+	s.RLock()
+	defer s.RUnlock()
+	return takeSnapshot(LinkDataBase)
+}
+
+// takeSnapshot writes a copy of d into SnapshotDir. The caller holds SYNC.
+func takeSnapshot(d *LinkDatabase) (Snapshot, error) {
+	var snap Snapshot
+	data, err := json.Marshal(d)
+	if err != nil {
+		LogError.Println("JSON marshal error:", err)
+		return snap, err
+	}
+	if err = os.MkdirAll(SnapshotDir, 0755); err != nil {
+		return snap, err
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	snap = Snapshot{Name: snapshotName(now), Time: now, Size: int64(len(data))}
+	err = WriteFileAtomic(filepath.Join(SnapshotDir, snap.Name), data, 0)
+	if err == nil {
+		LogInfo.Printf("Snapshot %s taken\n", snap.Name)
+	}
+	return snap, err
+}
+
+// ListSnapshots returns the snapshots in SnapshotDir, newest first.
+func ListSnapshots() ([]Snapshot, error) {
+	var snaps []Snapshot
+	entries, err := os.ReadDir(SnapshotDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return snaps, nil
+	} else if err != nil {
+		return snaps, err
+	}
+	for _, e := range entries {
+		t, err := parseSnapshotName(e.Name())
+		if err != nil || e.IsDir() {
+			continue // something else is in there, leave it alone
+		}
+		snap := Snapshot{Name: e.Name(), Time: t}
+		if info, err := e.Info(); err == nil {
+			snap.Size = info.Size()
+		}
+		snaps = append(snaps, snap)
+	}
+	sort.Slice(snaps, func(i, j int) bool { return snaps[i].Time.After(snaps[j].Time) })
+	return snaps, nil
+}
+
+// ReadSnapshotFile loads a link database from a snapshot (or any database file) at path.
+func ReadSnapshotFile(path string) (*LinkDatabase, error) {
+	var d LinkDatabase
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err = migrateOnLoad(data)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &d); err != nil {
+		LogError.Printf("json parsing error: %s", err)
+		return nil, err
+	}
+	d.relink()
+	return &d, err
+}
+
+// LoadSnapshot loads the named snapshot out of SnapshotDir.
+func LoadSnapshot(name string) (*LinkDatabase, error) {
+	if _, err := parseSnapshotName(name); err != nil || filepath.Base(name) != name {
+		return nil, fmt.Errorf("'%s' is not a snapshot name", name)
+	}
+	d, err := ReadSnapshotFile(filepath.Join(SnapshotDir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return d, err
+}
+
+/*
+RestoreSnapshot replaces the live link database with the named snapshot.
+
+A snapshot of the live database is taken first, so a restore can itself be undone. The
+restored database is saved to the storage backend before it goes live. If that fails the
+live database is left as it was. See supersede for its link IDs and generation.
+*/
+func RestoreSnapshot(name string, s *sync.RWMutex) error {
+	d, err := LoadSnapshot(name)
+	if err != nil {
+		return err
+	}
+
+	checkpointMu.Lock()
+	defer checkpointMu.Unlock()
+	s.Lock()
+	defer s.Unlock()
+	if _, err = takeSnapshot(LinkDataBase); err != nil {
+		return fmt.Errorf("could not snapshot the live database before restoring: %s", err)
+	}
+	d.supersede(LinkDataBase)
+	if err = DBStore.Save(d); err != nil {
+		return err
+	}
+	// the journal holds edits to the database being replaced, which are in its snapshot
+	d.AttachJournal(LinkDataBase.journal)
+	d.journal.Truncate()
+	// a standby can't get here by applying mutations, so it gets the whole database
+	d.replication = LinkDataBase.replication
+	d.replication.Reset()
+	LinkDataBase = d
+	LogInfo.Printf("Link database restored from snapshot %s\n", name)
+	return err
+}
+
+/*
+RestoreSnapshotFile replaces the configured database with a snapshot file. This is for
+the -restore flag, with the redirector stopped. The path can be a file or the name of a
+snapshot in SnapshotDir.
+*/
+func RestoreSnapshotFile(path string) error {
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		path = filepath.Join(SnapshotDir, path)
+	}
+	d, err := ReadSnapshotFile(path)
+	if err != nil {
+		return err
+	}
+	return ReplaceStoredDatabase(d)
+}
+
+/*
+ReplaceStoredDatabase saves d over the configured database, with the redirector stopped.
+It's how -restore and -import-ndjson install the database they read. See supersede.
+*/
+func ReplaceStoredDatabase(d *LinkDatabase) error {
+	if old, err := storedDatabase(DBStore); err == nil {
+		d.supersede(old)
+	} else {
+		LogInfo.Printf("No link database to replace: %s\n", err)
+	}
+	if err := DBStore.Save(d); err != nil {
+		return err
+	}
+	// edits journaled against the old database must not be replayed over this one
+	err := os.Truncate(JournalFileName(GodbFileName), 0)
+	if errors.Is(err, os.ErrNotExist) {
+		err = nil
+	}
+	return err
+}
+
+/*
+supersede readies d, a restored or imported database, to replace old. Its generation goes
+past both of theirs, so a peer that never saw the restore can't look newer at startup and
+hand the replaced data back, see Synchronize. Link IDs keep counting up from the higher of
+the two, so none already used in edit history is handed out again. The API tokens are old's,
+so restoring a database from before a token was revoked doesn't bring it back.
+*/
+func (d *LinkDatabase) supersede(old *LinkDatabase) {
+	d.APITokens = old.APITokens
+	if old.NextLinkID > d.NextLinkID {
+		d.NextLinkID = old.NextLinkID
+	}
+	if old.Generation > d.Generation {
+		d.Generation = old.Generation
+	}
+	d.Generation++
+}
+
+/*
+PruneSnapshots deletes the snapshots the retention rules no longer want, judged at the
+time now. It returns the names of the deleted snapshots.
+*/
+func PruneSnapshots(rules []RetentionRule, now time.Time) ([]string, error) {
+	var removed []string
+	snaps, err := ListSnapshots()
+	if err != nil || len(snaps) == 0 {
+		return removed, err
+	}
+
+	keep := map[string]bool{snaps[0].Name: true}
+	for _, rule := range rules {
+		every, err1 := time.ParseDuration(rule.Every)
+		keepFor, err2 := time.ParseDuration(rule.KeepFor)
+		if err1 != nil || err2 != nil || every <= 0 {
+			LogError.Printf("snapshot retention rule %+v is not valid, skipping it\n", rule)
+			continue
+		}
+		// walking oldest to newest keeps the first snapshot in each slice of time
+		seen := make(map[time.Time]bool)
+		for i := len(snaps) - 1; i >= 0; i-- {
+			if now.Sub(snaps[i].Time) > keepFor {
+				continue
+			}
+			slot := snaps[i].Time.Truncate(every)
+			if !seen[slot] {
+				seen[slot] = true
+				keep[snaps[i].Name] = true
+			}
+		}
+	}
+
+	for _, snap := range snaps {
+		if keep[snap.Name] {
+			continue
+		}
+		if err = os.Remove(filepath.Join(SnapshotDir, snap.Name)); err != nil {
+			LogError.Printf("could not remove snapshot %s: %s\n", snap.Name, err)
+			continue
+		}
+		removed = append(removed, snap.Name)
+	}
+	return removed, nil
+}
+
+// RunSnapshots takes a snapshot and prunes old ones at the provided interval (a time duration string).
+// A failed snapshot is logged and tried again on the next interval.
+func RunSnapshots(interval string, s *sync.RWMutex) {
+	d, err := time.ParseDuration(interval)
+	if err != nil {
+		LogError.Fatalf("Specified duration of '%s' could not be parsed\n", interval)
+	}
+	for {
+		time.Sleep(d)
+		if _, err := TakeSnapshot(s); err != nil {
+			LogError.Printf("Snapshot failed: %s\n", err)
+			continue
+		}
+		removed, err := PruneSnapshots(SnapshotRetention, time.Now().UTC())
+		if err != nil {
+			LogError.Printf("Snapshot pruning failed: %s\n", err)
+		}
+		for _, name := range removed {
+			LogDebug.Printf("Snapshot %s pruned\n", name)
+		}
+	}
+}
+
+// SnapshotDiff holds what restoring a snapshot would change in the live database.
+// Added things are only in the snapshot, removed things are only in the live database.
+type SnapshotDiff struct {
+	Snapshot         string    `json:"snapshot"`
+	ListsAdded       []Keyword `json:"lists_added"`
+	ListsRemoved     []Keyword `json:"lists_removed"`
+	ListsChanged     []Keyword `json:"lists_changed"`
+	LinksAdded       []int     `json:"links_added"`
+	LinksRemoved     []int     `json:"links_removed"`
+	LinksChanged     []int     `json:"links_changed"`
+	VariablesAdded   []string  `json:"variables_added"`
+	VariablesRemoved []string  `json:"variables_removed"`
+	VariablesChanged []string  `json:"variables_changed"`
+}
+
+// DiffSnapshot compares the snapshot database snap against the live database d.
+// Callers hold SYNC for reading d.
+func DiffSnapshot(name string, d, snap *LinkDatabase) SnapshotDiff {
+	diff := SnapshotDiff{Snapshot: name}
+
+	for k, ll := range snap.Lists {
+		if live, exists := d.Lists[k]; !exists {
+			diff.ListsAdded = append(diff.ListsAdded, k)
+		} else if listChanged(live, ll) {
+			diff.ListsChanged = append(diff.ListsChanged, k)
+		}
+	}
+	for k := range d.Lists {
+		if _, exists := snap.Lists[k]; !exists {
+			diff.ListsRemoved = append(diff.ListsRemoved, k)
+		}
+	}
+
+	for id, l := range snap.Links {
+		if live, exists := d.Links[id]; !exists {
+			diff.LinksAdded = append(diff.LinksAdded, id)
+		} else if live.URL != l.URL || live.Title != l.Title || !live.Dtime.Equal(l.Dtime) {
+			diff.LinksChanged = append(diff.LinksChanged, id)
+		}
+	}
+	for id := range d.Links {
+		if _, exists := snap.Links[id]; !exists {
+			diff.LinksRemoved = append(diff.LinksRemoved, id)
+		}
+	}
+
+	// string and map variables share a namespace in the diff, maps get a trailing "{}"
+	liveVars, snapVars := variableValues(d), variableValues(snap)
+	for name, v := range snapVars {
+		if lv, exists := liveVars[name]; !exists {
+			diff.VariablesAdded = append(diff.VariablesAdded, name)
+		} else if lv != v {
+			diff.VariablesChanged = append(diff.VariablesChanged, name)
+		}
+	}
+	for name := range liveVars {
+		if _, exists := snapVars[name]; !exists {
+			diff.VariablesRemoved = append(diff.VariablesRemoved, name)
+		}
+	}
+
+	sort.Slice(diff.ListsAdded, func(i, j int) bool { return diff.ListsAdded[i] < diff.ListsAdded[j] })
+	sort.Slice(diff.ListsRemoved, func(i, j int) bool { return diff.ListsRemoved[i] < diff.ListsRemoved[j] })
+	sort.Slice(diff.ListsChanged, func(i, j int) bool { return diff.ListsChanged[i] < diff.ListsChanged[j] })
+	sort.Ints(diff.LinksAdded)
+	sort.Ints(diff.LinksRemoved)
+	sort.Ints(diff.LinksChanged)
+	sort.Strings(diff.VariablesAdded)
+	sort.Strings(diff.VariablesRemoved)
+	sort.Strings(diff.VariablesChanged)
+	return diff
+}
+
+// listChanged reports whether two versions of a list differ in behavior, members, or tags.
+func listChanged(a, b *ListOfLinks) bool {
+	if a.Behavior != b.Behavior || len(a.Links) != len(b.Links) {
+		return true
+	}
+	for id := range a.Links {
+		if _, exists := b.Links[id]; !exists {
+			return true
+		}
+		if strings.Join(a.TagBindings[id], " ") != strings.Join(b.TagBindings[id], " ") {
+			return true
+		}
+	}
+	return false
+}
+
+// variableValues flattens the variables of a database into comparable strings.
+func variableValues(d *LinkDatabase) map[string]string {
+	vals := make(map[string]string)
+	if d.Variables == nil {
+		return vals
+	}
+	for name, v := range d.Variables.Strings {
+		vals[name] = v
+	}
+	for name, m := range d.Variables.Maps {
+		data, _ := json.Marshal(m) // map keys are marshaled in sorted order
+		vals[name+"{}"] = string(data)
+	}
+	return vals
+}
@@ -0,0 +1,966 @@
+package core
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite" // registers the "sqlite" database/sql driver
+)
+
+/*
+SQLStore keeps the link database in a SQLite file with a relational schema, one table per
+kind of thing in the database. It's meant to be queried directly for reports, e.g. links
+nobody has clicked in 90 days:
+
+	SELECT id, url FROM links WHERE atime < datetime('now', '-90 days') AND clicks = 0;
+
+Times are stored as RFC 3339 text, the same as godb.json. Like the bolt backend, a
+checkpoint only rewrites the rows of entities that changed since the last one (see changes.go).
+
+The relational schema has its own version, kept in PRAGMA user_version. The godb.json
+schema migrations don't apply here. New tables are created by sqliteSchema, and changes
+to existing ones are made by sqliteUpgrades.
+*/
+type SQLStore struct {
+	Path string
+
+	mu    sync.Mutex
+	db    *sql.DB
+	saved *LinkDatabase // the database the last save or load was for
+}
+
+// sqliteSchemaVersion is the version of the tables created by sqliteSchema.
+const sqliteSchemaVersion = 3
+
+var sqliteSchema = []string{
+	`CREATE TABLE IF NOT EXISTS info (key TEXT PRIMARY KEY, value TEXT NOT NULL)`,
+	`CREATE TABLE IF NOT EXISTS lists (
+		keyword TEXT PRIMARY KEY,
+		behavior INTEGER NOT NULL,
+		clicks INTEGER NOT NULL,
+		usage TEXT NOT NULL,
+		logging INTEGER NOT NULL,
+		protection TEXT NOT NULL DEFAULT '',
+		visibility TEXT NOT NULL DEFAULT '')`,
+	`CREATE TABLE IF NOT EXISTS links (
+		id INTEGER PRIMARY KEY,
+		url TEXT NOT NULL,
+		title TEXT NOT NULL,
+		ctime TEXT NOT NULL,
+		mtime TEXT NOT NULL,
+		atime TEXT NOT NULL,
+		dtime TEXT NOT NULL,
+		clicks INTEGER NOT NULL)`,
+	// the users (is_group 0) and groups (is_group 1) owning each list, in order
+	`CREATE TABLE IF NOT EXISTS list_owners (
+		keyword TEXT NOT NULL,
+		is_group INTEGER NOT NULL,
+		position INTEGER NOT NULL,
+		owner TEXT NOT NULL,
+		PRIMARY KEY (keyword, is_group, position))`,
+	// the links in each list
+	`CREATE TABLE IF NOT EXISTS list_links (
+		keyword TEXT NOT NULL,
+		link_id INTEGER NOT NULL,
+		PRIMARY KEY (keyword, link_id))`,
+	`CREATE INDEX IF NOT EXISTS list_links_by_link ON list_links (link_id)`,
+	// the lists each link says it is in, in order
+	`CREATE TABLE IF NOT EXISTS link_lists (
+		link_id INTEGER NOT NULL,
+		position INTEGER NOT NULL,
+		keyword TEXT NOT NULL,
+		PRIMARY KEY (link_id, position))`,
+	`CREATE TABLE IF NOT EXISTS link_variables (
+		link_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		value TEXT NOT NULL,
+		PRIMARY KEY (link_id, name))`,
+	`CREATE TABLE IF NOT EXISTS tag_bindings (
+		keyword TEXT NOT NULL,
+		link_id INTEGER NOT NULL,
+		position INTEGER NOT NULL,
+		tag TEXT NOT NULL,
+		PRIMARY KEY (keyword, link_id, position))`,
+	`CREATE TABLE IF NOT EXISTS extractions (
+		keyword TEXT NOT NULL,
+		link_id INTEGER NOT NULL,
+		example_param TEXT NOT NULL,
+		regex TEXT NOT NULL,
+		PRIMARY KEY (keyword, link_id))`,
+	`CREATE TABLE IF NOT EXISTS string_vars (name TEXT PRIMARY KEY, value TEXT NOT NULL)`,
+	`CREATE TABLE IF NOT EXISTS map_vars (name TEXT PRIMARY KEY)`,
+	`CREATE TABLE IF NOT EXISTS map_var_entries (
+		name TEXT NOT NULL,
+		key TEXT NOT NULL,
+		value TEXT NOT NULL,
+		PRIMARY KEY (name, key))`,
+	`CREATE TABLE IF NOT EXISTS list_edits (
+		keyword TEXT NOT NULL,
+		position INTEGER NOT NULL,
+		edit_date TEXT NOT NULL,
+		edit_user TEXT NOT NULL,
+		edit_msg TEXT NOT NULL,
+		PRIMARY KEY (keyword, position))`,
+	`CREATE TABLE IF NOT EXISTS link_edits (
+		link_id INTEGER NOT NULL,
+		position INTEGER NOT NULL,
+		edit_date TEXT NOT NULL,
+		edit_user TEXT NOT NULL,
+		edit_msg TEXT NOT NULL,
+		PRIMARY KEY (link_id, position))`,
+	`CREATE TABLE IF NOT EXISTS link_log (
+		keyword TEXT NOT NULL,
+		position INTEGER NOT NULL,
+		usage TEXT NOT NULL,
+		PRIMARY KEY (keyword, position))`,
+	// API tokens, with their scopes space-separated
+	`CREATE TABLE IF NOT EXISTS api_tokens (
+		name TEXT PRIMARY KEY,
+		hash TEXT NOT NULL,
+		scopes TEXT NOT NULL,
+		created TEXT NOT NULL,
+		created_by TEXT NOT NULL)`,
+}
+
+/*
+sqliteUpgrades change the tables of a database made by an older redirector, by the version
+they bring it up to. Tables that are new in a version are made by sqliteSchema.
+*/
+var sqliteUpgrades = map[int][]string{
+	2: {`ALTER TABLE lists ADD COLUMN protection TEXT NOT NULL DEFAULT ''`},
+	3: {`ALTER TABLE lists ADD COLUMN visibility TEXT NOT NULL DEFAULT ''`},
+}
+
+// every table holding database contents, for full rewrites
+var sqliteTables = []string{"lists", "list_owners", "links", "list_links", "link_lists", "link_variables", "tag_bindings",
+	"extractions", "string_vars", "map_vars", "map_var_entries", "list_edits", "link_edits", "link_log", "api_tokens"}
+
+func init() {
+	RegisterStore("sqlite", OpenSQLStore)
+}
+
+// OpenSQLStore opens (or creates) the SQLite database file at path.
+func OpenSQLStore(path string) (Store, error) {
+	if path == "" {
+		return nil, errors.New("the sqlite storage backend needs a file name")
+	}
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open sqlite database %s: %s", path, err)
+	}
+	// one connection: SQLite allows a single writer anyway, and this keeps the pragmas on it
+	db.SetMaxOpenConns(1)
+
+	var version int
+	if err = db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not open sqlite database %s: %s", path, err)
+	}
+	if version > sqliteSchemaVersion {
+		db.Close()
+		return nil, fmt.Errorf("sqlite database %s has schema version %d, newer than this redirector supports (%d)", path, version, sqliteSchemaVersion)
+	}
+	stmts := []string{`PRAGMA busy_timeout = 5000`}
+	if version > 0 { // a brand new file gets the current tables from sqliteSchema
+		for v := version + 1; v <= sqliteSchemaVersion; v++ {
+			stmts = append(stmts, sqliteUpgrades[v]...)
+		}
+	}
+	for _, stmt := range append(stmts, sqliteSchema...) {
+		if _, err = db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("could not set up sqlite database %s: %s", path, err)
+		}
+	}
+	if _, err = db.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, sqliteSchemaVersion)); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLStore{Path: path, db: db}, nil
+}
+
+// sqlTime and parseSQLTime convert times the way encoding/json does.
+func sqlTime(t time.Time) string {
+	return t.Format(time.RFC3339Nano)
+}
+
+func parseSQLTime(s string) time.Time {
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		LogError.Printf("sqlite: bad time '%s': %s\n", s, err)
+	}
+	return t
+}
+
+// queryer is what reads need, so they work inside and outside a transaction.
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// eachRow runs a query and calls scan for every row.
+func eachRow(q queryer, scan func(rows *sql.Rows) error, query string, args ...interface{}) error {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err = scan(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Load reads every table and puts the database back together.
+func (q *SQLStore) Load() (*LinkDatabase, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var next string
+	err := q.db.QueryRow(`SELECT value FROM info WHERE key = 'next_link_id'`).Scan(&next)
+	if errors.Is(err, sql.ErrNoRows) {
+		// a new, empty file
+		q.saved = nil
+		return MakeNewLinkDatabase(), nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	d := MakeNewLinkDatabase()
+	d.NextLinkID, _ = strconv.Atoi(next)
+	var generation string
+	err = q.db.QueryRow(`SELECT value FROM info WHERE key = 'generation'`).Scan(&generation)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	d.Generation, _ = strconv.ParseUint(generation, 10, 64)
+	d.Variables.Strings = make(map[string]string)
+	d.Variables.Maps = make(map[string]map[string]string)
+
+	err = eachRow(q.db, func(rows *sql.Rows) error {
+		l, err := scanLink(rows)
+		d.Links[l.ID] = l
+		return err
+	}, `SELECT id, url, title, ctime, mtime, atime, dtime, clicks FROM links`)
+	if err == nil {
+		err = eachRow(q.db, func(rows *sql.Rows) error {
+			var id int
+			var kw string
+			err := rows.Scan(&id, &kw)
+			if l, exists := d.Links[id]; exists {
+				l.Lists = append(l.Lists, Keyword(kw))
+			}
+			return err
+		}, `SELECT link_id, keyword FROM link_lists ORDER BY link_id, position`)
+	}
+	if err == nil {
+		err = eachRow(q.db, func(rows *sql.Rows) error {
+			var id int
+			var name, value string
+			err := rows.Scan(&id, &name, &value)
+			if l, exists := d.Links[id]; exists {
+				l.LinkVariables[name] = value
+			}
+			return err
+		}, `SELECT link_id, name, value FROM link_variables`)
+	}
+	if err == nil {
+		err = eachRow(q.db, func(rows *sql.Rows) error {
+			ll, err := scanList(rows)
+			d.Lists[ll.Keyword] = ll
+			return err
+		}, `SELECT keyword, behavior, clicks, usage, logging, protection, visibility FROM lists`)
+	}
+	if err == nil {
+		err = eachRow(q.db, func(rows *sql.Rows) error {
+			return scanOwner(rows, d.Lists)
+		}, `SELECT keyword, is_group, owner FROM list_owners ORDER BY keyword, is_group, position`)
+	}
+	if err == nil {
+		err = eachRow(q.db, func(rows *sql.Rows) error {
+			return scanMember(rows, d.Lists, d.Links)
+		}, `SELECT keyword, link_id FROM list_links`)
+	}
+	if err == nil {
+		err = eachRow(q.db, func(rows *sql.Rows) error {
+			return scanTag(rows, d.Lists)
+		}, `SELECT keyword, link_id, tag FROM tag_bindings ORDER BY keyword, link_id, position`)
+	}
+	if err == nil {
+		err = eachRow(q.db, func(rows *sql.Rows) error {
+			return scanExtraction(rows, d.Lists)
+		}, `SELECT keyword, link_id, example_param, regex FROM extractions`)
+	}
+	if err == nil {
+		err = eachRow(q.db, func(rows *sql.Rows) error {
+			var name, value string
+			err := rows.Scan(&name, &value)
+			d.Variables.Strings[name] = value
+			return err
+		}, `SELECT name, value FROM string_vars`)
+	}
+	if err == nil {
+		err = eachRow(q.db, func(rows *sql.Rows) error {
+			var name string
+			err := rows.Scan(&name)
+			d.Variables.Maps[name] = make(map[string]string)
+			return err
+		}, `SELECT name FROM map_vars`)
+	}
+	if err == nil {
+		err = eachRow(q.db, func(rows *sql.Rows) error {
+			var name, key, value string
+			err := rows.Scan(&name, &key, &value)
+			if m, exists := d.Variables.Maps[name]; exists {
+				m[key] = value
+			}
+			return err
+		}, `SELECT name, key, value FROM map_var_entries`)
+	}
+	if err == nil {
+		err = eachRow(q.db, func(rows *sql.Rows) error {
+			var kw string
+			e, err := scanEdit(rows, &kw)
+			d.Metadata.ListEdits[Keyword(kw)] = append(d.Metadata.ListEdits[Keyword(kw)], e)
+			return err
+		}, `SELECT keyword, edit_date, edit_user, edit_msg FROM list_edits ORDER BY keyword, position`)
+	}
+	if err == nil {
+		err = eachRow(q.db, func(rows *sql.Rows) error {
+			var id int
+			e, err := scanEdit(rows, &id)
+			d.Metadata.LinkEdits[id] = append(d.Metadata.LinkEdits[id], e)
+			return err
+		}, `SELECT link_id, edit_date, edit_user, edit_msg FROM link_edits ORDER BY link_id, position`)
+	}
+	if err == nil {
+		err = eachRow(q.db, func(rows *sql.Rows) error {
+			var kw, usage string
+			err := rows.Scan(&kw, &usage)
+			d.LinkLog[Keyword(kw)] = append(d.LinkLog[Keyword(kw)], usage)
+			return err
+		}, `SELECT keyword, usage FROM link_log ORDER BY keyword, position`)
+	}
+	if err == nil {
+		err = eachRow(q.db, func(rows *sql.Rows) error {
+			var t APIToken
+			var scopes, created string
+			err := rows.Scan(&t.Name, &t.Hash, &scopes, &created, &t.CreatedBy)
+			t.Scopes, t.Created = strings.Fields(scopes), parseSQLTime(created)
+			if d.APITokens == nil {
+				d.APITokens = make(map[string]*APIToken)
+			}
+			d.APITokens[t.Name] = &t
+			return err
+		}, `SELECT name, hash, scopes, created, created_by FROM api_tokens`)
+	}
+	if err != nil {
+		return nil, err
+	}
+	q.saved = d
+	return d, err
+}
+
+func scanLink(rows *sql.Rows) (*Link, error) {
+	var l Link
+	var ctime, mtime, atime, dtime string
+	err := rows.Scan(&l.ID, &l.URL, &l.Title, &ctime, &mtime, &atime, &dtime, &l.Clicks)
+	l.Ctime, l.Mtime, l.Atime, l.Dtime = parseSQLTime(ctime), parseSQLTime(mtime), parseSQLTime(atime), parseSQLTime(dtime)
+	l.LinkVariables = make(map[string]string)
+	return &l, err
+}
+
+func scanList(rows *sql.Rows) (*ListOfLinks, error) {
+	var kw string
+	ll := ListOfLinks{
+		Links:       make(map[int]*Link),
+		TagBindings: make(map[int][]string),
+		Extractions: make(map[int]ExtractionCapture),
+	}
+	err := rows.Scan(&kw, &ll.Behavior, &ll.Clicks, &ll.Usage, &ll.Logging, &ll.Protection, &ll.Visibility)
+	ll.Keyword = Keyword(kw)
+	return &ll, err
+}
+
+// scanOwner adds an owner to its list.
+func scanOwner(rows *sql.Rows, lists map[Keyword]*ListOfLinks) error {
+	var kw, owner string
+	var group bool
+	err := rows.Scan(&kw, &group, &owner)
+	if ll, exists := lists[Keyword(kw)]; exists {
+		if group {
+			ll.OwnerGroups = append(ll.OwnerGroups, owner)
+		} else {
+			ll.Owners = append(ll.Owners, owner)
+		}
+	}
+	return err
+}
+
+// scanMember puts a link into its list. Links missing from the links table (which the
+// JSON backend would have kept a copy of) come back with only their ID.
+func scanMember(rows *sql.Rows, lists map[Keyword]*ListOfLinks, links map[int]*Link) error {
+	var kw string
+	var id int
+	err := rows.Scan(&kw, &id)
+	if ll, exists := lists[Keyword(kw)]; exists {
+		if l, exists := links[id]; exists {
+			ll.Links[id] = l
+		} else {
+			ll.Links[id] = &Link{ID: id}
+		}
+	}
+	return err
+}
+
+func scanTag(rows *sql.Rows, lists map[Keyword]*ListOfLinks) error {
+	var kw, tag string
+	var id int
+	err := rows.Scan(&kw, &id, &tag)
+	if ll, exists := lists[Keyword(kw)]; exists {
+		ll.TagBindings[id] = append(ll.TagBindings[id], tag)
+	}
+	return err
+}
+
+func scanExtraction(rows *sql.Rows, lists map[Keyword]*ListOfLinks) error {
+	var kw string
+	var id int
+	var x ExtractionCapture
+	err := rows.Scan(&kw, &id, &x.ExampleParam, &x.Regex)
+	if ll, exists := lists[Keyword(kw)]; exists {
+		ll.Extractions[id] = x
+	}
+	return err
+}
+
+// scanEdit reads an edit record, with the keyword or link ID it belongs to going into owner.
+func scanEdit(rows *sql.Rows, owner interface{}) (*EditRecord, error) {
+	var e EditRecord
+	var date string
+	err := rows.Scan(owner, &date, &e.EditUser, &e.EditMsg)
+	e.EditDate = parseSQLTime(date)
+	return &e, err
+}
+
+/*
+Save writes the database. For the database this store last loaded or saved, only the
+rows of entities in its change set are rewritten, in one transaction. Any other database
+(the first save, a restored snapshot, a conversion) replaces the contents of every table.
+If the transaction fails, the changes are kept for the next save.
+*/
+func (q *SQLStore) Save(d *LinkDatabase) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if d.saveAs() != q.saved {
+		err := q.update(func(tx *sql.Tx) error {
+			return sqlWriteAll(tx, d)
+		})
+		if err != nil {
+			return err
+		}
+		d.changes.take()
+		q.saved = d.saveAs()
+		return err
+	}
+
+	pending := d.changes.take()
+	err := q.update(func(tx *sql.Tx) error {
+		for ch := range pending {
+			if err := sqlWriteChange(tx, d, ch); err != nil {
+				return err
+			}
+		}
+		return sqlWriteSmall(tx, d)
+	})
+	if err != nil {
+		d.changes.giveBack(pending)
+	}
+	return err
+}
+
+// update runs fn in a transaction, committing it if fn succeeds.
+func (q *SQLStore) update(fn func(tx *sql.Tx) error) error {
+	tx, err := q.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err = fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func sqlWriteAll(tx *sql.Tx, d *LinkDatabase) error {
+	for _, table := range sqliteTables {
+		if _, err := tx.Exec(`DELETE FROM ` + table); err != nil {
+			return err
+		}
+	}
+	for _, ll := range d.Lists {
+		if err := sqlPutList(tx, ll); err != nil {
+			return err
+		}
+	}
+	for _, l := range d.Links {
+		if err := sqlPutLink(tx, l); err != nil {
+			return err
+		}
+	}
+	if d.Variables != nil {
+		for name, v := range d.Variables.Strings {
+			if err := sqlPutString(tx, name, v); err != nil {
+				return err
+			}
+		}
+		for name, m := range d.Variables.Maps {
+			if err := sqlPutMap(tx, name, m); err != nil {
+				return err
+			}
+		}
+	}
+	if d.Metadata != nil {
+		for k, e := range d.Metadata.ListEdits {
+			if err := sqlPutEdits(tx, "list_edits", "keyword", string(k), e); err != nil {
+				return err
+			}
+		}
+		for id, e := range d.Metadata.LinkEdits {
+			if err := sqlPutEdits(tx, "link_edits", "link_id", id, e); err != nil {
+				return err
+			}
+		}
+	}
+	for _, t := range d.APITokens {
+		if err := sqlPutToken(tx, t); err != nil {
+			return err
+		}
+	}
+	return sqlWriteSmall(tx, d)
+}
+
+// sqlWriteSmall writes the usage logs, the next link ID, and the generation.
+func sqlWriteSmall(tx *sql.Tx, d *LinkDatabase) error {
+	if _, err := tx.Exec(`DELETE FROM link_log`); err != nil {
+		return err
+	}
+	for k, usages := range d.LinkLog {
+		for i, usage := range usages {
+			if _, err := tx.Exec(`INSERT INTO link_log (keyword, position, usage) VALUES (?, ?, ?)`, string(k), i, usage); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := tx.Exec(`INSERT OR REPLACE INTO info (key, value) VALUES ('next_link_id', ?)`, strconv.Itoa(d.NextLinkID)); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`INSERT OR REPLACE INTO info (key, value) VALUES ('generation', ?)`, strconv.FormatUint(d.Generation, 10))
+	return err
+}
+
+// sqlWriteChange writes the current rows of one changed entity, or deletes them if it's gone.
+func sqlWriteChange(tx *sql.Tx, d *LinkDatabase, ch change) error {
+	switch ch.Kind {
+	case changeList:
+		if ll, exists := d.Lists[Keyword(ch.Key)]; exists {
+			return sqlPutList(tx, ll)
+		}
+		return sqlDeleteList(tx, Keyword(ch.Key))
+	case changeLink:
+		id, _ := strconv.Atoi(ch.Key)
+		if l, exists := d.Links[id]; exists {
+			return sqlPutLink(tx, l)
+		}
+		return sqlDeleteLink(tx, id)
+	case changeString:
+		if v, exists := d.Variables.Strings[ch.Key]; exists {
+			return sqlPutString(tx, ch.Key, v)
+		}
+		_, err := tx.Exec(`DELETE FROM string_vars WHERE name = ?`, ch.Key)
+		return err
+	case changeMap:
+		if m, exists := d.Variables.Maps[ch.Key]; exists {
+			return sqlPutMap(tx, ch.Key, m)
+		}
+		return sqlDeleteMap(tx, ch.Key)
+	case changeListEdits:
+		return sqlPutEdits(tx, "list_edits", "keyword", ch.Key, d.Metadata.ListEdits[Keyword(ch.Key)])
+	case changeLinkEdits:
+		id, _ := strconv.Atoi(ch.Key)
+		return sqlPutEdits(tx, "link_edits", "link_id", id, d.Metadata.LinkEdits[id])
+	case changeToken:
+		if t, exists := d.APITokens[ch.Key]; exists {
+			return sqlPutToken(tx, t)
+		}
+		_, err := tx.Exec(`DELETE FROM api_tokens WHERE name = ?`, ch.Key)
+		return err
+	case changeLinkLog:
+		return nil // see sqlWriteSmall
+	}
+	return fmt.Errorf("unknown change kind '%s'", ch.Kind)
+}
+
+func sqlDeleteList(tx *sql.Tx, k Keyword) error {
+	for _, table := range []string{"lists", "list_owners", "list_links", "tag_bindings", "extractions"} {
+		if _, err := tx.Exec(`DELETE FROM `+table+` WHERE keyword = ?`, string(k)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sqlPutList(tx *sql.Tx, ll *ListOfLinks) error {
+	if err := sqlDeleteList(tx, ll.Keyword); err != nil {
+		return err
+	}
+	kw := string(ll.Keyword)
+	_, err := tx.Exec(`INSERT INTO lists (keyword, behavior, clicks, usage, logging, protection, visibility) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		kw, ll.Behavior, ll.Clicks, ll.Usage, ll.Logging, ll.Protection, ll.Visibility)
+	if err != nil {
+		return err
+	}
+	for group, owners := range [][]string{ll.Owners, ll.OwnerGroups} {
+		for i, owner := range owners {
+			if _, err = tx.Exec(`INSERT INTO list_owners (keyword, is_group, position, owner) VALUES (?, ?, ?, ?)`, kw, group, i, owner); err != nil {
+				return err
+			}
+		}
+	}
+	for id := range ll.Links {
+		if _, err = tx.Exec(`INSERT INTO list_links (keyword, link_id) VALUES (?, ?)`, kw, id); err != nil {
+			return err
+		}
+	}
+	for id, tags := range ll.TagBindings {
+		for i, tag := range tags {
+			if _, err = tx.Exec(`INSERT INTO tag_bindings (keyword, link_id, position, tag) VALUES (?, ?, ?, ?)`, kw, id, i, tag); err != nil {
+				return err
+			}
+		}
+	}
+	for id, x := range ll.Extractions {
+		if _, err = tx.Exec(`INSERT INTO extractions (keyword, link_id, example_param, regex) VALUES (?, ?, ?, ?)`, kw, id, x.ExampleParam, x.Regex); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func sqlDeleteLink(tx *sql.Tx, id int) error {
+	if _, err := tx.Exec(`DELETE FROM links WHERE id = ?`, id); err != nil {
+		return err
+	}
+	for _, table := range []string{"link_lists", "link_variables"} {
+		if _, err := tx.Exec(`DELETE FROM `+table+` WHERE link_id = ?`, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sqlPutLink(tx *sql.Tx, l *Link) error {
+	if err := sqlDeleteLink(tx, l.ID); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`INSERT INTO links (id, url, title, ctime, mtime, atime, dtime, clicks) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		l.ID, l.URL, l.Title, sqlTime(l.Ctime), sqlTime(l.Mtime), sqlTime(l.Atime), sqlTime(l.Dtime), l.Clicks)
+	if err != nil {
+		return err
+	}
+	for i, kw := range l.Lists {
+		if _, err = tx.Exec(`INSERT INTO link_lists (link_id, position, keyword) VALUES (?, ?, ?)`, l.ID, i, string(kw)); err != nil {
+			return err
+		}
+	}
+	for name, value := range l.LinkVariables {
+		if _, err = tx.Exec(`INSERT INTO link_variables (link_id, name, value) VALUES (?, ?, ?)`, l.ID, name, value); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func sqlPutString(tx *sql.Tx, name, value string) error {
+	_, err := tx.Exec(`INSERT OR REPLACE INTO string_vars (name, value) VALUES (?, ?)`, name, value)
+	return err
+}
+
+func sqlDeleteMap(tx *sql.Tx, name string) error {
+	if _, err := tx.Exec(`DELETE FROM map_vars WHERE name = ?`, name); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`DELETE FROM map_var_entries WHERE name = ?`, name)
+	return err
+}
+
+func sqlPutMap(tx *sql.Tx, name string, m map[string]string) error {
+	if err := sqlDeleteMap(tx, name); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO map_vars (name) VALUES (?)`, name); err != nil {
+		return err
+	}
+	for key, value := range m {
+		if _, err := tx.Exec(`INSERT INTO map_var_entries (name, key, value) VALUES (?, ?, ?)`, name, key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sqlPutEdits replaces the edit history of a list or link. table and column are one of
+// list_edits/keyword or link_edits/link_id.
+func sqlPutEdits(tx *sql.Tx, table, column string, owner interface{}, edits []*EditRecord) error {
+	if _, err := tx.Exec(`DELETE FROM `+table+` WHERE `+column+` = ?`, owner); err != nil {
+		return err
+	}
+	for i, e := range edits {
+		_, err := tx.Exec(`INSERT INTO `+table+` (`+column+`, position, edit_date, edit_user, edit_msg) VALUES (?, ?, ?, ?, ?)`,
+			owner, i, sqlTime(e.EditDate), e.EditUser, e.EditMsg)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sqlPutToken(tx *sql.Tx, t *APIToken) error {
+	_, err := tx.Exec(`INSERT OR REPLACE INTO api_tokens (name, hash, scopes, created, created_by) VALUES (?, ?, ?, ?, ?)`,
+		t.Name, t.Hash, strings.Join(t.Scopes, " "), sqlTime(t.Created), t.CreatedBy)
+	return err
+}
+
+// GetList returns a stored list. Its links only have their IDs filled in.
+func (q *SQLStore) GetList(k Keyword) (*ListOfLinks, error) {
+	lists := make(map[Keyword]*ListOfLinks)
+	err := eachRow(q.db, func(rows *sql.Rows) error {
+		ll, err := scanList(rows)
+		lists[ll.Keyword] = ll
+		return err
+	}, `SELECT keyword, behavior, clicks, usage, logging, protection, visibility FROM lists WHERE keyword = ?`, string(k))
+	if err != nil {
+		return nil, err
+	}
+	ll, exists := lists[k]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	err = eachRow(q.db, func(rows *sql.Rows) error {
+		return scanOwner(rows, lists)
+	}, `SELECT keyword, is_group, owner FROM list_owners WHERE keyword = ? ORDER BY is_group, position`, string(k))
+	if err == nil {
+		err = eachRow(q.db, func(rows *sql.Rows) error {
+			return scanMember(rows, lists, nil)
+		}, `SELECT keyword, link_id FROM list_links WHERE keyword = ?`, string(k))
+	}
+	if err == nil {
+		err = eachRow(q.db, func(rows *sql.Rows) error {
+			return scanTag(rows, lists)
+		}, `SELECT keyword, link_id, tag FROM tag_bindings WHERE keyword = ? ORDER BY link_id, position`, string(k))
+	}
+	if err == nil {
+		err = eachRow(q.db, func(rows *sql.Rows) error {
+			return scanExtraction(rows, lists)
+		}, `SELECT keyword, link_id, example_param, regex FROM extractions WHERE keyword = ?`, string(k))
+	}
+	return ll, err
+}
+
+func (q *SQLStore) PutList(ll *ListOfLinks) error {
+	return q.update(func(tx *sql.Tx) error {
+		return sqlPutList(tx, ll)
+	})
+}
+
+func (q *SQLStore) DeleteList(k Keyword) error {
+	return q.update(func(tx *sql.Tx) error {
+		return sqlDeleteList(tx, k)
+	})
+}
+
+func (q *SQLStore) GetLink(id int) (*Link, error) {
+	var l *Link
+	err := eachRow(q.db, func(rows *sql.Rows) error {
+		var err error
+		l, err = scanLink(rows)
+		return err
+	}, `SELECT id, url, title, ctime, mtime, atime, dtime, clicks FROM links WHERE id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	if l == nil {
+		return nil, ErrNotFound
+	}
+	err = eachRow(q.db, func(rows *sql.Rows) error {
+		var kw string
+		err := rows.Scan(&kw)
+		l.Lists = append(l.Lists, Keyword(kw))
+		return err
+	}, `SELECT keyword FROM link_lists WHERE link_id = ? ORDER BY position`, id)
+	if err == nil {
+		err = eachRow(q.db, func(rows *sql.Rows) error {
+			var name, value string
+			err := rows.Scan(&name, &value)
+			l.LinkVariables[name] = value
+			return err
+		}, `SELECT name, value FROM link_variables WHERE link_id = ?`, id)
+	}
+	return l, err
+}
+
+func (q *SQLStore) PutLink(l *Link) error {
+	return q.update(func(tx *sql.Tx) error {
+		if err := sqlPutLink(tx, l); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`INSERT INTO info (key, value) VALUES ('next_link_id', ?)
+			ON CONFLICT (key) DO UPDATE SET value = MAX(CAST(value AS INTEGER), CAST(excluded.value AS INTEGER))`, strconv.Itoa(l.ID+1))
+		return err
+	})
+}
+
+func (q *SQLStore) DeleteLink(id int) error {
+	return q.update(func(tx *sql.Tx) error {
+		return sqlDeleteLink(tx, id)
+	})
+}
+
+func (q *SQLStore) GetStringVar(name string) (string, error) {
+	var v string
+	err := q.db.QueryRow(`SELECT value FROM string_vars WHERE name = ?`, name).Scan(&v)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrNotFound
+	}
+	return v, err
+}
+
+func (q *SQLStore) PutStringVar(name, value string) error {
+	return q.update(func(tx *sql.Tx) error {
+		return sqlPutString(tx, name, value)
+	})
+}
+
+func (q *SQLStore) DeleteStringVar(name string) error {
+	_, err := q.db.Exec(`DELETE FROM string_vars WHERE name = ?`, name)
+	return err
+}
+
+func (q *SQLStore) GetMapVar(name string) (map[string]string, error) {
+	var found string
+	err := q.db.QueryRow(`SELECT name FROM map_vars WHERE name = ?`, name).Scan(&found)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	m := make(map[string]string)
+	err = eachRow(q.db, func(rows *sql.Rows) error {
+		var key, value string
+		err := rows.Scan(&key, &value)
+		m[key] = value
+		return err
+	}, `SELECT key, value FROM map_var_entries WHERE name = ?`, name)
+	return m, err
+}
+
+func (q *SQLStore) PutMapVar(name string, m map[string]string) error {
+	return q.update(func(tx *sql.Tx) error {
+		return sqlPutMap(tx, name, m)
+	})
+}
+
+func (q *SQLStore) DeleteMapVar(name string) error {
+	return q.update(func(tx *sql.Tx) error {
+		return sqlDeleteMap(tx, name)
+	})
+}
+
+func (q *SQLStore) LoadMetadata() (*Metadata, error) {
+	m := MakeNewMetadata()
+	err := eachRow(q.db, func(rows *sql.Rows) error {
+		var kw string
+		e, err := scanEdit(rows, &kw)
+		m.ListEdits[Keyword(kw)] = append(m.ListEdits[Keyword(kw)], e)
+		return err
+	}, `SELECT keyword, edit_date, edit_user, edit_msg FROM list_edits ORDER BY keyword, position`)
+	if err == nil {
+		err = eachRow(q.db, func(rows *sql.Rows) error {
+			var id int
+			e, err := scanEdit(rows, &id)
+			m.LinkEdits[id] = append(m.LinkEdits[id], e)
+			return err
+		}, `SELECT link_id, edit_date, edit_user, edit_msg FROM link_edits ORDER BY link_id, position`)
+	}
+	return m, err
+}
+
+func (q *SQLStore) SaveMetadata(m *Metadata) error {
+	return q.update(func(tx *sql.Tx) error {
+		for _, table := range []string{"list_edits", "link_edits"} {
+			if _, err := tx.Exec(`DELETE FROM ` + table); err != nil {
+				return err
+			}
+		}
+		for k, e := range m.ListEdits {
+			if err := sqlPutEdits(tx, "list_edits", "keyword", string(k), e); err != nil {
+				return err
+			}
+		}
+		for id, e := range m.LinkEdits {
+			if err := sqlPutEdits(tx, "link_edits", "link_id", id, e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (q *SQLStore) GetListEdits(k Keyword) ([]*EditRecord, error) {
+	var edits []*EditRecord
+	err := eachRow(q.db, func(rows *sql.Rows) error {
+		var kw string
+		e, err := scanEdit(rows, &kw)
+		edits = append(edits, e)
+		return err
+	}, `SELECT keyword, edit_date, edit_user, edit_msg FROM list_edits WHERE keyword = ? ORDER BY position`, string(k))
+	return edits, err
+}
+
+func (q *SQLStore) PutListEdits(k Keyword, e []*EditRecord) error {
+	return q.update(func(tx *sql.Tx) error {
+		return sqlPutEdits(tx, "list_edits", "keyword", string(k), e)
+	})
+}
+
+func (q *SQLStore) GetLinkEdits(id int) ([]*EditRecord, error) {
+	var edits []*EditRecord
+	err := eachRow(q.db, func(rows *sql.Rows) error {
+		var owner int
+		e, err := scanEdit(rows, &owner)
+		edits = append(edits, e)
+		return err
+	}, `SELECT link_id, edit_date, edit_user, edit_msg FROM link_edits WHERE link_id = ? ORDER BY position`, id)
+	return edits, err
+}
+
+func (q *SQLStore) PutLinkEdits(id int, e []*EditRecord) error {
+	return q.update(func(tx *sql.Tx) error {
+		return sqlPutEdits(tx, "link_edits", "link_id", id, e)
+	})
+}
+
+// Close closes the SQLite file.
+func (q *SQLStore) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.saved = nil
+	return q.db.Close()
+}
@@ -0,0 +1,161 @@
+package core
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+Replication status
+
+Status reports what this redirector knows about its place in a failover pair or cluster:
+its role, its term, how far along the replication stream it is, and how current each peer
+is. It's what /_cluster_ serves, for load balancers and dashboards.
+
+Lag is counted in edits on the side sending them, the active or leader: the edits it has
+sent or is about to send that the peer hasn't acknowledged. Either side can tell how long
+ago it last heard from the other, which is LastSync.
+*/
+
+// Replication modes.
+const (
+	ModeStandalone = "standalone"
+	ModeFailover   = "failover"
+	ModeCluster    = "cluster"
+)
+
+// Failover pair roles.
+const (
+	RoleActive  = "active"
+	RoleStandby = "standby"
+)
+
+// LocalNode is the cluster node this redirector runs, if it's in a cluster.
+var LocalNode *ClusterNode
+
+// PeerStatus is what this redirector knows about one peer.
+type PeerStatus struct {
+	Address  string     `json:"address"`
+	Leader   bool       `json:"leader,omitempty"`    // the active or leader we follow
+	Acked    uint64     `json:"acked,omitempty"`     // the last edit it acknowledged, when we send to it
+	Lag      uint64     `json:"lag"`                 // edits it hasn't acknowledged, when we send to it
+	LastSync *time.Time `json:"last_sync,omitempty"` // when we last heard from it over the stream
+}
+
+// ClusterStatus is what /_cluster_ reports.
+type ClusterStatus struct {
+	Mode        string       `json:"mode"`
+	Role        string       `json:"role"`
+	Node        string       `json:"node,omitempty"`   // our own peer address
+	Leader      string       `json:"leader,omitempty"` // the cluster leader we last heard from
+	Term        uint64       `json:"term"`
+	Stream      string       `json:"stream,omitempty"`
+	Sequence    uint64       `json:"sequence"` // the last edit sent, or applied by a standby
+	Generation  uint64       `json:"generation"`
+	Peers       []PeerStatus `json:"peers,omitempty"`
+	Maintenance bool         `json:"maintenance"`             // see switchover.go
+	LastChange  *time.Time   `json:"last_change,omitempty"`   // when the role last changed
+	Reason      string       `json:"change_reason,omitempty"` // and why
+}
+
+var roleChange struct {
+	mu     sync.Mutex
+	at     time.Time
+	reason string
+}
+
+// noteRoleChange keeps why a failover peer last changed roles.
+func noteRoleChange(reason string) {
+	roleChange.mu.Lock()
+	defer roleChange.mu.Unlock()
+	roleChange.at, roleChange.reason = time.Now(), reason
+}
+
+// timeOrNil leaves times that never happened out of the JSON.
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// Status reports on the live database's replication, guarded by s.
+func Status(s *sync.RWMutex) *ClusterStatus {
+	if LocalNode != nil {
+		return LocalNode.Status()
+	}
+	s.RLock()
+	log, generation := LinkDataBase.replication, LinkDataBase.Generation
+	s.RUnlock()
+	st := &ClusterStatus{Mode: ModeStandalone, Role: RoleActive, Generation: generation, Maintenance: InMaintenance()}
+	if FailoverPeer != "" {
+		failoverStatus(st, log)
+	}
+	return st
+}
+
+// failoverStatus fills in a failover pair's status, sending with log when we're active.
+func failoverStatus(st *ClusterStatus, log *ReplicationLog) {
+	st.Mode, st.Node, st.Term = ModeFailover, FailoverLocal, CurrentTerm()
+	roleChange.mu.Lock()
+	st.LastChange, st.Reason = timeOrNil(roleChange.at), roleChange.reason
+	roleChange.mu.Unlock()
+	peer := PeerStatus{Address: FailoverPeer}
+	if IsActive() {
+		if log != nil {
+			st.Stream, st.Sequence = log.Stream, log.Latest()
+			peer.Acked, peer.LastSync = log.Acked(), timeOrNil(log.AckedAt())
+			peer.Lag = lag(st.Sequence, peer.Acked)
+		}
+	} else {
+		st.Role, peer.Leader = RoleStandby, true
+		standbyReplica.posMu.Lock()
+		st.Stream, st.Sequence = standbyReplica.stream, standbyReplica.applied
+		peer.LastSync = timeOrNil(standbyReplica.syncedAt)
+		standbyReplica.posMu.Unlock()
+	}
+	st.Peers = []PeerStatus{peer}
+}
+
+// lag counts the edits after acked, up to latest.
+func lag(latest, acked uint64) uint64 {
+	if acked > latest {
+		return 0
+	}
+	return latest - acked
+}
+
+// Status reports on the node's role and its followers, or the leader it follows.
+func (n *ClusterNode) Status() *ClusterStatus {
+	st := &ClusterStatus{Mode: ModeCluster, Maintenance: InMaintenance()}
+	n.ref.lock.RLock()
+	st.Generation = (*n.ref.db).Generation
+	n.ref.lock.RUnlock()
+	n.replica.posMu.Lock()
+	stream, applied, synced := n.replica.stream, n.replica.applied, n.replica.syncedAt
+	n.replica.posMu.Unlock()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	st.Role, st.Node, st.Leader, st.Term = n.role, n.ID, n.leader, n.term
+	st.LastChange, st.Reason = timeOrNil(n.changed), n.why
+	leading := n.role == RoleLeader
+	if leading {
+		st.Stream, st.Sequence = n.log.Stream, n.log.Latest()
+	} else {
+		st.Stream, st.Sequence = stream, applied
+	}
+	for _, addr := range n.Peers {
+		peer := PeerStatus{Address: addr, Leader: addr == n.leader && !leading}
+		if leading {
+			peer.Acked = n.acked[addr]
+			if _, ok := n.acked[addr]; ok {
+				peer.LastSync = timeOrNil(n.contact[addr])
+			}
+			peer.Lag = lag(st.Sequence, peer.Acked)
+		} else if peer.Leader {
+			peer.LastSync = timeOrNil(synced)
+		}
+		st.Peers = append(st.Peers, peer)
+	}
+	return st
+}
@@ -0,0 +1,439 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+/*
+Storage backends
+
+The link database is held in memory while the redirector runs. A Store is the thing
+holding it between runs. Each backend can load and save the whole database, and it can
+also get, put, and delete the individual entities inside it: lists, links, variables, and
+the edit metadata for lists and links.
+
+Backends register themselves by name with RegisterStore. The config file selects one
+with "storage_backend" and main.go opens it with OpenStore. The JSON file backend is the
+default and is what godb.json has always been.
+*/
+
+// ErrNotFound is returned by a Store when the requested entity does not exist.
+var ErrNotFound = errors.New("not found in store")
+
+// Store is implemented by every persistence backend for the link database.
+// Callers are expected to hold SYNC while they use a Store with the live database.
+type Store interface {
+	// whole database
+	Load() (*LinkDatabase, error)
+	Save(d *LinkDatabase) error
+
+	// lists of links, by keyword
+	GetList(k Keyword) (*ListOfLinks, error)
+	PutList(ll *ListOfLinks) error
+	DeleteList(k Keyword) error
+
+	// links, by link ID
+	GetLink(id int) (*Link, error)
+	PutLink(l *Link) error
+	DeleteLink(id int) error
+
+	// user variables, by name
+	GetStringVar(name string) (string, error)
+	PutStringVar(name, value string) error
+	DeleteStringVar(name string) error
+	GetMapVar(name string) (map[string]string, error)
+	PutMapVar(name string, m map[string]string) error
+	DeleteMapVar(name string) error
+
+	// edit metadata
+	LoadMetadata() (*Metadata, error)
+	SaveMetadata(m *Metadata) error
+	GetListEdits(k Keyword) ([]*EditRecord, error)
+	PutListEdits(k Keyword, e []*EditRecord) error
+	GetLinkEdits(id int) ([]*EditRecord, error)
+	PutLinkEdits(id int, e []*EditRecord) error
+
+	Close() error
+}
+
+// StoreOpener opens a backend at the given path (a file name, for the backends we have now).
+type StoreOpener func(path string) (Store, error)
+
+var storeBackends = map[string]StoreOpener{
+	"json": OpenJSONFileStore,
+}
+
+// DBStore is the backend the running redirector loads from and checkpoints to.
+var DBStore Store
+
+// RegisterStore makes a storage backend available to OpenStore under the given name.
+func RegisterStore(name string, open StoreOpener) {
+	storeBackends[name] = open
+}
+
+// OpenStore opens the named storage backend. An empty name means the JSON file backend.
+func OpenStore(name, path string) (Store, error) {
+	if name == "" {
+		name = "json"
+	}
+	open, exists := storeBackends[name]
+	if !exists {
+		return nil, fmt.Errorf("unknown storage backend '%s'", name)
+	}
+	return open(path)
+}
+
+// LoadDatabase reads the entire link database out of a store and makes it the live
+// LinkDataBase.
+func LoadDatabase(st Store, s *sync.RWMutex) error {
+	s.Lock()
+	defer s.Unlock()
+	d, err := st.Load()
+	if err != nil {
+		return err
+	}
+	LinkDataBase = d
+	return err
+}
+
+// CopyStore loads the whole database out of one store and saves it into another. This is
+// how a godb.json file is converted to a different backend.
+func CopyStore(from, to Store) (*LinkDatabase, error) {
+	d, err := from.Load()
+	if err != nil {
+		return nil, err
+	}
+	return d, to.Save(d)
+}
+
+/*
+JSONFileStore is the original storage backend: the whole link database marshaled
+into a single JSON file (godb.json). Edit metadata used to be kept in a second file,
+which schema migration 4 moves into the database, see migrations.go.
+
+This backend has no way to write a single record, so the per-entity functions
+work on a cached copy of the document and rewrite the whole file each time. The copy is
+read off the disk for the store's own use, never one handed to or from Load and Save,
+so they can't change the live database behind SYNC's back. Only Save rotates the
+numbered backups, the per-entity writes would churn through them.
+*/
+type JSONFileStore struct {
+	Path    string
+	Backups int // numbered copies of the previous file kept by Save
+
+	mu  sync.Mutex
+	doc *LinkDatabase
+}
+
+// OpenJSONFileStore returns a JSON file backend for the link database at path.
+// Nothing is read from the disk until the store is used.
+func OpenJSONFileStore(path string) (Store, error) {
+	if path == "" {
+		return nil, errors.New("the JSON storage backend needs a file name")
+	}
+	return &JSONFileStore{Path: path, Backups: CheckpointBackups}, nil
+}
+
+// Load reads and parses the JSON database file, migrating it if it was written with an
+// older schema version.
+func (j *JSONFileStore) Load() (*LinkDatabase, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.load()
+}
+
+func (j *JSONFileStore) load() (*LinkDatabase, error) {
+	var tempdb LinkDatabase
+	data, err := os.ReadFile(j.Path)
+	if err != nil {
+		return nil, err
+	}
+	data, err = migrateOnLoad(data)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &tempdb)
+	if err != nil {
+		LogError.Printf("json parsing error: %s", err)
+		return nil, err
+	}
+	return &tempdb, err
+}
+
+// Save writes out the entire database. It goes through WriteFileAtomic, so the previous
+// copy survives a failed write and a numbered backup of it is kept.
+func (j *JSONFileStore) Save(d *LinkDatabase) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.doc = nil               // out of date now, it's read again when it's next needed
+	taken := d.changes.take() // everything is written, this backend has no use for them
+	err := j.write(d, j.Backups)
+	if err != nil {
+		d.changes.giveBack(taken) // so the next checkpoint doesn't think nothing changed
+	}
+	return err
+}
+
+func (j *JSONFileStore) write(d *LinkDatabase, backups int) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		LogError.Println("JSON marshal error:", err)
+		return err
+	}
+	return WriteFileAtomic(j.Path, data, backups)
+}
+
+// document returns the cached database, reading it off the disk the first time.
+func (j *JSONFileStore) document() (*LinkDatabase, error) {
+	if j.doc != nil {
+		return j.doc, nil
+	}
+	d, err := j.load()
+	if errors.Is(err, os.ErrNotExist) {
+		d, err = MakeNewLinkDatabase(), nil
+	}
+	if err == nil {
+		j.doc = d
+	}
+	return d, err
+}
+
+func (j *JSONFileStore) GetList(k Keyword) (*ListOfLinks, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	d, err := j.document()
+	if err != nil {
+		return nil, err
+	}
+	if ll, exists := d.Lists[k]; exists {
+		return ll, nil
+	}
+	return nil, ErrNotFound
+}
+
+func (j *JSONFileStore) PutList(ll *ListOfLinks) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	d, err := j.document()
+	if err != nil {
+		return err
+	}
+	d.Lists[ll.Keyword] = ll
+	return j.write(d, 0)
+}
+
+func (j *JSONFileStore) DeleteList(k Keyword) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	d, err := j.document()
+	if err != nil {
+		return err
+	}
+	delete(d.Lists, k)
+	return j.write(d, 0)
+}
+
+func (j *JSONFileStore) GetLink(id int) (*Link, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	d, err := j.document()
+	if err != nil {
+		return nil, err
+	}
+	if l, exists := d.Links[id]; exists {
+		return l, nil
+	}
+	return nil, ErrNotFound
+}
+
+func (j *JSONFileStore) PutLink(l *Link) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	d, err := j.document()
+	if err != nil {
+		return err
+	}
+	d.Links[l.ID] = l
+	if l.ID >= d.NextLinkID {
+		d.NextLinkID = l.ID + 1
+	}
+	return j.write(d, 0)
+}
+
+func (j *JSONFileStore) DeleteLink(id int) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	d, err := j.document()
+	if err != nil {
+		return err
+	}
+	delete(d.Links, id)
+	return j.write(d, 0)
+}
+
+func (j *JSONFileStore) GetStringVar(name string) (string, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	d, err := j.document()
+	if err != nil {
+		return "", err
+	}
+	if d.Variables != nil {
+		if v, exists := d.Variables.Strings[name]; exists {
+			return v, nil
+		}
+	}
+	return "", ErrNotFound
+}
+
+func (j *JSONFileStore) PutStringVar(name, value string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	d, err := j.document()
+	if err != nil {
+		return err
+	}
+	if d.Variables == nil {
+		d.Variables = &UserVariables{}
+	}
+	if d.Variables.Strings == nil {
+		d.Variables.Strings = make(map[string]string)
+	}
+	d.Variables.Strings[name] = value
+	return j.write(d, 0)
+}
+
+func (j *JSONFileStore) DeleteStringVar(name string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	d, err := j.document()
+	if err != nil {
+		return err
+	}
+	if d.Variables != nil {
+		delete(d.Variables.Strings, name)
+	}
+	return j.write(d, 0)
+}
+
+func (j *JSONFileStore) GetMapVar(name string) (map[string]string, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	d, err := j.document()
+	if err != nil {
+		return nil, err
+	}
+	if d.Variables != nil {
+		if m, exists := d.Variables.Maps[name]; exists {
+			return m, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (j *JSONFileStore) PutMapVar(name string, m map[string]string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	d, err := j.document()
+	if err != nil {
+		return err
+	}
+	if d.Variables == nil {
+		d.Variables = &UserVariables{}
+	}
+	if d.Variables.Maps == nil {
+		d.Variables.Maps = make(map[string]map[string]string)
+	}
+	d.Variables.Maps[name] = m
+	return j.write(d, 0)
+}
+
+func (j *JSONFileStore) DeleteMapVar(name string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	d, err := j.document()
+	if err != nil {
+		return err
+	}
+	if d.Variables != nil {
+		delete(d.Variables.Maps, name)
+	}
+	return j.write(d, 0)
+}
+
+// LoadMetadata returns the edit metadata kept in the database.
+func (j *JSONFileStore) LoadMetadata() (*Metadata, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	d, err := j.document()
+	if err != nil {
+		return nil, err
+	}
+	return d.Metadata, nil
+}
+
+func (j *JSONFileStore) SaveMetadata(m *Metadata) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	d, err := j.document()
+	if err != nil {
+		return err
+	}
+	d.Metadata = m
+	d.initMetadata()
+	return j.write(d, 0)
+}
+
+func (j *JSONFileStore) GetListEdits(k Keyword) ([]*EditRecord, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	d, err := j.document()
+	if err != nil {
+		return nil, err
+	}
+	return d.Metadata.ListEdits[k], nil
+}
+
+func (j *JSONFileStore) PutListEdits(k Keyword, e []*EditRecord) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	d, err := j.document()
+	if err != nil {
+		return err
+	}
+	d.Metadata.ListEdits[k] = e
+	return j.write(d, 0)
+}
+
+func (j *JSONFileStore) GetLinkEdits(id int) ([]*EditRecord, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	d, err := j.document()
+	if err != nil {
+		return nil, err
+	}
+	return d.Metadata.LinkEdits[id], nil
+}
+
+func (j *JSONFileStore) PutLinkEdits(id int, e []*EditRecord) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	d, err := j.document()
+	if err != nil {
+		return err
+	}
+	d.Metadata.LinkEdits[id] = e
+	return j.write(d, 0)
+}
+
+// Close drops the cached copy of the database. The files need no other cleanup.
+func (j *JSONFileStore) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.doc = nil
+	return nil
+}
@@ -0,0 +1,347 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Switchover and maintenance mode
+
+A switchover moves the active role to the standby on purpose, say to patch the active,
+instead of waiting for the standby to miss it. The active stops taking changes and waits
+for the standby to acknowledge every one it has made. Then it hands off: it tells the
+standby, on a connection of its own, how far along the stream it got. A standby that has
+everything up to there takes over in a new term straight away, and the old active carries
+on as its standby. If the standby doesn't catch up within replicationTimeout, or won't take
+over, the active goes back to taking changes.
+
+A cluster leader does the same with a follower that has acknowledged everything. That
+follower stands for election at once, and the others vote for it even though they've
+heard from their leader lately.
+
+Maintenance mode keeps a standby from taking over when the active goes quiet, and a cluster
+follower from standing for election, so the active or leader can be restarted without a
+failover. It lasts until it's turned off or the redirector restarts. A standby in
+maintenance mode won't take a handoff either.
+
+Both are admin actions, see Control. They can be asked for over HTTP (see RouteClusterAdmin)
+or, with the -switchover and -maintenance flags, over the peer connection.
+*/
+
+// Admin actions, see Control.
+const (
+	ControlSwitchover     = "switchover"
+	ControlMaintenanceOn  = "maintenance-on"
+	ControlMaintenanceOff = "maintenance-off"
+)
+
+var maintenance atomic.Bool
+
+// handedOff is told why when the active hands off to this standby, see WaitForFailure.
+var handedOff = make(chan string, 1)
+
+// failover is what a failover pair's switchover needs, once RunFailoverMonitor is running.
+var failover struct {
+	updates chan uint64
+	s       *sync.RWMutex
+}
+
+// InMaintenance reports whether automatic promotion is turned off.
+func InMaintenance() bool {
+	return maintenance.Load()
+}
+
+// SetMaintenance turns maintenance mode on or off.
+func SetMaintenance(on bool) {
+	if maintenance.Swap(on) != on {
+		LogInfo.Printf("Maintenance mode is now %v\n", on)
+	}
+}
+
+/*
+Control carries out an admin action on this redirector, and says what came of it. An
+action it doesn't know is ErrNotFound.
+*/
+func Control(action string) (string, error) {
+	switch action {
+	case ControlSwitchover:
+		return Switchover()
+	case ControlMaintenanceOn:
+		SetMaintenance(true)
+		return "maintenance mode is on, this redirector won't take over on its own", nil
+	case ControlMaintenanceOff:
+		SetMaintenance(false)
+		return "maintenance mode is off", nil
+	}
+	return "", ErrNotFound
+}
+
+/*
+TakingChanges reports whether this redirector still takes changes, for a handler that has
+just taken SYNC for writing. If a switchover or handoff made it a standby while the handler
+was waiting for SYNC, the request is turned away with a 503 like readOnlyStandby's, since
+the change would be made after the peer was told it had everything.
+*/
+func TakingChanges(w http.ResponseWriter) bool {
+	if IsActive() {
+		return true
+	}
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, "This redirector just handed off to its peer and no longer takes changes.", http.StatusServiceUnavailable)
+	return false
+}
+
+// Switchover hands the active role to the standby, or cluster leadership to a follower.
+func Switchover() (string, error) {
+	switch {
+	case LocalNode != nil:
+		return LocalNode.Handoff()
+	case FailoverPeer != "" && failover.s != nil:
+		return switchover(failover.updates, failover.s)
+	}
+	return "", errors.New("there's no peer to hand off to")
+}
+
+// switchover hands the active role to the standby peer, and follows it from then on.
+func switchover(updates chan uint64, s *sync.RWMutex) (string, error) {
+	stepping.Lock()
+	defer stepping.Unlock()
+	if !IsActive() {
+		return "", errors.New("this redirector isn't active")
+	}
+	// edits already under way are finished once we have the lock, and any waiting for it
+	// find we aren't active once they have it, see TakingChanges
+	s.Lock()
+	SetActive(false)
+	log := LinkDataBase.replication
+	latest := log.Latest()
+	s.Unlock()
+	LogInfo.Printf("Switchover: stopped taking changes at sequence %d, waiting for the standby to catch up\n", latest)
+
+	err := errors.New("the standby didn't acknowledge every change in time")
+	if waitFor(replicationTimeout, func() bool { return log.Acked() >= latest }) {
+		err = askHandoff(FailoverPeer, &Frame{Type: FrameHandoff, Term: CurrentTerm(), Node: FailoverLocal, Stream: log.Stream, Seq: latest})
+	}
+	if err != nil {
+		SetActive(true)
+		LogError.Printf("Switchover failed, staying active: %s\n", err)
+		return "", err
+	}
+	why := fmt.Sprintf("handed off to %s at sequence %d", FailoverPeer, latest)
+	noteRoleChange(why)
+	LogInfo.Printf("Switchover: %s, now STANDBY\n", why)
+	go func() {
+		why := WaitForFailure(updates)
+		LogError.Println("Active peer is gone. Assuming ACTIVE role...")
+		Promote(why, s)
+	}()
+	return why, nil
+}
+
+// waitFor checks cond until it holds, for up to timeout.
+func waitFor(timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+// askHandoff asks the peer at addr to take over from the point in the stream f names.
+func askHandoff(addr string, f *Frame) error {
+	conn, err := dialPeer(addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(replicationTimeout))
+	if _, err = io.WriteString(conn, replicationPreamble); err == nil {
+		err = WriteFrame(conn, f)
+	}
+	if err != nil {
+		return err
+	}
+	reply, err := ReadFrame(conn)
+	if err != nil {
+		return err
+	}
+	if reply.Type != FrameHandoff {
+		return fmt.Errorf("%s answered a handoff with a %s frame", addr, reply.Type)
+	}
+	if !reply.Granted {
+		return fmt.Errorf("%s won't take over: %s", addr, reply.Reason)
+	}
+	return nil
+}
+
+// takeHandoff answers an active handing off to us, and has us take over if we can.
+func takeHandoff(f *Frame) *Frame {
+	reply := &Frame{Type: FrameHandoff, Term: CurrentTerm()}
+	stream, _, applied := standbyReplica.position()
+	switch {
+	case IsActive():
+		reply.Reason = "it's active"
+	case f.Term != reply.Term:
+		reply.Reason = fmt.Sprintf("it's in term %d, not %d", reply.Term, f.Term)
+	case stream != f.Stream || applied < f.Seq:
+		reply.Reason = fmt.Sprintf("it only has up to sequence %d", applied)
+	case InMaintenance():
+		reply.Reason = "it's in maintenance mode"
+	default:
+		reply.Granted = true
+		select {
+		case handedOff <- fmt.Sprintf("%s handed off at sequence %d", f.Node, f.Seq):
+		default:
+		}
+		return reply
+	}
+	LogError.Printf("Not taking over from %s: %s\n", f.Node, reply.Reason)
+	return reply
+}
+
+/*
+Handoff hands leadership to a follower that has every change, which stands for election at
+once. The node takes no changes while it waits for one to catch up, and goes back to
+leading if none does.
+*/
+func (n *ClusterNode) Handoff() (string, error) {
+	n.mu.Lock()
+	if n.role != RoleLeader {
+		n.mu.Unlock()
+		return "", errors.New("this node isn't leading")
+	}
+	term, log, leading := n.term, n.log, n.leading
+	if n.OnLeader != nil {
+		n.OnLeader(false)
+	}
+	n.mu.Unlock()
+	// edits already under way are finished once we have the lock, and any waiting for it
+	// find we aren't leading once they have it, see TakingChanges
+	n.ref.lock.Lock()
+	latest := log.Latest()
+	n.ref.lock.Unlock()
+	LogInfo.Printf("cluster %s: stopped taking changes at sequence %d to hand off\n", n.ID, latest)
+
+	request := &Frame{Type: FrameHandoff, Term: term, Node: n.ID, Stream: log.Stream, Seq: latest}
+	err := errors.New("no follower acknowledged every change in time")
+	var to string
+	waitFor(replicationTimeout, func() bool {
+		n.mu.Lock()
+		if n.leading != leading {
+			n.mu.Unlock()
+			return true
+		}
+		var current []string
+		for _, peer := range n.Peers {
+			if acked, ok := n.acked[peer]; ok && acked >= latest {
+				current = append(current, peer)
+			}
+		}
+		n.mu.Unlock()
+		for _, peer := range current {
+			if err = askHandoff(peer, request); err == nil {
+				to = peer
+				return true
+			}
+		}
+		return len(current) > 0
+	})
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.leading != leading {
+		return "", errors.New("this node stopped leading during the handoff")
+	}
+	if err != nil {
+		if n.OnLeader != nil {
+			n.OnLeader(true)
+		}
+		LogError.Printf("cluster %s: handoff failed, still leading: %s\n", n.ID, err)
+		return "", err
+	}
+	why := fmt.Sprintf("handed off to %s at sequence %d", to, latest)
+	n.demote(term, "", why)
+	n.heardAt = time.Now()
+	select {
+	case n.granted <- struct{}{}: // give the new leader an election timeout to take over
+	default:
+	}
+	return why, nil
+}
+
+// takeHandoff answers a leader handing off to this node, and has it stand for election if it can.
+func (n *ClusterNode) takeHandoff(f *Frame) *Frame {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	reply := &Frame{Type: FrameHandoff, Term: n.term}
+	stream, _, applied := n.replica.position()
+	switch {
+	case n.role != RoleFollower || f.Term != n.term || f.Node != n.leader:
+		reply.Reason = fmt.Sprintf("it's a %s in term %d, following %s", n.role, n.term, n.leader)
+	case stream != f.Stream || applied < f.Seq:
+		reply.Reason = fmt.Sprintf("it only has up to sequence %d", applied)
+	case InMaintenance():
+		reply.Reason = "it's in maintenance mode"
+	default:
+		reply.Granted = true
+		select {
+		case n.transfer <- struct{}{}:
+		default:
+		}
+		return reply
+	}
+	LogError.Printf("cluster %s: not taking over from %s: %s\n", n.ID, f.Node, reply.Reason)
+	return reply
+}
+
+// answerControl carries out an admin action asked for over a peer connection.
+func answerControl(conn net.Conn, f *Frame) {
+	LogInfo.Printf("admin action '%s' asked for by %s\n", f.Action, conn.RemoteAddr())
+	conn.SetDeadline(time.Now().Add(3 * replicationTimeout))
+	result, err := Control(f.Action)
+	reply := &Frame{Type: FrameControl, Granted: err == nil, Reason: result}
+	if err == ErrNotFound {
+		reply.Reason = fmt.Sprintf("no such action '%s'", f.Action)
+	} else if err != nil {
+		reply.Reason = err.Error()
+	}
+	WriteFrame(conn, reply)
+}
+
+// RequestControl asks the redirector listening for peers at addr to carry out an admin
+// action, see Control.
+func RequestControl(addr, action string) (string, error) {
+	conn, err := dialPeer(addr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * replicationTimeout))
+	if _, err = io.WriteString(conn, replicationPreamble); err == nil {
+		err = WriteFrame(conn, &Frame{Type: FrameControl, Action: action})
+	}
+	if err != nil {
+		return "", err
+	}
+	reply, err := ReadFrame(conn)
+	if err != nil {
+		return "", err
+	}
+	if reply.Type != FrameControl {
+		return "", fmt.Errorf("%s answered with a %s frame", addr, reply.Type)
+	}
+	if !reply.Granted {
+		return "", errors.New(reply.Reason)
+	}
+	return reply.Reason, nil
+}
@@ -1,7 +1,9 @@
 package core
 
 import (
-	"encoding/json"
+	"bufio"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -9,41 +11,69 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 /*
 This is an active/standby model with the standby being a hot standby.
 
-Heartbeat mechanism: simple ping at a given time interval. We set a threshold
-for number of heartbeats we can miss before failing over/assuming an active role.
+Heartbeat mechanism: the active sends a heartbeat at a configured interval. We set a threshold
+for number of heartbeats we can miss before failing over/assuming an active role. See heartbeat.go.
 
 Active and Standby states:
-  - The standby does not handle incoming requests until it is active. This prevents
-    a confusing active-active situation. Being down on the HTTP client-facing side also
-	has the benefit of acting as the healthcheck metric for the upstream load balancer,
-	whatever that may be.
+  - The standby serves redirects read-only until it is active, and turns away anything
+    that could make a change. This prevents a confusing active-active situation.
   - When the redirector comes up, it determines it is active if no HA peer is listed in the config.
   - If there is an HA peer listed in the config, the two systems need to determine an active system.
 
   The protocol for determining active and standby goes like this.
 
 	  1. Each redirector generates a random number between 0 and a million.
-	  2. Each system opens a TCP connection to the peer, sharing their number.
-	  3. The system with the higher number becomes active. The lower number system becomes standby.
+	  2. Each system opens a TLS connection to the peer, sharing their number, the generation
+	     of their link database (see StoredGeneration), and their term.
+	  3. The system with the newer database becomes active, so old data is never pushed over
+	     new. If both are at the same generation, the higher number becomes active.
 
-Failover mechanism: The standby pings the active at a time interval.
+  A redirector that's already running answers for itself. It keeps its role unless the peer
+  coming up has a newer database. Then an active steps down and takes the peer's database,
+  reporting its own edits as it would in a split brain, and a standby lets the peer be active.
 
-Data sharing: We keep track of the newer link database with a simple epoch in the db itself.
+Failover mechanism: The standby takes over once the active's heartbeats stop, unless it's in
+maintenance mode, or when the active hands off to it. See switchover.go.
+
+Split brain: each time a redirector becomes active it starts a new term. If both end up
+active, the one in the earlier term steps down when they reconnect. See fencing.go.
+
+Security: peers authenticate each other with mutual TLS. See peerauth.go.
+
+Data sharing: The active streams every change to its link database to the standby as it
+happens, numbered in sequence. The standby applies them in order and acknowledges them. A
+standby that has fallen too far behind is sent the whole database. See replication.go.
 
 */
 
 // higher number wins and becomes active
 var ActiveStandbySeed = generateSeed()
 
-// enum/label determining if this is the active or standby
+// label determining if this is the active or standby (or a cluster's leader or a follower)
 // We start active until we lose a dice roll.
-var IsActiveRedirector = true
+var isActiveRedirector atomic.Bool
+
+func init() {
+	isActiveRedirector.Store(true)
+}
+
+// IsActive reports whether this redirector is the active one, serving requests and making changes.
+func IsActive() bool {
+	return isActiveRedirector.Load()
+}
+
+// SetActive makes this redirector active or standby.
+func SetActive(active bool) {
+	isActiveRedirector.Store(active)
+}
 
 // function to maintain the TCP connection to the peer
 
@@ -57,128 +87,227 @@ func generateSeed() int {
 	return r.Intn(1000000)
 }
 
-func (d *LinkDatabase) ExportNetwork() error {
-	file, err := json.Marshal(d)
-	if err != nil {
-		LogError.Println("JSON marshal error:", err)
-		return err
+// SendUpdates streams the live database's changes to the standby peer, reconnecting
+// whenever the connection is lost, for as long as we're active.
+func SendUpdates(updates chan uint64, s *sync.RWMutex) {
+	for {
+		if IsActive() {
+			if err := replicate(updates, s); err != nil {
+				LogError.Printf("Standby peer status: %s\n", err)
+			}
+		}
+		time.Sleep(1 * time.Second)
 	}
-	serviceAddress, err := net.ResolveTCPAddr("tcp4", FailoverPeer)
+}
+
+// standbyReplica is where a failover standby is in the active's stream.
+var standbyReplica = new(replica)
+
+// This handles incoming connections from the redirector peer. Each time the active sends
+// us something, the sequence number we're current to is offered on updates.
+func RunFailoverMonitor(updates chan uint64, s *sync.RWMutex) {
+	listener, err := listenPeer(FailoverLocal)
 	if err != nil {
-		LogError.Fatalf("couldn't convert IP:port tuple to a valid service address: %s", err)
+		LogError.Fatalf("couldn't open listening TCP socket at %s: %s\n", FailoverLocal, err)
+	}
+	LogInfo.Printf("failover monitor started, listening on: %s\n", FailoverLocal)
+	failover.updates, failover.s = updates, s
+	r := standbyReplica
+	r.ref = liveDB(s)
+	r.stale = func(term uint64) bool {
+		return IsActive() || term < CurrentTerm()
 	}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			continue
+		}
+		go handlePeer(conn.(*tls.Conn), r, updates, s)
+	}
+}
 
-	conn, err := net.DialTCP("tcp4", nil, serviceAddress)
+// Two cases here.
+// 1. The data arriving is a diceroll from a peer coming up. (we are active)
+// 2. The data arriving is the active's replication stream. (we are standby, or one of us
+// is active in a stale term)
+// Peers that don't pass the TLS handshake are dropped before anything they sent is read.
+func handlePeer(conn *tls.Conn, r *replica, updates chan uint64, s *sync.RWMutex) {
+	defer conn.Close()
+	if err := handshake(conn); err != nil {
+		LogError.Printf("rejected failover connection from %s: %s\n", conn.RemoteAddr(), err)
+		return
+	}
+	LogDebug.Printf("failover connection from %s, certificate '%s'\n", conn.RemoteAddr(), conn.ConnectionState().PeerCertificates[0].Subject.CommonName)
+	conn.SetDeadline(time.Now().Add(replicationTimeout))
+	reader := bufio.NewReader(conn)
+	if start, _ := reader.Peek(len("diceroll")); string(start) == "diceroll" {
+		// case 1
+		msg, _ := io.ReadAll(reader)
+		answerDiceroll(conn, string(msg), updates, s)
+		return
+	}
+	if start, _ := reader.Peek(len(replicationPreamble)); string(start) != replicationPreamble {
+		LogError.Printf("garbage input from the peer at %s\n", conn.RemoteAddr())
+		return
+	}
+	// case 2
+	reader.Discard(len(replicationPreamble))
+	hello, err := ReadFrame(reader)
+	if err == nil && hello.Type == FrameHandoff {
+		WriteFrame(conn, takeHandoff(hello))
+		return
+	} else if err == nil && hello.Type == FrameControl {
+		answerControl(conn, hello)
+		return
+	} else if err == nil && hello.Type != FrameHello {
+		err = fmt.Errorf("active peer sent a %s frame instead of hello", hello.Type)
+	}
 	if err != nil {
-		LogError.Printf("Standby peer status: %s\n", err)
-		return err
+		LogError.Printf("replication from the active peer stopped: %s\n", err)
+		return
 	}
-	defer conn.Close()
-
-	LogInfo.Println("Standby peer is up, sending update...")
-	if _, err := conn.Write(file); err != nil {
-		LogDebug.Fatal(err)
+	term := CurrentTerm()
+	if IsActive() && !peerWins(hello.Term, hello.Roll) {
+		LogError.Printf("%s is also active, in term %d. We're active in term %d, so it has to step down\n", conn.RemoteAddr(), hello.Term, term)
+		WriteFrame(conn, &Frame{Type: FrameResume, Term: term, Roll: ActiveStandbySeed})
+		return
+	}
+	if !IsActive() && hello.Term < term {
+		LogError.Printf("%s is active in term %d, but we've seen term %d, turning its stream away\n", conn.RemoteAddr(), hello.Term, term)
+		WriteFrame(conn, &Frame{Type: FrameResume, Term: term})
+		return
+	}
+	stepDown(fmt.Sprintf("%s is active in term %d", conn.RemoteAddr(), hello.Term), updates, s)
+	observeTerm(hello.Term)
+	err = r.follow(conn, reader, hello, CurrentTerm(), updates)
+	if err != nil && !errors.Is(err, io.EOF) {
+		LogError.Printf("replication from the active peer stopped: %s\n", err)
 	}
-	conn.Write(file)
-	return err
 }
 
-// This sends an entire link database out on the wire.
-// It needs to be improved to only send incremental updates.
-func SendUpdates(ldb *LinkDatabase) {
-	for {
-		time.Sleep(1 * time.Second)
-		ldb.ExportNetwork()
+/*
+answerDiceroll settles roles with a peer that has just come up. Unless its database is newer
+than ours, we send back a high number, impossible for the peer to beat, forcing it standby.
+A standby also lets a peer with the same generation be active, rather than have it wait for
+us to take over.
+*/
+func answerDiceroll(conn net.Conn, msg string, updates chan uint64, s *sync.RWMutex) {
+	_, theirs, _, err := parseDiceroll(msg)
+	if err != nil {
+		LogError.Printf("garbage diceroll from the peer at %s: %s\n", conn.RemoteAddr(), err)
+		return
+	}
+	s.RLock()
+	ours := LinkDataBase.Generation
+	s.RUnlock()
+	roll := 9999999
+	if theirs > ours || !IsActive() && theirs == ours {
+		roll = 0
+	}
+	switch {
+	case roll != 0:
+		LogDebug.Printf("A peer just came online with generation %d, letting them know we are active at %d\n", theirs, ours)
+	case IsActive():
+		stepDown(fmt.Sprintf("%s came up with a newer database, generation %d to our %d", conn.RemoteAddr(), theirs, ours), updates, s)
+	default:
+		LogInfo.Printf("A peer just came online with generation %d to our %d, letting it be active\n", theirs, ours)
 	}
+	conn.Write([]byte(diceroll(roll, ours, CurrentTerm())))
+}
+
+// diceroll is what a peer sends at startup: its roll, its database's generation, and its term.
+func diceroll(roll int, generation, term uint64) string {
+	return fmt.Sprintf("diceroll:%d:%d:%d", roll, generation, term)
 }
 
-// This handles incoming updates from the active redirector peer.
-func RunFailoverMonitor(updates chan *LinkDatabase) {
-	serviceAddress, err := net.ResolveTCPAddr("tcp4", FailoverLocal)
+// parseDiceroll reads a peer's diceroll.
+func parseDiceroll(msg string) (int, uint64, uint64, error) {
+	fields := strings.Split(strings.TrimSpace(msg), ":")
+	if len(fields) != 4 || fields[0] != "diceroll" {
+		return 0, 0, 0, fmt.Errorf("'%s' isn't a diceroll", msg)
+	}
+	roll, err := strconv.Atoi(fields[1])
 	if err != nil {
-		LogError.Fatalf("couldn't convert IP:port tuple to a valid service address: %s", err)
+		return 0, 0, 0, err
 	}
-
-	listener, err := net.ListenTCP("tcp", serviceAddress)
+	generation, err := strconv.ParseUint(fields[2], 10, 64)
 	if err != nil {
-		LogError.Fatalf("couldn't open listening TCP socket at %s\n", FailoverLocal)
+		return 0, 0, 0, err
 	}
-	LogInfo.Printf("failover monitor started, listening on: %s\n", FailoverLocal)
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			continue
-		}
-		// Two cases here.
-		// 1. The data arriving is a diceroll from a peer coming up. (we are active)
-		// 2. The data arriving is a DB we need to load into memory. (we are standby)
-		data, _ := io.ReadAll(conn)
-		result := strings.TrimSpace(string(data))
-		if strings.HasPrefix(result, "diceroll") {
-			// case 1
-			// Send back a high number, impossible for the peer to beat, forcing them standby.
-			LogDebug.Println("A peer just came online, letting them know we are active")
-			conn.Write([]byte("diceroll:9999999"))
-
-		} else {
-			// case 2
-			// We try to marshal the incoming data into JSON, if so, it's a DB update.
-			// We send back a message about how things went, for informational purposes.
-			var tempdb LinkDatabase
-			reader := strings.NewReader(result)
-			dec := json.NewDecoder(reader)
-			if err := dec.Decode(&tempdb); err == io.EOF {
-				continue
-			} else if err != nil {
-				LogError.Fatal(err)
-			}
-			// send a positive acknowledgement to the standby
-			conn.Write([]byte("SUCCESS"))
+	term, err := strconv.ParseUint(fields[3], 10, 64)
+	return roll, generation, term, err
+}
 
-			updated_database := &tempdb
-			updates <- updated_database
-		}
+/*
+StoredGeneration returns the generation of the database in st, counting the edits
+journaled since its last checkpoint. The standby never checkpoints, so its copy on disk is
+from when it was last active. A database that can't be loaded is generation 0.
+*/
+func StoredGeneration(st Store) uint64 {
+	d, err := storedDatabase(st)
+	if err != nil {
+		LogInfo.Printf("No link database to compare with the peer's: %s\n", err)
+		return 0
 	}
+	return d.Generation
 }
 
-func Synchronize() {
-	serviceAddress, err := net.ResolveTCPAddr("tcp4", FailoverPeer)
+// storedDatabase loads the database in st with the edits journaled since its last checkpoint.
+func storedDatabase(st Store) (*LinkDatabase, error) {
+	d, err := st.Load()
 	if err != nil {
-		LogError.Fatalf("couldn't convert IP:port tuple to a valid service address: %s", err)
+		return nil, err
 	}
-	conn, err := net.DialTCP("tcp4", nil, serviceAddress)
+	if j, err := OpenJournal(JournalFileName(GodbFileName)); err == nil {
+		j.Replay(d)
+		j.Close()
+	}
+	return d, nil
+}
 
-	if err != nil {
+// Synchronize settles which of the pair is active at startup, given the generation of our
+// database, see StoredGeneration.
+func Synchronize(generation uint64) {
+	conn, err := dialPeer(FailoverPeer)
+	if errors.Is(err, errPeerAuth) {
+		// It's up, so going active would make two of us.
+		LogError.Fatalf("Failover peer is up, but TLS with it failed: %s", err)
+	} else if err != nil {
 		LogInfo.Printf("Failed to connect to peer: %v", err)
 		LogInfo.Println("Failover peer unreachable, assuming active role")
-		LogInfo.Printf("Initial sync complete. active == %v\n", IsActiveRedirector)
+		LogInfo.Printf("Initial sync complete. active == %v\n", IsActive())
 		return
 	}
 	defer conn.Close()
 	LogDebug.Println("Peer was found, exchanging sync information...")
-	if _, err := conn.Write([]byte(fmt.Sprintf("diceroll:%d", ActiveStandbySeed))); err != nil {
+	if _, err := conn.Write([]byte(diceroll(ActiveStandbySeed, generation, CurrentTerm()))); err != nil {
 		log.Fatal(err)
 	}
 	conn.CloseWrite()
 
 	r, _ := io.ReadAll(conn)
-	// result should be a diceroll from the other side. See who's higher.
-	result := strings.TrimSpace(string(r))
-	if strings.HasPrefix(result, "diceroll") {
-		s := strings.Split(result, ":")
-		if len(s) > 1 {
-			theirRoll, _ := strconv.Atoi(s[1])
-			if ActiveStandbySeed < theirRoll {
-				LogInfo.Printf("Peer: %d, Us: %d (we are standby)\n", theirRoll, ActiveStandbySeed)
-				IsActiveRedirector = false
-			} else {
-				LogInfo.Printf("Peer: %d, Us: %d (we are active)\n", theirRoll, ActiveStandbySeed)
-			}
-		} else {
-			LogError.Println("garbage input from the peer")
-		}
+	// result should be a diceroll from the other side. See whose database is newer, then who's higher.
+	theirRoll, theirGeneration, theirTerm, err := parseDiceroll(string(r))
+	if err != nil {
+		LogError.Printf("TCP connection is up, but the peer's answer was garbage: %s\n", err)
+		LogInfo.Printf("Initial sync complete. active == %v\n", IsActive())
+		return
+	}
+	// whichever of us is active next starts a term after any the other has been in
+	observeTerm(theirTerm)
+	var why string
+	switch {
+	case theirGeneration > generation:
+		why = fmt.Sprintf("the peer's database is newer at startup, generation %d to our %d", theirGeneration, generation)
+	case theirGeneration == generation && ActiveStandbySeed < theirRoll:
+		why = fmt.Sprintf("lost the diceroll at startup, %d to %d", ActiveStandbySeed, theirRoll)
+	}
+	if why != "" {
+		LogInfo.Printf("Peer: %d at generation %d, Us: %d at generation %d (we are standby)\n", theirRoll, theirGeneration, ActiveStandbySeed, generation)
+		SetActive(false)
+		noteRoleChange(why)
 	} else {
-		LogError.Println("TCP connection is up, but the diceroll prefix wasn't found.")
+		LogInfo.Printf("Peer: %d at generation %d, Us: %d at generation %d (we are active)\n", theirRoll, theirGeneration, ActiveStandbySeed, generation)
 	}
-	LogInfo.Printf("Initial sync complete. active == %v\n", IsActiveRedirector)
+	LogInfo.Printf("Initial sync complete. active == %v\n", IsActive())
 }
@@ -0,0 +1,193 @@
+package core
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+API tokens
+
+Scripts authenticate to /api/ with a token in the Authorization header:
+
+	Authorization: Bearer go2_...
+
+Admins create, list and revoke tokens at /api/tokens. A token's secret is shown once, when
+it's created. The database only keeps a SHA-256 hash of it, which is plenty for a random
+256-bit secret, so a copy of godb.json doesn't give away any tokens. Tokens live in the
+database with the lists and links, so they're journaled, replicated and checkpointed the
+same way, and a failover peer takes the same tokens. /_db_ leaves them out.
+
+Each token has scopes saying what it may do, see Allows. Whatever a token changes is
+recorded with "token:" and the token's name as the user, so a token named after someone
+can't act as them, see User.
+
+Admins are the users in admin_users, members of the groups in admin_groups (when the
+Authenticator knows users' groups), and anyone using a token with the admin scope. The
+users and groups need "auth_mode" "header" or "oidc": with cookie logins anyone can claim
+to be an admin, so nobody is one.
+*/
+
+// Token scopes.
+const (
+	ScopeRead           = "read"            // GET anything under /api/
+	ScopeLinksWrite     = "links:write"     // change lists and links
+	ScopeVariablesWrite = "variables:write" // change string and map variables
+	ScopeAdmin          = "admin"           // everything, including managing tokens
+)
+
+// Scopes are the scopes a token can have.
+var Scopes = []string{ScopeRead, ScopeLinksWrite, ScopeVariablesWrite, ScopeAdmin}
+
+var AdminUsers []string  // users who may manage tokens
+var AdminGroups []string // and groups
+
+const tokenPrefix = "go2_"
+
+var tokenNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// APIToken is a token scripts use for the API. Only a hash of its secret is kept.
+type APIToken struct {
+	Name      string    `json:"name"`
+	Hash      string    `json:"hash"` // hex SHA-256 of the secret
+	Scopes    []string  `json:"scopes"`
+	Created   time.Time `json:"created"`
+	CreatedBy string    `json:"created_by"`
+}
+
+// User is who a request with the token is made by. It can't be anyone who logs in, since
+// names from a login never start with "token:".
+func (t *APIToken) User() string {
+	return "token:" + t.Name
+}
+
+// Allows reports whether the token may do what needs scope. Any scope may read.
+func (t *APIToken) Allows(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope || s == ScopeAdmin || scope == ScopeRead {
+			return true
+		}
+	}
+	return false
+}
+
+// hashToken hashes a token's secret for keeping.
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+/*
+CreateToken makes a new token with the given name and scopes, for user, and returns its
+secret. The secret isn't kept, so this is the only time anyone sees it.
+*/
+func (d *LinkDatabase) CreateToken(name string, scopes []string, user string) (string, error) {
+	if !tokenNamePattern.MatchString(name) {
+		return "", errors.New("token names are up to 64 letters, digits, dots, dashes and underscores")
+	}
+	if _, exists := d.APITokens[name]; exists {
+		return "", fmt.Errorf("there's already a token named '%s'", name)
+	}
+	if len(scopes) == 0 {
+		return "", fmt.Errorf("a token needs at least one of the scopes %s", strings.Join(Scopes, ", "))
+	}
+	for _, scope := range scopes {
+		if !contains(Scopes, scope) {
+			return "", fmt.Errorf("unknown scope '%s', scopes are %s", scope, strings.Join(Scopes, ", "))
+		}
+	}
+	secret := tokenPrefix + randomToken()
+	if d.APITokens == nil {
+		d.APITokens = make(map[string]*APIToken)
+	}
+	d.APITokens[name] = &APIToken{
+		Name:      name,
+		Hash:      hashToken(secret),
+		Scopes:    copyStrings(scopes),
+		Created:   time.Now(),
+		CreatedBy: user,
+	}
+	d.RecordToken(name)
+	return secret, nil
+}
+
+// RevokeToken deletes the token with the given name. A token that doesn't exist is ErrNotFound.
+func (d *LinkDatabase) RevokeToken(name string) error {
+	if _, exists := d.APITokens[name]; !exists {
+		return ErrNotFound
+	}
+	delete(d.APITokens, name)
+	d.RecordToken(name)
+	return nil
+}
+
+// Tokens returns the tokens, by name.
+func (d *LinkDatabase) Tokens() []*APIToken {
+	tokens := make([]*APIToken, 0, len(d.APITokens))
+	for _, t := range d.APITokens {
+		tokens = append(tokens, t)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Name < tokens[j].Name })
+	return tokens
+}
+
+// LookupToken returns the token with the given secret, or nil.
+func (d *LinkDatabase) LookupToken(secret string) *APIToken {
+	if !strings.HasPrefix(secret, tokenPrefix) {
+		return nil
+	}
+	hash := []byte(hashToken(secret))
+	var found *APIToken
+	for _, t := range d.APITokens {
+		if subtle.ConstantTimeCompare(hash, []byte(t.Hash)) == 1 {
+			found = t
+		}
+	}
+	return found
+}
+
+// BearerToken returns the token in r's Authorization header, or "" if there isn't one.
+func BearerToken(r *http.Request) string {
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// IsAdmin reports whether the user who made r is an admin, see admin_users and admin_groups.
+func IsAdmin(r *http.Request) bool {
+	if _, cookie := Auth.(CookieAuth); cookie {
+		return false // the user named themselves
+	}
+	user := ExtractUser(r)
+	if user == "" {
+		return false
+	}
+	if contains(AdminUsers, user) {
+		return true
+	}
+	for _, group := range Auth.Groups(r) {
+		if contains(AdminGroups, group) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
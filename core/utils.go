@@ -9,11 +9,13 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"reflect"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -93,52 +95,151 @@ Shutdown is meant to handle graceful termination of the redirector.
 
 Ctrl+C/sigterm is the signal this runs on.
 */
-func Shutdown(d *LinkDatabase, s chan int) {
+func Shutdown(d *LinkDatabase, s *sync.RWMutex) {
 	log.Println("Signal caught. Shutting down...")
 
-	// prevent destruction of data by writing to a backup first.
-	tmpfile := fmt.Sprintf("%s.tmp", GodbFileName)
-	fh, err := os.Create(tmpfile)
+	checkpointMu.Lock()
+	defer checkpointMu.Unlock()
+	s.Lock()
+	d.applyClicks()
+	err := DBStore.Save(d)
 	if err != nil {
-		log.Fatalf("Could not export to %s\n", tmpfile)
+		log.Fatalf("Could not save the link database: %s\n", err)
 	}
-	defer fh.Close()
-	d.Export(fh, s)
-
-	// now move over the existing db file so it can be used on the next startup
-	err = os.Rename(tmpfile, GodbFileName)
-	if err != nil {
-		log.Fatalf("Could not move %s to %s\n", tmpfile, GodbFileName)
-	}
-
-	RedirectorMetadata.Export("go2metadata.json")
+	// everything in the journal is in the database now
+	d.journal.Truncate()
+	d.journal.Close()
+	DBStore.Close()
+	s.Unlock()
 }
 
+// checkpointMu keeps anything else from saving the live database while a checkpoint is saving
+// its copy, which would then overwrite it with older contents.
+var checkpointMu sync.Mutex
+
 // CheckpointDB saves a copy of the link database at a provided interval (a time duration string).
-// This also syncs the DB to the failover peer through a TCP connection at the same interval.
-func CheckpointDB(duration string, s chan int) {
+// Nothing is written when the database hasn't changed since the last checkpoint.
+// A failed checkpoint is logged and retried on the next interval, the redirector keeps running.
+func CheckpointDB(duration string, s *sync.RWMutex) {
 	d, err := time.ParseDuration(duration)
 	if err != nil {
 		LogError.Fatalf("Specified duration of '%s' could not be parsed\n", duration)
 	}
+	var failures int
+	var saved *LinkDatabase // the database and generation of the last good checkpoint
+	var savedGeneration uint64
 	for {
-		// purpose 1: sync db to peer on a time interval
-
-		//
-
-		// purpose 2: export the db to local disk as a backup
-		fileName := fmt.Sprintf("%s.bak", GodbFileName)
-		fh, err := os.Create(GodbFileName)
+		// Queued clicks go into the database first, so they're saved too.
+		ApplyClicks(s)
+
+		// Save the db to the storage backend as a backup, if anything changed.
+		// A copy is saved, along with how far the journal went when it was made, so SYNC is
+		// only held for the copy. Then the journal is compacted up to there: any edit that
+		// came in during the save is kept, since the checkpoint doesn't have it.
+		checkpointMu.Lock()
+		s.RLock()
+		db := LinkDataBase
+		// Clicks don't move the generation, but they still need saving.
+		if db == saved && db.Generation == savedGeneration && !db.changes.any() {
+			s.RUnlock()
+			checkpointMu.Unlock()
+			time.Sleep(d)
+			continue
+		}
+		checkpoint, generation := db.checkpointCopy(), db.Generation
+		offset, err := db.journal.Offset()
+		s.RUnlock()
+		if err == nil {
+			err = DBStore.Save(checkpoint)
+		}
+		if err == nil {
+			db.journal.TruncateTo(offset)
+			saved, savedGeneration = db, generation
+		} else {
+			db.changes.giveBack(checkpoint.changes.take())
+		}
+		checkpointMu.Unlock()
 		if err != nil {
-			LogInfo.Printf("%s\n", err)
-			LogError.Fatalf("Could not export to %s\n", GodbFileName)
+			failures++
+			LogError.Printf("DB checkpoint to the '%s' storage backend failed (%d in a row), the previous checkpoint is intact: %s\n", StorageBackend, failures, err)
+		} else if failures > 0 {
+			LogInfo.Printf("DB checkpoint succeeded after %d failures\n", failures)
+			failures = 0
 		}
+		time.Sleep(d)
+	}
+}
 
-		err = LinkDataBase.Export(fh, s)
+/*
+WriteFileAtomic replaces the file at path with data in a way that can't leave a
+partially written file behind.
+
+The data is written to a temp file next to the target and synced, then renamed over
+the target, then the directory is synced so the rename itself is on the disk. If
+backups is above zero, the file being replaced is kept as path.1 and older copies move
+up to path.2, path.3, and so on until there are that many.
+*/
+func WriteFileAtomic(path string, data []byte, backups int) error {
+	tmpfile := fmt.Sprintf("%s.tmp", path)
+	fh, err := os.OpenFile(tmpfile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("could not create %s: %s", tmpfile, err)
+	}
+	_, err = fh.Write(data)
+	if err == nil {
+		err = fh.Sync()
+	}
+	if closeErr := fh.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpfile)
+		return fmt.Errorf("could not write %s: %s", tmpfile, err)
+	}
+
+	if backups > 0 {
+		rotateBackups(path, backups)
+	}
+
+	err = os.Rename(tmpfile, path)
+	if err != nil {
+		os.Remove(tmpfile)
+		return fmt.Errorf("could not move %s to %s: %s", tmpfile, path, err)
+	}
+
+	// The rename is only durable once the directory entry is synced.
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// rotateBackups shifts path.1 through path.(n-1) up by one and copies the current file
+// to path.1. The current file stays where it is until the caller renames over it.
+// Backups are a nice-to-have, so problems here are logged and otherwise ignored.
+func rotateBackups(path string, n int) {
+	if _, err := os.Stat(path); err != nil {
+		return // nothing to back up yet
+	}
+	os.Remove(fmt.Sprintf("%s.%d", path, n))
+	for i := n - 1; i > 0; i-- {
+		older := fmt.Sprintf("%s.%d", path, i)
+		if _, err := os.Stat(older); err == nil {
+			os.Rename(older, fmt.Sprintf("%s.%d", path, i+1))
+		}
+	}
+	// A hard link costs nothing and the rename that follows won't touch it.
+	newest := fmt.Sprintf("%s.1", path)
+	if err := os.Link(path, newest); err != nil {
+		data, err := os.ReadFile(path)
+		if err == nil {
+			err = os.WriteFile(newest, data, 0644)
+		}
 		if err != nil {
-			LogError.Fatalf("DB checkpoint to file '%s' failed. %s", fileName, err)
+			LogError.Printf("backup %s could not be written: %s\n", newest, err)
 		}
-		time.Sleep(d)
 	}
 }
 
@@ -270,34 +371,56 @@ func PrintList(ll ListOfLinks) {
 // destroyLink will remove a link object, then decouple it from all
 // lists that link is a member of.
 func DestroyLink(l *Link) {
+	LinkDataBase.destroyLink(l)
+}
+
+func (d *LinkDatabase) destroyLink(l *Link) {
 	for _, list := range l.Lists {
-		lol := LinkDataBase.Lists[list]
+		lol := d.Lists[list]
 		LogInfo.Printf("Decoupling link %d from %v\n", l.ID, lol)
-		LinkDataBase.Decouple(lol, l)
+		d.Decouple(lol, l)
 	}
-	delete(LinkDataBase.Links, l.ID) // Remove link object entirely
+	delete(d.Links, l.ID) // Remove link object entirely
+	d.RecordLink(l)
 }
 
 // pruneExpiringLinks will look through the link database and delete links which
 // have a Dtime in the past.
-func PruneExpiringLinks(c chan int) {
+// The links are looked over with SYNC held for reading. It's only held for writing
+// when some have expired. Cluster followers leave pruning to the leader.
+func PruneExpiringLinks(s *sync.RWMutex) {
 	duration, _ := time.ParseDuration(PruneInterval)
 	for {
-		<-c
-		LinkDataBase.Prune()
-		c <- 1
+		if !IsActive() {
+			time.Sleep(duration)
+			continue
+		}
+		s.RLock()
+		expired := LinkDataBase.expiring()
+		s.RUnlock()
+		if expired {
+			s.Lock()
+			if IsActive() { // it may have handed off meanwhile
+				LinkDataBase.Prune()
+			}
+			s.Unlock()
+		}
 		time.Sleep(duration)
 	}
 }
 
 // Populate easily-searchable structures with information from the real linkDB.
 // This is meant to be run in a goroutine every 30 seconds or so.
-func IndexSearchDB(interval string, s chan int) {
+// The new index is built with SYNC held for reading and swapped in with it held for writing.
+func IndexSearchDB(interval string, s *sync.RWMutex) {
 	duration, _ := time.ParseDuration(interval)
 	for {
-		<-s
-		LinkDataBase.IndexKeywords()
-		s <- 1
+		s.RLock()
+		trie, data := LinkDataBase.IndexKeywords()
+		s.RUnlock()
+		s.Lock()
+		SearchKeywordsTrie, SearchKeywordsData = trie, data
+		s.Unlock()
 		time.Sleep(duration)
 	}
 }
@@ -536,18 +659,17 @@ func ParsePath(s string) (Gpath, error) {
 }
 
 /*
-Extract the user login name from any cookies presented in their requests.
-The cookie name will be 'redirectorlogin' and the value is their login name.
+Extract the user's identity from their request, the way the configured Authenticator
+finds it (see auth.go). By default that's the 'redirectorlogin' cookie, whose value is
+their login name. Names starting with "token:" belong to API tokens, so nobody logs in as one.
 */
 func ExtractUser(r *http.Request) string {
-	if len(r.Cookies()) > 0 {
-		for _, c := range r.Cookies() {
-			if c.Name == "redirectorlogin" {
-				return c.Value
-			}
-		}
+	user := Auth.User(r)
+	if strings.HasPrefix(user, "token:") {
+		LogInfo.Printf("Ignoring the login '%s' from %s, which names an API token\n", user, r.RemoteAddr)
+		return ""
 	}
-	return ""
+	return user
 }
 
 // This returns a human-readable behavior or a link title if direct is selected as the behavior.
@@ -647,7 +769,8 @@ func MakeNewGoRequest(r *http.Request) (GoRequest, error) {
 // This can be used both for suggestions and full search
 // This search algorithm weights the results based on how much of a match we find.
 // Results are ordered from most to least relevant in the returned array.
-func SearchDB(term string, maxresults int, s chan int) []string {
+// Keywords hidden from the viewer are left out, see permissions.go.
+func SearchDB(term string, maxresults int, viewer Editor, s *sync.RWMutex) []string {
 	term = strings.ToLower(term)
 	term = strings.TrimSpace(term)
 
@@ -655,7 +778,7 @@ func SearchDB(term string, maxresults int, s chan int) []string {
 	// values are weight from 1-100 (1 is most relevant)
 	targets := make(map[string]int)
 
-	<-s
+	s.RLock()
 
 	// exact match on a keyword
 	if SearchKeywordsTrie.Search(term) {
@@ -702,6 +825,12 @@ func SearchDB(term string, maxresults int, s chan int) []string {
 		}
 	}
 
+	for kwd := range targets {
+		if ll, exists := LinkDataBase.Lists[Keyword(kwd)]; exists && !ll.CanSee(viewer) {
+			delete(targets, kwd)
+		}
+	}
+
 	keys := make([]string, 0, len(targets)) // keywords
 
 	buckets := make(map[int][]string)
@@ -729,7 +858,7 @@ func SearchDB(term string, maxresults int, s chan int) []string {
 		searchTerms = keys
 	}
 	LogDebug.Printf("search term: %s, results: %s\n", term, searchTerms)
-	s <- 1
+	s.RUnlock()
 
 	return searchTerms
 }
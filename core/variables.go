@@ -22,6 +22,12 @@ func CreateStringVar(n, v string) {
 		LogDebug.Println("String variables initialized")
 	}
 	LinkDataBase.Variables.Strings[n] = v
+	LinkDataBase.RecordStringVar(n)
+}
+
+func DeleteStringVar(n string) {
+	delete(LinkDataBase.Variables.Strings, n)
+	LinkDataBase.RecordStringVar(n)
 }
 
 func CreateMapVar(n string) {
@@ -32,4 +38,26 @@ func CreateMapVar(n string) {
 	}
 	LogDebug.Printf("initializing mapvar named '%s'\n", n)
 	LinkDataBase.Variables.Maps[n] = make(map[string]string)
+	LinkDataBase.RecordMapVar(n)
+}
+
+// SetMapVar replaces the entire contents of a map variable, creating it if needed.
+func SetMapVar(n string, values map[string]string) {
+	if LinkDataBase.Variables.Maps == nil {
+		LinkDataBase.Variables.Maps = make(map[string]map[string]string)
+		LogDebug.Println("Map variables initialized")
+	}
+	LinkDataBase.Variables.Maps[n] = values
+	LinkDataBase.RecordMapVar(n)
+}
+
+func DeleteMapVar(n string) {
+	delete(LinkDataBase.Variables.Maps, n)
+	LinkDataBase.RecordMapVar(n)
+}
+
+// DeleteMapKey removes a single key:value pair from a map variable.
+func DeleteMapKey(n, key string) {
+	delete(LinkDataBase.Variables.Maps[n], key)
+	LinkDataBase.RecordMapVar(n)
 }
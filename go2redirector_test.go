@@ -2,12 +2,17 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/cwbooth5/go2redirector/api"
 	"github.com/cwbooth5/go2redirector/core"
 )
 
@@ -468,6 +473,195 @@ func TestBurnAfterReading(t *testing.T) {
 	}
 }
 
+func TestReadOnlyStandby(t *testing.T) {
+	aLink, _ := core.MakeNewlink("www.example.com/standby", "served by either redirector")
+	core.LinkDataBase.CommitNewLink(aLink)
+	burner, _ := core.MakeNewlink("www.example.com/standby-burner", "only the active burns this")
+	burner.Dtime = core.BurnTime
+	core.LinkDataBase.CommitNewLink(burner)
+	aKw, _ := core.MakeNewKeyword("standby")
+	aList := core.MakeNewList(aKw)
+	core.LinkDataBase.Couple(aList, aLink)
+	bKw, _ := core.MakeNewKeyword("standbyburner")
+	core.LinkDataBase.Couple(core.MakeNewList(bKw), burner)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/", api.RouteAPI)
+	mux.HandleFunc("/", routeHappyHandler)
+	handler := readOnlyStandby(mux, func() string { return "10.0.0.2:9001" })
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest(method, path, nil)
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	core.SetActive(false)
+	defer core.SetActive(true)
+	if w := serve("GET", "/standby"); w.Code != 307 {
+		t.Errorf("a standby should redirect, got: %d", w.Code)
+	}
+	if w := serve("GET", "/.standby"); w.Code != 200 {
+		t.Errorf("a standby should serve list pages, got: %d", w.Code)
+	}
+	core.ApplyClicks(core.SYNC)
+	if aLink.Clicks != 0 {
+		t.Error("a standby shouldn't count clicks, the active's counts replace them")
+	}
+	if w := serve("GET", "/standbyburner"); w.Code == 307 || core.LinkDataBase.Links[burner.ID] == nil {
+		t.Error("a standby shouldn't follow or burn burner links")
+	}
+	for _, req := range [][2]string{{"POST", "/api/"}, {"GET", "/api/"}, {"GET", "/_link_/1"}, {"POST", "/_login_"}, {"POST", "/standby"}} {
+		w := serve(req[0], req[1])
+		if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "active redirector at 10.0.0.2.") {
+			t.Errorf("a standby should turn away %s %s naming the active, got %d: %s", req[0], req[1], w.Code, w.Body.String())
+		}
+	}
+
+	core.SetActive(true)
+	if w := serve("POST", "/api/"); w.Code == http.StatusServiceUnavailable {
+		t.Error("the active should let changes through")
+	}
+	serve("GET", "/standby")
+	core.ApplyClicks(core.SYNC)
+	if aLink.Clicks != 1 {
+		t.Errorf("the active should count clicks, got %d", aLink.Clicks)
+	}
+}
+
+/*
+Concurrency
+
+These are meant to be run with the race detector on (go test -race). Redirects only hold
+core.SYNC for reading, so they run alongside each other, API edits, search indexing, and
+exports. Clicks they count are queued and have to add up once applied.
+*/
+func TestConcurrentRedirects(t *testing.T) {
+	aLink, _ := core.MakeNewlink("www.example.com/racing/{1}", "who is fastest")
+	core.LinkDataBase.CommitNewLink(aLink)
+	aKw, _ := core.MakeNewKeyword("racers")
+	aList := core.MakeNewList(aKw)
+	core.LinkDataBase.Couple(aList, aLink)
+	aList.TagBindings[aLink.ID] = []string{"cars"}
+	core.ApplyClicks(core.SYNC)
+	clicks := aLink.Clicks
+
+	const redirectors, requests = 8, 25
+	// The tag without a parameter lands on the list page, the other two redirect and click.
+	paths := map[string]int{"racers/cars": http.StatusOK, "racers/horses": http.StatusTemporaryRedirect, "racers/cars/formula1": http.StatusTemporaryRedirect}
+	var wg sync.WaitGroup
+	for i := 0; i < redirectors; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < requests; j++ {
+				for p, code := range paths {
+					w := httptest.NewRecorder()
+					r, _ := http.NewRequest("GET", fmt.Sprintf("%s/%s", core.ListenURL(), p), nil)
+					routeHappyHandler(w, r)
+					if w.Code != code {
+						t.Errorf("%s: expected a %d, got: %d", p, code, w.Code)
+					}
+				}
+			}
+		}()
+	}
+	// edits, indexing, exports, and the click queue all go on at the same time
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < requests; j++ {
+			form := url.Values{}
+			form.Set("returnto", fmt.Sprintf("pitcrew%d", j))
+			form.Set("linkid", "0")
+			form.Set("title", "pit crew")
+			form.Set("url", "www.example.com/pits")
+			r, _ := http.NewRequest("POST", "/api/link/", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			api.RouteAPI(httptest.NewRecorder(), r)
+
+			core.SYNC.RLock()
+			trie, data := core.LinkDataBase.IndexKeywords()
+			core.SYNC.RUnlock()
+			core.SYNC.Lock()
+			core.SearchKeywordsTrie, core.SearchKeywordsData = trie, data
+			core.SYNC.Unlock()
+			core.SearchDB("rac", 5, core.Editor{}, core.SYNC)
+
+			core.LinkDataBase.ExportNDJSON(io.Discard, core.SYNC)
+			core.ApplyClicks(core.SYNC)
+		}
+	}()
+	wg.Wait()
+
+	core.ApplyClicks(core.SYNC)
+	if want := clicks + redirectors*requests*2; aLink.Clicks != want {
+		t.Errorf("expected %d clicks on the link, got %d", want, aLink.Clicks)
+	}
+}
+
+// A redirect must not wait on other readers of the database.
+func TestRedirectsShareTheLock(t *testing.T) {
+	aLink, _ := core.MakeNewlink("www.example.com/shared", "shared")
+	core.LinkDataBase.CommitNewLink(aLink)
+	aKw, _ := core.MakeNewKeyword("sharing")
+	core.LinkDataBase.Couple(core.MakeNewList(aKw), aLink)
+
+	core.SYNC.RLock()
+	defer core.SYNC.RUnlock()
+	done := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", fmt.Sprintf("%s/sharing", core.ListenURL()), nil)
+		routeHappyHandler(w, r)
+		done <- w.Code
+	}()
+	select {
+	case code := <-done:
+		if code != http.StatusTemporaryRedirect {
+			t.Errorf("We expected a 307 redirect but got: %d", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a redirect was blocked by another reader")
+	}
+}
+
+// However many redirects race for a burn-after-reading link, only one of them follows it.
+func TestConcurrentBurn(t *testing.T) {
+	aLink, _ := core.MakeNewlink("www.example.com/burnrace", "one time only")
+	aLink.Dtime = core.BurnTime
+	core.LinkDataBase.CommitNewLink(aLink)
+	aKw, _ := core.MakeNewKeyword("burnrace")
+	core.LinkDataBase.Couple(core.MakeNewList(aKw), aLink)
+
+	codes := make(chan int, 20)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(codes); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			r, _ := http.NewRequest("GET", fmt.Sprintf("%s/burnrace", core.ListenURL()), nil)
+			routeHappyHandler(w, r)
+			codes <- w.Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	var redirects int
+	for code := range codes {
+		if code == http.StatusTemporaryRedirect {
+			redirects++
+		}
+	}
+	if redirects != 1 {
+		t.Errorf("expected the burner link to redirect once, it redirected %d times", redirects)
+	}
+	if _, exists := core.LinkDataBase.Links[aLink.ID]; exists {
+		t.Error("the burned link is still in the database")
+	}
+}
+
 /*
 
 HTTP handler and API calls
@@ -485,6 +679,69 @@ func TestRouteIndex(t *testing.T) {
 	}
 }
 
+// A database loaded back out of the sqlite backend must redirect exactly like the one saved.
+func TestSQLiteRedirectsMatch(t *testing.T) {
+	defer func(d *core.LinkDatabase) { core.LinkDataBase = d }(core.LinkDataBase)
+	db := core.MakeNewLinkDatabase()
+	core.LinkDataBase = db
+	pinned, _ := core.MakeNewlink("www.example.com/pinned", "the one the list is pinned to")
+	db.CommitNewLink(pinned)
+	other, _ := core.MakeNewlink("www.example.com/other", "another link")
+	db.CommitNewLink(other)
+	special, _ := core.MakeNewlink("www.example.com/search?q={1}", "a search")
+	db.CommitNewLink(special)
+	kw, _ := core.MakeNewKeyword("sqlpinned")
+	ll := core.MakeNewList(kw)
+	db.Couple(ll, pinned)
+	db.Couple(ll, other)
+	db.Couple(ll, special)
+	ll.Behavior = pinned.ID
+	ll.TagBindings[other.ID] = []string{"other"}
+	ll.TagBindings[special.ID] = []string{"search"}
+	kw2, _ := core.MakeNewKeyword("sqlsearch")
+	db.Couple(core.MakeNewList(kw2), special)
+
+	st, err := core.OpenStore("sqlite", fmt.Sprintf("%s/godb.sqlite", t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	if err := st.Save(db); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := st.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paths := []string{"sqlpinned", "sqlpinned/other", "sqlpinned/search/otters", "sqlsearch/otters", "sqlsearch", ".sqlpinned", "sqlnothere"}
+	type result struct {
+		code     int
+		location string
+	}
+	run := func() []result {
+		var results []result
+		for _, p := range paths {
+			w := httptest.NewRecorder()
+			r, _ := http.NewRequest("GET", fmt.Sprintf("%s/%s", core.ListenURL(), p), nil)
+			http.HandlerFunc(routeHappyHandler).ServeHTTP(w, r)
+			results = append(results, result{w.Code, w.Header().Get("Location")})
+		}
+		return results
+	}
+	want := run()
+	core.LinkDataBase = loaded
+	got := run()
+	for i := range paths {
+		if want[i] != got[i] {
+			t.Errorf("'%s' gave %v from the original database but %v from sqlite", paths[i], want[i], got[i])
+		}
+	}
+	if want[0].location != "http://www.example.com/pinned" {
+		t.Errorf("expected the pinned link, got: %v", want[0])
+	}
+}
+
 /*
 
 utility functions
@@ -536,5 +793,4 @@ func FuzzHappyHandler(f *testing.F) {
 
 func init() {
 	core.ConfigureLogging(true, os.Stdout)
-	core.SYNC <- 1
 }
@@ -1,9 +1,22 @@
 package http
 
 import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -103,3 +116,348 @@ func FuzzRouteLogin(f *testing.F) {
 func init() {
 	core.ConfigureLogging(true, os.Stdout)
 }
+
+// proxyAuth trusts the user header on httptest's requests, since admins need more than a login cookie.
+func proxyAuth() core.Authenticator {
+	proxy, _ := core.ParseProxy("192.0.2.1")
+	return &core.TrustedHeaderAuth{UserHeader: core.DefaultAuthUserHeader, Proxies: []*net.IPNet{proxy}}
+}
+
+// Behind a single sign-on proxy, there's nothing to log in to.
+func TestRouteLoginHeaderAuth(t *testing.T) {
+	defer func(a core.Authenticator) { core.Auth = a }(core.Auth)
+	core.Auth = &core.TrustedHeaderAuth{UserHeader: core.DefaultAuthUserHeader}
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "/_login_", nil)
+	RouteLogin(w, r)
+	if w.Code != http.StatusNotFound || len(w.Result().Cookies()) != 0 {
+		t.Errorf("logging in behind the proxy should be a 404 with no cookie, got %d", w.Code)
+	}
+}
+
+// Unlinking from the edit page takes being allowed to edit the keyword.
+func TestRouteLinkDecouple(t *testing.T) {
+	core.LinkDataBase = core.MakeNewLinkDatabase()
+	l, _ := core.MakeNewlink("wiki.example.com", "wiki")
+	core.LinkDataBase.CommitNewLink(l)
+	ll := core.MakeNewList("wiki")
+	core.LinkDataBase.Couple(ll, l)
+	ll.SetPermissions(core.ProtectionOwners, "", []string{"alice"}, nil)
+	decouple := func(user string) int {
+		form := url.Values{"delete": {"decouple"}, "returnto": {"wiki"}, "linkid": {fmt.Sprint(l.ID)}}
+		r := httptest.NewRequest("POST", "/_link_/", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if user != "" {
+			r.AddCookie(&http.Cookie{Name: "redirectorlogin", Value: user})
+		}
+		w := httptest.NewRecorder()
+		RouteLink(w, r)
+		return w.Code
+	}
+	for _, user := range []string{"", "bob"} {
+		if code := decouple(user); code != http.StatusForbidden || len(ll.Links) != 1 {
+			t.Errorf("'%s' shouldn't unlink from an owners-only keyword, got %d", user, code)
+		}
+	}
+	if code := decouple("alice"); code != http.StatusFound || len(ll.Links) != 0 {
+		t.Errorf("an owner should unlink from their keyword, got %d", code)
+	}
+}
+
+// Only admins may see, take or restore snapshots, which hold every list and replace the whole database.
+func TestRouteSnapshotsAdmin(t *testing.T) {
+	dir := t.TempDir()
+	defer func(d string, st core.Store, admins []string, a core.Authenticator) {
+		core.SnapshotDir, core.DBStore, core.AdminUsers, core.Auth = d, st, admins, a
+	}(core.SnapshotDir, core.DBStore, core.AdminUsers, core.Auth)
+	core.SnapshotDir = filepath.Join(dir, "snapshots")
+	core.DBStore, _ = core.OpenJSONFileStore(filepath.Join(dir, "godb.json"))
+	core.AdminUsers = []string{"alice"}
+	core.Auth = proxyAuth()
+	core.LinkDataBase = core.MakeNewLinkDatabase()
+	snap, err := core.TakeSnapshot(core.SYNC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, _ := core.MakeNewlink("wiki.example.com", "wiki")
+	core.LinkDataBase.CommitNewLink(l)
+	core.LinkDataBase.Couple(core.MakeNewList("wiki"), l)
+	call := func(method, path, user string) int {
+		r := httptest.NewRequest(method, path, nil)
+		r.Header.Set(core.DefaultAuthUserHeader, user)
+		w := httptest.NewRecorder()
+		RouteSnapshots(w, r)
+		return w.Code
+	}
+
+	for _, method := range []string{"GET", "POST"} {
+		for _, path := range []string{"/_snapshots_/", "/_snapshots_/" + snap.Name} {
+			if code := call(method, path, "bob"); code != http.StatusForbidden {
+				t.Errorf("%s %s by someone who isn't an admin: got %d, want 403", method, path, code)
+			}
+			if method == "GET" && call(method, path, "alice") != http.StatusOK {
+				t.Errorf("an admin should see %s", path)
+			}
+		}
+	}
+	if core.LinkDataBase.Lists["wiki"] == nil {
+		t.Fatal("someone who isn't an admin restored a snapshot")
+	}
+	if code := call("POST", "/_snapshots_/"+snap.Name, "alice"); code != http.StatusOK || core.LinkDataBase.Lists["wiki"] != nil {
+		t.Errorf("an admin should restore a snapshot, got %d", code)
+	}
+}
+
+// Only admins, and API tokens with the admin scope, may switch over or change maintenance mode.
+func TestRouteClusterAdmin(t *testing.T) {
+	defer func(admins []string, a core.Authenticator) { core.AdminUsers, core.Auth = admins, a }(core.AdminUsers, core.Auth)
+	defer core.SetMaintenance(false)
+	core.AdminUsers = []string{"alice"}
+	core.Auth = proxyAuth()
+	core.LinkDataBase = core.MakeNewLinkDatabase()
+	writer, _ := core.LinkDataBase.CreateToken("deploy-bot", []string{core.ScopeLinksWrite}, "alice")
+	admin, _ := core.LinkDataBase.CreateToken("ops-bot", []string{core.ScopeAdmin}, "alice")
+	post := func(path, user, token string) int {
+		r := httptest.NewRequest("POST", path, nil)
+		if user != "" {
+			r.Header.Set(core.DefaultAuthUserHeader, user)
+		}
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		RouteClusterAdmin(w, r)
+		return w.Code
+	}
+
+	for _, path := range []string{"/_cluster_/maintenance-on", "/_cluster_/switchover"} {
+		if code := post(path, "", ""); code != http.StatusUnauthorized {
+			t.Errorf("POST %s without logging in: got %d, want 401", path, code)
+		}
+		if code := post(path, "bob", ""); code != http.StatusForbidden {
+			t.Errorf("POST %s by someone who isn't an admin: got %d, want 403", path, code)
+		}
+		if code := post(path, "", writer); code != http.StatusForbidden {
+			t.Errorf("POST %s with a token without the admin scope: got %d, want 403", path, code)
+		}
+	}
+	if core.InMaintenance() {
+		t.Fatal("someone who isn't an admin turned maintenance mode on")
+	}
+	if code := post("/_cluster_/maintenance-on", "alice", ""); code != http.StatusOK || !core.InMaintenance() {
+		t.Errorf("an admin should turn maintenance mode on, got %d", code)
+	}
+	if code := post("/_cluster_/maintenance-off", "", admin); code != http.StatusOK || core.InMaintenance() {
+		t.Errorf("an admin token should turn maintenance mode off, got %d", code)
+	}
+}
+
+// Keywords hidden from a user are left out of /_db_ and suggestions.
+func TestHiddenKeywords(t *testing.T) {
+	core.LinkDataBase = core.MakeNewLinkDatabase()
+	l, _ := core.MakeNewlink("wiki.example.com/private", "private wiki")
+	core.LinkDataBase.CommitNewLink(l)
+	ll := core.MakeNewList("secretwiki")
+	core.LinkDataBase.Couple(ll, l)
+	ll.SetPermissions("", core.VisibilityPrivate, []string{"alice"}, nil)
+	core.SearchKeywordsTrie, core.SearchKeywordsData = core.LinkDataBase.IndexKeywords()
+	get := func(handler http.HandlerFunc, path, user string) string {
+		r := httptest.NewRequest("GET", path, nil)
+		if user != "" {
+			r.AddCookie(&http.Cookie{Name: "redirectorlogin", Value: user})
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w.Body.String()
+	}
+
+	for _, path := range []string{"/_db_", "/_db_?format=ndjson", "/_suggest_/?q=secret"} {
+		handler := RouteGetDB
+		if strings.HasPrefix(path, "/_suggest_") {
+			handler = RouteSuggest
+		}
+		if body := get(handler, path, "bob"); strings.Contains(body, "secretwiki") || strings.Contains(body, "wiki.example.com") {
+			t.Errorf("%s shows a private keyword to someone else: %s", path, body)
+		}
+		if body := get(handler, path, "alice"); !strings.Contains(body, "secretwiki") {
+			t.Errorf("%s should show a private keyword to its owner: %s", path, body)
+		}
+	}
+}
+
+// fakeIssuer is an OpenID Connect issuer that logs in whoever asks, as alice.
+type fakeIssuer struct {
+	*httptest.Server
+	key    *rsa.PrivateKey
+	mu     sync.Mutex
+	codes  map[string]url.Values // the authorization requests, by the code given out for them
+	tamper func(claims map[string]interface{})
+}
+
+func newFakeIssuer(t *testing.T) *fakeIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeIssuer{key: key, codes: make(map[string]url.Values)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 f.URL,
+			"authorization_endpoint": f.URL + "/authorize",
+			"token_endpoint":         f.URL + "/token",
+			"jwks_uri":               f.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		b64 := base64.RawURLEncoding.EncodeToString
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA", "kid": "k1", "use": "sig",
+			"n": b64(key.N.Bytes()), "e": b64(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		code := fmt.Sprintf("code%d", time.Now().UnixNano())
+		f.mu.Lock()
+		f.codes[code] = q
+		f.mu.Unlock()
+		http.Redirect(w, r, q.Get("redirect_uri")+"?"+url.Values{"code": {code}, "state": {q.Get("state")}}.Encode(), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		f.mu.Lock()
+		asked, ok := f.codes[r.PostForm.Get("code")]
+		delete(f.codes, r.PostForm.Get("code"))
+		f.mu.Unlock()
+		verifier := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if !ok || asked.Get("code_challenge") != base64.RawURLEncoding.EncodeToString(verifier[:]) ||
+			r.PostForm.Get("redirect_uri") != asked.Get("redirect_uri") || r.PostForm.Get("client_id") != "go2" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		claims := map[string]interface{}{
+			"iss": f.URL, "aud": "go2", "sub": "1234", "nonce": asked.Get("nonce"),
+			"exp": time.Now().Add(time.Hour).Unix(), "iat": time.Now().Unix(),
+			"email": "alice@example.com", "groups": []string{"eng", "ops"},
+		}
+		if f.tamper != nil {
+			f.tamper(claims)
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": f.sign(t, claims)})
+	})
+	f.Server = httptest.NewServer(mux)
+	return f
+}
+
+// sign makes an RS256 ID token with the given claims.
+func (f *fakeIssuer) sign(t *testing.T, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "k1", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, f.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// login goes through a whole login with the issuer, and returns the response to coming back.
+func (f *fakeIssuer) login(t *testing.T, state func(string) string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/_login_", nil)
+	r.Header.Set("Referer", "http://go2.example.com/.docs?x=1")
+	RouteLogin(w, r)
+	if w.Code != http.StatusSeeOther || !strings.HasPrefix(w.Header().Get("Location"), f.URL+"/authorize?") {
+		t.Fatalf("logging in should send us to the issuer, got %d to %s", w.Code, w.Header().Get("Location"))
+	}
+	started := w.Result().Cookies()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	back, _ := url.Parse(resp.Header.Get("Location"))
+	q := back.Query()
+	if state != nil {
+		q.Set("state", state(q.Get("state")))
+	}
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/_login_?"+q.Encode(), nil)
+	for _, c := range started {
+		r.AddCookie(c)
+	}
+	RouteLogin(w, r)
+	return w
+}
+
+// session returns the session cookie a response sets, if any.
+func session(w *httptest.ResponseRecorder) *http.Cookie {
+	for _, c := range w.Result().Cookies() {
+		if c.Name == "redirectorsession" && c.Value != "" {
+			return c
+		}
+	}
+	return nil
+}
+
+func TestRouteLoginOIDC(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	defer issuer.Close()
+	defer func(a core.Authenticator) { core.Auth = a }(core.Auth)
+	core.AuthMode, core.OIDCIssuer, core.OIDCClientID = core.AuthOIDC, issuer.URL, "go2"
+	core.OIDCRedirectURL = "http://go2.example.com/_login_"
+	defer func() { core.AuthMode, core.OIDCIssuer, core.OIDCClientID, core.OIDCRedirectURL = "", "", "", "" }()
+	if err := core.ConfigureAuth(); err != nil {
+		t.Fatal(err)
+	}
+
+	w := issuer.login(t, nil)
+	cookie := session(w)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/.docs?x=1" || cookie == nil {
+		t.Fatalf("coming back from the issuer should log us in and send us back, got %d to %s", w.Code, w.Header().Get("Location"))
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookie)
+	if user, groups := core.ExtractUser(r), core.Auth.Groups(r); user != "alice@example.com" || strings.Join(groups, ",") != "eng,ops" {
+		t.Errorf("the session should be alice's, in eng and ops, got '%s' in %v", user, groups)
+	}
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: "redirectorlogin", Value: "mallory"})
+	forged, _ := json.Marshal(map[string]interface{}{"d": map[string]string{"user": "mallory"}, "exp": time.Now().Add(time.Hour).Unix()})
+	_, signature, _ := strings.Cut(cookie.Value, ".")
+	r.AddCookie(&http.Cookie{Name: "redirectorsession", Value: base64.RawURLEncoding.EncodeToString(forged) + "." + signature})
+	if user := core.ExtractUser(r); user != "" {
+		t.Errorf("a forged session shouldn't count, got '%s'", user)
+	}
+
+	for name, tamper := range map[string]func(map[string]interface{}){
+		"another client": func(c map[string]interface{}) { c["aud"] = "someone-else" },
+		"another issuer": func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" },
+		"expired":        func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() },
+		"another login":  func(c map[string]interface{}) { c["nonce"] = "replayed" },
+		"no user claim":  func(c map[string]interface{}) { delete(c, "email") },
+	} {
+		issuer.tamper = tamper
+		if w := issuer.login(t, nil); w.Code != http.StatusUnauthorized || session(w) != nil {
+			t.Errorf("an ID token for %s should be refused, got %d", name, w.Code)
+		}
+	}
+	issuer.tamper = nil
+	if w := issuer.login(t, func(string) string { return "forged" }); w.Code != http.StatusUnauthorized || session(w) != nil {
+		t.Errorf("a login with the wrong state should be refused, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("POST", "/_login_", strings.NewReader("delete=true"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(cookie)
+	RouteLogin(w, r)
+	if cookies := w.Result().Cookies(); len(cookies) != 1 || cookies[0].Name != "redirectorsession" || cookies[0].Value != "" {
+		t.Errorf("logging out should clear the session, got %v", cookies)
+	}
+}
@@ -28,6 +28,8 @@ func RouteStrings(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	core.LogDebug.Println("strings route hit")
+	core.SYNC.RLock()
+	defer core.SYNC.RUnlock()
 	model := ModelIndex{
 		Title:          "String Variables",
 		LinkDB:         core.LinkDataBase,
@@ -64,6 +66,8 @@ func RouteMaps(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	core.LogDebug.Println("maps route hit")
+	core.SYNC.RLock()
+	defer core.SYNC.RUnlock()
 	model := ModelIndex{
 		Title:          "Map Variables",
 		LinkDB:         core.LinkDataBase,
@@ -117,9 +121,23 @@ func RouteCheck(w http.ResponseWriter, r *http.Request) {
 	core.LogInfo.Println("Check mode activated for a keyword")
 }
 
-// Provide an external URL used to get the entire DB in JSON format
+// Provide an external URL used to get the entire DB in JSON format, less the API tokens.
+// With ?format=ndjson it is streamed as NDJSON instead, without holding up redirects.
 func RouteGetDB(w http.ResponseWriter, r *http.Request) {
-	data, err := json.Marshal(core.LinkDataBase)
+	core.SYNC.RLock()
+	db := core.LinkDataBase.Clone()
+	core.SYNC.RUnlock()
+	db.APITokens = nil
+	db.Redact(core.EditorOf(r)) // keywords hidden from them, see core/permissions.go
+	if r.URL.Query().Get("format") == "ndjson" {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		core.LogDebug.Println("_db_ route hit, NDJSON format")
+		if err := db.WriteNDJSON(w); err != nil {
+			core.LogError.Printf("NDJSON export to %s failed: %s\n", r.RemoteAddr, err)
+		}
+		return
+	}
+	data, err := json.Marshal(db)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -129,8 +147,171 @@ func RouteGetDB(w http.ResponseWriter, r *http.Request) {
 	w.Write(data)
 }
 
+/*
+The replication status handler, see core/status.go
+
+It serves JSON for load balancers and dashboards. With ?format=html it is a page for people.
+*/
+func RouteCluster(w http.ResponseWriter, r *http.Request) {
+	core.LogDebug.Println("_cluster_ route hit")
+	status := core.Status(core.SYNC)
+	if r.URL.Query().Get("format") == "html" {
+		model := ModelIndex{
+			Title:          "Replication",
+			RedirectorName: core.RedirectorName,
+			ActiveUser:     core.ExtractUser(r),
+			Cluster:        status,
+		}
+		if err := RenderTemplate(w, "cluster.gohtml", &model); err != nil {
+			core.LogError.Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	data, err := json.Marshal(status)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+/*
+The replication admin handler, see core/switchover.go
+
+POST /_cluster_/switchover hands the active role to the standby, or leadership to a follower.
+POST /_cluster_/maintenance-on and /_cluster_/maintenance-off turn maintenance mode on and off.
+Only admins, and API tokens with the admin scope, may do either.
+*/
+func RouteClusterAdmin(w http.ResponseWriter, r *http.Request) {
+	user, admin := adminOf(r)
+	if user == "" { // not logged in
+		http.Error(w, "log in to manage replication", http.StatusUnauthorized)
+		return
+	}
+	if !admin {
+		core.LogInfo.Printf("user %s isn't an admin and may not manage replication\n", user)
+		http.Error(w, "only admins can manage replication", http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	action := strings.TrimPrefix(r.URL.Path, "/_cluster_/")
+	core.LogInfo.Printf("user %s asked for admin action '%s'\n", user, action)
+	result, err := core.Control(action)
+	if err == core.ErrNotFound {
+		http.Error(w, fmt.Sprintf("no such action '%s'", action), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	data, err := json.Marshal(map[string]string{"result": result})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// adminOf returns who made r, a user or an API token, and whether they're an admin, see core/tokens.go.
+func adminOf(r *http.Request) (string, bool) {
+	secret := core.BearerToken(r)
+	if secret == "" {
+		return core.ExtractUser(r), core.IsAdmin(r)
+	}
+	core.SYNC.RLock()
+	defer core.SYNC.RUnlock()
+	if token := core.LinkDataBase.LookupToken(secret); token != nil {
+		return token.User(), token.Allows(core.ScopeAdmin)
+	}
+	return "", false
+}
+
+/*
+The snapshot admin handler, see core/snapshot.go
+
+GET /_snapshots_/ lists the snapshots, newest first.
+GET /_snapshots_/<name> shows what restoring that snapshot would change.
+POST /_snapshots_/ takes a snapshot now.
+POST /_snapshots_/<name> restores that snapshot over the live database.
+All of them take an admin, since a snapshot holds every list, including ones the user can't see.
+*/
+func RouteSnapshots(w http.ResponseWriter, r *http.Request) {
+	user := core.ExtractUser(r)
+	if user == "" { // not logged in
+		http.Error(w, "log in to manage snapshots", http.StatusUnauthorized)
+		return
+	}
+	if !core.IsAdmin(r) {
+		core.LogInfo.Printf("user %s isn't an admin and may not manage snapshots\n", user)
+		http.Error(w, "only admins can manage snapshots", http.StatusForbidden)
+		return
+	}
+	core.LogDebug.Println("snapshots route hit")
+	name := strings.TrimPrefix(r.URL.Path, "/_snapshots_/")
+
+	var result interface{}
+	var err error
+	switch {
+	case r.Method == http.MethodGet && name == "":
+		result, err = core.ListSnapshots()
+	case r.Method == http.MethodGet:
+		var snap *core.LinkDatabase
+		snap, err = core.LoadSnapshot(name)
+		if err == nil {
+			core.SYNC.RLock()
+			result = core.DiffSnapshot(name, core.LinkDataBase, snap)
+			core.SYNC.RUnlock()
+		}
+	case r.Method == http.MethodPost && name == "":
+		result, err = core.TakeSnapshot(core.SYNC)
+	case r.Method == http.MethodPost:
+		err = core.RestoreSnapshot(name, core.SYNC)
+		if err == nil {
+			core.LogInfo.Printf("user %s restored snapshot %s\n", user, name)
+			result = map[string]string{"restored": name}
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err == core.ErrNotFound {
+		http.Error(w, fmt.Sprintf("no snapshot named '%s'", name), http.StatusNotFound)
+		return
+	} else if err != nil {
+		core.LogError.Printf("snapshot request failed: %s\n", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
 func RouteLink(w http.ResponseWriter, r *http.Request) {
 	// GET requests will have the editlink template returned.
+	// Anything else could be a decouple, which changes the database.
+	if r.Method == http.MethodGet {
+		core.SYNC.RLock()
+		defer core.SYNC.RUnlock()
+	} else {
+		core.SYNC.Lock()
+		defer core.SYNC.Unlock()
+		if !core.TakingChanges(w) {
+			return
+		}
+		w = core.FailUnjournaled(w)
+	}
 
 	switch r.Method {
 	case http.MethodGet:
@@ -148,7 +329,8 @@ func RouteLink(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		if _, exists := core.LinkDataBase.Lists[keyword]; exists {
+		editor := core.EditorOf(r)
+		if ll, exists := core.LinkDataBase.Lists[keyword]; exists && ll.CanSee(editor) {
 			// TODO: need to figure out how to handle this edge case. add called when it already exists
 			kwdExists = true
 		}
@@ -159,9 +341,12 @@ func RouteLink(w http.ResponseWriter, r *http.Request) {
 
 		// They have a good keyword and provided a link URL to add. Do we have it already?
 		id := core.NewLinkID(path.Base(r.URL.Path)) // This is a GET so the link ID is the first thing after the slash.
-		var existingLink *core.Link
 
-		if existingLink, exists := core.LinkDataBase.Links[id]; !exists {
+		existingLink, exists := core.LinkDataBase.Links[id]
+		if exists && !core.LinkDataBase.LinkVisible(editor, existingLink) {
+			existingLink, exists = nil, false // links only in keywords hidden from them don't exist
+		}
+		if !exists {
 			core.LogDebug.Printf("We don't have a link for the provided ID: %d\n", id)
 			if existingLink == nil || id != 0 {
 				model := ModelIndex{
@@ -185,6 +370,9 @@ func RouteLink(w http.ResponseWriter, r *http.Request) {
 		}
 
 		existingLink = core.LinkDataBase.GetLink(id, "") // look up the existing link by ID
+		if existingLink.ID > 0 {
+			existingLink = core.LinkDataBase.VisibleLink(editor, existingLink)
+		}
 		if existingLink.ID > 0 {
 			// if the link is already there, they can submit a modification to the link.
 			// re-render the add page with all their form data and the existing link with the warning.
@@ -229,6 +417,7 @@ func RouteLink(w http.ResponseWriter, r *http.Request) {
 			RedirectorName:     core.RedirectorName,
 			Overrides:          overrides,
 			ActiveUser:         core.ExtractUser(r),
+			Editor:             editor,
 			Variable:           []string{core.ExternalProto, core.ExternalAddress, fmt.Sprintf("%d", core.ExternalPort)},
 		}
 
@@ -238,19 +427,22 @@ func RouteLink(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
 
-	default:
-		http.Error(w, "not allowed", http.StatusMethodNotAllowed)
-
-	}
-	// TODO: arghh this can't be under the delete method? Maybe have this redirect using delete?
-	// This is the removal of a link from a keyword.
-	if r.PostFormValue("delete") == "decouple" {
+	case http.MethodPost:
+		// This is the removal of a link from a keyword.
+		if r.PostFormValue("delete") != "decouple" {
+			http.Error(w, "not allowed", http.StatusMethodNotAllowed)
+			return
+		}
 		returnto := r.PostFormValue("returnto")
 		keyword := core.Keyword(returnto)
 		id := core.NewLinkID(r.PostFormValue("linkid"))
 		core.LogDebug.Printf("We are decoupling link ID: %d from keyword: %s\n", id, keyword)
 
 		if ll, exists := core.LinkDataBase.Lists[keyword]; exists {
+			if !ll.CanEdit(core.EditorOf(r)) {
+				http.Error(w, fmt.Sprintf("the keyword '%s' is protected (%s) and you may not edit it", keyword, ll.GetProtection()), http.StatusForbidden)
+				return
+			}
 			linkPtr := core.LinkDataBase.Links[id]
 			core.LinkDataBase.Decouple(ll, linkPtr)
 		}
@@ -258,6 +450,10 @@ func RouteLink(w http.ResponseWriter, r *http.Request) {
 		// send them back to the list page for that keyword.
 		s := fmt.Sprintf("%s/.%s", core.ListenURL(), keyword)
 		http.Redirect(w, r, s, http.StatusFound)
+
+	default:
+		http.Error(w, "not allowed", http.StatusMethodNotAllowed)
+
 	}
 }
 
@@ -275,7 +471,20 @@ func RouteNotFound(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+/*
+RouteLogin logs users in and out. Normally they just tell us their name, which goes in a
+cookie. With an OpenID Connect issuer configured, it's where logins start and where the
+issuer sends users back to, see routeSingleSignOn.
+*/
 func RouteLogin(w http.ResponseWriter, r *http.Request) {
+	if !core.Auth.LoginForm() {
+		http.Error(w, "users are logged in by the single sign-on proxy, not here", http.StatusNotFound)
+		return
+	}
+	if sso, ok := core.Auth.(*core.OIDCAuth); ok {
+		routeSingleSignOn(w, r, sso)
+		return
+	}
 	// Right now, this only supports POST requests to change their cookie.
 	if r.Method == "POST" {
 		// Login interface
@@ -317,6 +526,44 @@ func RouteLogin(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+/*
+routeSingleSignOn logs users in with the OpenID Connect issuer (see core/oidc.go). Logging
+in sends them to the issuer, which sends them back here with a code that gets them a
+session. Logging out ends the session.
+*/
+func routeSingleSignOn(w http.ResponseWriter, r *http.Request, sso *core.OIDCAuth) {
+	query := r.URL.Query()
+	switch {
+	case r.Method == "POST" && r.PostFormValue("delete") == "true":
+		core.LogInfo.Printf("User '%s' is logging out\n", core.ExtractUser(r))
+		sso.Logout(w)
+		http.Redirect(w, r, r.Referer(), http.StatusFound)
+	case r.Method == "GET" && (query.Has("code") || query.Has("error")):
+		id, next, err := sso.FinishLogin(w, r)
+		if err != nil {
+			core.LogError.Printf("Login from %s failed: %s\n", r.RemoteAddr, err)
+			http.Error(w, fmt.Sprintf("login failed: %s", err), http.StatusUnauthorized)
+			return
+		}
+		core.LogInfo.Printf("User %s is logging in, in groups %v\n", id.User, id.Groups)
+		http.Redirect(w, r, next, http.StatusFound)
+	case r.Method == "GET" || r.Method == "POST":
+		next := r.Referer()
+		if query.Has("next") {
+			next = query.Get("next")
+		}
+		u, err := sso.StartLogin(w, next)
+		if err != nil {
+			core.LogError.Printf("Could not start a login: %s\n", err)
+			http.Error(w, "the identity provider can't be reached", http.StatusBadGateway)
+			return
+		}
+		http.Redirect(w, r, u, http.StatusSeeOther)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
 /*
 	page functions
 */
@@ -338,6 +585,7 @@ func IndexPage(w http.ResponseWriter, r *http.Request) {
 		LinkBeingEdited:    core.LinkZero,
 		RedirectorName:     core.RedirectorName,
 		ActiveUser:         activeUser,
+		Editor:             core.EditorOf(r),
 	}
 
 	err = RenderTemplate(w, "index.gohtml", &model)
@@ -486,12 +734,14 @@ func RenderListPage(r *http.Request) (string, ModelIndex, error) {
 	for kwd := range core.SearchKeywordsData {
 		core.Similar(string(pth.Keyword), kwd)
 	}
+	editor := core.EditorOf(r)
 	// check to see if this keyword exists.
 	// model changes based on existence of a keyword input from the form
-	if k, exists := core.LinkDataBase.Lists[pth.Keyword]; exists {
+	// A keyword hidden from them doesn't, see core/permissions.go.
+	if k, exists := core.LinkDataBase.Lists[pth.Keyword]; exists && k.CanSee(editor) {
 		kwdExists = true
 		// keyword is going to get a click, plus an Atime update
-		k.Clicks++
+		core.LinkDataBase.ClickList(k)
 	}
 
 	var bEdited = true
@@ -512,12 +762,13 @@ func RenderListPage(r *http.Request) (string, ModelIndex, error) {
 		RedirectorName:     core.RedirectorName,
 		ErrorMessage:       "",
 		ActiveUser:         activeUser,
+		Editor:             editor,
 	}
 
 	// regular lists go to list, special goes to the special page
 	if pth.Keyword.IsSpecial() {
 		model.KeywordBeingEdited = false // abusing this to get another boolean in the template
-		model.UsageLog = core.LinkLog[pth.Keyword]
+		model.UsageLog = core.LinkDataBase.LinkLog[pth.Keyword]
 		tmpl = "listspecial.gohtml"
 	} else {
 		tmpl = "list.gohtml"
@@ -545,11 +796,20 @@ func RenderLinkPage(r *http.Request) (string, ModelIndex, error) {
 		pth.Keyword, err = core.MakeNewKeyword(inputSplit[0])
 	}
 
-	// Determine if the keyword already exists.
-	_, kwdExists := core.LinkDataBase.Lists[pth.Keyword]
+	editor := core.EditorOf(r)
+	// Determine if the keyword already exists, as far as they can tell.
+	ll, kwdExists := core.LinkDataBase.Lists[pth.Keyword]
+	kwdExists = kwdExists && ll.CanSee(editor)
 
 	url := r.URL.Query().Get("url")
 	link := core.LinkDataBase.GetLink(-1, url)
+	if link.ID > 0 {
+		if visible := core.LinkDataBase.VisibleLink(editor, link); visible != nil {
+			link = visible
+		} else {
+			link = core.LinkZero
+		}
+	}
 
 	activeUser := core.ExtractUser(r)
 
@@ -568,6 +828,7 @@ func RenderLinkPage(r *http.Request) (string, ModelIndex, error) {
 			LinkBeingEdited:    link,
 			RedirectorName:     core.RedirectorName,
 			ActiveUser:         activeUser,
+			Editor:             editor,
 			Variable:           []string{core.ExternalProto, core.ExternalAddress, fmt.Sprintf("%d", core.ExternalPort)},
 		}
 	} else {
@@ -581,6 +842,7 @@ func RenderLinkPage(r *http.Request) (string, ModelIndex, error) {
 			LinkBeingEdited:    core.LinkZero,
 			RedirectorName:     core.RedirectorName,
 			ActiveUser:         activeUser,
+			Editor:             editor,
 			Variable:           []string{core.ExternalProto, core.ExternalAddress, fmt.Sprintf("%d", core.ExternalPort)},
 		}
 	}
@@ -676,7 +938,7 @@ func RouteSuggest(w http.ResponseWriter, r *http.Request) {
 	}
 	suggestionPrefix = r.URL.Query()["q"][0]
 
-	searchTerms := core.SearchDB(suggestionPrefix, 15, core.SYNC)
+	searchTerms := core.SearchDB(suggestionPrefix, 15, core.EditorOf(r), core.SYNC)
 	core.LogDebug.Printf("suggest prefix: %s, terms: %s\n", suggestionPrefix, searchTerms)
 	// Other browsers *could* use these arrays, they're part of the standard/protocol.
 	reply := []interface{}{suggestionPrefix, searchTerms}
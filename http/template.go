@@ -34,9 +34,49 @@ type ModelIndex struct {
 	Overrides          map[string]string
 	KeywordParams      []string
 	UsageLog           []string
-	ErrorMessage       string   // user-facing error strings for templates
-	ActiveUser         string   // empty string means not logged in
-	Variable           []string // works with strings and maps. first is key, second value
+	ErrorMessage       string      // user-facing error strings for templates
+	ActiveUser         string      // empty string means not logged in
+	Editor             core.Editor // the active user, for what they may change
+	Variable           []string    // works with strings and maps. first is key, second value
+	Cluster            *core.ClusterStatus
+}
+
+// LoginForm reports whether the page offers to log users in and out, see core/auth.go.
+func (m *ModelIndex) LoginForm() bool {
+	return core.Auth.LoginForm()
+}
+
+// CanEdit reports whether the user may change the model's keyword, see core/permissions.go.
+func (m *ModelIndex) CanEdit() bool {
+	if ll, exists := core.LinkDataBase.Lists[m.Keyword]; exists {
+		return ll.CanEdit(m.Editor)
+	}
+	return m.Editor.User != ""
+}
+
+// CanEditLink reports whether the user may also change the link being edited, in all of its lists.
+func (m *ModelIndex) CanEditLink() bool {
+	if m.LinkBeingEdited != nil && m.LinkBeingEdited.ID > 0 && !core.LinkDataBase.CanEditLink(m.Editor, m.LinkBeingEdited) {
+		return false
+	}
+	return m.CanEdit()
+}
+
+// CanManage reports whether the user may change who owns the model's keyword and who may edit it.
+func (m *ModelIndex) CanManage() bool {
+	ll, exists := core.LinkDataBase.Lists[m.Keyword]
+	return exists && ll.CanManage(m.Editor)
+}
+
+// Join puts a list of names together with spaces, for the template.
+func (m *ModelIndex) Join(names []string) string {
+	return strings.Join(names, " ")
+}
+
+// SingleSignOn reports whether users log in with the OpenID Connect issuer, without giving a name.
+func (m *ModelIndex) SingleSignOn() bool {
+	_, ok := core.Auth.(*core.OIDCAuth)
+	return ok
 }
 
 // GetBehavior returns a string representation of the behavior for a model's keyword.
@@ -180,8 +220,41 @@ func (m *ModelIndex) IdentifyBuild() string {
 }
 
 // give keyword, get list of links
+// Lists hidden from the user come back nil, as if they didn't exist.
 func (m *ModelIndex) GetMyList(k core.Keyword) *core.ListOfLinks {
-	return core.LinkDataBase.Lists[k]
+	if ll, exists := core.LinkDataBase.Lists[k]; exists && ll.CanSee(m.Editor) {
+		return ll
+	}
+	return nil
+}
+
+// VisibleLists returns the keywords a link is in that the user may see, see core/permissions.go.
+func (m *ModelIndex) VisibleLists(l *core.Link) []core.Keyword {
+	return core.LinkDataBase.VisibleLists(m.Editor, l)
+}
+
+// LinksByMtime returns the most recently changed links the user may see.
+func (m *ModelIndex) LinksByMtime(count int) []*core.Link {
+	return m.visibleLinks(core.LinkDataBase.LinksByMtime(len(core.LinkDataBase.Links)), count)
+}
+
+// LinksByClicks returns the most clicked links the user may see.
+func (m *ModelIndex) LinksByClicks(count int) []*core.Link {
+	return m.visibleLinks(core.LinkDataBase.LinksByClicks(len(core.LinkDataBase.Links)), count)
+}
+
+// visibleLinks returns up to count of the links, as the user may see them.
+func (m *ModelIndex) visibleLinks(links []*core.Link, count int) []*core.Link {
+	visible := []*core.Link{}
+	for _, l := range links {
+		if len(visible) == count {
+			break
+		}
+		if v := core.LinkDataBase.VisibleLink(m.Editor, l); v != nil {
+			visible = append(visible, v)
+		}
+	}
+	return visible
 }
 
 // Return the configuration external_address value for use in templates.
@@ -197,11 +270,11 @@ func (m *ModelIndex) GetExternalRedirectorProto() string {
 }
 
 func (m *ModelIndex) GetListEdits(k core.Keyword) []*core.EditRecord {
-	return core.RedirectorMetadata.ListEdits[k]
+	return core.LinkDataBase.Metadata.ListEdits[k]
 }
 
 func (m *ModelIndex) GetLinkEdits(id int) []*core.EditRecord {
-	return core.RedirectorMetadata.LinkEdits[id]
+	return core.LinkDataBase.Metadata.LinkEdits[id]
 }
 
 // GetSimilar locates keywords which are named similarly or which have tags or links
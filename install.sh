@@ -22,6 +22,23 @@ JSON=$(grep -v '^ *#' << EOF
 # If behind a NAT or LB, this is the http or https protocol they use for initial requests.
     "external_proto": "http",
     "godb_filename": "godb.json",
+# The storage backend holding the link database between runs. "json" keeps it in the godb_filename file.
+# "bolt" keeps it in a bbolt file, which checkpoints faster for large databases. See -convert.
+# "sqlite" keeps it in a SQLite file with a relational schema, for running SQL reports against.
+    "storage_backend": "json",
+# Every checkpoint keeps the previous database file as godb.json.1, godb.json.2, and so on.
+# This is how many of those numbered backups are kept. 0 turns them off.
+    "checkpoint_backups": 5,
+# Timestamped snapshots of the database are written to this directory every snapshot_interval.
+# An empty snapshot_dir or snapshot_interval turns snapshots off.
+    "snapshot_dir": "snapshots",
+    "snapshot_interval": "1h",
+# Each rule keeps one snapshot per 'every' for snapshots younger than 'keep_for'.
+# These keep hourly snapshots for a day and daily snapshots for 30 days.
+    "snapshot_retention": [
+        {"every": "1h", "keep_for": "24h"},
+        {"every": "24h", "keep_for": "720h"}
+    ],
 # The redirector name in both the go2/ redirects themselves and the HTML templates
     "redirector_name": "go2",
 # The time interval for the redirector to prune expiring links
@@ -44,7 +61,25 @@ JSON=$(grep -v '^ *#' << EOF
 # state between this system and the peer. An empty string here means this system comes up active at all times.
     "failover_peer": "",
 # This is the ip:port combo on the local system which will be used as a TCP listener for failover.
-    "failover_local": ""
+    "failover_local": "",
+# Failover peers authenticate each other with mutual TLS. This is the PEM certificate and key for this
+# system, and the CA that signed both peers' certificates. They're required when failover_peer is set.
+    "failover_tls_cert": "",
+    "failover_tls_key": "",
+    "failover_tls_ca": "",
+# The active sends the standby a heartbeat this often.
+    "heartbeat_interval": "1s",
+# After this many heartbeats in a row are missed, the standby suspects the active is down.
+    "heartbeat_misses": 3,
+# A suspecting standby waits this long to hear from the active again before it takes over.
+    "promotion_holddown": "2s",
+# Instead of a failover pair, any number of redirectors can run as a cluster that elects its leader.
+# This is the ip:port combo this system listens on for the rest of the cluster, which they reach it at.
+    "cluster_local": "",
+# These are the ip:port combos of the other redirectors in the cluster. Leave failover_peer empty when
+# using these. The failover_tls settings above are required, and every cluster member's certificate
+# needs its cluster_local address in it.
+    "cluster_peers": []
 }
 EOF
 )
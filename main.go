@@ -4,6 +4,7 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -11,7 +12,6 @@ import (
 	"strings"
 	"syscall"
 	"text/template"
-	"time"
 
 	"github.com/cwbooth5/go2redirector/api"
 	gohttp "github.com/cwbooth5/go2redirector/http"
@@ -45,8 +45,9 @@ func handleKeyword(w http.ResponseWriter, r *http.Request, check chan<- string)
 	msg = fmt.Sprintf("Parsed keyword: '%s', tag: '%s', parameter: '%s'", request.Path.Keyword, request.Path.Tag, request.Path.Params)
 	check <- msg
 
+	// Keywords hidden from them don't exist either, see core/permissions.go.
 	ll, exists := core.LinkDataBase.Lists[request.Path.Keyword]
-	if !exists {
+	if !exists || !ll.CanSee(core.EditorOf(r)) {
 		msg = fmt.Sprintf("keyword '%s' does not exist, rendering list page", request.Path.Keyword)
 		check <- msg
 		tmpl, model, err = gohttp.RenderListPage(r)
@@ -101,7 +102,12 @@ func handleKeyword(w http.ResponseWriter, r *http.Request, check chan<- string)
 				return tmpl, model, redirect, err
 			}
 
-			lnk.Clicks++
+			if !core.LinkDataBase.Burn(lnk) {
+				tmpl, model, _ = gohttp.RenderListPage(r)
+				model.ErrorMessage = burnedMessage(lnk)
+				return tmpl, model, redirect, err
+			}
+			core.LinkDataBase.Click(lnk)
 			core.LogDebug.Printf("Bare keyword redirect on '%s', clicks: %d\n", ll.Keyword, lnk.Clicks)
 			core.LogInfo.Printf("Path '%s' redirect rendered: %s\n", request.Path.Keyword, ll.GetRedirectURL())
 			check <- fmt.Sprintf("The URL this will redirect to: %s", lnk.URL)
@@ -113,10 +119,6 @@ func handleKeyword(w http.ResponseWriter, r *http.Request, check chan<- string)
 			} else {
 				http.Redirect(w, r, ll.GetRedirectURL(), http.StatusTemporaryRedirect)
 			}
-			if lnk.Dtime == core.BurnTime {
-				core.LogInfo.Printf("Link %d is being burned.\n", lnk.ID)
-				core.DestroyLink(lnk)
-			}
 		}
 		return tmpl, model, redirect, err
 
@@ -173,18 +175,17 @@ func handleKeyword(w http.ResponseWriter, r *http.Request, check chan<- string)
 						return tmpl, model, redirect, err
 					}
 
-					l.Clicks++
+					if !core.LinkDataBase.Burn(l) {
+						tmpl, model, _ = gohttp.RenderListPage(r)
+						model.ErrorMessage = burnedMessage(l)
+						return tmpl, model, redirect, err
+					}
+					core.LinkDataBase.Click(l)
 					core.LogInfo.Printf("Path '%s/%s' redirect rendered: %s\n", request.Path.Keyword, request.Path.Tag, url)
 					core.LogDebug.Println("Redirecting based on tag")
 					http.Redirect(w, r, url, http.StatusTemporaryRedirect)
 
 					redirect = true
-					if l.Dtime == core.BurnTime {
-						msg = fmt.Sprintf("Link %d is being burned.\n", l.ID)
-						core.LogInfo.Println(msg)
-						core.DestroyLink(l)
-					}
-
 					return tmpl, model, redirect, err
 				}
 			}
@@ -212,7 +213,7 @@ func handleKeyword(w http.ResponseWriter, r *http.Request, check chan<- string)
 				msg = "final field is not a tag, so it is being treated as an input parameter"
 				check <- msg
 				l := core.LinkDataBase.GetLink(-1, url)
-				l.Clicks++
+				core.LinkDataBase.Click(l)
 				url, complete, err = gohttp.RenderSpecial([]string{request.Path.Tag}, l, ll, check)
 
 				if err != nil {
@@ -232,11 +233,11 @@ func handleKeyword(w http.ResponseWriter, r *http.Request, check chan<- string)
 					// If check mode enabled, don't modify anything. Send to check page.
 					if core.GetCheckMode(r) {
 						core.LogDebug.Printf("CHECK MODE (%s): returning early\n", request.StringPath())
+					} else if !core.LinkDataBase.Burn(l) {
+						redirect = false
+						tmpl, model, _ = gohttp.RenderListPage(r)
+						model.ErrorMessage = burnedMessage(l)
 					} else {
-						if l.Dtime == core.BurnTime {
-							core.LogInfo.Printf("Link %d is being burned.\n", l.ID)
-							core.DestroyLink(l)
-						}
 						http.Redirect(w, r, url, http.StatusTemporaryRedirect)
 					}
 
@@ -282,15 +283,14 @@ func handleKeyword(w http.ResponseWriter, r *http.Request, check chan<- string)
 								// check mode: render check page early
 								if core.GetCheckMode(r) {
 									core.LogDebug.Println("CHECK MODE: returning without redirect")
+								} else if !core.LinkDataBase.Burn(l) {
+									tmpl, model, _ = gohttp.RenderListPage(r)
+									model.ErrorMessage = burnedMessage(l)
 								} else {
 									core.LogInfo.Printf("Path '%s/%s' redirect rendered: %s\n", request.Path.Keyword, request.Path.Tag, url)
-									l.Clicks++
+									core.LinkDataBase.Click(l)
 									http.Redirect(w, r, url, http.StatusTemporaryRedirect)
 									redirect = true
-									if l.Dtime == core.BurnTime {
-										core.LogInfo.Printf("Link %d is being burned.\n", l.ID)
-										core.DestroyLink(l)
-									}
 								}
 								return tmpl, model, redirect, err
 							} // if incomplete, I guess we can error out?
@@ -307,6 +307,14 @@ func handleKeyword(w http.ResponseWriter, r *http.Request, check chan<- string)
 	return tmpl, model, redirect, err
 }
 
+// burnedMessage explains why a burner link wasn't followed.
+func burnedMessage(l *core.Link) string {
+	if !core.IsActive() {
+		return fmt.Sprintf("Link %d is burned after reading, so it can only be followed on the active redirector", l.ID)
+	}
+	return fmt.Sprintf("Link %d was burned after reading", l.ID)
+}
+
 // This is the happy path handler for normal requests coming in.
 func routeHappyHandler(w http.ResponseWriter, r *http.Request) {
 	/*
@@ -317,12 +325,14 @@ func routeHappyHandler(w http.ResponseWriter, r *http.Request) {
 
 		The "check" interface: They send a redirect in with check=true in the url parameters
 	*/
-	<-core.SYNC
+	// Redirects only read the database. Any links they burned are removed once they let go of it.
+	defer core.ApplyBurns(core.SYNC)
+	core.SYNC.RLock()
+	defer core.SYNC.RUnlock()
 	if r.RequestURI == "/favicon.ico" {
 		// This is requested by so many browsers, we can handle it specifically
 		// here to avoid nonsensical keyword lookups.
 		http.Redirect(w, r, "/static/img/favicon.ico", http.StatusPermanentRedirect)
-		core.SYNC <- 1
 		return
 	}
 
@@ -333,21 +343,18 @@ func routeHappyHandler(w http.ResponseWriter, r *http.Request) {
 
 	if r.Method != http.MethodGet {
 		http.Error(w, "GET requests only", http.StatusBadRequest)
-		core.SYNC <- 1
 		return
 	}
 
 	request, reqerr := core.MakeNewGoRequest(r)
 	if reqerr != nil {
 		gohttp.IndexPage(w, r)
-		core.SYNC <- 1
 		return
 	}
 
 	// If for any reason their request didn't look like a go2 keyword/tag, they get index
 	if r.URL.Path == "/" && !request.Valid {
 		gohttp.IndexPage(w, r)
-		core.SYNC <- 1
 		return
 	}
 
@@ -366,7 +373,6 @@ func routeHappyHandler(w http.ResponseWriter, r *http.Request) {
 			u = fmt.Sprintf("http://%s:%d/%s?check=true", core.ExternalAddress, core.ExternalPort, request.StringPath())
 		}
 		http.Redirect(w, r, u, http.StatusTemporaryRedirect)
-		core.SYNC <- 1
 		return
 	}
 
@@ -392,7 +398,6 @@ func routeHappyHandler(w http.ResponseWriter, r *http.Request) {
 			model.Variable = append(model.Variable, item)
 		}
 		gohttp.RenderTemplate(w, tmpl, &model)
-		core.SYNC <- 1
 		return
 	}
 
@@ -411,7 +416,6 @@ func routeHappyHandler(w http.ResponseWriter, r *http.Request) {
 			core.LogError.Println(err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
-		core.SYNC <- 1
 		return
 	} else {
 		// call to handleKeyword is synchronous here, channel is buffered to allow it to run/return
@@ -423,15 +427,12 @@ func routeHappyHandler(w http.ResponseWriter, r *http.Request) {
 
 		if !redirect {
 			gohttp.RenderTemplate(w, tmpl, &model)
-			core.SYNC <- 1
 			return
 		}
 	}
-	core.SYNC <- 1
 }
 
-// Run the webserver frontend. This is only done when this instance of the redirector
-// is the active member of the pair.
+// Run the webserver frontend. A standby runs it too, behind readOnlyStandby.
 func configureWebserver(a string, p int) string {
 	fs := http.FileServer(http.Dir("./static"))
 	http.Handle("/static/", http.StripPrefix("/static/", fs))
@@ -444,11 +445,60 @@ func configureWebserver(a string, p int) string {
 	http.HandleFunc("/_db_", gohttp.RouteGetDB)
 	http.HandleFunc("/_strings_/", gohttp.RouteStrings)
 	http.HandleFunc("/_maps_/", gohttp.RouteMaps)
+	http.HandleFunc("/_snapshots_/", gohttp.RouteSnapshots)
+	http.HandleFunc("/_cluster_", gohttp.RouteCluster)
+	http.HandleFunc("/_cluster_/", gohttp.RouteClusterAdmin)
 	http.HandleFunc("/", routeHappyHandler)
 	core.LogInfo.Printf(fmt.Sprintf("Server starting with arguments: %s:%d", core.ListenAddress, core.ListenPort))
 	return fmt.Sprintf("%s:%d", a, p)
 }
 
+// Routes a standby turns away whatever the method, since they can all make changes.
+var standbyRejects = []string{"/api/", "/_link_/", "/_login_"}
+
+// Routes a standby serves whatever the method, since they don't change the link database.
+var standbyAllows = []string{"/_cluster_/"}
+
+/*
+readOnlyStandby serves everything while this redirector is active. A standby, or a cluster
+follower, only serves requests that can't change anything: redirects, suggestions, and list
+pages. The rest are turned away, naming the active redirector's host when activeName knows it.
+*/
+func readOnlyStandby(next http.Handler, activeName func() string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if core.IsActive() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		reject := r.Method != http.MethodGet && r.Method != http.MethodHead
+		for _, prefix := range standbyRejects {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				reject = true
+			}
+		}
+		for _, prefix := range standbyAllows {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				reject = false
+			}
+		}
+		if !reject {
+			next.ServeHTTP(w, r)
+			return
+		}
+		active := "the active redirector"
+		if name := activeName(); name != "" {
+			// peers are named by the address they replicate on, which isn't the one to browse to
+			if host, _, err := net.SplitHostPort(name); err == nil {
+				name = host
+			}
+			active = fmt.Sprintf("the active redirector at %s", name)
+		}
+		core.LogDebug.Printf("Standby turned away %s %s\n", r.Method, r.URL.Path)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, fmt.Sprintf("This redirector is a standby and only serves redirects and list pages. Changes have to be made on %s.", active), http.StatusServiceUnavailable)
+	})
+}
+
 /*
 	Initialization
 */
@@ -475,9 +525,6 @@ func main() {
 		anything hitting URLs we cannot handle or objective errors must not log
 	*/
 
-	// This is the starting point of the goroutine sync mechanism
-	core.SYNC <- 1
-
 	// TODO: flags for log levels
 	go2Config, e := core.RenderConfig("go2config.json")
 	if e != nil {
@@ -497,16 +544,56 @@ func main() {
 	core.LinkLogCapacity = go2Config.LinkLogCapacity
 	core.FailoverPeer = go2Config.FailoverPeer
 	core.FailoverLocal = go2Config.FailoverLocal
+	core.FailoverTLSCert = go2Config.FailoverTLSCert
+	core.FailoverTLSKey = go2Config.FailoverTLSKey
+	core.FailoverTLSCA = go2Config.FailoverTLSCA
+	core.HeartbeatInterval = go2Config.HeartbeatInterval
+	core.HeartbeatMisses = go2Config.HeartbeatMisses
+	core.PromotionHolddown = go2Config.PromotionHolddown
+	core.ClusterLocal = go2Config.ClusterLocal
+	core.ClusterPeers = go2Config.ClusterPeers
+	core.StorageBackend = go2Config.StorageBackend
+	core.CheckpointBackups = go2Config.CheckpointBackups
+	core.SnapshotDir = go2Config.SnapshotDir
+	core.SnapshotInterval = go2Config.SnapshotInterval
+	core.SnapshotRetention = go2Config.SnapshotRetention
+	core.AuthMode = go2Config.AuthMode
+	core.AuthTrustedProxies = go2Config.AuthTrustedProxies
+	core.AuthUserHeader = go2Config.AuthUserHeader
+	core.AuthEmailHeader = go2Config.AuthEmailHeader
+	core.AuthGroupsHeader = go2Config.AuthGroupsHeader
+	core.AuthSessionKey = go2Config.AuthSessionKey
+	core.OIDCIssuer = go2Config.OIDCIssuer
+	core.OIDCClientID = go2Config.OIDCClientID
+	core.OIDCClientSecret = go2Config.OIDCClientSecret
+	core.OIDCRedirectURL = go2Config.OIDCRedirectURL
+	core.OIDCScopes = go2Config.OIDCScopes
+	core.OIDCUserClaim = go2Config.OIDCUserClaim
+	core.OIDCGroupsClaim = go2Config.OIDCGroupsClaim
+	core.AdminUsers = go2Config.AdminUsers
+	core.AdminGroups = go2Config.AdminGroups
 	var logFile = go2Config.LogFile
 
 	var importPath string
 	var debugMode bool
 	var listenAddress string
 	var listenPort int
-	flag.StringVar(&importPath, "i", core.GodbFileName, "Existing go2 redirector JSON DB to import")
+	var migrate, dryRun bool
+	var restore, convert, exportNDJSON, importNDJSON string
+	var switchover bool
+	var maintenance string
+	flag.StringVar(&importPath, "i", core.GodbFileName, "Existing go2 redirector DB to import (opened with the configured storage backend)")
 	flag.BoolVar(&debugMode, "d", false, "Debug mode, set this to send debug logging to STDOUT")
 	flag.StringVar(&listenAddress, "l", core.ListenAddress, "local TCP address to listen on, overrides LocalListenAddress in the config file")
 	flag.IntVar(&listenPort, "p", core.ListenPort, "local TCP port to listen on, overrides LocalListenPort in the config file")
+	flag.BoolVar(&migrate, "migrate", false, "Upgrade the DB to the current schema version, report what changed, then exit")
+	flag.BoolVar(&dryRun, "dry-run", false, "With -migrate, only report what would change")
+	flag.StringVar(&convert, "convert", "", "Copy the JSON DB given by -i into the configured storage backend at this path, then exit")
+	flag.StringVar(&exportNDJSON, "export-ndjson", "", "Write the DB given by -i to this file as NDJSON ('-' for stdout), then exit")
+	flag.StringVar(&importNDJSON, "import-ndjson", "", "Replace the DB with the contents of this NDJSON export, then exit")
+	flag.StringVar(&restore, "restore", "", "Replace the DB with this snapshot (a file, or a name in snapshot_dir), then exit")
+	flag.BoolVar(&switchover, "switchover", false, "Ask the redirector running here to hand the active role to its peer, then exit")
+	flag.StringVar(&maintenance, "maintenance", "", "Turn maintenance mode 'on' or 'off' on the redirector running here, then exit")
 	flag.Parse()
 
 	file, err := os.OpenFile(logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
@@ -515,6 +602,76 @@ func main() {
 	}
 	core.ConfigureLogging(debugMode, file)
 
+	// Admin actions go to the redirector already running here, over its peer connection.
+	if switchover || maintenance != "" {
+		action := core.ControlSwitchover
+		if maintenance == "on" || maintenance == "off" {
+			action = "maintenance-" + maintenance
+		} else if maintenance != "" {
+			log.Fatalf("-maintenance takes 'on' or 'off', not '%s'", maintenance)
+		}
+		addr := core.FailoverLocal
+		if len(core.ClusterPeers) > 0 {
+			addr = core.ClusterLocal
+		}
+		if addr == "" {
+			log.Fatal("-switchover and -maintenance need failover_local or cluster_local in the config file")
+		}
+		if err := core.LoadPeerTLS(); err != nil {
+			log.Fatal(err)
+		}
+		result, err := core.RequestControl(addr, action)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(result)
+		os.Exit(0)
+	}
+
+	// Migrations also happen automatically on every load. This is for seeing what will
+	// happen (with -dry-run) or for upgrading a DB file ahead of time.
+	if migrate {
+		if core.StorageBackend != "" && core.StorageBackend != "json" {
+			log.Fatalf("-migrate works on JSON DB files, not the '%s' storage backend", core.StorageBackend)
+		}
+		report, err := core.MigrateFile(importPath, dryRun)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(report) == 0 {
+			fmt.Printf("%s is already at schema version %d, nothing to do\n", importPath, core.CurrentSchemaVersion())
+		}
+		for _, line := range report {
+			fmt.Println(line)
+		}
+		if dryRun {
+			fmt.Println("dry run: nothing was written")
+		}
+		os.Exit(0)
+	}
+
+	// A one-shot conversion of a godb.json file to the configured backend, e.g. before
+	// switching storage_backend to "bolt".
+	if convert != "" {
+		source, err := core.OpenJSONFileStore(importPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		target, err := core.OpenStore(core.StorageBackend, convert)
+		if err != nil {
+			log.Fatal(err)
+		}
+		d, err := core.CopyStore(source, target)
+		if err != nil {
+			log.Fatalf("could not convert '%s': %s", importPath, err)
+		}
+		if err = target.Close(); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%d lists and %d links copied from %s to the '%s' storage backend at %s\n", len(d.Lists), len(d.Links), importPath, core.StorageBackend, convert)
+		os.Exit(0)
+	}
+
 	// Render the opensearch XML template using config values.
 	gohttp.RenderOpenSearch("templates/opensearch.goxml", "static/xml/opensearch.xml")
 
@@ -526,6 +683,73 @@ func main() {
 		log.Fatal(err)
 	}
 
+	// Work out who users are: the name they log in with, the identity from a trusted proxy,
+	// or who the OpenID Connect issuer says they are.
+	if err = core.ConfigureAuth(); err != nil {
+		log.Fatal(err)
+	}
+
+	// The storage backend is opened for both roles. The standby never loads from it, but
+	// it checkpoints there once it has been promoted.
+	core.DBStore, err = core.OpenStore(core.StorageBackend, core.GodbFileName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// NDJSON export and import, for backups too big to want in one JSON document.
+	// Like -restore, importing is done with the redirector stopped.
+	if exportNDJSON != "" {
+		source := core.DBStore
+		if importPath != core.GodbFileName {
+			if source, err = core.OpenStore(core.StorageBackend, importPath); err != nil {
+				log.Fatal(err)
+			}
+		}
+		d, err := source.Load()
+		if err != nil {
+			log.Fatalf("could not load '%s': %s", importPath, err)
+		}
+		out := os.Stdout
+		if exportNDJSON != "-" {
+			if out, err = os.Create(exportNDJSON); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if err = d.WriteNDJSON(out); err == nil {
+			err = out.Close()
+		}
+		if err != nil {
+			log.Fatalf("NDJSON export failed: %s", err)
+		}
+		os.Exit(0)
+	}
+	if importNDJSON != "" {
+		fh, err := os.Open(importNDJSON)
+		if err != nil {
+			log.Fatal(err)
+		}
+		d, err := core.ReadNDJSON(fh)
+		fh.Close()
+		if err != nil {
+			log.Fatalf("could not read '%s': %s", importNDJSON, err)
+		}
+		if err = core.ReplaceStoredDatabase(d); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%s replaced with %d lists and %d links from %s\n", core.GodbFileName, len(d.Lists), len(d.Links), importNDJSON)
+		os.Exit(0)
+	}
+
+	// Restoring is done with the redirector stopped, otherwise its next checkpoint
+	// would write the old database right back.
+	if restore != "" {
+		if err := core.RestoreSnapshotFile(restore); err != nil {
+			log.Fatalf("could not restore from '%s': %s", restore, err)
+		}
+		fmt.Printf("%s restored from %s\n", core.GodbFileName, restore)
+		os.Exit(0)
+	}
+
 	/*
 		This is a simple active-standby failover mechanism.
 		If we see a value in the configuration file for the failover peer,
@@ -533,93 +757,126 @@ func main() {
 		If the peer is down, we assume an ACTIVE role.
 
 		Active == web server is turned on, we are sending updates to the standby
-		Standby == web server is off, we are receiving linkdb updates from the peer
+		Standby == web server is read-only, we are receiving linkdb updates from the peer
 
 		This is designed specifically as a simple failover mechanism. It only supports
 		two systems in a coordinated pair.
 
-		When the active system shuts off, it will miss its heartbeat on the standby.
-		After a few seconds, the standby will load in the latest copy of the linkdb
-		and it will turn on its webserver.
+		When the active system shuts off, it will miss its heartbeats on the standby.
+		After heartbeat_misses of them and the promotion_holddown, the standby starts
+		taking changes to the linkdb it has been applying the active's changes to.
+		Every promotion starts a new term, so if both systems end up active, the one
+		in the stale term steps down when they reconnect. See core/fencing.go.
+
+		A cluster (cluster_peers) takes the active path below, loading its own linkdb, but
+		only takes changes while it's the elected leader. See core/cluster.go.
 	*/
-	updateChan := make(chan *core.LinkDatabase, 1)
-	if core.FailoverPeer != "" {
-		core.Synchronize()
-		go core.RunFailoverMonitor(updateChan)
+	updateChan := make(chan uint64, 1)
+	var cluster *core.ClusterNode
+	if len(core.ClusterPeers) > 0 {
+		if err := core.LoadPeerTLS(); err != nil {
+			core.LogError.Fatal(err)
+		}
+		core.SetActive(false)
+		cluster = core.NewClusterNode(core.ClusterLocal, core.ClusterPeers, core.SYNC, &core.LinkDataBase)
+		cluster.StateFile = core.GodbFileName + ".cluster"
+		cluster.OnLeader = core.SetActive
+		core.LocalNode = cluster
+	} else if core.FailoverPeer != "" {
+		if err := core.LoadPeerTLS(); err != nil {
+			core.LogError.Fatal(err)
+		}
+		if err := core.LoadTerm(); err != nil {
+			core.LogError.Fatal(err)
+		}
+		core.Synchronize(core.StoredGeneration(core.DBStore))
+		go core.RunFailoverMonitor(updateChan, core.SYNC)
 	}
 
-	if !core.IsActiveRedirector {
+	if !core.IsActive() && cluster == nil {
 		// This is the standby loop.
 		core.LogInfo.Println("We are starting in STANDBY mode")
-		for {
-			select {
-			case incomingDB := <-updateChan:
-				core.LogDebug.Println("got a link DB update")
-				core.LinkDataBase = incomingDB
-			case <-time.After(2 * time.Second):
-				core.LogError.Println("Timeout hit! Active did not sync with us. Assuming ACTIVE role...")
-				core.IsActiveRedirector = true
-				// This is the standby -> active transition. Note we are loading our linkdb
-				// not from the disk, but from our core.LinkDataBase object.
-				go core.SendUpdates(core.LinkDataBase)
-				go core.PruneExpiringLinks(core.SYNC)
-				go core.CheckpointDB("300s", core.SYNC)
-				s := configureWebserver(listenAddress, listenPort)
-				err := http.ListenAndServe(s, nil)
-				if err != nil {
-					core.LogError.Fatal(err)
-				}
-				break
-			}
+		// The standby serves redirects from its copy of the linkdb, but no changes.
+		go core.IndexSearchDB("10s", core.SYNC)
+		go func() {
+			s := configureWebserver(listenAddress, listenPort)
+			core.LogError.Fatal(http.ListenAndServe(s, readOnlyStandby(http.DefaultServeMux, func() string { return core.FailoverPeer })))
+		}()
+		// Returns once the active has stopped sending heartbeats.
+		why := core.WaitForFailure(updateChan)
+		core.LogError.Println("Active peer is gone. Assuming ACTIVE role...")
+		// This is the standby -> active transition. Note we are loading our linkdb
+		// not from the disk, but from our core.LinkDataBase object.
+		// Our link DB came from the peer, so any journal on disk here is stale.
+		if _, err := core.StartJournal(core.LinkDataBase, false); err != nil {
+			core.LogError.Printf("journal could not be started: %s", err)
+		}
+		core.Promote(why, core.SYNC)
+		go core.SendUpdates(updateChan, core.SYNC)
+		go core.PruneExpiringLinks(core.SYNC)
+		go core.CheckpointDB("300s", core.SYNC)
+		go core.RunClickQueue("1s", core.SYNC)
+		if core.SnapshotDir != "" && core.SnapshotInterval != "" {
+			go core.RunSnapshots(core.SnapshotInterval, core.SYNC)
 		}
+		// the webserver is already up, and lets changes through now that we're active
+		select {}
 	} else {
 		// This is the active execution path.
 		core.LogDebug.Println("We are starting in ACTIVE mode")
 
-		// load the link database off the disk.
-		core.LogDebug.Printf("Loading link database from file: %s", importPath)
-		fh, err := os.Open(importPath)
-		if err != nil {
-			fmt.Printf("DB file '%s' could not be opened! Run the install script to create one.\n", core.GodbFileName)
+		// load the link database out of the storage backend.
+		core.LogDebug.Printf("Loading link database from the '%s' storage backend: %s", core.StorageBackend, importPath)
+		source := core.DBStore
+		if importPath != core.GodbFileName {
+			// importing from somewhere else, checkpoints still go to the configured DB
+			source, err = core.OpenStore(core.StorageBackend, importPath)
+			if err != nil {
+				core.LogError.Fatal(err)
+			}
 		}
-		err = core.LinkDataBase.Import(fh, core.SYNC)
+		err = core.LoadDatabase(source, core.SYNC)
 		if err != nil {
+			fmt.Printf("DB '%s' could not be loaded! Run the install script to create one.\n", importPath)
 			core.LogError.Fatal(err)
 		}
 
-		// Initialize string and map variable structures
-		if core.LinkDataBase.Variables == nil {
-			core.LinkDataBase.Variables = &core.UserVariables{}
-			core.LogDebug.Println("Variables data structure initialized")
-		}
-		// The upgrade case from a db containing variables but no Uses
-		if core.LinkDataBase.Variables.Uses == nil {
-			core.LinkDataBase.Variables.Uses = make(map[string][]*core.Link)
-		}
-		// Init LinkZero fields not created in previous revisions of the DB schema
-		// LinkVariables must not be null
-		if core.LinkDataBase.Links[0].LinkVariables == nil {
-			core.LinkDataBase.Links[0].LinkVariables = make(map[string]string)
-			core.LogDebug.Println("LinkZero modified to init LinkVariables")
+		// Edits made since the last checkpoint are in the journal. They only belong to the
+		// configured database, so they are discarded if we imported from somewhere else.
+		replayed, err := core.StartJournal(core.LinkDataBase, source == core.DBStore)
+		if err != nil {
+			core.LogError.Fatalf("journal could not be started: %s", err)
 		}
-
-		// If the file is found on disk, init metadata with that file.
-		// Metadata is initialized empty before this, so an error is ignored for now and we default to "empty metadata"
-		meta, metaerr := core.RedirectorMetadata.Import("go2metadata.json")
-		if metaerr == nil {
-			core.LogDebug.Println("Edit metadata found on disk and loaded: go2metadata.json")
-			core.RedirectorMetadata = meta
+		if replayed > 0 {
+			core.LogInfo.Printf("Replayed %d journaled edits made since the last checkpoint\n", replayed)
 		}
 
 		// When we go active and we have a peer, we will start sending regular updates to
 		// that peer indefinitely.
 		if core.FailoverPeer != "" {
-			go core.SendUpdates(core.LinkDataBase)
+			core.Promote("came up active", core.SYNC)
+			go core.SendUpdates(updateChan, core.SYNC)
 		}
 		go core.PruneExpiringLinks(core.SYNC)
 		go core.CheckpointDB("7s", core.SYNC)
+		go core.RunClickQueue("1s", core.SYNC)
+		if core.SnapshotDir != "" && core.SnapshotInterval != "" {
+			go core.RunSnapshots(core.SnapshotInterval, core.SYNC)
+		}
 		go core.IndexSearchDB("10s", core.SYNC)
 
+		// The database is loaded, so the cluster can start comparing it with its peers'.
+		var handler http.Handler
+		if cluster != nil {
+			if err := cluster.Start(); err != nil {
+				core.LogError.Fatal(err)
+			}
+			handler = readOnlyStandby(http.DefaultServeMux, cluster.Leader)
+		} else if core.FailoverPeer != "" {
+			// we step down to standby if the peer turns out to be active in a later term
+			handler = readOnlyStandby(http.DefaultServeMux, func() string { return core.FailoverPeer })
+		}
+
 		// handle ctrl+c and sigterm - try to shut down gracefully and dump the db
 		shutdownChan := make(chan os.Signal, 1)
 		signal.Notify(shutdownChan, os.Interrupt, syscall.SIGTERM)
@@ -631,7 +888,7 @@ func main() {
 		}()
 
 		ipPort := configureWebserver(listenAddress, listenPort)
-		err = http.ListenAndServe(ipPort, nil)
+		err = http.ListenAndServe(ipPort, handler)
 		// most common errors are:
 		// - port already in-use by another process
 		// - insufficient privileges to bind to requested port